@@ -0,0 +1,625 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// The ts-dns command inspects and drives the host's DNS configuration
+// through the same OSConfigurator code paths as the library, so that
+// field reports can be reproduced with it.
+//
+// Usage:
+//
+//	ts-dns [global flags] <command> [flags]
+//
+// The commands are:
+//
+//	detect   print the DNS mode that would be used and why
+//	base     print the OS's base DNS configuration
+//	set      apply a DNS configuration
+//	restore  remove our DNS configuration
+//	watch    stream health and trample events
+//	journal  print the changes journaled under -state-dir
+//
+// Run "ts-dns <command> -h" for the flags of a command.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/anywherelan/ts-dns/health"
+	"github.com/anywherelan/ts-dns/net/dns"
+	"github.com/anywherelan/ts-dns/types/logger"
+	"github.com/anywherelan/ts-dns/util/dnsname"
+)
+
+// globalFlags are the flags shared by all commands, which build the
+// dns.Options.
+type globalFlags struct {
+	iface    string
+	mode     string
+	root     string
+	name     string
+	trample  string
+	stateDir string
+	verbose  bool
+	trace    bool
+
+	// runner records the external commands run, for -trace.
+	runner dns.RecordingRunner
+}
+
+// register registers g's flags in fs. Their defaults are the current
+// values of g, so that flags given before the command name survive
+// registering them again for the command.
+func (g *globalFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&g.iface, "iface", g.iface, "network interface to manage DNS for")
+	fs.StringVar(&g.mode, "mode", g.mode, "force the named DNS mode instead of detecting it")
+	fs.StringVar(&g.root, "root", g.root, "prefix for the paths of the files read and written")
+	fs.StringVar(&g.name, "name", g.name, "product name for the files and records written (default tailscale)")
+	fs.StringVar(&g.trample, "trample", g.trample, "what direct mode does when resolv.conf is overwritten: warn, reassert or yield")
+	fs.StringVar(&g.stateDir, "state-dir", g.stateDir, "directory to journal the changes made to the OS in, for restore -stale to undo")
+	fs.BoolVar(&g.verbose, "v", g.verbose, "log library messages to stderr")
+	fs.BoolVar(&g.trace, "trace", g.trace, "print the external commands run, with their exit codes and durations, to stderr")
+}
+
+// options returns the dns.Options described by g.
+func (g *globalFlags) options() (dns.Options, error) {
+	opts := dns.Options{
+		Mode:     g.mode,
+		Root:     g.root,
+		StateDir: g.stateDir,
+		Runner:   &g.runner,
+	}
+	if g.name != "" {
+		opts.Identity = dns.Identity{Name: g.name}
+	}
+	switch g.trample {
+	case "warn":
+		opts.Trample = dns.TrampleWarn
+	case "reassert":
+		opts.Trample = dns.TrampleReassert
+	case "yield":
+		opts.Trample = dns.TrampleYield
+	default:
+		return opts, fmt.Errorf("unknown trample policy %q", g.trample)
+	}
+	return opts, nil
+}
+
+// logf returns the logger.Logf for library messages.
+func (g *globalFlags) logf() logger.Logf {
+	if !g.verbose {
+		return logger.Discard
+	}
+	return log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds).Printf
+}
+
+// A command is a ts-dns subcommand.
+type command struct {
+	name  string
+	args  string // usage of the positional arguments, if any
+	short string
+	flags func(*flag.FlagSet) // registers the command's own flags, if any
+	run   func(ctx context.Context, env *env, args []string) error
+}
+
+// env is what commands run with.
+type env struct {
+	global globalFlags
+	stdout io.Writer
+	stderr io.Writer
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{detectCmd, baseCmd, setCmd, restoreCmd, watchCmd, journalCmd}
+}
+
+func main() {
+	log.SetFlags(0)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if err := run(ctx, os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "ts-dns: %v\n", err)
+		}
+		os.Exit(2)
+	}
+}
+
+// run runs the command line args.
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	e := &env{stdout: stdout, stderr: stderr}
+	e.global.trample = "warn"
+	root := flag.NewFlagSet("ts-dns", flag.ContinueOnError)
+	root.SetOutput(stderr)
+	e.global.register(root)
+	root.Usage = func() {
+		fmt.Fprintf(stderr, "usage: ts-dns [global flags] <command> [flags]\n\ncommands:\n")
+		for _, c := range commands {
+			fmt.Fprintf(stderr, "  %-8s %s\n", c.name, c.short)
+		}
+		fmt.Fprintf(stderr, "\nglobal flags:\n")
+		root.PrintDefaults()
+	}
+	if err := root.Parse(args); err != nil {
+		return err
+	}
+	if root.NArg() == 0 {
+		root.Usage()
+		return flag.ErrHelp
+	}
+
+	name := root.Arg(0)
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		fs := flag.NewFlagSet("ts-dns "+c.name, flag.ContinueOnError)
+		fs.SetOutput(stderr)
+		// Global flags are accepted after the command name too.
+		e.global.register(fs)
+		if c.flags != nil {
+			c.flags(fs)
+		}
+		fs.Usage = func() {
+			fmt.Fprintf(stderr, "usage: ts-dns %s [flags] %s\n\n%s\n\nflags:\n", c.name, c.args, c.short)
+			fs.PrintDefaults()
+		}
+		if err := fs.Parse(root.Args()[1:]); err != nil {
+			return err
+		}
+		err := c.run(ctx, e, fs.Args())
+		if e.global.trace {
+			for _, r := range e.global.runner.Records() {
+				fmt.Fprintf(stderr, "ran %v\n", r)
+			}
+		}
+		return err
+	}
+	return fmt.Errorf("unknown command %q; run ts-dns -h for a list", name)
+}
+
+// newConfigurator returns the OSConfigurator for the global flags, and
+// the Tracker its health is reported to.
+func (e *env) newConfigurator() (dns.OSConfigurator, *health.Tracker, error) {
+	opts, err := e.global.options()
+	if err != nil {
+		return nil, nil, err
+	}
+	tracker := new(health.Tracker)
+	opts.Health = tracker
+	cfg, err := dns.NewOSConfiguratorWithOptions(e.global.logf(), e.global.iface, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, tracker, nil
+}
+
+// printJSON writes v to w as indented JSON.
+func printJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+var detectJSON bool
+
+var detectCmd = &command{
+	name:  "detect",
+	short: "print the DNS mode that would be used and the probes and reasoning that chose it",
+	flags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&detectJSON, "json", false, "print the report as JSON")
+	},
+	run: func(ctx context.Context, e *env, args []string) error {
+		opts, err := e.global.options()
+		if err != nil {
+			return err
+		}
+		rep, err := dns.DetectModeWithOptions(ctx, opts)
+		if err != nil {
+			return err
+		}
+		if detectJSON {
+			return printJSON(e.stdout, rep)
+		}
+		printReport(e.stdout, rep)
+		return nil
+	},
+}
+
+// printReport writes rep to w in a human-readable form.
+func printReport(w io.Writer, rep *dns.ModeReport) {
+	mode := rep.Mode
+	if mode == "" {
+		mode = "(platform default)"
+	}
+	fmt.Fprintf(w, "mode: %s\n", mode)
+	if rep.ForcedBy != "" {
+		fmt.Fprintf(w, "forced by: %s\n", rep.ForcedBy)
+	}
+	if rep.ResolvConfOwner != "" {
+		fmt.Fprintf(w, "resolv.conf owner: %s\n", rep.ResolvConfOwner)
+	}
+	if rep.NMVersion != "" {
+		fmt.Fprintf(w, "NetworkManager version: %s\n", rep.NMVersion)
+	}
+	if rep.ResolvConfMode != "" {
+		fmt.Fprintf(w, "systemd-resolved ResolvConfMode: %s\n", rep.ResolvConfMode)
+	}
+	if len(rep.Probes) > 0 {
+		fmt.Fprintf(w, "probes:\n")
+		for _, p := range rep.Probes {
+			fmt.Fprintf(w, "  %v\n", p)
+		}
+	}
+	if len(rep.Reasons) > 0 {
+		fmt.Fprintf(w, "reasons:\n")
+		for _, r := range rep.Reasons {
+			fmt.Fprintf(w, "  - %s\n", r)
+		}
+	}
+	if rep.Journal != nil {
+		printJournal(w, rep.Journal)
+	}
+}
+
+// printJournal writes j to w in a human-readable form.
+func printJournal(w io.Writer, j *dns.Journal) {
+	fmt.Fprintf(w, "journal of %v:\n", j.Owner)
+	for _, e := range j.Entries {
+		fmt.Fprintf(w, "  %s %v\n", e.Time.Format(time.RFC3339), e)
+	}
+}
+
+var journalJSON bool
+
+var journalCmd = &command{
+	name:  "journal",
+	short: "print the changes to the OS journaled under -state-dir, which restore -stale undoes",
+	flags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&journalJSON, "json", false, "print the journal as JSON")
+	},
+	run: func(ctx context.Context, e *env, args []string) error {
+		opts, err := e.global.options()
+		if err != nil {
+			return err
+		}
+		if opts.StateDir == "" {
+			return errors.New("no -state-dir given")
+		}
+		j, err := dns.ReadJournal(opts)
+		if err != nil {
+			return err
+		}
+		if journalJSON {
+			return printJSON(e.stdout, j)
+		}
+		if j == nil {
+			fmt.Fprintf(e.stdout, "no changes journaled\n")
+			return nil
+		}
+		printJournal(e.stdout, j)
+		return nil
+	},
+}
+
+var baseJSON bool
+
+var baseCmd = &command{
+	name:  "base",
+	short: "print the OS's base DNS configuration, as returned by GetBaseConfig",
+	flags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&baseJSON, "json", false, "print the configuration as JSON")
+	},
+	run: func(ctx context.Context, e *env, args []string) error {
+		cfg, _, err := e.newConfigurator()
+		if err != nil {
+			return err
+		}
+		// Not closed: Close would remove a configuration applied by
+		// an earlier "set".
+		base, err := cfg.GetBaseConfig()
+		if err != nil {
+			return err
+		}
+		if baseJSON {
+			return printJSON(e.stdout, configFromOS(base))
+		}
+		fmt.Fprintf(e.stdout, "%v\n", base)
+		return nil
+	},
+}
+
+// configFlags are the flags that describe an OSConfig.
+type configFlags struct {
+	nameservers string
+	search      string
+	match       string
+	file        string
+}
+
+func (c *configFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.nameservers, "nameservers", "", "comma-separated nameserver IPs")
+	fs.StringVar(&c.search, "search", "", "comma-separated search domains")
+	fs.StringVar(&c.match, "match", "", "comma-separated match domains, for split DNS")
+	fs.StringVar(&c.file, "config", "", "JSON file with the configuration; flags add to it")
+}
+
+// isSet reports whether any configuration was given.
+func (c *configFlags) isSet() bool {
+	return *c != configFlags{}
+}
+
+// osConfig returns the OSConfig described by c.
+func (c *configFlags) osConfig() (dns.OSConfig, error) {
+	var jc jsonConfig
+	if c.file != "" {
+		bs, err := os.ReadFile(c.file)
+		if err != nil {
+			return dns.OSConfig{}, err
+		}
+		if err := json.Unmarshal(bs, &jc); err != nil {
+			return dns.OSConfig{}, fmt.Errorf("parsing %s: %w", c.file, err)
+		}
+	}
+	for _, s := range splitList(c.nameservers) {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return dns.OSConfig{}, err
+		}
+		jc.Nameservers = append(jc.Nameservers, ip)
+	}
+	jc.SearchDomains = append(jc.SearchDomains, splitList(c.search)...)
+	jc.MatchDomains = append(jc.MatchDomains, splitList(c.match)...)
+	return jc.osConfig()
+}
+
+// splitList splits a comma-separated flag value.
+func splitList(s string) []string {
+	var ret []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// jsonConfig is the JSON form of an OSConfig, as read by "set -config"
+// and printed by "base -json".
+type jsonConfig struct {
+	Nameservers   []netip.Addr        `json:"nameservers,omitempty"`
+	SearchDomains []string            `json:"searchDomains,omitempty"`
+	MatchDomains  []string            `json:"matchDomains,omitempty"`
+	Options       jsonResolverOptions `json:"options"`
+}
+
+// jsonResolverOptions is the JSON form of dns.ResolverOptions.
+type jsonResolverOptions struct {
+	Ndots    int    `json:"ndots,omitempty"`
+	Timeout  string `json:"timeout,omitempty"` // a time.Duration
+	Attempts int    `json:"attempts,omitempty"`
+	Rotate   bool   `json:"rotate,omitempty"`
+	EDNS0    bool   `json:"edns0,omitempty"`
+	UseVC    bool   `json:"useVC,omitempty"`
+	TrustAD  bool   `json:"trustAD,omitempty"`
+}
+
+func configFromOS(cfg dns.OSConfig) jsonConfig {
+	jc := jsonConfig{Nameservers: cfg.Nameservers}
+	for _, d := range cfg.SearchDomains {
+		jc.SearchDomains = append(jc.SearchDomains, d.WithoutTrailingDot())
+	}
+	for _, d := range cfg.MatchDomains {
+		jc.MatchDomains = append(jc.MatchDomains, d.WithoutTrailingDot())
+	}
+	o := cfg.ResolverOptions
+	jc.Options = jsonResolverOptions{
+		Ndots:    o.Ndots,
+		Attempts: o.Attempts,
+		Rotate:   o.Rotate,
+		EDNS0:    o.EDNS0,
+		UseVC:    o.UseVC,
+		TrustAD:  o.TrustAD,
+	}
+	if o.Timeout != 0 {
+		jc.Options.Timeout = o.Timeout.String()
+	}
+	return jc
+}
+
+func (jc jsonConfig) osConfig() (dns.OSConfig, error) {
+	cfg := dns.OSConfig{Nameservers: jc.Nameservers}
+	var err error
+	if cfg.SearchDomains, err = toFQDNs(jc.SearchDomains); err != nil {
+		return dns.OSConfig{}, err
+	}
+	if cfg.MatchDomains, err = toFQDNs(jc.MatchDomains); err != nil {
+		return dns.OSConfig{}, err
+	}
+	o := jc.Options
+	cfg.ResolverOptions = dns.ResolverOptions{
+		Ndots:    o.Ndots,
+		Attempts: o.Attempts,
+		Rotate:   o.Rotate,
+		EDNS0:    o.EDNS0,
+		UseVC:    o.UseVC,
+		TrustAD:  o.TrustAD,
+	}
+	if o.Timeout != "" {
+		if cfg.ResolverOptions.Timeout, err = time.ParseDuration(o.Timeout); err != nil {
+			return dns.OSConfig{}, fmt.Errorf("options timeout: %w", err)
+		}
+	}
+	return cfg, nil
+}
+
+func toFQDNs(names []string) ([]dnsname.FQDN, error) {
+	var ret []dnsname.FQDN
+	for _, n := range names {
+		fqdn, err := dnsname.ToFQDN(n)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, fqdn)
+	}
+	return ret, nil
+}
+
+var (
+	setConfig configFlags
+	setHold   bool
+)
+
+var setCmd = &command{
+	name:  "set",
+	short: "apply a DNS configuration; it stays in place until \"restore\" unless -hold is given",
+	flags: func(fs *flag.FlagSet) {
+		setConfig.register(fs)
+		fs.BoolVar(&setHold, "hold", false, "keep running, and remove the configuration on interrupt")
+	},
+	run: func(ctx context.Context, e *env, args []string) error {
+		ocfg, err := setConfig.osConfig()
+		if err != nil {
+			return err
+		}
+		cfg, tracker, err := e.newConfigurator()
+		if err != nil {
+			return err
+		}
+		if unsupported := unsupportedOptions(cfg, ocfg.ResolverOptions); len(unsupported) > 0 {
+			fmt.Fprintf(e.stderr, "warning: options not supported by this mode: %s\n", strings.Join(unsupported, ", "))
+		}
+		if err := cfg.SetDNS(ocfg); err != nil {
+			return err
+		}
+		fmt.Fprintf(e.stdout, "applied %v\n", ocfg)
+		if !setHold {
+			return nil
+		}
+		defer tracker.RegisterWatcher(printChange(e.stdout))()
+		<-ctx.Done()
+		return cfg.Close()
+	},
+}
+
+func unsupportedOptions(cfg dns.OSConfigurator, o dns.ResolverOptions) []string {
+	if c, ok := cfg.(dns.ResolverOptionsChecker); ok {
+		return c.UnsupportedResolverOptions(o)
+	}
+	return nil
+}
+
+var restoreStale bool
+
+var restoreCmd = &command{
+	name:  "restore",
+	short: "remove our DNS configuration and restore the OS's",
+	flags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&restoreStale, "stale", false, "also clean up leftovers of every mode, as after a crash")
+	},
+	run: func(ctx context.Context, e *env, args []string) error {
+		if restoreStale {
+			opts, err := e.global.options()
+			if err != nil {
+				return err
+			}
+			actions, err := dns.RecoverStale(e.global.logf(), e.global.iface, opts)
+			if err != nil {
+				return err
+			}
+			for _, a := range actions {
+				fmt.Fprintf(e.stdout, "%v\n", a)
+			}
+		}
+		cfg, _, err := e.newConfigurator()
+		if err != nil {
+			return err
+		}
+		return cfg.Close()
+	},
+}
+
+var (
+	watchConfig   configFlags
+	watchInterval time.Duration
+)
+
+var watchCmd = &command{
+	name:  "watch",
+	short: "stream health and trample events until interrupted, optionally applying a configuration first",
+	flags: func(fs *flag.FlagSet) {
+		watchConfig.register(fs)
+		fs.DurationVar(&watchInterval, "interval", time.Second, "how often to poll trample counters")
+	},
+	run: func(ctx context.Context, e *env, args []string) error {
+		cfg, tracker, err := e.newConfigurator()
+		if err != nil {
+			return err
+		}
+		defer tracker.RegisterWatcher(printChange(e.stdout))()
+
+		if watchConfig.isSet() {
+			ocfg, err := watchConfig.osConfig()
+			if err != nil {
+				return err
+			}
+			if err := cfg.SetDNS(ocfg); err != nil {
+				return err
+			}
+			fmt.Fprintf(e.stdout, "applied %v\n", ocfg)
+			defer cfg.Close()
+		}
+
+		tr, ok := cfg.(dns.TrampleReporter)
+		if !ok {
+			<-ctx.Done()
+			return nil
+		}
+		var last dns.TrampleStats
+		t := time.NewTicker(watchInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-t.C:
+			}
+			if st := tr.TrampleStats(); st != last {
+				fmt.Fprintf(e.stdout, "%s trample: %+v\n", timestamp(), st)
+				last = st
+			}
+		}
+	},
+}
+
+// printChange returns a health watcher that writes changes to w.
+func printChange(w io.Writer) func(health.Change) {
+	return func(c health.Change) {
+		what := string(c.Subsystem)
+		if c.Warnable != nil {
+			what = c.Warnable.Name()
+		}
+		state := "ok"
+		if c.Err != nil {
+			state = c.Err.Error()
+		}
+		fmt.Fprintf(w, "%s health: %s: %s\n", timestamp(), what, state)
+	}
+}
+
+func timestamp() string {
+	return time.Now().Format(time.RFC3339)
+}
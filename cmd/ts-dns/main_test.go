@@ -0,0 +1,178 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/anywherelan/ts-dns/net/dns"
+	"github.com/anywherelan/ts-dns/util/dnsname"
+)
+
+func TestConfigFlags(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	const js = `{"nameservers":["100.100.100.100"],"searchDomains":["corp.example"],"options":{"ndots":2,"timeout":"1500ms"}}`
+	if err := os.WriteFile(file, []byte(js), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := configFlags{
+		nameservers: "8.8.8.8, 1.1.1.1",
+		match:       "ts.net",
+		file:        file,
+	}
+	got, err := c.osConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := dns.OSConfig{
+		Nameservers: []netip.Addr{
+			netip.MustParseAddr("100.100.100.100"),
+			netip.MustParseAddr("8.8.8.8"),
+			netip.MustParseAddr("1.1.1.1"),
+		},
+		SearchDomains:   []dnsname.FQDN{"corp.example."},
+		MatchDomains:    []dnsname.FQDN{"ts.net."},
+		ResolverOptions: dns.ResolverOptions{Ndots: 2, Timeout: 1500 * time.Millisecond},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("osConfig = %+v; want %+v", got, want)
+	}
+
+	// The JSON form round-trips.
+	bs, err := json.Marshal(configFromOS(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jc jsonConfig
+	if err := json.Unmarshal(bs, &jc); err != nil {
+		t.Fatal(err)
+	}
+	back, err := jc.osConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(back, want) {
+		t.Errorf("round trip = %+v; want %+v", back, want)
+	}
+
+	if _, err := (&configFlags{nameservers: "not-an-ip"}).osConfig(); err == nil {
+		t.Error("bad nameserver accepted")
+	}
+}
+
+func TestDetectForced(t *testing.T) {
+	t.Setenv("TS_DEBUG_DNS_MODE", "")
+	var stdout, stderr bytes.Buffer
+	// Global flags may come before or after the command name.
+	err := run(context.Background(), []string{"-mode", "direct", "detect", "-json", "-root", t.TempDir()}, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("run: %v; stderr: %s", err, stderr.Bytes())
+	}
+	var rep dns.ModeReport
+	if err := json.Unmarshal(stdout.Bytes(), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Mode != dns.ModeDirect || rep.ForcedBy != "options" {
+		t.Errorf("report = %+v; want direct forced by options", rep)
+	}
+}
+
+func TestSetRestoreDirect(t *testing.T) {
+	t.Setenv("TS_DEBUG_DNS_MODE", "")
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	const orig = "nameserver 9.9.9.9\n"
+	resolvConf := filepath.Join(root, "etc", "resolv.conf")
+	if err := os.WriteFile(resolvConf, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	global := []string{"-mode", "direct", "-root", root, "-name", "example"}
+	run1 := func(args ...string) string {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		if err := run(context.Background(), append(append([]string(nil), global...), args...), &stdout, &stderr); err != nil {
+			t.Fatalf("%v: %v; stderr: %s", args, err, stderr.Bytes())
+		}
+		return stdout.String()
+	}
+
+	run1("set", "-nameservers", "100.100.100.100", "-search", "example.net")
+	got, err := os.ReadFile(resolvConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(got, []byte("nameserver 100.100.100.100\n")) || !bytes.Contains(got, []byte("search example.net\n")) {
+		t.Errorf("resolv.conf after set:\n%s", got)
+	}
+
+	var base jsonConfig
+	if err := json.Unmarshal([]byte(run1("base", "-json")), &base); err != nil {
+		t.Fatal(err)
+	}
+	if want := []netip.Addr{netip.MustParseAddr("9.9.9.9")}; !reflect.DeepEqual(base.Nameservers, want) {
+		t.Errorf("base nameservers = %v; want %v", base.Nameservers, want)
+	}
+
+	run1("restore")
+	got, err = os.ReadFile(resolvConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != orig {
+		t.Errorf("resolv.conf after restore:\n%s, want:\n%s", got, orig)
+	}
+}
+
+func TestJournalRestoreStale(t *testing.T) {
+	t.Setenv("TS_DEBUG_DNS_MODE", "")
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	const orig = "nameserver 9.9.9.9\n"
+	resolvConf := filepath.Join(root, "etc", "resolv.conf")
+	if err := os.WriteFile(resolvConf, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	global := []string{"-mode", "direct", "-root", root, "-name", "example", "-state-dir", filepath.Join(root, "state")}
+	run1 := func(args ...string) string {
+		t.Helper()
+		var stdout, stderr bytes.Buffer
+		if err := run(context.Background(), append(append([]string(nil), global...), args...), &stdout, &stderr); err != nil {
+			t.Fatalf("%v: %v; stderr: %s", args, err, stderr.Bytes())
+		}
+		return stdout.String()
+	}
+
+	run1("set", "-nameservers", "100.100.100.100")
+	var j dns.Journal
+	if err := json.Unmarshal([]byte(run1("journal", "-json")), &j); err != nil {
+		t.Fatal(err)
+	}
+	if len(j.Entries) != 1 || j.Entries[0].Kind != dns.JournalBackup || !j.Entries[0].Applied {
+		t.Fatalf("journal after set = %+v", j)
+	}
+
+	run1("restore", "-stale")
+	got, err := os.ReadFile(resolvConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != orig {
+		t.Errorf("resolv.conf after restore -stale:\n%s, want:\n%s", got, orig)
+	}
+	if out := run1("journal"); out != "no changes journaled\n" {
+		t.Errorf("journal after restore -stale = %q", out)
+	}
+}
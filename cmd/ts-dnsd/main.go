@@ -0,0 +1,177 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// The ts-dnsd daemon owns the host's DNS configuration on behalf of
+// unprivileged clients. It runs as root, holds a single OSConfigurator
+// and accepts JSON requests on a Unix socket.
+//
+// Each client connection holds a lease on the configuration it
+// contributes with a "set" request. The daemon applies the merge of all
+// live contributions, oldest lease first (see dns.MergeOSConfigs), and
+// reverts a client's contribution when its connection closes. A
+// contribution whose nameservers would serve an older one's match
+// domains, or the other way around, is rejected; if an older lease
+// changes into such a conflict, the younger one is left out, as its
+// status reports. Clients are authorized by the kernel-checked
+// credentials of their socket peer; root and the daemon's own user are
+// always allowed.
+//
+// Requests and responses are JSON objects, one after another on the
+// connection:
+//
+//	{"op":"set","config":{"Nameservers":["100.100.100.100"],"MatchDomains":["ts.net"]}}
+//	{"lease":1}
+//	{"op":"status"}
+//	{"lease":1,"status":{...}}
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/anywherelan/ts-dns/net/dns"
+)
+
+var (
+	socketPath = flag.String("socket", "/run/ts-dnsd.sock", "path of the Unix socket to listen on")
+	allowUIDs  = flag.String("allow-uid", "", "comma-separated user IDs allowed to contribute DNS settings")
+	allowGIDs  = flag.String("allow-gid", "", "comma-separated primary group IDs allowed to contribute DNS settings")
+	iface      = flag.String("iface", "", "network interface to manage DNS for")
+	mode       = flag.String("mode", "", "force the named DNS mode instead of detecting it")
+	name       = flag.String("name", "", "product name for the files and records written (default tailscale)")
+	root       = flag.String("root", "", "prefix for the paths of the files read and written")
+	recoverAll = flag.Bool("recover", true, "clean up DNS configuration left behind by a previous run at startup")
+	hostsMode  = flag.String("hosts", "ignore", "how to apply hosts entries: ignore, file (/etc/hosts) or responder")
+	hostsAddr  = flag.String("hosts-responder", "127.0.0.101", "loopback address of the responder for -hosts=responder")
+	splitStub  = flag.String("split-stub", "", "loopback address, such as 127.0.0.100, to run a split DNS forwarder on for DNS modes without split DNS")
+	stateDir   = flag.String("state-dir", "", "directory to journal the changes made to the OS in, so that -recover can undo them after a crash")
+	queue      = flag.Bool("queue", false, "wait for another program that owns the DNS configuration to release it, instead of failing")
+)
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		log.Fatalf("ts-dnsd: %v", err)
+	}
+}
+
+func run() error {
+	authorize, err := newAuthorizer(*allowUIDs, *allowGIDs)
+	if err != nil {
+		return err
+	}
+	opts := dns.Options{Mode: *mode, Root: *root, StateDir: *stateDir}
+	if *name != "" {
+		opts.Identity = dns.Identity{Name: *name}
+	}
+	if *queue {
+		opts.Ownership = dns.OwnershipQueue
+	}
+	if *splitStub != "" {
+		ip, err := netip.ParseAddr(*splitStub)
+		if err != nil {
+			return fmt.Errorf("-split-stub: %w", err)
+		}
+		opts.SplitDNSStub = netip.AddrPortFrom(ip, 53)
+	}
+	switch *hostsMode {
+	case "ignore":
+	case "file":
+		opts.Hosts = dns.HostsFile
+	case "responder":
+		ip, err := netip.ParseAddr(*hostsAddr)
+		if err != nil {
+			return fmt.Errorf("-hosts-responder: %w", err)
+		}
+		opts.Hosts = dns.HostsResponder
+		opts.HostsResponderAddr = netip.AddrPortFrom(ip, 53)
+	default:
+		return fmt.Errorf("-hosts: unknown mode %q", *hostsMode)
+	}
+	if *recoverAll {
+		if _, err := dns.RecoverStale(log.Printf, *iface, opts); err != nil {
+			return err
+		}
+	}
+	oscfg, err := dns.NewOSConfiguratorWithOptions(log.Printf, *iface, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := oscfg.Close(); err != nil {
+			log.Printf("closing: %v", err)
+		}
+	}()
+
+	// A socket left behind by a previous run would make Listen fail.
+	if err := os.Remove(*socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ln, err := net.Listen("unix", *socketPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(*socketPath)
+	// Anyone may connect; authorization is by peer credentials.
+	if err := os.Chmod(*socketPath, 0666); err != nil {
+		ln.Close()
+		return err
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigc
+		log.Printf("%v: shutting down", sig)
+		ln.Close()
+	}()
+
+	log.Printf("listening on %s", *socketPath)
+	return newServer(log.Printf, oscfg, authorize).serve(ln)
+}
+
+// newAuthorizer returns a function that allows root, the daemon's own
+// user, and the users and primary groups in the comma-separated lists
+// uids and gids.
+func newAuthorizer(uids, gids string) (func(peerCred) error, error) {
+	allowedUID, err := parseIDs(uids)
+	if err != nil {
+		return nil, fmt.Errorf("-allow-uid: %w", err)
+	}
+	allowedGID, err := parseIDs(gids)
+	if err != nil {
+		return nil, fmt.Errorf("-allow-gid: %w", err)
+	}
+	allowedUID[0] = true
+	allowedUID[uint32(os.Getuid())] = true
+	return func(p peerCred) error {
+		if allowedUID[p.UID] || allowedGID[p.GID] {
+			return nil
+		}
+		return fmt.Errorf("%v is not allowed", p)
+	}, nil
+}
+
+func parseIDs(s string) (map[uint32]bool, error) {
+	ret := map[uint32]bool{}
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return nil, errors.New("bad ID " + strconv.Quote(f))
+		}
+		ret[uint32(id)] = true
+	}
+	return ret, nil
+}
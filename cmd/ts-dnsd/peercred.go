@@ -0,0 +1,18 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import "fmt"
+
+// peerCred are the credentials of the process at the other end of a
+// Unix socket connection, as checked by the kernel.
+type peerCred struct {
+	UID uint32
+	GID uint32 // the primary group only
+	PID int32
+}
+
+func (p peerCred) String() string {
+	return fmt.Sprintf("pid %d (uid %d, gid %d)", p.PID, p.UID, p.GID)
+}
@@ -0,0 +1,36 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials returns the credentials of the peer of the Unix
+// socket connection c, using SO_PEERCRED.
+func peerCredentials(c net.Conn) (peerCred, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return peerCred{}, fmt.Errorf("not a Unix socket connection: %T", c)
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return peerCred{}, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+	if err != nil {
+		return peerCred{}, fmt.Errorf("getting peer credentials: %w", err)
+	}
+	return peerCred{UID: cred.Uid, GID: cred.Gid, PID: cred.Pid}, nil
+}
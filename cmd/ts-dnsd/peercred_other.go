@@ -0,0 +1,18 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"runtime"
+)
+
+// peerCredentials always fails: peer credentials aren't implemented on
+// this platform, so no client can be authorized.
+func peerCredentials(net.Conn) (peerCred, error) {
+	return peerCred{}, errors.New("peer credentials are not supported on " + runtime.GOOS)
+}
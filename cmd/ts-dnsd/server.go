@@ -0,0 +1,329 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/anywherelan/ts-dns/net/dns"
+	"github.com/anywherelan/ts-dns/types/logger"
+	"github.com/anywherelan/ts-dns/util/dnsname"
+	"github.com/anywherelan/ts-dns/util/hostsfile"
+)
+
+// A request is a message from a client. Each is answered by exactly one
+// response, in order.
+type request struct {
+	// Op is the operation:
+	//
+	//	"set"    replace the client's contribution with Config
+	//	"clear"  withdraw the client's contribution
+	//	"status" report the merged configuration and the leases
+	Op string `json:"op"`
+
+	// Config is the client's contribution, for "set".
+	Config *dns.OSConfig `json:"config,omitempty"`
+}
+
+// A response answers a request.
+type response struct {
+	// Error, if non-empty, says why the request failed. A failed
+	// "set" leaves the client's previous contribution in place.
+	Error string `json:"error,omitempty"`
+
+	// Lease is the ID of the client's lease.
+	Lease uint64 `json:"lease"`
+
+	// Status is set for "status".
+	Status *status `json:"status,omitempty"`
+}
+
+// status is the daemon's state, as reported to "status".
+type status struct {
+	Applied dns.OSConfig  `json:"applied"` // the merged configuration
+	Leases  []leaseStatus `json:"leases"`  // in order of precedence
+}
+
+type leaseStatus struct {
+	ID     uint64       `json:"id"`
+	UID    uint32       `json:"uid"`
+	PID    int32        `json:"pid"`
+	Config dns.OSConfig `json:"config"`
+
+	// ConflictsWith, if non-zero, is the older lease whose config
+	// left this one's out of the applied configuration, since the
+	// nameservers of each would have served the other's domains.
+	ConflictsWith uint64 `json:"conflictsWith,omitempty"`
+}
+
+// A lease is a client connection's hold on its contribution to the DNS
+// configuration. It ends when the connection closes.
+type lease struct {
+	id   uint64
+	peer peerCred
+	cfg  dns.OSConfig
+}
+
+// server owns an OSConfigurator and applies the merge of its clients'
+// contributions to it.
+type server struct {
+	logf      logger.Logf
+	os        dns.OSConfigurator
+	authorize func(peerCred) error
+	peerCreds func(net.Conn) (peerCred, error) // peerCredentials, in production
+
+	mu        sync.Mutex
+	nextID    uint64
+	leases    map[uint64]*lease
+	applied   dns.OSConfig
+	conflicts map[uint64]uint64 // lease ID => older lease ID, see leaseStatus
+}
+
+func newServer(logf logger.Logf, oscfg dns.OSConfigurator, authorize func(peerCred) error) *server {
+	return &server{
+		logf:      logf,
+		os:        oscfg,
+		authorize: authorize,
+		peerCreds: peerCredentials,
+		leases:    map[uint64]*lease{},
+	}
+}
+
+// serve accepts connections on ln until it's closed.
+func (s *server) serve(ln net.Listener) error {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.handle(c)
+	}
+}
+
+// handle serves the client on c, for as long as it's connected.
+func (s *server) handle(c net.Conn) {
+	defer c.Close()
+	peer, err := s.peerCreds(c)
+	if err == nil {
+		err = s.authorize(peer)
+	}
+	if err != nil {
+		s.logf("rejecting client: %v", err)
+		json.NewEncoder(c).Encode(response{Error: err.Error()})
+		return
+	}
+
+	l := s.newLease(peer)
+	s.logf("lease %d: acquired by %v", l.id, peer)
+	defer s.release(l)
+
+	dec := json.NewDecoder(c)
+	enc := json.NewEncoder(c)
+	for {
+		var req request
+		if err := dec.Decode(&req); err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.logf("lease %d: %v", l.id, err)
+				enc.Encode(response{Lease: l.id, Error: fmt.Sprintf("bad request: %v", err)})
+			}
+			return
+		}
+		res := s.do(l, req)
+		res.Lease = l.id
+		if err := enc.Encode(res); err != nil {
+			s.logf("lease %d: %v", l.id, err)
+			return
+		}
+	}
+}
+
+func (s *server) do(l *lease, req request) response {
+	switch req.Op {
+	case "set":
+		if req.Config == nil {
+			return response{Error: "set: missing config"}
+		}
+		cfg, err := normalizeConfig(*req.Config)
+		if err != nil {
+			return response{Error: fmt.Sprintf("set: %v", err)}
+		}
+		if err := s.update(l, cfg); err != nil {
+			return response{Error: fmt.Sprintf("set: %v", err)}
+		}
+		return response{}
+	case "clear":
+		if err := s.update(l, dns.OSConfig{}); err != nil {
+			return response{Error: fmt.Sprintf("clear: %v", err)}
+		}
+		return response{}
+	case "status":
+		return response{Status: s.status()}
+	}
+	return response{Error: fmt.Sprintf("unknown op %q", req.Op)}
+}
+
+// normalizeConfig validates the client-supplied cfg and canonicalizes
+// its domain names.
+func normalizeConfig(cfg dns.OSConfig) (dns.OSConfig, error) {
+	for _, ds := range []*[]dnsname.FQDN{&cfg.SearchDomains, &cfg.MatchDomains} {
+		for i, d := range *ds {
+			fqdn, err := dnsname.ToFQDN(string(d))
+			if err != nil {
+				return dns.OSConfig{}, err
+			}
+			(*ds)[i] = fqdn
+		}
+	}
+	for _, ip := range cfg.Nameservers {
+		if !ip.IsValid() {
+			return dns.OSConfig{}, errors.New("invalid nameserver")
+		}
+	}
+	for _, he := range cfg.Hosts {
+		if he == nil || !he.Addr.IsValid() || len(he.Hosts) == 0 {
+			return dns.OSConfig{}, errors.New("invalid hosts entry")
+		}
+		for _, h := range he.Hosts {
+			if err := checkHostName(h); err != nil {
+				return dns.OSConfig{}, err
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// checkHostName checks that the hosts entry name h is a DNS name that
+// can be written to /etc/hosts as it is.
+func checkHostName(h string) error {
+	if h == "" || h == "." || !hostsfile.ValidName(h) {
+		return fmt.Errorf("invalid host name %q", h)
+	}
+	if _, err := dnsname.ToFQDN(h); err != nil {
+		return fmt.Errorf("invalid host name %q: %w", h, err)
+	}
+	return nil
+}
+
+func (s *server) newLease(peer peerCred) *lease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	l := &lease{id: s.nextID, peer: peer}
+	s.leases[l.id] = l
+	return l
+}
+
+// release ends l and reverts its contribution.
+func (s *server) release(l *lease) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.leases, l.id)
+	s.logf("lease %d: released", l.id)
+	if err := s.applyLocked(); err != nil {
+		s.logf("lease %d: reverting: %v", l.id, err)
+	}
+}
+
+// update replaces l's contribution with cfg and applies the result. If
+// cfg conflicts with an older lease's, it's rejected. If applying it
+// fails, l's previous contribution is restored.
+func (s *server) update(l *lease, cfg dns.OSConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := l.cfg
+	l.cfg = cfg
+	if _, conflicts := s.mergeLocked(); conflicts[l.id] != 0 {
+		l.cfg = old
+		return fmt.Errorf("conflicts with lease %d, whose nameservers would serve this config's domains or the other way around", conflicts[l.id])
+	}
+	err := s.applyLocked()
+	if err != nil {
+		l.cfg = old
+		if rerr := s.applyLocked(); rerr != nil {
+			s.logf("lease %d: restoring previous config: %v", l.id, rerr)
+		}
+	}
+	return err
+}
+
+// sortedLeasesLocked returns the live leases, oldest first.
+func (s *server) sortedLeasesLocked() []*lease {
+	ret := make([]*lease, 0, len(s.leases))
+	for _, l := range s.leases {
+		ret = append(ret, l)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].id < ret[j].id })
+	return ret
+}
+
+// mergeLocked returns the merge of all leases, oldest first, and the
+// leases left out of it, mapped to the older leases they conflict with.
+func (s *server) mergeLocked() (dns.OSConfig, map[uint64]uint64) {
+	leases := s.sortedLeasesLocked()
+	var cfgs []dns.OSConfig
+	for _, l := range leases {
+		cfgs = append(cfgs, l.cfg)
+	}
+	merged, conflicts := dns.MergeOSConfigs(cfgs...)
+	ret := map[uint64]uint64{}
+	for _, c := range conflicts {
+		ret[leases[c.Index].id] = leases[c.With].id
+	}
+	return merged, ret
+}
+
+// applyLocked applies the merge of all leases, unless it's already
+// applied. The leases left out of it are recorded in s.conflicts.
+func (s *server) applyLocked() error {
+	merged, conflicts := s.mergeLocked()
+	s.conflicts = conflicts
+	if merged.Equal(s.applied) && sameHosts(merged.Hosts, s.applied.Hosts) {
+		return nil
+	}
+	for id, with := range conflicts {
+		s.logf("lease %d: left out, conflicts with lease %d", id, with)
+	}
+	s.logf("applying %v", merged)
+	if err := s.os.SetDNS(merged); err != nil {
+		return err
+	}
+	s.applied = merged
+	return nil
+}
+
+func (s *server) status() *status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := &status{Applied: s.applied}
+	for _, l := range s.sortedLeasesLocked() {
+		st.Leases = append(st.Leases, leaseStatus{ID: l.id, UID: l.peer.UID, PID: l.peer.PID, Config: l.cfg, ConflictsWith: s.conflicts[l.id]})
+	}
+	return st
+}
+
+func sameHosts(a, b []*dns.HostEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Addr != b[i].Addr || len(a[i].Hosts) != len(b[i].Hosts) {
+			return false
+		}
+		for j := range a[i].Hosts {
+			if a[i].Hosts[j] != b[i].Hosts[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,270 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anywherelan/ts-dns/net/dns"
+	"github.com/anywherelan/ts-dns/util/dnsname"
+)
+
+// fakeOS is an OSConfigurator that records the configs it's given.
+type fakeOS struct {
+	mu      sync.Mutex
+	set     []dns.OSConfig
+	failFor dnsname.FQDN // SetDNS fails for configs with this match domain
+}
+
+func (f *fakeOS) SetDNS(cfg dns.OSConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, d := range cfg.MatchDomains {
+		if d == f.failFor {
+			return errors.New("injected failure")
+		}
+	}
+	f.set = append(f.set, cfg)
+	return nil
+}
+
+func (f *fakeOS) last() dns.OSConfig {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.set) == 0 {
+		return dns.OSConfig{}
+	}
+	return f.set[len(f.set)-1]
+}
+
+func (f *fakeOS) SupportsSplitDNS() bool { return true }
+func (f *fakeOS) GetBaseConfig() (dns.OSConfig, error) {
+	return dns.OSConfig{}, dns.ErrGetBaseConfigNotSupported
+}
+func (f *fakeOS) Close() error { return nil }
+
+type client struct {
+	t   *testing.T
+	c   net.Conn
+	enc *json.Encoder
+	dec *json.Decoder
+}
+
+// connect connects a client with the credentials peer to s.
+func connect(t *testing.T, s *server, peer peerCred) *client {
+	a, b := net.Pipe()
+	s.peerCreds = func(net.Conn) (peerCred, error) { return peer, nil }
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handle(b)
+	}()
+	// Wait for the handler, which logs to t, before the test completes.
+	t.Cleanup(func() {
+		a.Close()
+		<-done
+	})
+	return &client{t: t, c: a, enc: json.NewEncoder(a), dec: json.NewDecoder(a)}
+}
+
+func (c *client) do(req request) response {
+	c.t.Helper()
+	if err := c.enc.Encode(req); err != nil {
+		c.t.Fatal(err)
+	}
+	var res response
+	if err := c.dec.Decode(&res); err != nil {
+		c.t.Fatal(err)
+	}
+	return res
+}
+
+func TestServerLeases(t *testing.T) {
+	ip := netip.MustParseAddr
+	fos := &fakeOS{failFor: "fail.example."}
+	authorize := func(p peerCred) error {
+		if p.UID != 1000 {
+			return errors.New("denied")
+		}
+		return nil
+	}
+	s := newServer(t.Logf, fos, authorize)
+
+	c1 := connect(t, s, peerCred{UID: 1000, PID: 1})
+	res := c1.do(request{Op: "set", Config: &dns.OSConfig{
+		Nameservers:  []netip.Addr{ip("100.100.100.100")},
+		MatchDomains: []dnsname.FQDN{"ts.net"},
+	}})
+	if res.Error != "" || res.Lease != 1 {
+		t.Fatalf("set: %+v", res)
+	}
+	c2 := connect(t, s, peerCred{UID: 1000, PID: 2})
+	if res := c2.do(request{Op: "set", Config: &dns.OSConfig{
+		Nameservers:  []netip.Addr{ip("100.100.100.100")},
+		MatchDomains: []dnsname.FQDN{"corp"},
+	}}); res.Error != "" {
+		t.Fatalf("set: %+v", res)
+	}
+	want := dns.OSConfig{
+		Nameservers:  []netip.Addr{ip("100.100.100.100")},
+		MatchDomains: []dnsname.FQDN{"ts.net.", "corp."},
+	}
+	if got := fos.last(); !reflect.DeepEqual(got, want) {
+		t.Errorf("applied %+v; want %+v", got, want)
+	}
+
+	// A failing update keeps the previous contribution.
+	res = c2.do(request{Op: "set", Config: &dns.OSConfig{
+		Nameservers:  []netip.Addr{ip("100.100.100.100")},
+		MatchDomains: []dnsname.FQDN{"fail.example"},
+	}})
+	if res.Error == "" {
+		t.Error("failing set succeeded")
+	}
+	st := c1.do(request{Op: "status"}).Status
+	if st == nil || len(st.Leases) != 2 || !reflect.DeepEqual(st.Applied, want) {
+		t.Errorf("status after failed set = %+v", st)
+	}
+
+	// Disconnecting reverts the client's part.
+	c2.c.Close()
+	want = dns.OSConfig{
+		Nameservers:  []netip.Addr{ip("100.100.100.100")},
+		MatchDomains: []dnsname.FQDN{"ts.net."},
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(fos.last(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("applied %+v after disconnect; want %+v", fos.last(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if res := c1.do(request{Op: "clear"}); res.Error != "" {
+		t.Fatalf("clear: %+v", res)
+	}
+	if got := fos.last(); !got.IsZero() {
+		t.Errorf("applied %+v after clear; want nothing", got)
+	}
+
+	if res := c1.do(request{Op: "frob"}); res.Error == "" {
+		t.Error("unknown op succeeded")
+	}
+
+	// Unauthorized clients are turned away.
+	c3 := connect(t, s, peerCred{UID: 1001, PID: 3})
+	var rej response
+	if err := c3.dec.Decode(&rej); err != nil {
+		t.Fatal(err)
+	}
+	if rej.Error == "" {
+		t.Error("unauthorized client accepted")
+	}
+}
+
+func TestServerConflicts(t *testing.T) {
+	ip := netip.MustParseAddr
+	fos := new(fakeOS)
+	s := newServer(t.Logf, fos, func(peerCred) error { return nil })
+	ts := &dns.OSConfig{
+		Nameservers:  []netip.Addr{ip("100.100.100.100")},
+		MatchDomains: []dnsname.FQDN{"ts.net"},
+	}
+	corp := &dns.OSConfig{
+		Nameservers:  []netip.Addr{ip("10.0.0.53")},
+		MatchDomains: []dnsname.FQDN{"corp"},
+	}
+
+	c1 := connect(t, s, peerCred{UID: 1000, PID: 1})
+	if res := c1.do(request{Op: "set", Config: ts}); res.Error != "" {
+		t.Fatalf("set: %+v", res)
+	}
+	tsWant := dns.OSConfig{Nameservers: ts.Nameservers, MatchDomains: []dnsname.FQDN{"ts.net."}}
+
+	// Another client's split DNS can't share the OS's single
+	// configuration without its queries going to c1's nameservers.
+	c2 := connect(t, s, peerCred{UID: 1000, PID: 2})
+	if res := c2.do(request{Op: "set", Config: corp}); res.Error == "" {
+		t.Error("conflicting set succeeded")
+	}
+	if got := fos.last(); !reflect.DeepEqual(got, tsWant) {
+		t.Errorf("applied %+v; want %+v", got, tsWant)
+	}
+
+	// Once c1 is gone, c2 can have it. Then c1 turning up again with
+	// its split DNS is left out, as the status shows.
+	if res := c1.do(request{Op: "clear"}); res.Error != "" {
+		t.Fatalf("clear: %+v", res)
+	}
+	if res := c2.do(request{Op: "set", Config: corp}); res.Error != "" {
+		t.Fatalf("set after clear: %+v", res)
+	}
+	if res := c1.do(request{Op: "set", Config: ts}); res.Error != "" {
+		t.Fatalf("set by the older lease: %+v", res)
+	}
+	if got := fos.last(); !reflect.DeepEqual(got, tsWant) {
+		t.Errorf("applied %+v; want the older lease's %+v", got, tsWant)
+	}
+	st := c2.do(request{Op: "status"}).Status
+	if st == nil || len(st.Leases) != 2 || st.Leases[1].ConflictsWith != 1 {
+		t.Errorf("status = %+v; want lease 2 in conflict with lease 1", st)
+	}
+}
+
+func TestNormalizeConfigHosts(t *testing.T) {
+	addr := netip.MustParseAddr("100.64.0.1")
+	tests := []struct {
+		name  string
+		hosts []*dns.HostEntry
+		ok    bool
+	}{
+		{"valid", []*dns.HostEntry{{Addr: addr, Hosts: []string{"peer.ts.net.", "peer"}}}, true},
+		{"no-names", []*dns.HostEntry{{Addr: addr}}, false},
+		{"empty-name", []*dns.HostEntry{{Addr: addr, Hosts: []string{""}}}, false},
+		{"newline", []*dns.HostEntry{{Addr: addr, Hosts: []string{"peer\n1.2.3.4 bank.example"}}}, false},
+		{"space", []*dns.HostEntry{{Addr: addr, Hosts: []string{"a b"}}}, false},
+		{"comment", []*dns.HostEntry{{Addr: addr, Hosts: []string{"peer#x"}}}, false},
+		{"control", []*dns.HostEntry{{Addr: addr, Hosts: []string{"peer\x00"}}}, false},
+		{"empty-label", []*dns.HostEntry{{Addr: addr, Hosts: []string{"a..b"}}}, false},
+		{"no-addr", []*dns.HostEntry{{Hosts: []string{"peer"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := normalizeConfig(dns.OSConfig{Hosts: tt.hosts})
+			if (err == nil) != tt.ok {
+				t.Errorf("normalizeConfig = %v; want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	authorize, err := newAuthorizer("1000, 1001", "50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		peer peerCred
+		ok   bool
+	}{
+		{peerCred{UID: 0}, true},
+		{peerCred{UID: 1001, GID: 1001}, true},
+		{peerCred{UID: 2000, GID: 50}, true},
+		{peerCred{UID: 2000, GID: 2000}, false},
+	} {
+		if err := authorize(tt.peer); (err == nil) != tt.ok {
+			t.Errorf("authorize(%v) = %v; want ok=%v", tt.peer, err, tt.ok)
+		}
+	}
+	if _, err := newAuthorizer("root", ""); err == nil {
+		t.Error("non-numeric UID accepted")
+	}
+}
@@ -0,0 +1,402 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// The ts-resolvconf command is a resolvconf(8) replacement backed by
+// the DNS library. Installed as resolvconf, it lets wg-quick, OpenVPN
+// scripts and DHCP hooks configure DNS on any host the library
+// supports, such as one running systemd-resolved or with no
+// resolvconf at all.
+//
+// It accepts the common flags of openresolv and Debian's resolvconf:
+//
+//	-a IFACE    add or replace the configuration for IFACE, read from stdin
+//	-d IFACE    delete the configuration for IFACE (-f: don't fail if there's none)
+//	-m METRIC   with -a, the order of IFACE relative to the others
+//	-x          with -a, use only IFACE's nameservers
+//	-p          with -a, use IFACE's nameservers only for its search domains
+//	-u          apply all configurations again
+//	-I          delete all configurations
+//	-l [PATTERN]  print the configurations of the matching interfaces
+//	-i [PATTERN]  print the names of the matching interfaces
+//	--enable-updates, --disable-updates, --updates-are-enabled
+//
+// When the host's DNS mode supports split DNS, each interface's
+// configuration is applied to its own link. Otherwise all of them are
+// merged, by metric, into one configuration for the whole host, leaving
+// out the records that can't share it with a lower metric one without
+// their queries crossing over (see dns.MergeOSConfigs).
+//
+// The environment variables TS_RESOLVCONF_DIR and TS_RESOLVCONF_NAME
+// override the state directory and the product name written to the OS;
+// TS_DEBUG_DNS_MODE forces the DNS mode as for the library.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/anywherelan/ts-dns/net/dns"
+	"github.com/anywherelan/ts-dns/net/dns/resolvconffile"
+	"github.com/anywherelan/ts-dns/types/logger"
+)
+
+const (
+	defaultStateDir = "/run/ts-resolvconf"
+	defaultName     = "ts-resolvconf"
+
+	// nestedEnv is set for the programs we run. The library runs
+	// resolvconf on some hosts, which may be us.
+	nestedEnv = "TS_RESOLVCONF_NESTED"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("resolvconf: ")
+	if os.Getenv(nestedEnv) != "" {
+		log.Fatal("called by itself; ts-resolvconf can't be used on hosts where resolvconf manages DNS")
+	}
+	os.Setenv(nestedEnv, "1")
+
+	s := &shim{
+		store: store{dir: envOr("TS_RESOLVCONF_DIR", defaultStateDir)},
+		logf:  log.Printf,
+		opts:  dns.Options{Identity: dns.Identity{Name: envOr("TS_RESOLVCONF_NAME", defaultName)}},
+		interfaceExists: func(name string) bool {
+			_, err := net.InterfaceByName(name)
+			return err == nil
+		},
+	}
+	if err := s.run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		var ec exitCode
+		if errors.As(err, &ec) {
+			os.Exit(int(ec))
+		}
+		log.Print(err)
+		os.Exit(1)
+	}
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// exitCode is an error that exits silently with its value.
+type exitCode int
+
+func (e exitCode) Error() string { return "exit status " + strconv.Itoa(int(e)) }
+
+// invocation is a parsed command line.
+type invocation struct {
+	add, del  string // interface names for -a and -d
+	metric    int
+	exclusive bool
+	private   bool
+	force     bool // -f
+	update    bool // -u
+	init      bool // -I
+	list      *string
+	listNames *string
+	updates   string // "enable", "disable" or "query"
+	version   bool
+}
+
+func parseArgs(args []string) (*invocation, error) {
+	inv := new(invocation)
+	// optArg returns the next argument, for flags with optional
+	// arguments.
+	optArg := func(i *int) *string {
+		s := ""
+		if *i+1 < len(args) && !strings.HasPrefix(args[*i+1], "-") {
+			*i++
+			s = args[*i]
+		}
+		return &s
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		needArg := func() (string, error) {
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("%s: missing argument", arg)
+			}
+			i++
+			return args[i], nil
+		}
+		var err error
+		switch arg {
+		case "-a":
+			inv.add, err = needArg()
+		case "-d":
+			inv.del, err = needArg()
+		case "-m":
+			var s string
+			if s, err = needArg(); err == nil {
+				inv.metric, err = strconv.Atoi(s)
+			}
+		case "-x":
+			inv.exclusive = true
+		case "-p":
+			inv.private = true
+		case "-f":
+			inv.force = true
+		case "-u":
+			inv.update = true
+		case "-I":
+			inv.init = true
+		case "-l":
+			inv.list = optArg(&i)
+		case "-i":
+			inv.listNames = optArg(&i)
+		case "--enable-updates":
+			inv.updates = "enable"
+		case "--disable-updates":
+			inv.updates = "disable"
+		case "--updates-are-enabled":
+			inv.updates = "query"
+		case "--version", "-V":
+			inv.version = true
+		default:
+			return nil, fmt.Errorf("unsupported argument %q", arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range []string{inv.add, inv.del} {
+		if name == "" {
+			continue
+		}
+		if err := validRecordName(name); err != nil {
+			return nil, err
+		}
+	}
+	return inv, nil
+}
+
+// shim runs resolvconf invocations.
+type shim struct {
+	store           store
+	logf            logger.Logf
+	opts            dns.Options
+	interfaceExists func(string) bool
+
+	// newOSConfigurator is dns.NewOSConfiguratorWithOptions, unless
+	// replaced in tests.
+	newOSConfigurator func(logger.Logf, string, dns.Options) (dns.OSConfigurator, error)
+}
+
+func (s *shim) run(args []string, stdin io.Reader, stdout io.Writer) error {
+	inv, err := parseArgs(args)
+	if err != nil {
+		return err
+	}
+	if inv.version {
+		fmt.Fprintln(stdout, "ts-resolvconf, resolvconf(8) compatible")
+		return nil
+	}
+	unlock, err := lockDir(s.store.dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	switch inv.updates {
+	case "enable", "disable":
+		if err := s.store.setUpdatesEnabled(inv.updates == "enable"); err != nil {
+			return err
+		}
+		if inv.updates == "enable" {
+			return s.applyAll()
+		}
+		return nil
+	case "query":
+		if !s.store.updatesEnabled() {
+			return exitCode(1)
+		}
+		return nil
+	}
+
+	switch {
+	case inv.init:
+		recs, err := s.store.list("")
+		if err != nil {
+			return err
+		}
+		for _, r := range recs {
+			if err := s.store.remove(r.Name); err != nil {
+				return err
+			}
+		}
+		return s.applyChanged(recs...)
+	case inv.add != "":
+		bs, err := io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		_, diags, err := resolvconffile.ParseLenient(strings.NewReader(string(bs)))
+		if err != nil {
+			return err
+		}
+		for _, d := range diags {
+			s.logf("%s: line %d: %v", inv.add, d.Line, d.Err)
+		}
+		r := &record{Name: inv.add, Metric: inv.metric, Exclusive: inv.exclusive, Private: inv.private, Conf: string(bs)}
+		if err := s.store.put(r); err != nil {
+			return err
+		}
+		return s.applyChanged(r)
+	case inv.del != "":
+		recs, err := s.store.list("")
+		if err != nil {
+			return err
+		}
+		var r *record
+		for _, rr := range recs {
+			if rr.Name == inv.del {
+				r = rr
+			}
+		}
+		if r == nil {
+			if inv.force {
+				return nil
+			}
+			return fmt.Errorf("no configuration for %s", inv.del)
+		}
+		if err := s.store.remove(r.Name); err != nil {
+			return err
+		}
+		return s.applyChanged(r)
+	case inv.update:
+		return s.applyAll()
+	case inv.list != nil:
+		recs, err := s.store.list(*inv.list)
+		if err != nil {
+			return err
+		}
+		for _, r := range recs {
+			fmt.Fprintf(stdout, "# resolv.conf from %s\n%s", r.Name, r.Conf)
+			if !strings.HasSuffix(r.Conf, "\n") {
+				fmt.Fprintln(stdout)
+			}
+		}
+		return nil
+	case inv.listNames != nil:
+		recs, err := s.store.list(*inv.listNames)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for _, r := range recs {
+			names = append(names, r.Name)
+		}
+		if len(names) > 0 {
+			fmt.Fprintln(stdout, strings.Join(names, " "))
+		}
+		return nil
+	}
+	return errors.New("nothing to do; see -a, -d, -u, -l or -i")
+}
+
+// applyAll applies the configuration of every record.
+func (s *shim) applyAll() error {
+	recs, err := s.store.list("")
+	if err != nil {
+		return err
+	}
+	if len(recs) == 0 {
+		return nil
+	}
+	return s.applyChanged(recs...)
+}
+
+// applyChanged applies the configuration for the links of the changed
+// records, which have already been added to or removed from the store.
+func (s *shim) applyChanged(changed ...*record) error {
+	if len(changed) == 0 || !s.store.updatesEnabled() {
+		return nil
+	}
+	recs, err := s.store.list("")
+	if err != nil {
+		return err
+	}
+
+	// Whether the mode supports split DNS doesn't depend on the
+	// link, so ask the configurator for the first changed record.
+	first := s.linkFor(changed[0].Name)
+	cfgr, err := s.configurator(first)
+	if err != nil {
+		return err
+	}
+	if !cfgr.SupportsSplitDNS() {
+		// The mode has a single, host-wide configuration.
+		cfg, err := mergeRecords(s.logf, recs)
+		if err != nil {
+			return err
+		}
+		return s.apply(cfgr, cfg)
+	}
+
+	done := map[string]bool{}
+	for _, c := range changed {
+		link := s.linkFor(c.Name)
+		if done[link] {
+			continue
+		}
+		done[link] = true
+		var linkRecs []*record
+		for _, r := range recs {
+			if s.linkFor(r.Name) == link {
+				linkRecs = append(linkRecs, r)
+			}
+		}
+		cfg, err := mergeRecords(s.logf, linkRecs)
+		if err != nil {
+			return err
+		}
+		if cfg.IsZero() && !s.interfaceExists(link) {
+			// The link is gone, and its settings with it.
+			continue
+		}
+		if link != first {
+			if cfgr, err = s.configurator(link); err != nil {
+				return err
+			}
+		}
+		if err := s.apply(cfgr, cfg); err != nil {
+			return fmt.Errorf("%s: %w", link, err)
+		}
+	}
+	return nil
+}
+
+// apply applies cfg with cfgr. A zero cfg removes our configuration
+// altogether, so cfgr is closed then.
+func (s *shim) apply(cfgr dns.OSConfigurator, cfg dns.OSConfig) error {
+	if err := cfgr.SetDNS(cfg); err != nil {
+		return err
+	}
+	if cfg.IsZero() {
+		return cfgr.Close()
+	}
+	return nil
+}
+
+func (s *shim) linkFor(name string) string {
+	return linkFor(name, s.interfaceExists)
+}
+
+func (s *shim) configurator(link string) (dns.OSConfigurator, error) {
+	newOSConfigurator := s.newOSConfigurator
+	if newOSConfigurator == nil {
+		newOSConfigurator = dns.NewOSConfiguratorWithOptions
+	}
+	return newOSConfigurator(s.logf, link, s.opts)
+}
@@ -0,0 +1,227 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/anywherelan/ts-dns/net/dns"
+	"github.com/anywherelan/ts-dns/types/logger"
+	"github.com/anywherelan/ts-dns/util/dnsname"
+)
+
+func TestParseArgs(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		args    []string
+		want    *invocation
+		wantErr bool
+	}{
+		{args: []string{"-a", "tun.wg0", "-m", "0", "-x"}, want: &invocation{add: "tun.wg0", exclusive: true}},
+		{args: []string{"-a", "eth0.dhclient", "-m", "10", "-p"}, want: &invocation{add: "eth0.dhclient", metric: 10, private: true}},
+		{args: []string{"-d", "tun.wg0", "-f"}, want: &invocation{del: "tun.wg0", force: true}},
+		{args: []string{"-l"}, want: &invocation{list: str("")}},
+		{args: []string{"-i", "tun.*"}, want: &invocation{listNames: str("tun.*")}},
+		{args: []string{"--updates-are-enabled"}, want: &invocation{updates: "query"}},
+		{args: []string{"-a"}, wantErr: true},
+		{args: []string{"-m", "x"}, wantErr: true},
+		{args: []string{"-a", "../etc"}, wantErr: true},
+		{args: []string{"-z"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseArgs(tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseArgs(%q) error = %v; want error %v", tt.args, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseArgs(%q) = %+v; want %+v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestLinkFor(t *testing.T) {
+	exists := func(name string) bool { return name == "wg0" || name == "eth0" }
+	for name, want := range map[string]string{
+		"wg0":           "wg0",
+		"tun.wg0":       "wg0",
+		"eth0.dhclient": "eth0",
+		"tun.gone":      "tun",
+		"gone":          "gone",
+	} {
+		if got := linkFor(name, exists); got != want {
+			t.Errorf("linkFor(%q) = %q; want %q", name, got, want)
+		}
+	}
+}
+
+// fakeOS is an OSConfigurator that records what's applied to each link.
+type fakeOS struct {
+	split  bool
+	link   string
+	links  map[string]dns.OSConfig
+	closed map[string]bool
+}
+
+func (f *fakeOS) SetDNS(cfg dns.OSConfig) error {
+	f.links[f.link] = cfg
+	return nil
+}
+func (f *fakeOS) SupportsSplitDNS() bool               { return f.split }
+func (f *fakeOS) GetBaseConfig() (dns.OSConfig, error) { return dns.OSConfig{}, nil }
+func (f *fakeOS) Close() error {
+	f.closed[f.link] = true
+	return nil
+}
+
+func newTestShim(t *testing.T, split bool) (*shim, map[string]dns.OSConfig, map[string]bool) {
+	links := map[string]dns.OSConfig{}
+	closed := map[string]bool{}
+	s := &shim{
+		store:           store{dir: t.TempDir()},
+		logf:            t.Logf,
+		interfaceExists: func(name string) bool { return name == "wg0" || name == "eth0" },
+		newOSConfigurator: func(_ logger.Logf, link string, _ dns.Options) (dns.OSConfigurator, error) {
+			return &fakeOS{split: split, link: link, links: links, closed: closed}, nil
+		},
+	}
+	return s, links, closed
+}
+
+func runShim(t *testing.T, s *shim, stdin string, args ...string) string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := s.run(args, strings.NewReader(stdin), &out); err != nil {
+		t.Fatalf("%q: %v", args, err)
+	}
+	return out.String()
+}
+
+func TestShimSplit(t *testing.T) {
+	s, links, closed := newTestShim(t, true)
+	runShim(t, s, "nameserver 10.0.0.1\nsearch corp.example\n", "-a", "tun.wg0", "-m", "0", "-x")
+	runShim(t, s, "nameserver 192.168.1.1\n", "-a", "eth0.dhclient")
+
+	want := map[string]dns.OSConfig{
+		"wg0": {
+			Nameservers:   []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+			SearchDomains: []dnsname.FQDN{"corp.example."},
+		},
+		"eth0": {Nameservers: []netip.Addr{netip.MustParseAddr("192.168.1.1")}},
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("links = %+v; want %+v", links, want)
+	}
+
+	if got := runShim(t, s, "", "-i"); got != "eth0.dhclient tun.wg0\n" {
+		t.Errorf("-i = %q", got)
+	}
+
+	runShim(t, s, "", "-d", "tun.wg0")
+	if !links["wg0"].IsZero() || !closed["wg0"] {
+		t.Errorf("wg0 not cleared: %+v, closed %v", links["wg0"], closed["wg0"])
+	}
+	if links["eth0"].IsZero() {
+		t.Error("eth0 cleared along with wg0")
+	}
+	runShim(t, s, "", "-d", "tun.wg0", "-f")
+	if err := s.run([]string{"-d", "tun.wg0"}, nil, new(bytes.Buffer)); err == nil {
+		t.Error("deleting a missing record without -f succeeded")
+	}
+}
+
+func TestShimGlobal(t *testing.T) {
+	s, links, closed := newTestShim(t, false)
+	runShim(t, s, "nameserver 192.168.1.1\nsearch lan\n", "-a", "eth0.dhclient", "-m", "10")
+	runShim(t, s, "nameserver 10.0.0.1\n", "-a", "tun.wg0", "-m", "0")
+
+	// The configuration is host-wide, whichever link the configurator
+	// is created for; here it's for the lowest metric record. Lower
+	// metrics come first.
+	want := dns.OSConfig{
+		Nameservers:   []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("192.168.1.1")},
+		SearchDomains: []dnsname.FQDN{"lan."},
+	}
+	if got := links["wg0"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("applied %+v; want %+v", got, want)
+	}
+
+	runShim(t, s, "", "--disable-updates")
+	runShim(t, s, "nameserver 10.9.9.9\n", "-a", "tun.wg0", "-x")
+	if got := links["wg0"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("applied %+v with updates disabled", got)
+	}
+	runShim(t, s, "", "--enable-updates")
+	want = dns.OSConfig{Nameservers: []netip.Addr{netip.MustParseAddr("10.9.9.9")}}
+	if got := links["wg0"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("applied %+v with an exclusive record; want %+v", got, want)
+	}
+
+	runShim(t, s, "", "-I")
+	if got := links["wg0"]; !got.IsZero() || !closed["wg0"] {
+		t.Errorf("applied %+v after -I; want nothing", got)
+	}
+}
+
+func TestShimGlobalPrivate(t *testing.T) {
+	s, links, _ := newTestShim(t, false)
+	runShim(t, s, "nameserver 192.168.1.1\nsearch lan\n", "-a", "eth0.dhclient", "-m", "0")
+	runShim(t, s, "nameserver 10.0.0.1\nsearch corp.example\n", "-a", "tun.wg0", "-m", "10", "-p")
+
+	// Without split DNS, the private record's domains can't go to its
+	// nameservers alone, so it's left out rather than having eth0's
+	// queries sent to it, or its own to eth0's nameservers.
+	want := dns.OSConfig{
+		Nameservers:   []netip.Addr{netip.MustParseAddr("192.168.1.1")},
+		SearchDomains: []dnsname.FQDN{"lan."},
+	}
+	if got := links["wg0"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("applied %+v; want %+v", got, want)
+	}
+}
+
+func TestShimDirect(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	resolvConf := filepath.Join(root, "etc", "resolv.conf")
+	const orig = "nameserver 9.9.9.9\n"
+	if err := os.WriteFile(resolvConf, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TS_DEBUG_DNS_MODE", "")
+	s := &shim{
+		store:           store{dir: t.TempDir()},
+		logf:            t.Logf,
+		opts:            dns.Options{Mode: dns.ModeDirect, Root: root, Identity: dns.Identity{Name: defaultName}},
+		interfaceExists: func(string) bool { return false },
+	}
+
+	runShim(t, s, "nameserver 10.0.0.1\nsearch corp.example\noptions ndots:2\n", "-a", "tun.wg0")
+	got, err := os.ReadFile(resolvConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"nameserver 10.0.0.1\n", "search corp.example\n", "options ndots:2\n"} {
+		if !strings.Contains(string(got), line) {
+			t.Errorf("resolv.conf lacks %q:\n%s", line, got)
+		}
+	}
+
+	runShim(t, s, "", "-d", "tun.wg0")
+	got, err = os.ReadFile(resolvConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != orig {
+		t.Errorf("resolv.conf after -d:\n%s, want:\n%s", got, orig)
+	}
+}
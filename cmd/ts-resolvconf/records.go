@@ -0,0 +1,191 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/anywherelan/ts-dns/net/dns"
+	"github.com/anywherelan/ts-dns/net/dns/resolvconffile"
+	"github.com/anywherelan/ts-dns/types/logger"
+)
+
+// A record is the configuration added for one interface with -a.
+type record struct {
+	Name      string `json:"name"`      // as given to -a, such as "tun.wg0" or "eth0.dhclient"
+	Metric    int    `json:"metric"`    // from -m; lower metrics come first
+	Exclusive bool   `json:"exclusive"` // from -x: only this record's nameservers are used
+	Private   bool   `json:"private"`   // from -p: its nameservers only serve its search domains
+	Conf      string `json:"conf"`      // the resolv.conf(5) text read from stdin
+}
+
+// osConfig returns the OSConfig r contributes.
+func (r *record) osConfig() (dns.OSConfig, error) {
+	c, _, err := resolvconffile.ParseLenient(strings.NewReader(r.Conf))
+	if err != nil {
+		return dns.OSConfig{}, err
+	}
+	cfg := dns.OSConfigFromResolvConf(c)
+	if r.Private && len(cfg.Nameservers) > 0 {
+		cfg.MatchDomains = cfg.SearchDomains
+	}
+	return cfg, nil
+}
+
+// validRecordName reports whether name can name a record file.
+func validRecordName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, "-") {
+		return fmt.Errorf("invalid interface name %q", name)
+	}
+	return nil
+}
+
+// store keeps the records in a directory, one JSON file each.
+type store struct {
+	dir string
+}
+
+func (s store) path(name string) string {
+	return filepath.Join(s.dir, "interfaces", name)
+}
+
+func (s store) put(r *record) error {
+	bs, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(s.dir, "interfaces"), 0755); err != nil {
+		return err
+	}
+	tmp := s.path(r.Name) + ".tmp"
+	if err := os.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(r.Name))
+}
+
+// remove removes the record named name. It returns an error satisfying
+// os.IsNotExist if there's none.
+func (s store) remove(name string) error {
+	return os.Remove(s.path(name))
+}
+
+// list returns the records whose names match the path.Match pattern,
+// or all of them if pattern is empty, ordered by metric and then name.
+func (s store) list(pattern string) ([]*record, error) {
+	des, err := os.ReadDir(filepath.Join(s.dir, "interfaces"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ret []*record
+	for _, de := range des {
+		name := de.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		if pattern != "" {
+			if ok, err := filepath.Match(pattern, name); err != nil {
+				return nil, err
+			} else if !ok {
+				continue
+			}
+		}
+		bs, err := os.ReadFile(s.path(name))
+		if err != nil {
+			return nil, err
+		}
+		r := new(record)
+		if err := json.Unmarshal(bs, r); err != nil {
+			return nil, fmt.Errorf("record %s: %w", name, err)
+		}
+		r.Name = name
+		ret = append(ret, r)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Metric != ret[j].Metric {
+			return ret[i].Metric < ret[j].Metric
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
+
+// updatesDisabledFile is present while updates are disabled with
+// --disable-updates.
+const updatesDisabledFile = "updates-disabled"
+
+func (s store) updatesEnabled() bool {
+	_, err := os.Stat(filepath.Join(s.dir, updatesDisabledFile))
+	return os.IsNotExist(err)
+}
+
+func (s store) setUpdatesEnabled(enabled bool) error {
+	p := filepath.Join(s.dir, updatesDisabledFile)
+	if enabled {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(p, nil, 0644)
+}
+
+// mergeRecords returns the merge of the configurations of recs, which
+// must be in order. If any record is exclusive, only the exclusive ones
+// are used. Records left out of the merge, since their nameservers
+// would serve an earlier record's private domains or the other way
+// around, are logged to logf.
+func mergeRecords(logf logger.Logf, recs []*record) (dns.OSConfig, error) {
+	var exclusive []*record
+	for _, r := range recs {
+		if r.Exclusive {
+			exclusive = append(exclusive, r)
+		}
+	}
+	if len(exclusive) > 0 {
+		recs = exclusive
+	}
+	var cfgs []dns.OSConfig
+	for _, r := range recs {
+		cfg, err := r.osConfig()
+		if err != nil {
+			return dns.OSConfig{}, fmt.Errorf("record %s: %w", r.Name, err)
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	merged, conflicts := dns.MergeOSConfigs(cfgs...)
+	for _, c := range conflicts {
+		logf("record %s: left out, conflicts with record %s", recs[c.Index].Name, recs[c.With].Name)
+	}
+	return merged, nil
+}
+
+// linkFor returns the network interface that the record named name is
+// for. Record names are often an interface name with a prefix or
+// suffix, as in Debian's "tun.wg0" or the "eth0.dhclient" used by DHCP
+// hooks. The first candidate that names an existing interface wins; if
+// none does, the part before the first dot is the best guess.
+func linkFor(name string, exists func(string) bool) string {
+	before, after, ok := strings.Cut(name, ".")
+	if !ok {
+		return name
+	}
+	for _, c := range []string{name, after, before} {
+		if exists(c) {
+			return c
+		}
+	}
+	return before
+}
@@ -8,7 +8,8 @@ require (
 	github.com/illarion/gonotify v1.0.1
 	github.com/josharian/native v1.1.1-0.20230202152459-5c7d0dd6ab86
 	go4.org/mem v0.0.0-20220726221520-4f986261bf13
-	golang.org/x/sys v0.8.0
+	golang.org/x/net v0.11.0
+	golang.org/x/sys v0.9.0
 	golang.zx2c4.com/wireguard/windows v0.5.3
 	inet.af/netaddr v0.0.0-20220811202034-502d2d690317
 )
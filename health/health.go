@@ -6,17 +6,36 @@
 package health
 
 import (
+	"encoding/json"
+	"sort"
 	"sync"
-	"sync/atomic"
+	"time"
 )
 
-var (
-	// mu guards everything in this var block.
+// Tracker tracks the health of a set of subsystems and Warnables.
+//
+// The zero value is ready to use. The package-level functions operate
+// on the Tracker returned by Default.
+type Tracker struct {
+	// mu guards everything in this struct.
 	mu sync.Mutex
 
-	sysErr    = map[Subsystem]error{}    // error key => err (or nil for no error)
-	warnables = map[*Warnable]struct{}{} // set of warnables
-)
+	sysErr    map[Subsystem]error     // error key => err (or nil for no error)
+	sysSince  map[Subsystem]time.Time // error key => time of last transition
+	warnables []*Warnable             // in order of registration
+	watchers  map[*watcher]bool       // registered watchers
+
+	timeNow func() time.Time // nil means time.Now; for tests
+}
+
+type watcher struct {
+	cb func(Change)
+}
+
+var defaultTracker = new(Tracker)
+
+// Default returns the Tracker that the package-level functions use.
+func Default() *Tracker { return defaultTracker }
 
 // Subsystem is the name of a subsystem whose health can be monitored.
 type Subsystem string
@@ -29,16 +48,85 @@ const (
 	SysDNSManager = Subsystem("dns-manager")
 )
 
+// A Change is a transition of a subsystem or Warnable between healthy
+// and unhealthy, as passed to the callbacks registered with
+// RegisterWatcher.
+type Change struct {
+	// Subsystem is the subsystem that changed, or empty if a
+	// Warnable changed.
+	Subsystem Subsystem
+	// Warnable is the Warnable that changed, or nil if a subsystem
+	// changed.
+	Warnable *Warnable
+	// Err is the new error, or nil if it's now healthy.
+	Err error
+}
+
+// RegisterWatcher adds cb to the functions called when a subsystem or
+// Warnable tracked by t goes from healthy to unhealthy or back. Changes
+// to the error of something that's already unhealthy aren't reported.
+//
+// Callbacks are called synchronously, without t's lock held, by the
+// goroutine that made the change, so they must not block for long.
+//
+// The returned function unregisters cb.
+func (t *Tracker) RegisterWatcher(cb func(Change)) (unregister func()) {
+	w := &watcher{cb: cb}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.watchers == nil {
+		t.watchers = map[*watcher]bool{}
+	}
+	t.watchers[w] = true
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.watchers, w)
+	}
+}
+
+// callbacksLocked returns the callbacks to run for a change.
+// t.mu must be held.
+func (t *Tracker) callbacksLocked() []func(Change) {
+	if len(t.watchers) == 0 {
+		return nil
+	}
+	cbs := make([]func(Change), 0, len(t.watchers))
+	for w := range t.watchers {
+		cbs = append(cbs, w.cb)
+	}
+	return cbs
+}
+
+func runCallbacks(cbs []func(Change), c Change) {
+	for _, cb := range cbs {
+		cb(c)
+	}
+}
+
+func (t *Tracker) now() time.Time {
+	if t.timeNow != nil {
+		return t.timeNow()
+	}
+	return time.Now()
+}
+
 // NewWarnable returns a new warnable item that the caller can mark
 // as health or in warning state.
 func NewWarnable(opts ...WarnableOpt) *Warnable {
-	w := new(Warnable)
+	return defaultTracker.NewWarnable(opts...)
+}
+
+// NewWarnable returns a new warnable item, tracked by t, that the
+// caller can mark as health or in warning state.
+func (t *Tracker) NewWarnable(opts ...WarnableOpt) *Warnable {
+	w := &Warnable{t: t}
 	for _, o := range opts {
 		o.mod(w)
 	}
-	mu.Lock()
-	defer mu.Unlock()
-	warnables[w] = struct{}{}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.warnables = append(t.warnables, w)
 	return w
 }
 
@@ -56,6 +144,14 @@ func WithMapDebugFlag(name string) WarnableOpt {
 	})
 }
 
+// WithName returns a WarnableOpt for NewWarnable that names the
+// returned Warnable in listings and snapshots.
+func WithName(name string) WarnableOpt {
+	return warnOptFunc(func(w *Warnable) {
+		w.name = name
+	})
+}
+
 type warnOptFunc func(*Warnable)
 
 func (f warnOptFunc) mod(w *Warnable) { f(w) }
@@ -63,68 +159,232 @@ func (f warnOptFunc) mod(w *Warnable) { f(w) }
 // Warnable is a health check item that may or may not be in a bad warning state.
 // The caller of NewWarnable is responsible for calling Set to update the state.
 type Warnable struct {
-	debugFlag string // optional MapRequest.DebugFlag to send when unhealthy
+	t         *Tracker // the tracker that owns w
+	name      string   // optional name for listings
+	debugFlag string   // optional MapRequest.DebugFlag to send when unhealthy
 
-	isSet atomic.Bool
-	mu    sync.Mutex
-	err   error
+	// Guarded by t.mu:
+	err     error
+	since   time.Time // time of the last transition; zero if never unhealthy
+	removed bool      // whether Unregister was called
 }
 
+// Name returns the name w was created with, if any.
+func (w *Warnable) Name() string { return w.name }
+
 // Set updates the Warnable's state.
 // If non-nil, it's considered unhealthy.
+//
+// Set does nothing on a Warnable that wasn't created by NewWarnable,
+// such as the zero Warnable, or that was unregistered.
 func (w *Warnable) Set(err error) {
-	w.mu.Lock()
-	defer w.mu.Unlock()
+	t := w.t
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if w.removed {
+		t.mu.Unlock()
+		return
+	}
+	changed := (w.err == nil) != (err == nil)
 	w.err = err
-	w.isSet.Store(err != nil)
+	var cbs []func(Change)
+	if changed {
+		w.since = t.now()
+		cbs = t.callbacksLocked()
+	}
+	t.mu.Unlock()
+	runCallbacks(cbs, Change{Warnable: w, Err: err})
+}
+
+// Unregister removes w from its Tracker, for when what it reports on
+// goes away. If w was unhealthy, watchers see it become healthy. Later
+// calls to Set do nothing.
+func (w *Warnable) Unregister() {
+	t := w.t
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if w.removed {
+		t.mu.Unlock()
+		return
+	}
+	w.removed = true
+	for i, o := range t.warnables {
+		if o == w {
+			t.warnables = append(t.warnables[:i], t.warnables[i+1:]...)
+			break
+		}
+	}
+	var cbs []func(Change)
+	if w.err != nil {
+		w.err = nil
+		w.since = t.now()
+		cbs = t.callbacksLocked()
+	}
+	t.mu.Unlock()
+	runCallbacks(cbs, Change{Warnable: w})
 }
 
 func (w *Warnable) get() error {
-	if !w.isSet.Load() {
+	if w.t == nil {
 		return nil
 	}
-	w.mu.Lock()
-	defer w.mu.Unlock()
+	w.t.mu.Lock()
+	defer w.t.mu.Unlock()
 	return w.err
 }
 
 // SetDNSOSHealth sets the state of the net/dns.OSConfigurator
-func SetDNSOSHealth(err error) { setErr(SysDNSOS, err) }
+func SetDNSOSHealth(err error) { defaultTracker.SetDNSOSHealth(err) }
+
+// SetDNSManagerHealth sets the state of the Linux net/dns manager's
+// discovery of the /etc/resolv.conf situation.
+func SetDNSManagerHealth(err error) { defaultTracker.SetDNSManagerHealth(err) }
+
+// DNSOSHealth returns the net/dns.OSConfigurator error state.
+func DNSOSHealth() error { return defaultTracker.DNSOSHealth() }
+
+// SetDNSOSHealth sets the state of the net/dns.OSConfigurator
+func (t *Tracker) SetDNSOSHealth(err error) { t.setErr(SysDNSOS, err) }
 
 // SetDNSManagerHealth sets the state of the Linux net/dns manager's
 // discovery of the /etc/resolv.conf situation.
-func SetDNSManagerHealth(err error) { setErr(SysDNSManager, err) }
+func (t *Tracker) SetDNSManagerHealth(err error) { t.setErr(SysDNSManager, err) }
 
 // DNSOSHealth returns the net/dns.OSConfigurator error state.
-func DNSOSHealth() error { return get(SysDNSOS) }
+func (t *Tracker) DNSOSHealth() error { return t.get(SysDNSOS) }
 
-func get(key Subsystem) error {
-	mu.Lock()
-	defer mu.Unlock()
-	return sysErr[key]
+func (t *Tracker) get(key Subsystem) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sysErr[key]
 }
 
-func setErr(key Subsystem, err error) {
-	mu.Lock()
-	defer mu.Unlock()
-	setLocked(key, err)
+func (t *Tracker) setErr(key Subsystem, err error) {
+	t.mu.Lock()
+	cbs := t.setLocked(key, err)
+	t.mu.Unlock()
+	runCallbacks(cbs, Change{Subsystem: key, Err: err})
 }
 
-func setLocked(key Subsystem, err error) {
-	old, ok := sysErr[key]
+// setLocked sets the state of key and returns the callbacks to run
+// for the change, if any. t.mu must be held.
+func (t *Tracker) setLocked(key Subsystem, err error) []func(Change) {
+	if t.sysErr == nil {
+		t.sysErr = map[Subsystem]error{}
+		t.sysSince = map[Subsystem]time.Time{}
+	}
+	old, ok := t.sysErr[key]
 	if !ok && err == nil {
 		// Initial happy path.
-		sysErr[key] = nil
-		return
+		t.sysErr[key] = nil
+		t.sysSince[key] = t.now()
+		return nil
 	}
 	if ok && (old == nil) == (err == nil) {
 		// No change in overall error status (nil-vs-not), so
 		// don't run callbacks, but exact error might've
 		// changed, so note it.
 		if err != nil {
-			sysErr[key] = err
+			t.sysErr[key] = err
 		}
-		return
+		return nil
+	}
+	t.sysErr[key] = err
+	t.sysSince[key] = t.now()
+	return t.callbacksLocked()
+}
+
+// SubsystemState is the health of a subsystem.
+type SubsystemState struct {
+	Subsystem Subsystem `json:"subsystem"`
+	// Err is the current error, or nil if healthy.
+	Err error `json:"-"`
+	// Error is Err's text, or empty if healthy.
+	Error string `json:"error,omitempty"`
+	// Since is when the subsystem last went from healthy to
+	// unhealthy or back, or when it was first reported healthy.
+	Since time.Time `json:"since"`
+}
+
+// WarnableState is the health of a Warnable.
+type WarnableState struct {
+	Warnable  *Warnable `json:"-"`
+	Name      string    `json:"name,omitempty"`
+	DebugFlag string    `json:"debugFlag,omitempty"`
+	// Err is the current error, or nil if healthy.
+	Err error `json:"-"`
+	// Error is Err's text, or empty if healthy.
+	Error string `json:"error,omitempty"`
+	// Since is when the Warnable last went from healthy to unhealthy
+	// or back. It's zero if it has never been unhealthy.
+	Since time.Time `json:"since"`
+}
+
+// Snapshot is the health of everything tracked by a Tracker at one
+// point in time. It's suitable for encoding as JSON.
+type Snapshot struct {
+	Subsystems []SubsystemState `json:"subsystems"`
+	Warnables  []WarnableState  `json:"warnables"`
+}
+
+// Warnables returns the state of all the Warnables created by t and
+// not unregistered, in order of creation.
+func (t *Tracker) Warnables() []WarnableState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.warnablesLocked()
+}
+
+func (t *Tracker) warnablesLocked() []WarnableState {
+	ret := make([]WarnableState, 0, len(t.warnables))
+	for _, w := range t.warnables {
+		ret = append(ret, WarnableState{
+			Warnable:  w,
+			Name:      w.name,
+			DebugFlag: w.debugFlag,
+			Err:       w.err,
+			Error:     errString(w.err),
+			Since:     w.since,
+		})
+	}
+	return ret
+}
+
+// Snapshot returns the current state of everything t tracks.
+// Subsystems are sorted by name, and Warnables are in order of creation.
+func (t *Tracker) Snapshot() Snapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := Snapshot{
+		Subsystems: make([]SubsystemState, 0, len(t.sysErr)),
+		Warnables:  t.warnablesLocked(),
+	}
+	for key, err := range t.sysErr {
+		s.Subsystems = append(s.Subsystems, SubsystemState{
+			Subsystem: key,
+			Err:       err,
+			Error:     errString(err),
+			Since:     t.sysSince[key],
+		})
+	}
+	sort.Slice(s.Subsystems, func(i, j int) bool {
+		return s.Subsystems[i].Subsystem < s.Subsystems[j].Subsystem
+	})
+	return s
+}
+
+// MarshalJSON implements json.Marshaler by encoding t's Snapshot.
+func (t *Tracker) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Snapshot())
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
 	}
-	sysErr[key] = err
+	return err.Error()
 }
@@ -0,0 +1,134 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTrackerWatchers(t *testing.T) {
+	var tr Tracker
+	var got []Change
+	unregister := tr.RegisterWatcher(func(c Change) { got = append(got, c) })
+
+	errBroken := errors.New("broken")
+	errStillBroken := errors.New("still broken")
+	w := tr.NewWarnable(WithName("w"))
+
+	tr.SetDNSOSHealth(nil)            // initial happy path: no callback
+	tr.SetDNSOSHealth(errBroken)      // transition
+	tr.SetDNSOSHealth(errStillBroken) // no transition
+	w.Set(nil)                        // no transition
+	w.Set(errBroken)                  // transition
+	tr.SetDNSOSHealth(nil)            // transition
+	w.Set(nil)                        // transition
+
+	want := []Change{
+		{Subsystem: SysDNSOS, Err: errBroken},
+		{Warnable: w, Err: errBroken},
+		{Subsystem: SysDNSOS},
+		{Warnable: w},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("changes = %+v; want %+v", got, want)
+	}
+
+	unregister()
+	got = nil
+	w.Set(errBroken)
+	if len(got) != 0 {
+		t.Errorf("unregistered watcher called: %+v", got)
+	}
+}
+
+func TestTrackersIndependent(t *testing.T) {
+	var a, b Tracker
+	a.SetDNSOSHealth(errors.New("a is broken"))
+	if err := b.DNSOSHealth(); err != nil {
+		t.Errorf("b.DNSOSHealth = %v; want nil", err)
+	}
+	if err := DNSOSHealth(); err != nil {
+		t.Errorf("default DNSOSHealth = %v; want nil", err)
+	}
+	a.NewWarnable()
+	if n := len(b.Warnables()); n != 0 {
+		t.Errorf("b has %d warnables; want 0", n)
+	}
+}
+
+func TestTrackerSnapshot(t *testing.T) {
+	now := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	tr := &Tracker{timeNow: func() time.Time { return now }}
+	w1 := tr.NewWarnable(WithName("first"), WithMapDebugFlag("flag"))
+	tr.NewWarnable(WithName("second"))
+	tr.SetDNSManagerHealth(errors.New("bad setup"))
+	tr.SetDNSOSHealth(nil)
+	w1.Set(errors.New("trampled"))
+
+	ws := tr.Warnables()
+	if len(ws) != 2 || ws[0].Warnable != w1 || ws[0].Error != "trampled" || !ws[0].Since.Equal(now) {
+		t.Errorf("unexpected first warnable state: %+v", ws)
+	}
+	if ws[1].Name != "second" || ws[1].Err != nil || !ws[1].Since.IsZero() {
+		t.Errorf("unexpected second warnable state: %+v", ws[1])
+	}
+
+	got, err := json.Marshal(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{"subsystems":[` +
+		`{"subsystem":"dns-manager","error":"bad setup","since":"2023-04-05T06:07:08Z"},` +
+		`{"subsystem":"dns-os","since":"2023-04-05T06:07:08Z"}],` +
+		`"warnables":[` +
+		`{"name":"first","debugFlag":"flag","error":"trampled","since":"2023-04-05T06:07:08Z"},` +
+		`{"name":"second","since":"0001-01-01T00:00:00Z"}]}`
+	if string(got) != want {
+		t.Errorf("JSON mismatch\n got: %s\nwant: %s", got, want)
+	}
+}
+
+func TestWarnableUnregister(t *testing.T) {
+	var tr Tracker
+	var got []Change
+	tr.RegisterWatcher(func(c Change) { got = append(got, c) })
+
+	w1 := tr.NewWarnable(WithName("first"))
+	w2 := tr.NewWarnable(WithName("second"))
+	w1.Set(errors.New("broken"))
+	got = nil
+
+	// An unhealthy Warnable goes away healthy.
+	w1.Unregister()
+	if want := []Change{{Warnable: w1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("changes = %+v; want %+v", got, want)
+	}
+	if ws := tr.Warnables(); len(ws) != 1 || ws[0].Warnable != w2 {
+		t.Errorf("warnables after Unregister = %+v; want only second", ws)
+	}
+
+	got = nil
+	w1.Set(errors.New("broken again"))
+	w1.Unregister()
+	if len(got) != 0 {
+		t.Errorf("unregistered warnable reported changes: %+v", got)
+	}
+	if err := w1.get(); err != nil {
+		t.Errorf("unregistered warnable has error %v", err)
+	}
+}
+
+func TestZeroWarnable(t *testing.T) {
+	var w Warnable
+	w.Set(errors.New("broken"))
+	if err := w.get(); err != nil {
+		t.Errorf("zero warnable has error %v", err)
+	}
+	w.Set(nil)
+	w.Unregister()
+}
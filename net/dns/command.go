@@ -0,0 +1,174 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Command is an external program invocation made by an OSConfigurator.
+type Command struct {
+	Name  string   // program name or path
+	Args  []string // arguments, not including Name
+	Dir   string   // working directory; empty means the current one
+	Stdin []byte   // standard input; nil means none
+}
+
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// CommandResult is the outcome of running a Command.
+type CommandResult struct {
+	Stdout []byte
+	Stderr []byte
+	// ExitCode is the program's exit status, or -1 if it couldn't
+	// be started or was terminated by a signal.
+	ExitCode int
+}
+
+// CombinedOutput returns r's standard output followed by its standard
+// error.
+func (r CommandResult) CombinedOutput() []byte {
+	return append(append([]byte(nil), r.Stdout...), r.Stderr...)
+}
+
+// A CommandRunner runs external programs on behalf of an
+// OSConfigurator. Implementations must be safe for concurrent use.
+type CommandRunner interface {
+	// LookPath reports the path of the named program, like
+	// exec.LookPath.
+	LookPath(file string) (string, error)
+	// Run runs cmd to completion. It returns a non-nil error if
+	// the program couldn't be started or exited with a non-zero
+	// status; res.ExitCode is set either way.
+	Run(ctx context.Context, cmd Command) (res CommandResult, err error)
+}
+
+// execRunner is the CommandRunner that runs programs on the host with
+// os/exec.
+type execRunner struct{}
+
+func (execRunner) LookPath(file string) (string, error) { return exec.LookPath(file) }
+
+func (execRunner) Run(ctx context.Context, c Command) (CommandResult, error) {
+	cmd := exec.CommandContext(ctx, c.Name, c.Args...)
+	cmd.Dir = c.Dir
+	release, err := setProcAttr(cmd)
+	if err != nil {
+		return CommandResult{ExitCode: -1}, err
+	}
+	defer release()
+	if c.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(c.Stdin)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	res := CommandResult{
+		Stdout:   stdout.Bytes(),
+		Stderr:   stderr.Bytes(),
+		ExitCode: -1,
+	}
+	if cmd.ProcessState != nil {
+		res.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	return res, err
+}
+
+// A CommandRecord is a Command run by a RecordingRunner, and its
+// outcome.
+type CommandRecord struct {
+	Command  Command
+	ExitCode int
+	Err      error // as returned by Run
+	Start    time.Time
+	Duration time.Duration
+}
+
+func (r CommandRecord) String() string {
+	s := fmt.Sprintf("%v: exit %d in %v", r.Command, r.ExitCode, r.Duration.Round(time.Millisecond))
+	if r.Command.Stdin != nil {
+		s += fmt.Sprintf(" (%d bytes of stdin)", len(r.Command.Stdin))
+	}
+	return s
+}
+
+// RecordingRunner is a CommandRunner that runs programs through another
+// and records each run, for diagnostics and tests. Its zero value runs
+// them on the host with os/exec.
+type RecordingRunner struct {
+	// Runner runs the programs. If nil, they're run with os/exec.
+	Runner CommandRunner
+
+	mu      sync.Mutex
+	records []CommandRecord
+}
+
+func (r *RecordingRunner) LookPath(file string) (string, error) {
+	return runnerOrDefault(r.Runner).LookPath(file)
+}
+
+func (r *RecordingRunner) Run(ctx context.Context, c Command) (CommandResult, error) {
+	start := time.Now()
+	res, err := runnerOrDefault(r.Runner).Run(ctx, c)
+	rec := CommandRecord{
+		Command:  c,
+		ExitCode: res.ExitCode,
+		Err:      err,
+		Start:    start,
+		Duration: time.Since(start),
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, rec)
+	return res, err
+}
+
+// Records returns the runs so far, in the order they finished.
+func (r *RecordingRunner) Records() []CommandRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]CommandRecord(nil), r.records...)
+}
+
+// runnerOrDefault returns r, or the os/exec runner if r is nil.
+func runnerOrDefault(r CommandRunner) CommandRunner {
+	if r == nil {
+		return execRunner{}
+	}
+	return r
+}
+
+// runCommand runs the named program with args through r, until ctx is
+// done. If it fails, the returned error includes its combined output.
+func runCommand(ctx context.Context, r CommandRunner, name string, args ...string) (CommandResult, error) {
+	return runCommandStdin(ctx, r, nil, name, args...)
+}
+
+// runCommandStdin is like runCommand, but feeds stdin to the program.
+func runCommandStdin(ctx context.Context, r CommandRunner, stdin []byte, name string, args ...string) (CommandResult, error) {
+	c := Command{Name: name, Args: args, Stdin: stdin}
+	res, err := runnerOrDefault(r).Run(ctx, c)
+	if err != nil {
+		return res, commandError(c, res, err)
+	}
+	return res, nil
+}
+
+// commandError returns an error describing the failure err of c, whose
+// result was res.
+func commandError(c Command, res CommandResult, err error) error {
+	if out := bytes.TrimSpace(res.CombinedOutput()); len(out) > 0 {
+		return fmt.Errorf("running %s: %s", c, out)
+	}
+	return fmt.Errorf("running %s: %w", c, err)
+}
@@ -0,0 +1,79 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+func TestFakeRunner(t *testing.T) {
+	f := new(FakeRunner)
+	f.On("prog --flag", FakeResponse{Stdout: "one"}, FakeResponse{Stdout: "two", ExitCode: 3})
+
+	if p, err := f.LookPath("prog"); err != nil || p != "prog" {
+		t.Errorf("LookPath(prog) = %q, %v", p, err)
+	}
+	if _, err := f.LookPath("pro"); !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("LookPath(pro) = %v; want ErrNotFound", err)
+	}
+
+	for _, want := range []struct {
+		out  string
+		exit int
+	}{{"one", 0}, {"two", 3}, {"two", 3}} {
+		res, err := runCommand(context.Background(), f, "prog", "--flag")
+		if string(res.Stdout) != want.out || res.ExitCode != want.exit || (err != nil) != (want.exit != 0) {
+			t.Errorf("run = %q, %d, %v; want %q, %d", res.Stdout, res.ExitCode, err, want.out, want.exit)
+		}
+	}
+	if _, err := runCommand(context.Background(), f, "other"); err == nil {
+		t.Error("unscripted command succeeded")
+	}
+	if got := len(f.Calls()); got != 4 {
+		t.Errorf("%d calls; want 4", got)
+	}
+}
+
+func TestRecordingRunner(t *testing.T) {
+	f := new(FakeRunner)
+	f.On("resolvconf -a tun0", FakeResponse{Func: func(c Command) CommandResult {
+		if string(c.Stdin) != "nameserver 1.1.1.1\n" {
+			return CommandResult{ExitCode: 1}
+		}
+		return CommandResult{}
+	}})
+	f.On("resolvconf --version", FakeResponse{ExitCode: 99})
+	r := &RecordingRunner{Runner: f}
+
+	if _, err := runCommandStdin(context.Background(), r, []byte("nameserver 1.1.1.1\n"), "resolvconf", "-a", "tun0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runCommand(context.Background(), r, "resolvconf", "--version"); err == nil {
+		t.Fatal("failing command succeeded")
+	}
+	recs := r.Records()
+	if len(recs) != 2 {
+		t.Fatalf("records = %v", recs)
+	}
+	if got := recs[0].Command.String(); got != "resolvconf -a tun0" || string(recs[0].Command.Stdin) != "nameserver 1.1.1.1\n" || recs[0].ExitCode != 0 || recs[0].Err != nil {
+		t.Errorf("first record = %v", recs[0])
+	}
+	if recs[1].ExitCode != 99 || recs[1].Err == nil {
+		t.Errorf("second record = %v", recs[1])
+	}
+	for _, rec := range recs {
+		if rec.Start.IsZero() || rec.Duration < 0 {
+			t.Errorf("record %v has no timing", rec)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.Run(ctx, Command{Name: "resolvconf", Args: []string{"--version"}}); !errors.Is(err, context.Canceled) {
+		t.Errorf("run with a canceled context = %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/anywherelan/ts-dns/util/winutil"
+	"golang.org/x/sys/windows"
+)
+
+// setProcAttr keeps cmd from flashing a console window. wsl.exe doesn't
+// work as SYSTEM (https://github.com/microsoft/WSL/issues/4803), so
+// when we run as SYSTEM, it's run as the user of the active console
+// session instead. The returned function releases what it took.
+func setProcAttr(cmd *exec.Cmd) (release func(), err error) {
+	var token windows.Token
+	if strings.EqualFold(filepath.Base(cmd.Path), "wsl.exe") {
+		if u, err := user.Current(); err == nil && u.Name == "SYSTEM" {
+			sessionID := winutil.WTSGetActiveConsoleSessionId()
+			if sessionID != 0xFFFFFFFF {
+				if err := windows.WTSQueryUserToken(sessionID, &token); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Token:      syscall.Token(token),
+		HideWindow: true,
+	}
+	return func() {
+		if token != 0 {
+			token.Close()
+		}
+	}, nil
+}
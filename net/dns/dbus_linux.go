@@ -0,0 +1,137 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package dns
+
+import (
+	"context"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// A Bus is the part of a D-Bus connection that the systemd-resolved and
+// NetworkManager backends use.
+type Bus interface {
+	// Call calls method, in "interface.member" notation, on the object
+	// at path of the bus name dest, and returns the body of the reply.
+	// Use dbus.Store to decode it.
+	Call(ctx context.Context, dest string, path dbus.ObjectPath, method string, args ...any) ([]any, error)
+
+	// GetProperty reads the property iface.name of the object at
+	// path of the bus name dest.
+	GetProperty(ctx context.Context, dest string, path dbus.ObjectPath, iface, name string) (dbus.Variant, error)
+
+	// Subscribe asks for the signals matching m to be sent to ch,
+	// which is closed when the connection is lost. If it fails to
+	// set up the filter, ch may still get other signals too.
+	Subscribe(ch chan *dbus.Signal, m SignalMatch) error
+
+	// Close closes the connection.
+	Close() error
+}
+
+// A SignalMatch selects the D-Bus signals to Subscribe to. Empty fields
+// match anything.
+type SignalMatch struct {
+	Path      dbus.ObjectPath
+	Interface string
+	Member    string
+	Arg0      string // the first argument, if a string
+}
+
+// matches reports whether the signal sig is selected by m.
+func (m SignalMatch) matches(sig *dbus.Signal) bool {
+	if m.Path != "" && sig.Path != m.Path {
+		return false
+	}
+	if m.Interface != "" || m.Member != "" {
+		if sig.Name != m.Interface+"."+m.Member {
+			return false
+		}
+	}
+	if m.Arg0 != "" {
+		if len(sig.Body) == 0 {
+			return false
+		}
+		if s, ok := sig.Body[0].(string); !ok || s != m.Arg0 {
+			return false
+		}
+	}
+	return true
+}
+
+// matchOptions returns the godbus equivalent of m.
+func (m SignalMatch) matchOptions() []dbus.MatchOption {
+	var opts []dbus.MatchOption
+	if m.Path != "" {
+		opts = append(opts, dbus.WithMatchObjectPath(m.Path))
+	}
+	if m.Interface != "" {
+		opts = append(opts, dbus.WithMatchInterface(m.Interface))
+	}
+	if m.Member != "" {
+		opts = append(opts, dbus.WithMatchMember(m.Member))
+	}
+	if m.Arg0 != "" {
+		opts = append(opts, dbus.WithMatchArg(0, m.Arg0))
+	}
+	return opts
+}
+
+// systemBusDialer is the BusDialer of the host's system bus. Each Dial
+// makes a connection of its own, rather than sharing godbus's, so that
+// closing it doesn't break the others.
+type systemBusDialer struct{}
+
+func (systemBusDialer) Dial() (Bus, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return systemBus{conn}, nil
+}
+
+// systemBus is a Bus on a godbus connection.
+type systemBus struct {
+	conn *dbus.Conn
+}
+
+func (b systemBus) Call(ctx context.Context, dest string, path dbus.ObjectPath, method string, args ...any) ([]any, error) {
+	call := b.conn.Object(dest, path).CallWithContext(ctx, method, 0, args...)
+	return call.Body, call.Err
+}
+
+func (b systemBus) GetProperty(ctx context.Context, dest string, path dbus.ObjectPath, iface, name string) (dbus.Variant, error) {
+	var v dbus.Variant
+	err := b.conn.Object(dest, path).CallWithContext(ctx, dbusPropertiesInterface+".Get", 0, iface, name).Store(&v)
+	return v, err
+}
+
+func (b systemBus) Subscribe(ch chan *dbus.Signal, m SignalMatch) error {
+	err := b.conn.AddMatchSignal(m.matchOptions()...)
+	b.conn.Signal(ch)
+	return err
+}
+
+func (b systemBus) Close() error {
+	return b.conn.Close()
+}
+
+// busOrDefault returns d, or the system bus's BusDialer if d is nil.
+func busOrDefault(d BusDialer) BusDialer {
+	if d == nil {
+		return systemBusDialer{}
+	}
+	return d
+}
+
+// D-Bus names of the bus itself, shared by the backends and FakeBus.
+const (
+	dbusPath                dbus.ObjectPath = "/org/freedesktop/DBus"
+	dbusInterface                           = "org.freedesktop.DBus"
+	dbusOwnerSignal                         = "NameOwnerChanged" // broadcast when a well-known name's owning process changes.
+	dbusPropertiesInterface                 = "org.freedesktop.DBus.Properties"
+	dbusPeerPing                            = "org.freedesktop.DBus.Peer.Ping"
+)
@@ -0,0 +1,15 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package dns
+
+// A Bus is a D-Bus connection, which only Linux backends use.
+type Bus interface {
+	Close() error
+}
+
+func busOrDefault(d BusDialer) BusDialer {
+	return d
+}
@@ -8,10 +8,10 @@ package dns
 import (
 	"bufio"
 	"bytes"
+	"context"
 	_ "embed"
-	"fmt"
+	"errors"
 	"os"
-	"os/exec"
 	"path/filepath"
 
 	"github.com/anywherelan/ts-dns/atomicfile"
@@ -21,8 +21,8 @@ import (
 //go:embed resolvconf-workaround.sh
 var workaroundScript []byte
 
-// resolvconfConfigName is the name of the config submitted to
-// resolvconf.
+// The name of the config submitted to resolvconf is
+// resolvconfRecordFor(Identity.Name), for example "tun-tailscale.inet".
 // The name starts with 'tun' in order to match the hardcoded
 // interface order in debian resolvconf, which will place this
 // configuration ahead of regular network links. In theory, this
@@ -33,34 +33,64 @@ var workaroundScript []byte
 // resolvconf implementations encourage adding a suffix roughly
 // indicating where the config came from, and "inet" is the "none of
 // the above" value (rather than, say, "ppp" or "dhcp").
-const resolvconfConfigName = "tun-tailscale.inet"
 
 // resolvconfLibcHookPath is the directory containing libc update
 // scripts, which are run by Debian resolvconf when /etc/resolv.conf
 // has been updated.
 const resolvconfLibcHookPath = "/etc/resolvconf/update-libc.d"
 
-// resolvconfHookPath is the name of the libc hook script we install
-// to force Tailscale's DNS config to take effect.
-var resolvconfHookPath = filepath.Join(resolvconfLibcHookPath, "tailscale")
+// resolvconfHookPathFor returns the name of the libc hook script
+// installed by the product called name to force its DNS config to take
+// effect.
+func resolvconfHookPathFor(name string) string {
+	return filepath.Join(resolvconfLibcHookPath, name)
+}
+
+// workaroundScriptFor returns workaroundScript adapted to the
+// resolvconf record named record.
+func workaroundScriptFor(record string) []byte {
+	return bytes.ReplaceAll(workaroundScript, []byte(resolvconfRecordFor(legacyName)), []byte(record))
+}
 
 // resolvconfManager manages DNS configuration using the Debian
 // implementation of the `resolvconf` program, written by Thomas Hood.
 type resolvconfManager struct {
 	logf            logger.Logf
+	ident           Identity
+	runner          CommandRunner
+	root            string // prefix for the files we touch directly
 	listRecordsPath string
 	interfacesDir   string
-	scriptInstalled bool // libc update script has been installed
+	scriptInstalled bool       // libc update script has been installed
+	journal         *journal   // records our record, or nil
+	owner           *ownerLock // held around our changes
+	life            lifecycle
+}
+
+// NewDebianResolvconfManager returns an OSConfigurator that uses the
+// Debian implementation of resolvconf(8). It's the ModeDebianResolvconf
+// backend.
+func NewDebianResolvconfManager(logf logger.Logf, opts Options) (OSConfigurator, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return newDebianResolvconfManager(logf, opts)
 }
 
-func newDebianResolvconfManager(logf logger.Logf) (*resolvconfManager, error) {
+func newDebianResolvconfManager(logf logger.Logf, opts Options) (*resolvconfManager, error) {
 	ret := &resolvconfManager{
 		logf:            logf,
+		ident:           opts.Identity,
+		runner:          opts.Runner,
+		root:            opts.Root,
+		journal:         opts.journal,
+		owner:           newOwnerLock(logf, opts),
 		listRecordsPath: "/lib/resolvconf/list-records",
 		interfacesDir:   "/etc/resolvconf/run/interface", // panic fallback if nothing seems to work
 	}
 
-	if _, err := os.Stat(ret.listRecordsPath); os.IsNotExist(err) {
+	if _, err := os.Stat(ret.path(ret.listRecordsPath)); os.IsNotExist(err) {
 		// This might be a Debian system from before the big /usr
 		// merge, try /usr instead.
 		ret.listRecordsPath = "/usr" + ret.listRecordsPath
@@ -75,7 +105,7 @@ func newDebianResolvconfManager(logf logger.Logf) (*resolvconfManager, error) {
 		"/run/resolvconf/interface",
 		"/var/run/resolvconf/interface",
 	} {
-		if _, err := os.Stat(path); err == nil {
+		if _, err := os.Stat(ret.path(path)); err == nil {
 			ret.interfacesDir = path
 			break
 		}
@@ -89,73 +119,148 @@ func newDebianResolvconfManager(logf logger.Logf) (*resolvconfManager, error) {
 	return ret, nil
 }
 
-func (m *resolvconfManager) deleteTailscaleConfig() error {
-	cmd := exec.Command("resolvconf", "-d", resolvconfConfigName)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("running %s: %s", cmd, out)
+// path returns the location of the absolute path p under m.root.
+func (m *resolvconfManager) path(p string) string {
+	return filepath.Join(m.root, p)
+}
+
+func (m *resolvconfManager) deleteConfig(ctx context.Context, record string) error {
+	_, err := runCommand(ctx, m.runner, "resolvconf", "-d", record)
+	return err
+}
+
+// removeLegacy removes records and hook scripts left behind under our
+// legacy product names. It's best effort.
+func (m *resolvconfManager) removeLegacy(ctx context.Context) {
+	for _, name := range m.ident.legacyNames() {
+		record := resolvconfRecordFor(name)
+		if _, err := os.Stat(m.path(filepath.Join(m.interfacesDir, record))); err == nil {
+			m.logf("removing legacy resolvconf record %q", record)
+			if err := m.deleteConfig(ctx, record); err != nil {
+				m.logf("removing legacy resolvconf record: %v", err)
+			}
+		}
+		if err := os.Remove(m.path(resolvconfHookPathFor(name))); err == nil {
+			m.logf("removed legacy resolvconf workaround script %q", resolvconfHookPathFor(name))
+		}
 	}
-	return nil
 }
 
 func (m *resolvconfManager) SetDNS(config OSConfig) error {
+	return m.SetDNSContext(context.Background(), config)
+}
+
+// SetDNSContext implements ContextOSConfigurator.
+func (m *resolvconfManager) SetDNSContext(ctx context.Context, config OSConfig) error {
+	return m.life.set(func() error { return m.setDNS(ctx, config) })
+}
+
+// setDNS implements SetDNSContext.
+func (m *resolvconfManager) setDNS(ctx context.Context, config OSConfig) error {
+	unlock, err := m.owner.serialize(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	record := resolvconfRecordFor(m.ident.name())
+	// Snapshot our record, to put it back if we fail partway.
+	prev, err := os.ReadFile(m.path(filepath.Join(m.interfacesDir, record)))
+	hadRecord := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	entry := JournalEntry{Mode: ModeDebianResolvconf, Kind: JournalRecord, Target: record}
+	if !config.IsZero() {
+		if err := m.journal.intend(entry); err != nil {
+			return err
+		}
+	}
+	installedNow := false
 	if !m.scriptInstalled {
 		m.logf("injecting resolvconf workaround script")
-		if err := os.MkdirAll(resolvconfLibcHookPath, 0755); err != nil {
+		m.removeLegacy(ctx)
+		if err := os.MkdirAll(m.path(resolvconfLibcHookPath), 0755); err != nil {
 			return err
 		}
-		if err := atomicfile.WriteFile(resolvconfHookPath, workaroundScript, 0755); err != nil {
+		if err := atomicfile.WriteFile(m.path(resolvconfHookPathFor(m.ident.name())), workaroundScriptFor(record), 0755); err != nil {
 			return err
 		}
 		m.scriptInstalled = true
+		installedNow = true
 	}
-
 	if config.IsZero() {
-		if err := m.deleteTailscaleConfig(); err != nil {
-			return err
-		}
+		err = m.deleteConfig(ctx, record)
 	} else {
 		stdin := new(bytes.Buffer)
-		writeResolvConf(stdin, config.Nameservers, config.SearchDomains) // dns_direct.go
-
+		writeResolvConf(stdin, m.ident, config) // dns_direct.go
 		// This resolvconf implementation doesn't support exclusive
 		// mode or interface priorities, so it will end up blending
 		// our configuration with other sources. However, this will
 		// get fixed up by the script we injected above.
-		cmd := exec.Command("resolvconf", "-a", resolvconfConfigName)
-		cmd.Stdin = stdin
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("running %s: %s", cmd, out)
-		}
+		_, err = runCommandStdin(ctx, m.runner, stdin.Bytes(), "resolvconf", "-a", record)
+	}
+	if err != nil {
+		return rollBack(m.logf, err, func() (bool, error) {
+			return true, m.restore(record, hadRecord, prev, installedNow)
+		})
+	}
+	if config.IsZero() {
+		m.journal.forget(m.logf, entry)
+	} else {
+		m.journal.applied(m.logf, entry)
 	}
-
 	return nil
 }
 
+// restore puts back our record as it was before a failed SetDNS: with
+// the contents prev if hadRecord, or not at all. If uninstallScript is
+// set, it also removes the workaround script that SetDNS installed.
+// The context of the failed SetDNS may be done, so restore isn't bound
+// by it.
+func (m *resolvconfManager) restore(record string, hadRecord bool, prev []byte, uninstallScript bool) error {
+	ctx := context.Background()
+	var err error
+	if hadRecord {
+		_, err = runCommandStdin(ctx, m.runner, prev, "resolvconf", "-a", record)
+	} else {
+		err = m.deleteConfig(ctx, record)
+	}
+	if uninstallScript {
+		if rerr := os.Remove(m.path(resolvconfHookPathFor(m.ident.name()))); rerr != nil && !os.IsNotExist(rerr) {
+			err = errors.Join(err, rerr)
+		} else {
+			m.scriptInstalled = false
+		}
+	}
+	return err
+}
+
 func (m *resolvconfManager) SupportsSplitDNS() bool {
 	return false
 }
 
 func (m *resolvconfManager) GetBaseConfig() (OSConfig, error) {
-	var bs bytes.Buffer
-
-	cmd := exec.Command(m.listRecordsPath)
 	// list-records assumes it's being run with CWD set to the
 	// interfaces runtime dir, and returns nonsense otherwise.
-	cmd.Dir = m.interfacesDir
-	cmd.Stdout = &bs
-	if err := cmd.Run(); err != nil {
-		return OSConfig{}, err
+	c := Command{Name: m.listRecordsPath, Dir: m.interfacesDir}
+	res, err := runnerOrDefault(m.runner).Run(context.Background(), c)
+	if err != nil {
+		return OSConfig{}, commandError(c, res, err)
+	}
+	bs := bytes.NewBuffer(res.Stdout)
+
+	ours := map[string]bool{}
+	for _, name := range m.ident.allNames() {
+		ours[resolvconfRecordFor(name)] = true
 	}
 
 	var conf bytes.Buffer
-	sc := bufio.NewScanner(&bs)
+	sc := bufio.NewScanner(bs)
 	for sc.Scan() {
-		if sc.Text() == resolvconfConfigName {
+		if ours[sc.Text()] {
 			continue
 		}
-		bs, err := os.ReadFile(filepath.Join(m.interfacesDir, sc.Text()))
+		bs, err := os.ReadFile(m.path(filepath.Join(m.interfacesDir, sc.Text())))
 		if err != nil {
 			if os.IsNotExist(err) {
 				// Probably raced with a deletion, that's okay.
@@ -171,13 +276,30 @@ func (m *resolvconfManager) GetBaseConfig() (OSConfig, error) {
 }
 
 func (m *resolvconfManager) Close() error {
-	if err := m.deleteTailscaleConfig(); err != nil {
+	return m.CloseContext(context.Background())
+}
+
+// CloseContext implements ContextOSConfigurator.
+func (m *resolvconfManager) CloseContext(ctx context.Context) error {
+	return m.life.close(func() error { return m.close(ctx) })
+}
+
+// close implements CloseContext.
+func (m *resolvconfManager) close(ctx context.Context) error {
+	unlock, err := m.owner.serialize(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	record := resolvconfRecordFor(m.ident.name())
+	if err := m.deleteConfig(ctx, record); err != nil {
 		return err
 	}
+	m.journal.forget(m.logf, JournalEntry{Mode: ModeDebianResolvconf, Kind: JournalRecord, Target: record})
 
 	if m.scriptInstalled {
 		m.logf("removing resolvconf workaround script")
-		os.Remove(resolvconfHookPath) // Best-effort
+		os.Remove(m.path(resolvconfHookPathFor(m.ident.name()))) // Best-effort
 	}
 
 	return nil
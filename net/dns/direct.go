@@ -13,7 +13,6 @@ import (
 	"io/fs"
 	"net/netip"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -28,17 +27,58 @@ import (
 )
 
 const (
-	backupConf = "/etc/resolv.pre-tailscale-backup.conf"
 	resolvConf = "/etc/resolv.conf"
 )
 
-// writeResolvConf writes DNS configuration in resolv.conf format to the given writer.
-func writeResolvConf(w io.Writer, servers []netip.Addr, domains []dnsname.FQDN) error {
-	c := &resolvconffile.Config{
-		Nameservers:   servers,
-		SearchDomains: domains,
+// writeResolvConf writes the nameservers, search domains and resolver
+// options of cfg in resolv.conf format to the given writer, with a
+// header naming id as its generator.
+func writeResolvConf(w io.Writer, id Identity, cfg OSConfig) error {
+	return writeResolvConfFile(w, id, resolvConfFor(cfg))
+}
+
+// writeResolvConfFile writes c to the given writer, with a header naming
+// id as its generator.
+func writeResolvConfFile(w io.Writer, id Identity, c *resolvconffile.Config) error {
+	return c.WriteGenerated(w, id.name(), id.helpURL("resolvconf-overwrite"))
+}
+
+// resolvConfFor returns the resolv.conf contents for cfg.
+func resolvConfFor(cfg OSConfig) *resolvconffile.Config {
+	return &resolvconffile.Config{
+		Nameservers:   cfg.Nameservers,
+		SearchDomains: cfg.SearchDomains,
+		Options:       cfg.ResolverOptions.resolvConfOptions(),
 	}
-	return c.Write(w)
+}
+
+// mergeResolvConf merges base, the resolv.conf we replace, into ours
+// according to merge.
+func mergeResolvConf(ours, base *resolvconffile.Config, merge DirectMerge) {
+	if merge.KeepNameservers {
+		ours.Nameservers = appendUniqueAddrs(append([]netip.Addr(nil), ours.Nameservers...), base.Nameservers...)
+	}
+
+	baseSearch := base.SearchDomains
+	if len(baseSearch) == 0 && base.Domain != "" {
+		// Without a search directive, the resolver searches the
+		// local domain.
+		baseSearch = []dnsname.FQDN{base.Domain}
+	}
+	switch merge.Search {
+	case SearchPrepend:
+		ours.SearchDomains = appendUniqueDomains(append([]dnsname.FQDN(nil), ours.SearchDomains...), baseSearch...)
+	case SearchAppend:
+		ours.SearchDomains = appendUniqueDomains(append([]dnsname.FQDN(nil), baseSearch...), ours.SearchDomains...)
+	}
+
+	var opts []resolvconffile.Option
+	for _, o := range base.Options {
+		if _, ok := ours.Option(o.Name); !ok {
+			opts = append(opts, o)
+		}
+	}
+	ours.Options = append(opts, ours.Options...)
 }
 
 func readResolv(r io.Reader) (OSConfig, error) {
@@ -46,10 +86,7 @@ func readResolv(r io.Reader) (OSConfig, error) {
 	if err != nil {
 		return OSConfig{}, err
 	}
-	return OSConfig{
-		Nameservers:   c.Nameservers,
-		SearchDomains: c.SearchDomains,
-	}, nil
+	return OSConfigFromResolvConf(c), nil
 }
 
 // resolvOwner returns the apparent owner of the resolv.conf
@@ -84,30 +121,33 @@ func resolvOwner(bs []byte) string {
 }
 
 // isResolvedRunning reports whether systemd-resolved is running on the system,
-// even if it is not managing the system DNS settings.
-func isResolvedRunning() bool {
+// even if it is not managing the system DNS settings. The check gives up
+// after 2s, or sooner if ctx is done.
+func isResolvedRunning(ctx context.Context, r CommandRunner) bool {
 	if runtime.GOOS != "linux" {
 		return false
 	}
+	r = runnerOrDefault(r)
 
 	// systemd-resolved is never installed without systemd.
-	_, err := exec.LookPath("systemctl")
+	_, err := r.LookPath("systemctl")
 	if err != nil {
 		return false
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
-	err = exec.CommandContext(ctx, "systemctl", "is-active", "systemd-resolved.service").Run()
+	_, err = r.Run(ctx, Command{Name: "systemctl", Args: []string{"is-active", "systemd-resolved.service"}})
 
 	// is-active exits with code 3 if the service is not active.
 	return err == nil
 }
 
-func restartResolved() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func restartResolved(ctx context.Context, r CommandRunner) error {
+	ctx, cancel := withDefaultTimeout(ctx, 5*time.Second)
 	defer cancel()
-	return exec.CommandContext(ctx, "systemctl", "restart", "systemd-resolved.service").Run()
+	_, err := runnerOrDefault(r).Run(ctx, Command{Name: "systemctl", Args: []string{"restart", "systemd-resolved.service"}})
+	return err
 }
 
 // directManager is an OSConfigurator which replaces /etc/resolv.conf with a file
@@ -118,8 +158,23 @@ func restartResolved() error {
 // The caller must call Down before program shutdown
 // or as cleanup if the program terminates unexpectedly.
 type directManager struct {
-	logf logger.Logf
-	fs   wholeFileFS
+	logf   logger.Logf
+	fs     WholeFileFS
+	ident  Identity      // names our backup file and generated header
+	runner CommandRunner // for systemctl; nil means os/exec
+	merge  DirectMerge   // how to combine our config with the base resolv.conf
+	// trample reports /etc/resolv.conf being overwritten by another
+	// program.
+	trample *health.Warnable
+	// ownTrample is whether trample was created for m, and so is
+	// unregistered by Close, rather than shared with other managers.
+	ownTrample bool
+	// owner is held around changes, so that other processes using
+	// this package don't overwrite our configuration, or we theirs.
+	// It's nil where the files aren't shared with them.
+	owner *ownerLock
+	// journal records our changes under Options.StateDir, or is nil.
+	journal *journal
 	// renameBroken is set if fs.Rename to or from /etc/resolv.conf
 	// fails. This can happen in some container runtimes, where
 	// /etc/resolv.conf is bind-mounted from outside the container,
@@ -135,23 +190,79 @@ type directManager struct {
 	ctx      context.Context    // valid until Close
 	ctxClose context.CancelFunc // closes ctx
 
+	tramplePolicy TramplePolicy
+	// reactMinDelay and reactMaxDelay bound the delay before
+	// reacting to a trample that follows our last reaction within
+	// reactResetAfter.
+	reactMinDelay, reactMaxDelay, reactResetAfter time.Duration
+
+	// applyMu serializes changes to /etc/resolv.conf made by SetDNS,
+	// Close and trample reactions.
+	applyMu    sync.Mutex
+	lastConfig OSConfig // last config passed to SetDNS; guarded by applyMu
+	closed     bool     // whether Close was called; guarded by applyMu
+
 	mu               sync.Mutex
 	wantResolvConf   []byte // if non-nil, what we expect /etc/resolv.conf to contain
 	lastWarnContents []byte // last resolv.conf contents that we warned about
+	stats            TrampleStats
+	reactPending     bool      // whether a trample reaction is scheduled
+	reactions        int       // consecutive reactions within reactResetAfter
+	lastReaction     time.Time // when the last reaction ran
+}
+
+// TrampleStats are counters of another program overwriting the
+// /etc/resolv.conf that ModeDirect wrote, and of the reactions to it
+// required by the TramplePolicy.
+type TrampleStats struct {
+	Trampled   int // times resolv.conf was found overwritten
+	Deferred   int // reactions delayed because of repeated tramples
+	Reasserted int // times our resolv.conf was rewritten
+	Yielded    int // times the new file was taken as the base config
+	Failed     int // reactions that failed
 }
 
-func newDirectManager(logf logger.Logf) *directManager {
-	return newDirectManagerOnFS(logf, directFS{})
+// A TrampleReporter is an OSConfigurator that watches for other
+// programs overwriting its configuration.
+type TrampleReporter interface {
+	// TrampleStats returns the counters since the OSConfigurator
+	// was created.
+	TrampleStats() TrampleStats
 }
 
-func newDirectManagerOnFS(logf logger.Logf, fs wholeFileFS) *directManager {
+// Defaults for the directManager trample reaction delays.
+const (
+	defaultReactMinDelay   = time.Second
+	defaultReactMaxDelay   = 5 * time.Minute
+	defaultReactResetAfter = 10 * time.Minute
+)
+
+func newDirectManager(logf logger.Logf, opts Options) *directManager {
+	return newDirectManagerWithOwner(logf, opts.fs(), opts, newOwnerLock(logf, opts))
+}
+
+func newDirectManagerOnFS(logf logger.Logf, fs WholeFileFS, opts Options) *directManager {
+	return newDirectManagerWithOwner(logf, fs, opts, nil)
+}
+
+func newDirectManagerWithOwner(logf logger.Logf, fs WholeFileFS, opts Options, owner *ownerLock) *directManager {
 	ctx, cancel := context.WithCancel(context.Background())
 	m := &directManager{
-		logf:     logf,
-		fs:       fs,
-		ctx:      ctx,
-		ctxClose: cancel,
-	}
+		logf:            logf,
+		fs:              fs,
+		ident:           opts.Identity,
+		runner:          opts.Runner,
+		merge:           opts.DirectMerge,
+		tramplePolicy:   opts.Trample,
+		reactMinDelay:   defaultReactMinDelay,
+		reactMaxDelay:   defaultReactMaxDelay,
+		reactResetAfter: defaultReactResetAfter,
+		owner:           owner,
+		journal:         opts.journal,
+		ctx:             ctx,
+		ctxClose:        cancel,
+	}
+	m.trample, m.ownTrample = trampleWarnable(opts.Health)
 	go m.runFileWatcher()
 	return m
 }
@@ -164,9 +275,9 @@ func (m *directManager) readResolvFile(path string) (OSConfig, error) {
 	return readResolv(bytes.NewReader(b))
 }
 
-// ownedByTailscale reports whether /etc/resolv.conf seems to be a
-// tailscale-managed file.
-func (m *directManager) ownedByTailscale() (bool, error) {
+// ownedByUs reports whether /etc/resolv.conf seems to be a file we
+// generated, under our current product name or a legacy one.
+func (m *directManager) ownedByUs() (bool, error) {
 	isRegular, err := m.fs.Stat(resolvConf)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -181,15 +292,43 @@ func (m *directManager) ownedByTailscale() (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	if bytes.Contains(bs, []byte("generated by tailscale")) {
-		return true, nil
+	return m.ident.withUpgradeFrom(bs).isGeneratedResolvConf(bs), nil
+}
+
+// migrateLegacyBackup renames a resolv.conf backup made under a legacy
+// product name to our current backup path, so that restoring the
+// original config keeps working after the product is renamed.
+//
+// It does nothing if a backup already exists at the current path.
+func (m *directManager) migrateLegacyBackup() error {
+	backupConf := m.ident.backupConf()
+	if _, err := m.fs.Stat(backupConf); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	cur, err := m.fs.ReadFile(resolvConf)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, name := range m.ident.withUpgradeFrom(cur).legacyNames() {
+		legacy := backupConfFor(name)
+		if _, err := m.fs.Stat(legacy); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		m.logf("migrating resolv.conf backup %q to %q", legacy, backupConf)
+		return m.rename(legacy, backupConf)
 	}
-	return false, nil
+	return nil
 }
 
 // backupConfig creates or updates a backup of /etc/resolv.conf, if
-// resolv.conf does not currently contain a Tailscale-managed config.
+// resolv.conf does not currently contain a config we generated.
 func (m *directManager) backupConfig() error {
+	backupConf := m.ident.backupConf()
 	if _, err := m.fs.Stat(resolvConf); err != nil {
 		if os.IsNotExist(err) {
 			// No resolv.conf, nothing to back up. Also get rid of any
@@ -200,7 +339,7 @@ func (m *directManager) backupConfig() error {
 		return err
 	}
 
-	owned, err := m.ownedByTailscale()
+	owned, err := m.ownedByUs()
 	if err != nil {
 		return err
 	}
@@ -212,6 +351,7 @@ func (m *directManager) backupConfig() error {
 }
 
 func (m *directManager) restoreBackup() (restored bool, err error) {
+	backupConf := m.ident.backupConf()
 	if _, err := m.fs.Stat(backupConf); err != nil {
 		if os.IsNotExist(err) {
 			// No backup, nothing we can do.
@@ -219,7 +359,7 @@ func (m *directManager) restoreBackup() (restored bool, err error) {
 		}
 		return false, err
 	}
-	owned, err := m.ownedByTailscale()
+	owned, err := m.ownedByUs()
 	if err != nil {
 		return false, err
 	}
@@ -230,8 +370,8 @@ func (m *directManager) restoreBackup() (restored bool, err error) {
 	resolvConfExists := !os.IsNotExist(err)
 
 	if resolvConfExists && !owned {
-		// There's already a non-tailscale config in place, get rid of
-		// our backup.
+		// There's already a config we didn't generate in place, get
+		// rid of our backup.
 		m.fs.Remove(backupConf)
 		return false, nil
 	}
@@ -293,7 +433,24 @@ func (m *directManager) setWant(want []byte) {
 	m.wantResolvConf = want
 }
 
-var warnTrample = health.NewWarnable()
+var warnTrample = health.NewWarnable(health.WithName(trampleWarnableName))
+
+// trampleWarnableName names the Warnable that reports /etc/resolv.conf
+// being overwritten by another program.
+const trampleWarnableName = "dns-resolv-conf-trample"
+
+// trampleWarnable returns the Warnable that reports /etc/resolv.conf
+// being overwritten, tracked by h if it can track Warnables, and
+// whether it's a new one rather than the shared warnTrample.
+func trampleWarnable(h HealthSink) (w *health.Warnable, isNew bool) {
+	if h == nil || h == HealthSink(health.Default()) {
+		return warnTrample, false
+	}
+	if wt, ok := h.(warnableTracker); ok {
+		return wt.NewWarnable(health.WithName(trampleWarnableName)), true
+	}
+	return warnTrample, false
+}
 
 // checkForFileTrample checks whether /etc/resolv.conf has been trampled
 // by another program on the system. (e.g. a DHCP client)
@@ -313,7 +470,7 @@ func (m *directManager) checkForFileTrample() {
 		return
 	}
 	if bytes.Equal(cur, want) {
-		warnTrample.Set(nil)
+		m.trample.Set(nil)
 		if lastWarn != nil {
 			m.mu.Lock()
 			m.lastWarnContents = nil
@@ -336,10 +493,146 @@ func (m *directManager) checkForFileTrample() {
 		show = show[:1024]
 	}
 	m.logf("trample: resolv.conf changed from what we expected. did some other program interfere? current contents: %q", show)
-	warnTrample.Set(errors.New("Linux DNS config not ideal. /etc/resolv.conf overwritten. See https://tailscale.com/s/dns-fight"))
+	m.trample.Set(errors.New("Linux DNS config not ideal. /etc/resolv.conf overwritten." + m.ident.seeHelp("dns-fight")))
+
+	m.mu.Lock()
+	m.stats.Trampled++
+	m.mu.Unlock()
+	if m.tramplePolicy != TrampleWarn {
+		m.scheduleReaction()
+	}
 }
 
-func (m *directManager) SetDNS(config OSConfig) (err error) {
+// TrampleStats implements TrampleReporter.
+func (m *directManager) TrampleStats() TrampleStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+// reactDelay returns how long to wait before the n'th consecutive
+// trample reaction, counting from zero.
+func (m *directManager) reactDelay(n int) time.Duration {
+	if n == 0 {
+		return 0
+	}
+	d := m.reactMinDelay
+	for i := 1; i < n && d < m.reactMaxDelay; i++ {
+		d *= 2
+	}
+	if d > m.reactMaxDelay {
+		d = m.reactMaxDelay
+	}
+	return d
+}
+
+// scheduleReaction arranges for react to run, after a delay that grows
+// while tramples keep happening. Tramples that happen while a reaction
+// is pending are handled by that reaction.
+func (m *directManager) scheduleReaction() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.reactPending {
+		return
+	}
+	if !m.lastReaction.IsZero() && time.Since(m.lastReaction) < m.reactResetAfter {
+		m.reactions++
+	} else {
+		m.reactions = 0
+	}
+	delay := m.reactDelay(m.reactions)
+	if delay > 0 {
+		m.stats.Deferred++
+		m.logf("trample: resolv.conf overwritten again; reacting in %v", delay)
+	}
+	m.reactPending = true
+	go func() {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-t.C:
+		}
+		m.react()
+	}()
+}
+
+// react applies the trample policy, if resolv.conf still isn't what we
+// wrote.
+func (m *directManager) react() {
+	m.applyMu.Lock()
+	defer m.applyMu.Unlock()
+
+	m.mu.Lock()
+	m.reactPending = false
+	m.lastReaction = time.Now()
+	want := m.wantResolvConf
+	m.mu.Unlock()
+
+	if want == nil || m.ctx.Err() != nil {
+		// SetDNS reset our expectations, or we're closed.
+		return
+	}
+	if cur, err := m.fs.ReadFile(resolvConf); err == nil && bytes.Equal(cur, want) {
+		return
+	}
+
+	unlock, err := m.owner.tryLock(m.ctx)
+	if err != nil {
+		m.mu.Lock()
+		m.stats.Failed++
+		m.mu.Unlock()
+		m.logf("trample: %v", err)
+		return
+	}
+	defer unlock(false)
+	switch m.tramplePolicy {
+	case TrampleReassert:
+		m.logf("trample: rewriting resolv.conf")
+		err = m.atomicWriteFile(m.fs, resolvConf, want, 0644)
+	case TrampleYield:
+		m.logf("trample: taking the new resolv.conf as the base config")
+		err = m.setDNS(context.Background(), m.lastConfig)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case err != nil:
+		m.stats.Failed++
+		m.logf("trample: reacting: %v", err)
+	case m.tramplePolicy == TrampleReassert:
+		m.stats.Reasserted++
+	case m.tramplePolicy == TrampleYield:
+		m.stats.Yielded++
+	}
+}
+
+func (m *directManager) SetDNS(config OSConfig) error {
+	return m.SetDNSContext(context.Background(), config)
+}
+
+// SetDNSContext implements ContextOSConfigurator. ctx bounds the wait
+// for the ownership lock and the restart of systemd-resolved.
+func (m *directManager) SetDNSContext(ctx context.Context, config OSConfig) error {
+	m.applyMu.Lock()
+	defer m.applyMu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	m.lastConfig = config
+	unlock, err := m.owner.lock(ctx)
+	if err != nil {
+		return err
+	}
+	err = m.setDNS(ctx, config)
+	unlock(err == nil && config.IsZero())
+	return err
+}
+
+// setDNS implements SetDNS. m.applyMu must be held.
+func (m *directManager) setDNS(ctx context.Context, config OSConfig) (err error) {
 	defer func() {
 		if err != nil && errors.Is(err, fs.ErrPermission) && runtime.GOOS == "linux" &&
 			distro.Get() == distro.Synology && os.Geteuid() != 0 {
@@ -350,29 +643,40 @@ func (m *directManager) SetDNS(config OSConfig) (err error) {
 			err = nil
 		}
 	}()
+	m.mu.Lock()
+	prevWant := m.wantResolvConf
+	m.mu.Unlock()
 	m.setWant(nil) // reset our expectations before any work
-	var changed bool
-	if config.IsZero() {
-		changed, err = m.restoreBackup()
-		if err != nil {
-			return err
-		}
-	} else {
-		changed = true
-		if err := m.backupConfig(); err != nil {
-			return err
-		}
-
-		buf := new(bytes.Buffer)
-		writeResolvConf(buf, config.Nameservers, config.SearchDomains)
-		if err := m.atomicWriteFile(m.fs, resolvConf, buf.Bytes(), 0644); err != nil {
+	if err := m.migrateLegacyBackup(); err != nil {
+		return err
+	}
+	snap, err := snapshotFiles(m.fs, resolvConf, m.ident.backupConf())
+	if err != nil {
+		return err
+	}
+	entry := m.journalEntry()
+	if !config.IsZero() {
+		if err := m.journal.intend(entry); err != nil {
 			return err
 		}
+	}
+	changed, err := m.writeConfig(config)
+	if err != nil {
+		return rollBack(m.logf, err, func() (bool, error) {
+			restored, err := restoreFiles(m.fs, snap, func(name string, contents []byte) error {
+				return m.atomicWriteFile(m.fs, name, contents, 0644)
+			})
+			if err == nil {
+				m.setWant(prevWant)
+			}
+			return restored, err
+		})
+	}
 
-		// Now that we've successfully written to the file, lock it in.
-		// If we see /etc/resolv.conf with different contents, we know somebody
-		// else trampled on it.
-		m.setWant(buf.Bytes())
+	if config.IsZero() {
+		m.journal.forget(m.logf, entry)
+	} else {
+		m.journal.applied(m.logf, entry)
 	}
 
 	// We might have taken over a configuration managed by resolved,
@@ -391,9 +695,9 @@ func (m *directManager) SetDNS(config OSConfig) (err error) {
 	// the running DNS manager. In that very edge-case scenario, we
 	// cause a disruptive DNS outage each time we reset an empty
 	// OS configuration.
-	if changed && isResolvedRunning() && !runningAsGUIDesktopUser() {
+	if changed && isResolvedRunning(ctx, m.runner) && !runningAsGUIDesktopUser() {
 		t0 := time.Now()
-		err := restartResolved()
+		err := restartResolved(ctx, m.runner)
 		d := time.Since(t0).Round(time.Millisecond)
 		if err != nil {
 			m.logf("error restarting resolved after %v: %v", d, err)
@@ -405,30 +709,142 @@ func (m *directManager) SetDNS(config OSConfig) (err error) {
 	return nil
 }
 
+// writeConfig writes the resolv.conf for config, backing up or restoring
+// the base one as needed, and reports whether it changed anything.
+func (m *directManager) writeConfig(config OSConfig) (changed bool, err error) {
+	if config.IsZero() {
+		return m.restoreBackup()
+	}
+	if err := m.backupConfig(); err != nil {
+		return false, err
+	}
+
+	rc := resolvConfFor(config)
+	if m.merge.enabled() {
+		if err := m.mergeBase(rc); err != nil {
+			return false, err
+		}
+	}
+	buf := new(bytes.Buffer)
+	if o := m.owner.owner(); o != nil {
+		rc.WriteGeneratedWithNotes(buf, m.ident.name(), m.ident.helpURL("resolvconf-overwrite"), o.note())
+	} else {
+		writeResolvConfFile(buf, m.ident, rc)
+	}
+	if err := m.atomicWriteFile(m.fs, resolvConf, buf.Bytes(), 0644); err != nil {
+		return false, err
+	}
+
+	// Now that we've successfully written to the file, lock it in.
+	// If we see /etc/resolv.conf with different contents, we know somebody
+	// else trampled on it.
+	m.setWant(buf.Bytes())
+	return true, nil
+}
+
+// mergeBase merges the base resolv.conf, which backupConfig has moved
+// to our backup file, into rc according to m.merge. It's a no-op if
+// there was no base resolv.conf.
+func (m *directManager) mergeBase(rc *resolvconffile.Config) error {
+	bs, err := m.fs.ReadFile(m.ident.backupConf())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	base, diags, err := resolvconffile.ParseLenient(bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	for _, d := range diags {
+		m.logf("ignoring base resolv.conf %v", d)
+	}
+	mergeResolvConf(rc, base, m.merge)
+	if len(rc.Nameservers) > 3 {
+		m.logf("merged resolv.conf has %d nameservers; most resolvers only use the first 3", len(rc.Nameservers))
+	}
+	return nil
+}
+
 func (m *directManager) SupportsSplitDNS() bool {
 	return false
 }
 
 func (m *directManager) GetBaseConfig() (OSConfig, error) {
-	owned, err := m.ownedByTailscale()
+	if err := m.migrateLegacyBackup(); err != nil {
+		return OSConfig{}, err
+	}
+	owned, err := m.ownedByUs()
 	if err != nil {
 		return OSConfig{}, err
 	}
 	fileToRead := resolvConf
 	if owned {
-		fileToRead = backupConf
+		fileToRead = m.ident.backupConf()
 	}
 
 	return m.readResolvFile(fileToRead)
 }
 
+// journalEntry returns the journal entry for our changes.
+func (m *directManager) journalEntry() JournalEntry {
+	return JournalEntry{Mode: ModeDirect, Kind: JournalBackup, Target: resolvConf, Backup: m.ident.backupConf()}
+}
+
 func (m *directManager) Close() error {
+	return m.CloseContext(context.Background())
+}
+
+// CloseContext implements ContextOSConfigurator. ctx bounds the restart
+// of systemd-resolved.
+func (m *directManager) CloseContext(ctx context.Context) error {
+	if m.ctxClose != nil {
+		m.ctxClose()
+	}
+	m.applyMu.Lock()
+	defer m.applyMu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	if m.ownTrample {
+		m.trample.Unregister()
+	}
+	err := m.closeLocked(ctx)
+	if err == nil {
+		m.journal.forget(m.logf, m.journalEntry())
+	}
+	return err
+}
+
+// closeLocked implements Close. m.applyMu must be held.
+func (m *directManager) closeLocked(ctx context.Context) error {
+	unlock, err := m.owner.tryLock(ctx)
+	var other *OwnedError
+	if errors.As(err, &other) {
+		// Another process took over, so there's nothing of ours to
+		// restore.
+		m.logf("not restoring resolv.conf: %v", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock(true)
+
 	// We used to keep a file for the tailscale config and symlinked
 	// to it, but then we stopped because /etc/resolv.conf being a
 	// symlink to surprising places breaks snaps and other sandboxing
 	// things. Clean it up if it's still there.
-	m.fs.Remove("/etc/resolv.tailscale.conf")
+	for _, name := range m.ident.allNames() {
+		m.fs.Remove("/etc/resolv." + name + ".conf")
+	}
 
+	if err := m.migrateLegacyBackup(); err != nil {
+		return err
+	}
+	backupConf := m.ident.backupConf()
 	if _, err := m.fs.Stat(backupConf); err != nil {
 		if os.IsNotExist(err) {
 			// No backup, nothing we can do.
@@ -436,7 +852,7 @@ func (m *directManager) Close() error {
 		}
 		return err
 	}
-	owned, err := m.ownedByTailscale()
+	owned, err := m.ownedByUs()
 	if err != nil {
 		return err
 	}
@@ -447,8 +863,8 @@ func (m *directManager) Close() error {
 	resolvConfExists := !os.IsNotExist(err)
 
 	if resolvConfExists && !owned {
-		// There's already a non-tailscale config in place, get rid of
-		// our backup.
+		// There's already a config we didn't generate in place, get
+		// rid of our backup.
 		m.fs.Remove(backupConf)
 		return nil
 	}
@@ -458,9 +874,9 @@ func (m *directManager) Close() error {
 		return err
 	}
 
-	if isResolvedRunning() && !runningAsGUIDesktopUser() {
+	if isResolvedRunning(ctx, m.runner) && !runningAsGUIDesktopUser() {
 		m.logf("restarting systemd-resolved...")
-		if err := restartResolved(); err != nil {
+		if err := restartResolved(ctx, m.runner); err != nil {
 			m.logf("restart of systemd-resolved failed: %v", err)
 		} else {
 			m.logf("restarted systemd-resolved")
@@ -470,7 +886,7 @@ func (m *directManager) Close() error {
 	return nil
 }
 
-func (m *directManager) atomicWriteFile(fs wholeFileFS, filename string, data []byte, perm os.FileMode) error {
+func (m *directManager) atomicWriteFile(fs WholeFileFS, filename string, data []byte, perm os.FileMode) error {
 	var randBytes [12]byte
 	if _, err := rand.Read(randBytes[:]); err != nil {
 		return fmt.Errorf("atomicWriteFile: %w", err)
@@ -485,20 +901,29 @@ func (m *directManager) atomicWriteFile(fs wholeFileFS, filename string, data []
 	return m.rename(tmpName, filename)
 }
 
-// wholeFileFS is a high-level file system abstraction designed just for use
+// WholeFileFS is a high-level file system abstraction designed just for use
 // by directManager, with the goal that it is easy to implement over wsl.exe.
+// Options.FS sets the one that ModeDirect and Options.Hosts use.
 //
-// All name parameters are absolute paths.
-type wholeFileFS interface {
+// All name parameters are absolute paths. The errors are those of the
+// os package, such as *fs.PathError.
+type WholeFileFS interface {
+	// Stat reports whether name is a regular file.
 	Stat(name string) (isRegular bool, err error)
+	// Rename renames oldName to newName, replacing it if it exists.
 	Rename(oldName, newName string) error
+	// Remove removes the file name.
 	Remove(name string) error
+	// ReadFile returns the contents of the file name.
 	ReadFile(name string) ([]byte, error)
+	// Truncate empties the file name.
 	Truncate(name string) error
+	// WriteFile replaces the contents of the file name with
+	// contents, creating it with perm if it doesn't exist.
 	WriteFile(name string, contents []byte, perm os.FileMode) error
 }
 
-// directFS is a wholeFileFS implemented directly on the OS.
+// directFS is a WholeFileFS implemented directly on the OS.
 type directFS struct {
 	// prefix is file path prefix.
 	//
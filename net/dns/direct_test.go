@@ -4,16 +4,21 @@
 package dns
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"io/fs"
 	"net/netip"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
 	"syscall"
 	"testing"
+	"time"
 
+	"github.com/anywherelan/ts-dns/health"
 	"github.com/anywherelan/ts-dns/util/dnsname"
 	qt "github.com/frankban/quicktest"
 )
@@ -26,25 +31,36 @@ func TestDirectManager(t *testing.T) {
 	testDirect(t, directFS{prefix: tmp})
 }
 
+func TestDirectBindMounted(t *testing.T) {
+	// As in a container, resolv.conf can't be renamed or removed.
+	fs := new(FakeFS)
+	fs.BindMount(resolvConf)
+	testDirect(t, fs)
+}
+
+// boundResolvConfFS is a directFS on which resolv.conf can't be renamed
+// or removed, as if it were bind-mounted.
 type boundResolvConfFS struct {
 	directFS
 }
 
 func (fs boundResolvConfFS) Rename(old, new string) error {
-	if old == "/etc/resolv.conf" || new == "/etc/resolv.conf" {
-		return errors.New("cannot move to/from /etc/resolv.conf")
+	if old == resolvConf || new == resolvConf {
+		return &os.LinkError{Op: "rename", Old: old, New: new, Err: syscall.EBUSY}
 	}
 	return fs.directFS.Rename(old, new)
 }
 
 func (fs boundResolvConfFS) Remove(name string) error {
-	if name == "/etc/resolv.conf" {
-		return errors.New("cannot remove /etc/resolv.conf")
+	if name == resolvConf {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
 	}
 	return fs.directFS.Remove(name)
 }
 
 func TestDirectBrokenRename(t *testing.T) {
+	// Like TestDirectBindMounted, but on the real file system, where
+	// the fallback truncates and writes resolv.conf in place.
 	tmp := t.TempDir()
 	if err := os.MkdirAll(filepath.Join(tmp, "etc"), 0700); err != nil {
 		t.Fatal(err)
@@ -52,7 +68,32 @@ func TestDirectBrokenRename(t *testing.T) {
 	testDirect(t, boundResolvConfFS{directFS{prefix: tmp}})
 }
 
-func testDirect(t *testing.T, fs wholeFileFS) {
+// brokenRemoveFS is a directFS on which no rename works, and
+// resolv.conf can't be removed, as in some containers.
+type brokenRemoveFS struct {
+	directFS
+}
+
+func (b brokenRemoveFS) Rename(old, new string) error {
+	return &os.LinkError{Op: "rename", Old: old, New: new, Err: syscall.EBUSY}
+}
+
+func (b brokenRemoveFS) Remove(name string) error {
+	if strings.Contains(name, resolvConf) {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+	return b.directFS.Remove(name)
+}
+
+func TestDirectBrokenRemove(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmp, "etc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	testDirect(t, brokenRemoveFS{directFS{prefix: tmp}})
+}
+
+func testDirect(t *testing.T, fs WholeFileFS) {
 	const orig = "nameserver 9.9.9.9 # orig"
 	resolvPath := "/etc/resolv.conf"
 	backupPath := "/etc/resolv.pre-tailscale-backup.conf"
@@ -117,27 +158,18 @@ search ts.net ts-dns.test
 	assertBaseState(t)
 }
 
-type brokenRemoveFS struct {
-	directFS
-}
-
-func (b brokenRemoveFS) Rename(old, new string) error {
-	return errors.New("nyaaah I'm a silly container!")
-}
+func TestDirectCrossDevice(t *testing.T) {
+	// No rename works, as when /etc is on another file system than
+	// our temporary files, and resolv.conf is bind-mounted too.
+	fs := new(FakeFS)
+	fs.Inject(FakeFSFault{Op: "Rename", Err: syscall.EXDEV})
+	fs.BindMount(resolvConf)
+	testDirect(t, fs)
 
-func (b brokenRemoveFS) Remove(name string) error {
-	if strings.Contains(name, "/etc/resolv.conf") {
-		return fmt.Errorf("Faking remove failure: %q", &fs.PathError{Err: syscall.EBUSY})
+	// The copies made instead of renames leave nothing behind.
+	if got, want := fs.Files(), []string{resolvConf}; !reflect.DeepEqual(got, want) {
+		t.Errorf("files = %q; want %q", got, want)
 	}
-	return b.directFS.Remove(name)
-}
-
-func TestDirectBrokenRemove(t *testing.T) {
-	tmp := t.TempDir()
-	if err := os.MkdirAll(filepath.Join(tmp, "etc"), 0700); err != nil {
-		t.Fatal(err)
-	}
-	testDirect(t, brokenRemoveFS{directFS{prefix: tmp}})
 }
 
 func TestReadResolve(t *testing.T) {
@@ -183,8 +215,32 @@ func TestReadResolve(t *testing.T) {
 				SearchDomains: []dnsname.FQDN{"tailsacle.com."},
 			},
 		},
+		{in: "domain example.com\n",
+			want: OSConfig{
+				SearchDomains: []dnsname.FQDN{"example.com."},
+			},
+		},
+		{in: "domain example.com\nsearch tailsacle.com\n",
+			want: OSConfig{
+				SearchDomains: []dnsname.FQDN{"tailsacle.com."},
+			},
+		},
 		{in: `searchtailsacle.com`, wantErr: true},
 		{in: `search`, wantErr: true},
+
+		{in: `options ndots:5 timeout:2 attempts:3 rotate edns0 use-vc trust-ad single-request`,
+			want: OSConfig{
+				ResolverOptions: ResolverOptions{
+					Ndots:    5,
+					Timeout:  2 * time.Second,
+					Attempts: 3,
+					Rotate:   true,
+					EDNS0:    true,
+					UseVC:    true,
+					TrustAD:  true,
+				},
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -197,3 +253,476 @@ func TestReadResolve(t *testing.T) {
 		c.Assert(cfg, qt.DeepEquals, test.want)
 	}
 }
+
+func TestDirectIdentity(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmp, "etc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	fs := directFS{prefix: tmp}
+
+	// Simulate a config left behind by a version that still used the
+	// legacy product name.
+	const orig = "nameserver 9.9.9.9 # orig\n"
+	const legacyConf = "# resolv.conf(5) file generated by tailscale\nnameserver 100.100.100.100\n"
+	if err := fs.WriteFile("/etc/resolv.pre-tailscale-backup.conf", []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/etc/resolv.conf", []byte(legacyConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	id := Identity{Name: "example", HelpURLBase: "https://example.com/help/", LegacyNames: []string{"tailscale"}}
+	m := directManager{logf: t.Logf, fs: fs, ident: id}
+
+	base, err := m.GetBaseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []netip.Addr{netip.MustParseAddr("9.9.9.9")}; !reflect.DeepEqual(base.Nameservers, want) {
+		t.Errorf("base nameservers = %v; want %v", base.Nameservers, want)
+	}
+	if _, err := fs.Stat("/etc/resolv.pre-tailscale-backup.conf"); !os.IsNotExist(err) {
+		t.Errorf("legacy backup still present: %v", err)
+	}
+
+	if err := m.SetDNS(OSConfig{Nameservers: []netip.Addr{netip.MustParseAddr("8.8.8.8")}}); err != nil {
+		t.Fatal(err)
+	}
+	want := `# resolv.conf(5) file generated by example
+# For more info, see https://example.com/help/resolvconf-overwrite
+# DO NOT EDIT THIS FILE BY HAND -- CHANGES WILL BE OVERWRITTEN
+
+nameserver 8.8.8.8
+`
+	got, err := fs.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("resolv.conf:\n%s, want:\n%s", got, want)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err = fs.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != orig {
+		t.Errorf("restored resolv.conf:\n%s, want:\n%s", got, orig)
+	}
+	if _, err := fs.Stat("/etc/resolv.pre-example-backup.conf"); !os.IsNotExist(err) {
+		t.Errorf("backup still present after Close: %v", err)
+	}
+}
+
+func TestDirectIdentityWithoutLegacyNames(t *testing.T) {
+	fs := new(FakeFS)
+
+	// A Tailscale daemon on the same host may own this backup, so it
+	// isn't ours unless "tailscale" is one of our legacy names, or
+	// resolv.conf shows we're upgrading from it (see below).
+	const tsBackup = "nameserver 9.9.9.9 # orig\n"
+	const base = "nameserver 192.168.1.1\n"
+	fs.SetFile("/etc/resolv.pre-tailscale-backup.conf", []byte(tsBackup))
+	fs.SetFile("/etc/resolv.conf", []byte(base))
+
+	m := directManager{logf: t.Logf, fs: fs, ident: Identity{Name: "example"}}
+	got, err := m.GetBaseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustIPs("192.168.1.1"); !reflect.DeepEqual(got.Nameservers, want) {
+		t.Errorf("base nameservers = %v; want %v", got.Nameservers, want)
+	}
+	if err := m.SetDNS(OSConfig{Nameservers: mustIPs("8.8.8.8")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := fs.File("/etc/resolv.conf"); string(got) != base {
+		t.Errorf("resolv.conf after Close:\n%s\nwant:\n%s", got, base)
+	}
+	if got, ok := fs.File("/etc/resolv.pre-tailscale-backup.conf"); !ok || string(got) != tsBackup {
+		t.Errorf("Tailscale's backup = %q, %v; want it untouched", got, ok)
+	}
+}
+
+func TestDirectUpgradeFromLegacyLayout(t *testing.T) {
+	fs := new(FakeFS)
+
+	// A version from before Identity existed wrote these. Even
+	// without "tailscale" in LegacyNames, its backup is the user's
+	// original resolv.conf, which must be restored.
+	const orig = "nameserver 9.9.9.9 # orig\n"
+	fs.SetFile("/etc/resolv.pre-tailscale-backup.conf", []byte(orig))
+	fs.SetFile("/etc/resolv.conf", []byte("# resolv.conf(5) file generated by tailscale\nnameserver 100.100.100.100\n"))
+
+	m := directManager{logf: t.Logf, fs: fs, ident: Identity{Name: "example"}}
+	base, err := m.GetBaseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustIPs("9.9.9.9"); !reflect.DeepEqual(base.Nameservers, want) {
+		t.Errorf("base nameservers = %v; want the original %v", base.Nameservers, want)
+	}
+	if err := m.SetDNS(OSConfig{Nameservers: mustIPs("8.8.8.8")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := fs.File("/etc/resolv.conf"); string(got) != orig {
+		t.Errorf("resolv.conf after Close:\n%s\nwant the original:\n%s", got, orig)
+	}
+	for _, backup := range []string{"/etc/resolv.pre-tailscale-backup.conf", "/etc/resolv.pre-example-backup.conf"} {
+		if _, ok := fs.File(backup); ok {
+			t.Errorf("%s left behind", backup)
+		}
+	}
+}
+
+func TestDirectTrampleHealth(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmp, "etc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	fs := directFS{prefix: tmp}
+	tracker := new(health.Tracker)
+	m := newDirectManagerOnFS(t.Logf, fs, Options{Health: tracker})
+	defer m.Close()
+
+	if err := m.SetDNS(OSConfig{Nameservers: []netip.Addr{netip.MustParseAddr("8.8.8.8")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/etc/resolv.conf", []byte("nameserver 1.1.1.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m.checkForFileTrample()
+
+	ws := tracker.Warnables()
+	if len(ws) != 1 || ws[0].Name != trampleWarnableName || ws[0].Err == nil {
+		t.Fatalf("tracker warnables = %+v; want trample warning", ws)
+	}
+	for _, w := range health.Default().Warnables() {
+		if w.Err != nil {
+			t.Errorf("default tracker has warning %q: %v", w.Name, w.Err)
+		}
+	}
+
+	// Closing the manager takes its Warnable off the tracker.
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if ws := tracker.Warnables(); len(ws) != 0 {
+		t.Errorf("tracker warnables after Close = %+v; want none", ws)
+	}
+}
+
+func TestDirectResolverOptions(t *testing.T) {
+	tmp := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmp, "etc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	fs := directFS{prefix: tmp}
+	m := newDirectManagerOnFS(t.Logf, fs, Options{})
+	defer m.Close()
+
+	cfg := OSConfig{
+		Nameservers: []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+		ResolverOptions: ResolverOptions{
+			Timeout: 1500 * time.Millisecond,
+			EDNS0:   true,
+			TrustAD: true,
+		},
+	}
+	if err := m.SetDNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := fs.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "\noptions timeout:2 edns0 trust-ad\n") {
+		t.Errorf("resolv.conf lacks options line; got:\n%s", got)
+	}
+	back, err := readResolv(strings.NewReader(string(got)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := cfg.ResolverOptions
+	want.Timeout = 2 * time.Second
+	if back.ResolverOptions != want {
+		t.Errorf("read back %+v; want %+v", back.ResolverOptions, want)
+	}
+}
+
+func TestDirectMerge(t *testing.T) {
+	const base = "# from DHCP\n" +
+		"nameserver 192.168.1.1\n" +
+		"nameserver 127.0.0.1\n" +
+		"search home.example\n" +
+		"options ndots:2 timeout:5 single-request\n"
+	tests := []struct {
+		name  string
+		merge DirectMerge
+		cfg   OSConfig
+		want  string // directives after the header
+	}{
+		{
+			name:  "fallback",
+			merge: DirectMerge{KeepNameservers: true, Search: SearchPrepend},
+			cfg: OSConfig{
+				Nameservers:     []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("100.100.100.100")},
+				SearchDomains:   []dnsname.FQDN{"corp.example."},
+				ResolverOptions: ResolverOptions{Timeout: time.Second, EDNS0: true},
+			},
+			want: "nameserver 127.0.0.1\n" +
+				"nameserver 100.100.100.100\n" +
+				"nameserver 192.168.1.1\n" +
+				"search corp.example home.example\n" +
+				"options ndots:2 single-request timeout:1 edns0\n",
+		},
+		{
+			name:  "search_only",
+			merge: DirectMerge{KeepNameservers: true, Search: SearchAppend},
+			cfg: OSConfig{
+				SearchDomains: []dnsname.FQDN{"corp.example."},
+			},
+			want: "nameserver 192.168.1.1\n" +
+				"nameserver 127.0.0.1\n" +
+				"search home.example corp.example\n" +
+				"options ndots:2 timeout:5 single-request\n",
+		},
+		{
+			name: "replace",
+			cfg: OSConfig{
+				SearchDomains: []dnsname.FQDN{"corp.example."},
+			},
+			want: "search corp.example\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(tmp, "etc"), 0700); err != nil {
+				t.Fatal(err)
+			}
+			fs := directFS{prefix: tmp}
+			if err := fs.WriteFile("/etc/resolv.conf", []byte(base), 0644); err != nil {
+				t.Fatal(err)
+			}
+			m := newDirectManagerOnFS(t.Logf, fs, Options{DirectMerge: tt.merge})
+			defer m.Close()
+
+			// Apply twice, to check that we merge with the backup
+			// rather than with our own previous output.
+			for i := 0; i < 2; i++ {
+				if err := m.SetDNS(tt.cfg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := fs.ReadFile("/etc/resolv.conf")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, directives, _ := strings.Cut(string(got), "\n\n")
+			if directives != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", directives, tt.want)
+			}
+
+			if err := m.SetDNS(OSConfig{}); err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := fs.ReadFile("/etc/resolv.conf"); string(got) != base {
+				t.Errorf("base not restored; got:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestDirectTramplePolicy(t *testing.T) {
+	const base = "nameserver 192.168.1.1\n"
+	const dhcp = "nameserver 10.0.0.1\n"
+	cfg := OSConfig{Nameservers: []netip.Addr{netip.MustParseAddr("100.100.100.100")}}
+
+	waitFor := func(t *testing.T, what string, cond func() bool) {
+		t.Helper()
+		for i := 0; i < 200; i++ {
+			if cond() {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for %s", what)
+	}
+
+	for _, policy := range []TramplePolicy{TrampleWarn, TrampleReassert, TrampleYield} {
+		t.Run(fmt.Sprint(policy), func(t *testing.T) {
+			tmp := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(tmp, "etc"), 0700); err != nil {
+				t.Fatal(err)
+			}
+			fs := directFS{prefix: tmp}
+			if err := fs.WriteFile("/etc/resolv.conf", []byte(base), 0644); err != nil {
+				t.Fatal(err)
+			}
+			m := newDirectManagerOnFS(t.Logf, fs, Options{Trample: policy})
+			m.reactMinDelay = 10 * time.Millisecond
+			defer m.Close()
+
+			if err := m.SetDNS(cfg); err != nil {
+				t.Fatal(err)
+			}
+			ours, err := fs.ReadFile("/etc/resolv.conf")
+			if err != nil {
+				t.Fatal(err)
+			}
+			isOurs := func() bool {
+				cur, _ := fs.ReadFile("/etc/resolv.conf")
+				return bytes.Equal(cur, ours)
+			}
+
+			// Trample twice: the second reaction is deferred.
+			for i := 0; i < 2; i++ {
+				if err := fs.WriteFile("/etc/resolv.conf", []byte(dhcp), 0644); err != nil {
+					t.Fatal(err)
+				}
+				m.checkForFileTrample()
+				if policy == TrampleWarn {
+					continue
+				}
+				waitFor(t, "reaction", isOurs)
+				m.checkForFileTrample()
+			}
+
+			want := TrampleStats{Trampled: 2}
+			switch policy {
+			case TrampleWarn:
+				// The second trample wrote the same contents as the
+				// first, which was already reported.
+				want.Trampled = 1
+				if isOurs() {
+					t.Error("resolv.conf rewritten with warn policy")
+				}
+			case TrampleReassert:
+				want.Reasserted, want.Deferred = 2, 1
+			case TrampleYield:
+				want.Yielded, want.Deferred = 2, 1
+			}
+			waitFor(t, "stats", func() bool { return m.TrampleStats() == want })
+
+			backup, err := fs.ReadFile(m.ident.backupConf())
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantBackup := base
+			if policy == TrampleYield {
+				wantBackup = dhcp
+			}
+			if string(backup) != wantBackup {
+				t.Errorf("backup = %q; want %q", backup, wantBackup)
+			}
+		})
+	}
+}
+
+func TestDirectRollback(t *testing.T) {
+	const orig = "nameserver 9.9.9.9 # orig\n"
+	cfg := OSConfig{Nameservers: []netip.Addr{netip.MustParseAddr("8.8.8.8")}}
+	for _, tt := range []struct {
+		name           string
+		failWrites     int
+		wantRolledBack bool
+	}{
+		{"rolled-back", 1, true},
+		{"rollback-failed", 2, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// The backup is made by renaming resolv.conf, then
+			// writing the new one fails, as when the disk fills
+			// up, and so does restoring the old one if
+			// failWrites is 2.
+			fsys := new(FakeFS)
+			fsys.SetFile(resolvConf, []byte(orig))
+			fsys.Inject(FakeFSFault{Op: "WriteFile", Path: resolvConf + ".*", Times: tt.failWrites, Err: syscall.ENOSPC})
+			m := directManager{logf: t.Logf, fs: fsys, ident: DefaultIdentity}
+
+			err := m.SetDNS(cfg)
+			var rerr *RollbackError
+			if !errors.As(err, &rerr) {
+				t.Fatalf("SetDNS = %v; want a RollbackError", err)
+			}
+			if !errors.Is(err, syscall.ENOSPC) {
+				t.Errorf("SetDNS = %v; want it to wrap ENOSPC", err)
+			}
+			if got := rerr.RolledBack(); got != tt.wantRolledBack {
+				t.Fatalf("RolledBack = %v; want %v (err: %v)", got, tt.wantRolledBack, err)
+			}
+			if !tt.wantRolledBack {
+				return
+			}
+			got, err := fsys.ReadFile(resolvConf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != orig {
+				t.Errorf("resolv.conf after rollback:\n%s, want:\n%s", got, orig)
+			}
+			if _, err := fsys.Stat(DefaultIdentity.backupConf()); !os.IsNotExist(err) {
+				t.Errorf("backup left after rollback: %v", err)
+			}
+
+			// Nothing fails before any change, so that's not a
+			// RollbackError.
+			if err := m.SetDNS(cfg); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestDirectDiskFull(t *testing.T) {
+	const orig = "nameserver 9.9.9.9 # orig\n"
+	fs := new(FakeFS)
+	fs.SetFile(resolvConf, []byte(orig))
+	// There's room to put back the original resolv.conf, but not for
+	// the longer one we generate.
+	fs.SetFreeSpace(2 * len(orig))
+	m, err := NewDirectManager(t.Logf, Options{Root: t.TempDir(), FS: fs, Health: new(health.Tracker)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	err = m.SetDNS(OSConfig{Nameservers: []netip.Addr{netip.MustParseAddr("8.8.8.8")}})
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("SetDNS = %v; want ENOSPC", err)
+	}
+	if got, _ := fs.File(resolvConf); string(got) != orig {
+		t.Errorf("resolv.conf after a full disk:\n%s, want:\n%s", got, orig)
+	}
+	if got, want := fs.Files(), []string{resolvConf}; !reflect.DeepEqual(got, want) {
+		t.Errorf("files = %q; want %q, with the partial write removed", got, want)
+	}
+}
+
+func TestIsResolvedRunningContext(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("systemd-resolved is only checked for on Linux")
+	}
+	r := new(FakeRunner)
+	r.On("systemctl is-active systemd-resolved.service", FakeResponse{Stdout: "active\n"})
+	if !isResolvedRunning(context.Background(), r) {
+		t.Errorf("isResolvedRunning = false; want true")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if isResolvedRunning(ctx, r) {
+		t.Errorf("isResolvedRunning with a done context = true; want false")
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package dnstest checks that implementations of dns.OSConfigurator
+// keep the contract the rest of the dns package relies on.
+package dnstest
+
+import (
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/anywherelan/ts-dns/net/dns"
+	"github.com/anywherelan/ts-dns/util/dnsname"
+)
+
+// A Target is an OSConfigurator under test, along with a view of the
+// OS state it changes.
+type Target struct {
+	Configurator dns.OSConfigurator
+
+	// State returns the part of the OS's DNS configuration that
+	// Configurator changes, such as the contents of
+	// /etc/resolv.conf, in any form that's equal for equal states.
+	State func() (string, error)
+}
+
+// A Factory returns a new Target, in a fresh OS state of its own. It
+// registers the cleanup of that state with t.
+type Factory func(t *testing.T) Target
+
+// RunConformance runs the conformance tests, as subtests of t, against
+// the Targets that newTarget returns. It checks that:
+//
+//   - SetDNS changes the State, and a zero config restores it;
+//   - GetBaseConfig, if supported, doesn't see our configuration;
+//   - Close restores the State, and is idempotent;
+//   - SetDNS fails with dns.ErrClosed after Close;
+//   - concurrent calls of SetDNS are safe.
+func RunConformance(t *testing.T, newTarget Factory) {
+	for _, tt := range []struct {
+		name string
+		test func(*testing.T, Target)
+	}{
+		{"SetDNS", testSetDNS},
+		{"SplitDNS", testSplitDNS},
+		{"GetBaseConfig", testGetBaseConfig},
+		{"Close", testClose},
+		{"CloseUnused", testCloseUnused},
+		{"ConcurrentSetDNS", testConcurrentSetDNS},
+		{"ConcurrentClose", testConcurrentClose},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tg := newTarget(t)
+			// Close, if the test didn't. After it did, this
+			// checks that closing again does nothing.
+			t.Cleanup(func() {
+				if err := tg.Configurator.Close(); err != nil {
+					t.Errorf("Close at cleanup: %v", err)
+				}
+			})
+			tt.test(t, tg)
+		})
+	}
+}
+
+// config returns the OSConfig the tests apply, varied by n. It's a new
+// one every time, since SetDNS takes ownership of it.
+func config(n int) dns.OSConfig {
+	return dns.OSConfig{
+		Hosts: []*dns.HostEntry{{
+			Addr:  netip.AddrFrom4([4]byte{100, 64, 0, byte(1 + n)}),
+			Hosts: []string{"peer.ts.example."},
+		}},
+		Nameservers:   []netip.Addr{netip.AddrFrom4([4]byte{100, 100, 100, byte(100 + n)})},
+		SearchDomains: []dnsname.FQDN{"ts.example."},
+	}
+}
+
+// splitConfig is like config, for split DNS.
+func splitConfig(n int) dns.OSConfig {
+	cfg := config(n)
+	cfg.MatchDomains = []dnsname.FQDN{"ts.example.", "corp.example."}
+	return cfg
+}
+
+// state returns the state of tg, or fails the test.
+func state(t *testing.T, tg Target) string {
+	t.Helper()
+	s, err := tg.State()
+	if err != nil {
+		t.Fatalf("reading the state: %v", err)
+	}
+	return s
+}
+
+// wantState fails the test unless tg is in the state want.
+func wantState(t *testing.T, tg Target, what, want string) {
+	t.Helper()
+	if got := state(t, tg); got != want {
+		t.Errorf("state %s:\n%s\nwant:\n%s", what, got, want)
+	}
+}
+
+// setDNS applies cfg to tg, or fails the test.
+func setDNS(t *testing.T, tg Target, cfg dns.OSConfig) {
+	t.Helper()
+	if err := tg.Configurator.SetDNS(cfg); err != nil {
+		t.Fatalf("SetDNS(%v): %v", cfg, err)
+	}
+}
+
+func testSetDNS(t *testing.T, tg Target) {
+	initial := state(t, tg)
+
+	setDNS(t, tg, config(0))
+	set := state(t, tg)
+	if set == initial {
+		t.Fatalf("state unchanged by SetDNS:\n%s", set)
+	}
+	setDNS(t, tg, config(0))
+	wantState(t, tg, "after the same SetDNS again", set)
+
+	setDNS(t, tg, config(1))
+	if state(t, tg) == set {
+		t.Errorf("state unchanged by SetDNS of other nameservers:\n%s", set)
+	}
+	setDNS(t, tg, config(0))
+	wantState(t, tg, "after going back to the first config", set)
+
+	setDNS(t, tg, dns.OSConfig{})
+	wantState(t, tg, "after SetDNS of a zero config", initial)
+	setDNS(t, tg, dns.OSConfig{})
+	wantState(t, tg, "after SetDNS of a zero config again", initial)
+}
+
+func testSplitDNS(t *testing.T, tg Target) {
+	if !tg.Configurator.SupportsSplitDNS() {
+		t.Skip("no split DNS")
+	}
+	initial := state(t, tg)
+
+	setDNS(t, tg, splitConfig(0))
+	split := state(t, tg)
+	if split == initial {
+		t.Fatalf("state unchanged by SetDNS:\n%s", split)
+	}
+	setDNS(t, tg, config(0))
+	if state(t, tg) == split {
+		t.Errorf("state unchanged by going from split to full DNS:\n%s", split)
+	}
+	setDNS(t, tg, splitConfig(0))
+	wantState(t, tg, "after going back to split DNS", split)
+
+	setDNS(t, tg, dns.OSConfig{})
+	wantState(t, tg, "after SetDNS of a zero config", initial)
+}
+
+func testGetBaseConfig(t *testing.T, tg Target) {
+	c := tg.Configurator
+	base, err := c.GetBaseConfig()
+	if errors.Is(err, dns.ErrGetBaseConfigNotSupported) {
+		t.Skip("GetBaseConfig not supported")
+	}
+	if err != nil {
+		t.Fatalf("GetBaseConfig: %v", err)
+	}
+
+	for _, cfg := range []dns.OSConfig{config(0), splitConfig(1), {}} {
+		if len(cfg.MatchDomains) > 0 && !c.SupportsSplitDNS() {
+			continue
+		}
+		setDNS(t, tg, cfg)
+		got, err := c.GetBaseConfig()
+		if err != nil {
+			t.Fatalf("GetBaseConfig after SetDNS(%v): %v", cfg, err)
+		}
+		if !got.Equal(base) {
+			t.Errorf("GetBaseConfig after SetDNS(%v) = %v; want %v, as before", cfg, got, base)
+		}
+	}
+}
+
+func testClose(t *testing.T, tg Target) {
+	c := tg.Configurator
+	initial := state(t, tg)
+	setDNS(t, tg, config(0))
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	wantState(t, tg, "after Close", initial)
+	if err := c.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	wantState(t, tg, "after the second Close", initial)
+
+	if err := c.SetDNS(config(0)); !errors.Is(err, dns.ErrClosed) {
+		t.Errorf("SetDNS after Close = %v; want %v", err, dns.ErrClosed)
+	}
+	wantState(t, tg, "after SetDNS after Close", initial)
+}
+
+func testCloseUnused(t *testing.T, tg Target) {
+	initial := state(t, tg)
+	if err := tg.Configurator.Close(); err != nil {
+		t.Fatalf("Close without SetDNS: %v", err)
+	}
+	wantState(t, tg, "after Close without SetDNS", initial)
+}
+
+// concurrency is the number of goroutines of the concurrency tests.
+const concurrency = 8
+
+func testConcurrentSetDNS(t *testing.T, tg Target) {
+	initial := state(t, tg)
+
+	// The state after the concurrent calls must be that of one of
+	// their configs, whichever was applied last.
+	states := map[string]bool{}
+	for i := 0; i < concurrency; i++ {
+		setDNS(t, tg, config(i))
+		states[state(t, tg)] = true
+	}
+
+	var wg sync.WaitGroup
+	errc := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errc <- tg.Configurator.SetDNS(config(i))
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Errorf("concurrent SetDNS: %v", err)
+		}
+	}
+	if got := state(t, tg); !states[got] {
+		t.Errorf("state after concurrent SetDNS is that of none of their configs:\n%s", got)
+	}
+
+	setDNS(t, tg, dns.OSConfig{})
+	wantState(t, tg, "after SetDNS of a zero config", initial)
+}
+
+func testConcurrentClose(t *testing.T, tg Target) {
+	initial := state(t, tg)
+	setDNS(t, tg, config(0))
+
+	var wg sync.WaitGroup
+	errc := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errc <- tg.Configurator.SetDNS(config(i))
+		}(i)
+	}
+	if err := tg.Configurator.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil && !errors.Is(err, dns.ErrClosed) {
+			t.Errorf("SetDNS racing with Close = %v; want nil or %v", err, dns.ErrClosed)
+		}
+	}
+	wantState(t, tg, "after Close", initial)
+}
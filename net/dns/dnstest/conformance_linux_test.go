@@ -0,0 +1,308 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dnstest
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/anywherelan/ts-dns/health"
+	"github.com/anywherelan/ts-dns/net/dns"
+)
+
+// baseResolvConf is the OS's configuration before the tests change it.
+const baseResolvConf = "nameserver 192.168.1.1\nsearch lan\n"
+
+var testIdentity = dns.Identity{Name: "example"}
+
+// writeFile writes contents to the file at the absolute path name under
+// root, or fails the test.
+func writeFile(t *testing.T, root, name, contents string) {
+	t.Helper()
+	p := filepath.Join(root, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dirState returns the names and contents of the files in dir, as a
+// Target's State.
+func dirState(dir string) (string, error) {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, e := range ents {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		bs, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sb, "== %s\n%s", e.Name(), bs)
+	}
+	return sb.String(), nil
+}
+
+// newConfigurator returns a new OSConfigurator made with opts, or fails
+// the test.
+func newConfigurator(t *testing.T, opts dns.Options) dns.OSConfigurator {
+	t.Helper()
+	opts.Identity = testIdentity
+	opts.Health = new(health.Tracker)
+	c, err := dns.NewOSConfiguratorWithOptions(t.Logf, "tun0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestDirect(t *testing.T) {
+	RunConformance(t, func(t *testing.T) Target {
+		root := t.TempDir()
+		writeFile(t, root, "/etc/resolv.conf", baseResolvConf)
+		return Target{
+			Configurator: newConfigurator(t, dns.Options{Mode: dns.ModeDirect, Root: root}),
+			State:        func() (string, error) { return dirState(filepath.Join(root, "etc")) },
+		}
+	})
+}
+
+func TestDirectHostsFile(t *testing.T) {
+	RunConformance(t, func(t *testing.T) Target {
+		root := t.TempDir()
+		writeFile(t, root, "/etc/resolv.conf", baseResolvConf)
+		writeFile(t, root, "/etc/hosts", "127.0.0.1 localhost\n")
+		return Target{
+			Configurator: newConfigurator(t, dns.Options{Mode: dns.ModeDirect, Root: root, Hosts: dns.HostsFile}),
+			State:        func() (string, error) { return dirState(filepath.Join(root, "etc")) },
+		}
+	})
+}
+
+func TestDirectBindMounted(t *testing.T) {
+	RunConformance(t, func(t *testing.T) Target {
+		// As in a Docker container, resolv.conf is bind-mounted,
+		// and /etc is on another file system than the rest.
+		fs := new(dns.FakeFS)
+		fs.SetFile("/etc/resolv.conf", []byte(baseResolvConf))
+		fs.BindMount("/etc/resolv.conf")
+		fs.Inject(dns.FakeFSFault{Op: "Rename", Err: syscall.EXDEV})
+		return Target{
+			Configurator: newConfigurator(t, dns.Options{Mode: dns.ModeDirect, Root: t.TempDir(), FS: fs}),
+			State: func() (string, error) {
+				var sb strings.Builder
+				for _, name := range fs.Files() {
+					bs, _ := fs.File(name)
+					fmt.Fprintf(&sb, "== %s\n%s", name, bs)
+				}
+				return sb.String(), nil
+			},
+		}
+	})
+}
+
+// loopbackInterface returns the loopback interface, for
+// systemd-resolved, which needs a real one.
+func loopbackInterface(t *testing.T) net.Interface {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifs {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface
+		}
+	}
+	t.Skip("no loopback interface")
+	return net.Interface{}
+}
+
+func TestSystemdResolved(t *testing.T) {
+	RunConformance(t, func(t *testing.T) Target {
+		lo := loopbackInterface(t)
+		bus := dns.NewFakeBus()
+		r := dns.NewFakeResolved(bus)
+		c, err := dns.NewResolvedManager(t.Logf, lo.Name, dns.Options{Bus: bus, Health: new(health.Tracker)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Target{
+			Configurator: c,
+			State: func() (string, error) {
+				l := r.Link(lo.Index)
+				return fmt.Sprintf("dns=%v domains=%v default-route=%v", l.DNS, l.Domains, l.DefaultRoute), nil
+			},
+		}
+	})
+}
+
+func TestNetworkManager(t *testing.T) {
+	RunConformance(t, func(t *testing.T) Target {
+		bus := dns.NewFakeBus()
+		nm := dns.NewFakeNetworkManager(bus, "1.26.2", "dnsmasq")
+		nm.AddDevice("tun0")
+		c, err := dns.NewNMManager(t.Logf, "tun0", dns.Options{Bus: bus, Health: new(health.Tracker)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Target{
+			Configurator: c,
+			State: func() (string, error) {
+				settings, _ := nm.Applied("tun0")
+				var sb strings.Builder
+				for _, k := range []string{"ipv4.dns", "ipv4.dns-search", "ipv6.dns", "ipv6.dns-search"} {
+					ip, name, _ := strings.Cut(k, ".")
+					// A missing setting is the same as an
+					// empty one.
+					var v any = "[]"
+					if s, ok := settings[ip][name]; ok {
+						v = s.Value()
+					}
+					fmt.Fprintf(&sb, "%s=%v\n", k, v)
+				}
+				return sb.String(), nil
+			},
+		}
+	})
+}
+
+// run returns a FakeResponse that runs fn, and fails the command with
+// the error fn returns.
+func run(fn func(dns.Command) (stdout string, err error)) dns.FakeResponse {
+	return dns.FakeResponse{Func: func(c dns.Command) dns.CommandResult {
+		stdout, err := fn(c)
+		if err != nil {
+			return dns.CommandResult{Stderr: []byte(err.Error()), ExitCode: 1}
+		}
+		return dns.CommandResult{Stdout: []byte(stdout)}
+	}}
+}
+
+func TestDebianResolvconf(t *testing.T) {
+	RunConformance(t, func(t *testing.T) Target {
+		root := t.TempDir()
+		const interfaces = "/run/resolvconf/interface"
+		dir := filepath.Join(root, interfaces)
+		writeFile(t, root, interfaces+"/eth0", baseResolvConf)
+
+		// Debian's resolvconf keeps a file per record.
+		const record = "tun-example.inet"
+		f := new(dns.FakeRunner)
+		f.On("resolvconf -a "+record, run(func(c dns.Command) (string, error) {
+			return "", os.WriteFile(filepath.Join(dir, record), c.Stdin, 0644)
+		}))
+		f.On("resolvconf -d "+record, run(func(dns.Command) (string, error) {
+			if err := os.Remove(filepath.Join(dir, record)); err != nil && !os.IsNotExist(err) {
+				return "", err
+			}
+			return "", nil
+		}))
+		f.On("/usr/lib/resolvconf/list-records", run(func(dns.Command) (string, error) {
+			ents, err := os.ReadDir(dir)
+			if err != nil {
+				return "", err
+			}
+			var sb strings.Builder
+			for _, e := range ents {
+				fmt.Fprintln(&sb, e.Name())
+			}
+			return sb.String(), nil
+		}))
+
+		return Target{
+			Configurator: newConfigurator(t, dns.Options{Mode: dns.ModeDebianResolvconf, Root: root, Runner: f}),
+			State:        func() (string, error) { return dirState(dir) },
+		}
+	})
+}
+
+// fakeOpenresolv keeps the snippets of a fake openresolv.
+type fakeOpenresolv struct {
+	mu       sync.Mutex
+	snippets map[string]string // by name
+}
+
+// state returns the snippets of o, as a Target's State.
+func (o *fakeOpenresolv) state() (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var names []string
+	for name := range o.snippets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "== %s\n%s", name, o.snippets[name])
+	}
+	return sb.String(), nil
+}
+
+// script scripts f to act as o, with our snippet and the snippets
+// named others.
+func (o *fakeOpenresolv) script(f *dns.FakeRunner, ours string, others ...string) {
+	for _, name := range append([]string{"tailscale"}, ours) {
+		name := name
+		f.On("resolvconf -f -d "+name, run(func(dns.Command) (string, error) {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			delete(o.snippets, name)
+			return "", nil
+		}))
+	}
+	f.On("resolvconf -l "+ours, run(func(dns.Command) (string, error) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		return o.snippets[ours], nil
+	}))
+	f.On("resolvconf -m 0 -x -a "+ours, run(func(c dns.Command) (string, error) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		o.snippets[ours] = string(c.Stdin)
+		return "", nil
+	}))
+	f.On("resolvconf -i", run(func(dns.Command) (string, error) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		var names []string
+		if _, ok := o.snippets[ours]; ok {
+			names = append(names, ours)
+		}
+		return strings.Join(append(names, others...), " ") + "\n", nil
+	}))
+	f.On("resolvconf -l "+strings.Join(others, " "), run(func(dns.Command) (string, error) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		var sb strings.Builder
+		for _, name := range others {
+			sb.WriteString(o.snippets[name])
+		}
+		return sb.String(), nil
+	}))
+}
+
+func TestOpenresolv(t *testing.T) {
+	RunConformance(t, func(t *testing.T) Target {
+		o := &fakeOpenresolv{snippets: map[string]string{"eth0": baseResolvConf}}
+		f := new(dns.FakeRunner)
+		o.script(f, testIdentity.Name, "eth0")
+		return Target{
+			Configurator: newConfigurator(t, dns.Options{Mode: dns.ModeOpenresolv, Root: t.TempDir(), Runner: f}),
+			State:        o.state,
+		}
+	})
+}
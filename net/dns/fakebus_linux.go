@@ -0,0 +1,663 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"golang.org/x/sys/unix"
+)
+
+// Errors of FakeBus, named like those of a real bus.
+var (
+	errFakeServiceUnknown  = dbus.Error{Name: "org.freedesktop.DBus.Error.ServiceUnknown", Body: []any{"The name is not activatable"}}
+	errFakeUnknownProperty = dbus.Error{Name: "org.freedesktop.DBus.Error.UnknownProperty", Body: []any{"Unknown property"}}
+	errFakeConnClosed      = errors.New("dbus: connection closed")
+)
+
+// FakeBus is a BusDialer for tests: an in-memory D-Bus whose services
+// are scripted with Own, Handle and SetProperty, or set up by the fakes
+// of systemd-resolved and NetworkManager built on it. Dial returns
+// connections to it.
+//
+// Its signals are delivered without blocking; those that don't fit in
+// a subscriber's channel are dropped.
+type FakeBus struct {
+	mu      sync.Mutex
+	dialErr error
+	owners  map[string]string // unique connection name, by well-known name
+	nextID  int
+	methods map[fakeBusMethodKey]FakeMethod
+	props   map[fakeBusPropKey]dbus.Variant
+	conns   map[*fakeBusConn]bool
+	calls   []FakeBusCall
+}
+
+// A FakeMethod implements a method of a FakeBus service. It's called
+// with the object path and the arguments of the call, and returns the
+// body of the reply.
+type FakeMethod func(ctx context.Context, path dbus.ObjectPath, args []any) ([]any, error)
+
+// A FakeBusCall is a method call made on a FakeBus.
+type FakeBusCall struct {
+	Dest   string
+	Path   dbus.ObjectPath
+	Method string // in "interface.member" notation
+	Args   []any
+}
+
+func (c FakeBusCall) String() string {
+	return fmt.Sprintf("%s %s %s%v", c.Dest, c.Path, c.Method, c.Args)
+}
+
+type fakeBusMethodKey struct {
+	dest, method string
+}
+
+type fakeBusPropKey struct {
+	dest        string
+	path        dbus.ObjectPath
+	iface, name string
+}
+
+// NewFakeBus returns an empty FakeBus.
+func NewFakeBus() *FakeBus {
+	return &FakeBus{
+		owners:  map[string]string{},
+		methods: map[fakeBusMethodKey]FakeMethod{},
+		props:   map[fakeBusPropKey]dbus.Variant{},
+		conns:   map[*fakeBusConn]bool{},
+	}
+}
+
+// Dial implements BusDialer.
+func (b *FakeBus) Dial() (Bus, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.dialErr != nil {
+		return nil, b.dialErr
+	}
+	c := &fakeBusConn{bus: b}
+	b.conns[c] = true
+	return c, nil
+}
+
+// SetDialError makes Dial fail with err, or succeed again if err is nil.
+func (b *FakeBus) SetDialError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dialErr = err
+}
+
+// Disconnect closes all the connections to b, as if the bus went away.
+func (b *FakeBus) Disconnect() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		b.closeLocked(c)
+	}
+}
+
+// Own makes name owned by a new connection, as if its service started,
+// and broadcasts the NameOwnerChanged signal.
+func (b *FakeBus) Own(name string) {
+	b.mu.Lock()
+	old := b.owners[name]
+	b.nextID++
+	owner := fmt.Sprintf(":1.%d", b.nextID)
+	b.owners[name] = owner
+	b.mu.Unlock()
+	b.emitOwnerChanged(name, old, owner)
+}
+
+// Release makes name unowned, as if its service exited, and broadcasts
+// the NameOwnerChanged signal.
+func (b *FakeBus) Release(name string) {
+	b.mu.Lock()
+	old, ok := b.owners[name]
+	delete(b.owners, name)
+	b.mu.Unlock()
+	if ok {
+		b.emitOwnerChanged(name, old, "")
+	}
+}
+
+func (b *FakeBus) emitOwnerChanged(name, old, owner string) {
+	b.Emit(&dbus.Signal{
+		Sender: dbusInterface,
+		Path:   dbusPath,
+		Name:   dbusInterface + "." + dbusOwnerSignal,
+		Body:   []any{name, old, owner},
+	})
+}
+
+// Handle scripts the method, in "interface.member" notation, of the
+// service dest, for all its object paths. Calls fail unless dest is
+// owned.
+func (b *FakeBus) Handle(dest, method string, fn FakeMethod) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.methods[fakeBusMethodKey{dest, method}] = fn
+}
+
+// SetProperty sets the property iface.name of the object at path of
+// the service dest to v.
+func (b *FakeBus) SetProperty(dest string, path dbus.ObjectPath, iface, name string, v any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	vv, ok := v.(dbus.Variant)
+	if !ok {
+		vv = dbus.MakeVariant(v)
+	}
+	b.props[fakeBusPropKey{dest, path, iface, name}] = vv
+}
+
+// Emit broadcasts sig to the matching subscribers.
+func (b *FakeBus) Emit(sig *dbus.Signal) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.conns {
+		for _, s := range c.subs {
+			if !s.m.matches(sig) {
+				continue
+			}
+			select {
+			case s.ch <- sig:
+			default:
+			}
+		}
+	}
+}
+
+// Calls returns the method calls made so far, in order.
+func (b *FakeBus) Calls() []FakeBusCall {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]FakeBusCall(nil), b.calls...)
+}
+
+// OpenConns returns the number of connections dialed and not yet
+// closed.
+func (b *FakeBus) OpenConns() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.conns)
+}
+
+// call implements the calls of the connection c.
+func (b *FakeBus) call(ctx context.Context, c *fakeBusConn, dest string, path dbus.ObjectPath, method string, args []any) ([]any, error) {
+	b.mu.Lock()
+	if !b.conns[c] {
+		b.mu.Unlock()
+		return nil, errFakeConnClosed
+	}
+	b.calls = append(b.calls, FakeBusCall{Dest: dest, Path: path, Method: method, Args: args})
+	_, owned := b.owners[dest]
+	fn := b.methods[fakeBusMethodKey{dest, method}]
+	var prop dbus.Variant
+	var propOK bool
+	if method == dbusPropertiesInterface+".Get" && len(args) == 2 {
+		iface, _ := args[0].(string)
+		name, _ := args[1].(string)
+		prop, propOK = b.props[fakeBusPropKey{dest, path, iface, name}]
+	}
+	b.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	switch {
+	case !owned:
+		return nil, errFakeServiceUnknown
+	case method == dbusPeerPing:
+		return nil, nil
+	case propOK:
+		return []any{prop}, nil
+	case fn != nil:
+		return fn(ctx, path, args)
+	case method == dbusPropertiesInterface+".Get":
+		return nil, errFakeUnknownProperty
+	}
+	return nil, dbus.ErrMsgUnknownMethod
+}
+
+// closeLocked closes the connection c. b.mu must be held.
+func (b *FakeBus) closeLocked(c *fakeBusConn) {
+	if !b.conns[c] {
+		return
+	}
+	delete(b.conns, c)
+	closed := map[chan *dbus.Signal]bool{}
+	for _, s := range c.subs {
+		if !closed[s.ch] {
+			close(s.ch)
+			closed[s.ch] = true
+		}
+	}
+	c.subs = nil
+}
+
+// fakeBusConn is a connection to a FakeBus.
+type fakeBusConn struct {
+	bus  *FakeBus
+	subs []fakeBusSub // guarded by bus.mu
+}
+
+type fakeBusSub struct {
+	ch chan *dbus.Signal
+	m  SignalMatch
+}
+
+func (c *fakeBusConn) Call(ctx context.Context, dest string, path dbus.ObjectPath, method string, args ...any) ([]any, error) {
+	return c.bus.call(ctx, c, dest, path, method, args)
+}
+
+func (c *fakeBusConn) GetProperty(ctx context.Context, dest string, path dbus.ObjectPath, iface, name string) (dbus.Variant, error) {
+	var v dbus.Variant
+	body, err := c.Call(ctx, dest, path, dbusPropertiesInterface+".Get", iface, name)
+	if err == nil {
+		err = dbus.Store(body, &v)
+	}
+	return v, err
+}
+
+func (c *fakeBusConn) Subscribe(ch chan *dbus.Signal, m SignalMatch) error {
+	c.bus.mu.Lock()
+	defer c.bus.mu.Unlock()
+	if !c.bus.conns[c] {
+		close(ch)
+		return errFakeConnClosed
+	}
+	c.subs = append(c.subs, fakeBusSub{ch, m})
+	return nil
+}
+
+func (c *fakeBusConn) Close() error {
+	c.bus.mu.Lock()
+	defer c.bus.mu.Unlock()
+	c.bus.closeLocked(c)
+	return nil
+}
+
+// FakeResolved is a fake systemd-resolved on a FakeBus. It keeps the
+// per-link settings made through its Manager interface, and serves
+// them as the properties of its Link objects.
+type FakeResolved struct {
+	bus *FakeBus
+
+	mu       sync.Mutex
+	links    map[int]*FakeResolvedLink
+	failures map[string]error // by method name
+}
+
+// A FakeResolvedLink is the settings of a link in a FakeResolved. A
+// link that was never set, or was reverted, has the zero settings.
+type FakeResolvedLink struct {
+	DNS          []netip.Addr
+	Domains      []FakeResolvedDomain
+	DefaultRoute bool
+	LLMNR        string
+	MulticastDNS string
+	DNSSEC       string
+	DNSOverTLS   string
+}
+
+// A FakeResolvedDomain is a domain of a FakeResolvedLink.
+type FakeResolvedDomain struct {
+	Domain      string
+	RoutingOnly bool
+}
+
+// NewFakeResolved starts a FakeResolved on bus.
+func NewFakeResolved(bus *FakeBus) *FakeResolved {
+	r := &FakeResolved{
+		bus:      bus,
+		links:    map[int]*FakeResolvedLink{},
+		failures: map[string]error{},
+	}
+	bus.SetProperty(dbusResolvedObject, dbusResolvedPath, dbusResolvedInterface, "ResolvConfMode", "stub")
+	for _, method := range []string{
+		"GetLink", "SetLinkDNS", "SetLinkDomains", "SetLinkDefaultRoute",
+		"SetLinkLLMNR", "SetLinkMulticastDNS", "SetLinkDNSSEC", "SetLinkDNSOverTLS",
+		"RevertLink", "FlushCaches",
+	} {
+		method := method
+		bus.Handle(dbusResolvedObject, dbusResolvedInterface+"."+method, func(_ context.Context, _ dbus.ObjectPath, args []any) ([]any, error) {
+			return r.call(method, args)
+		})
+	}
+	bus.Handle(dbusResolvedObject, dbusPropertiesInterface+".Get", r.getLinkProperty)
+	bus.Own(dbusResolvedObject)
+	return r
+}
+
+// Fail makes the calls of the Manager method, such as "SetLinkDomains",
+// fail with err, or succeed again if err is nil.
+func (r *FakeResolved) Fail(method string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		delete(r.failures, method)
+		return
+	}
+	r.failures[method] = err
+}
+
+// Restart restarts r, which forgets the settings of all links, and
+// changes the owner of its bus name.
+func (r *FakeResolved) Restart() {
+	r.bus.Release(dbusResolvedObject)
+	r.mu.Lock()
+	r.links = map[int]*FakeResolvedLink{}
+	r.mu.Unlock()
+	r.bus.Own(dbusResolvedObject)
+}
+
+// Link returns the settings of the link with index ifidx.
+func (r *FakeResolved) Link(ifidx int) FakeResolvedLink {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if l := r.links[ifidx]; l != nil {
+		return *l
+	}
+	return FakeResolvedLink{}
+}
+
+// fakeResolvedLinkPath is the object path of the link with index ifidx.
+// Like resolved, it escapes the leading digit, as "_3" and its hex
+// code's last digit.
+func fakeResolvedLinkPath(ifidx int) dbus.ObjectPath {
+	return dbusResolvedPath + dbus.ObjectPath("/link/_3"+strconv.Itoa(ifidx))
+}
+
+func (r *FakeResolved) call(method string, args []any) ([]any, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.failures[method]; err != nil {
+		return nil, err
+	}
+	if method == "FlushCaches" {
+		return nil, nil
+	}
+	if len(args) == 0 {
+		return nil, dbus.ErrMsgInvalidArg
+	}
+	var ifidx int
+	switch v := args[0].(type) {
+	case int:
+		ifidx = v
+	case int32:
+		ifidx = int(v)
+	default:
+		return nil, dbus.ErrMsgInvalidArg
+	}
+	if method == "RevertLink" {
+		delete(r.links, ifidx)
+		return nil, nil
+	}
+	if method == "GetLink" {
+		return []any{fakeResolvedLinkPath(ifidx)}, nil
+	}
+	if len(args) != 2 {
+		return nil, dbus.ErrMsgInvalidArg
+	}
+	l := r.links[ifidx]
+	if l == nil {
+		l = new(FakeResolvedLink)
+		r.links[ifidx] = l
+	}
+	var err error
+	switch method {
+	case "SetLinkDNS":
+		var servers []resolvedLinkNameserver
+		if err = dbus.Store(args[1:], &servers); err == nil {
+			l.DNS = nil
+			for _, s := range servers {
+				ip, ok := netip.AddrFromSlice(s.Address)
+				if !ok {
+					return nil, dbus.ErrMsgInvalidArg
+				}
+				l.DNS = append(l.DNS, ip)
+			}
+		}
+	case "SetLinkDomains":
+		var domains []resolvedLinkDomain
+		if err = dbus.Store(args[1:], &domains); err == nil {
+			l.Domains = nil
+			for _, d := range domains {
+				l.Domains = append(l.Domains, FakeResolvedDomain(d))
+			}
+		}
+	case "SetLinkDefaultRoute":
+		err = dbus.Store(args[1:], &l.DefaultRoute)
+	case "SetLinkLLMNR":
+		err = dbus.Store(args[1:], &l.LLMNR)
+	case "SetLinkMulticastDNS":
+		err = dbus.Store(args[1:], &l.MulticastDNS)
+	case "SetLinkDNSSEC":
+		err = dbus.Store(args[1:], &l.DNSSEC)
+	case "SetLinkDNSOverTLS":
+		err = dbus.Store(args[1:], &l.DNSOverTLS)
+	}
+	if err != nil {
+		return nil, dbus.ErrMsgInvalidArg
+	}
+	return nil, nil
+}
+
+// getLinkProperty serves the properties of the Link objects.
+func (r *FakeResolved) getLinkProperty(_ context.Context, path dbus.ObjectPath, args []any) ([]any, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var l FakeResolvedLink
+	for idx, ll := range r.links {
+		if fakeResolvedLinkPath(idx) == path {
+			l = *ll
+		}
+	}
+	if len(args) != 2 || args[0] != dbusResolvedLinkInterface {
+		return nil, errFakeUnknownProperty
+	}
+	var v any
+	switch args[1] {
+	case "DNS":
+		dns := []resolvedLinkNameserver{}
+		for _, ip := range l.DNS {
+			if ip.Is4() {
+				dns = append(dns, resolvedLinkNameserver{Family: unix.AF_INET, Address: ip.AsSlice()})
+			} else {
+				dns = append(dns, resolvedLinkNameserver{Family: unix.AF_INET6, Address: ip.AsSlice()})
+			}
+		}
+		v = dns
+	case "Domains":
+		domains := []resolvedLinkDomain{}
+		for _, d := range l.Domains {
+			domains = append(domains, resolvedLinkDomain(d))
+		}
+		v = domains
+	case "DefaultRoute":
+		v = l.DefaultRoute
+	default:
+		return nil, errFakeUnknownProperty
+	}
+	return []any{dbus.MakeVariant(v)}, nil
+}
+
+// FakeNetworkManager is a fake NetworkManager on a FakeBus. It keeps
+// the applied connection of each device added with AddDevice, which
+// its Reapply method replaces.
+type FakeNetworkManager struct {
+	bus *FakeBus
+
+	mu       sync.Mutex
+	devices  map[string]*fakeNMDevice // by interface name
+	failures map[string]error         // by method name
+}
+
+type fakeNMDevice struct {
+	path     dbus.ObjectPath
+	settings nmConnectionSettings
+	version  uint64
+}
+
+// NewFakeNetworkManager starts a FakeNetworkManager of the given
+// version on bus, whose DNS processing mode, such as "systemd-resolved"
+// or "default", is dnsMode.
+func NewFakeNetworkManager(bus *FakeBus, version, dnsMode string) *FakeNetworkManager {
+	nm := &FakeNetworkManager{
+		bus:      bus,
+		devices:  map[string]*fakeNMDevice{},
+		failures: map[string]error{},
+	}
+	bus.SetProperty(dbusNMObject, dbusNMPath, dbusNMInterface, "Version", version)
+	bus.SetProperty(dbusNMObject, dbusNMDNSPath, dbusNMDNSInterface, "Mode", dnsMode)
+	bus.SetProperty(dbusNMObject, dbusNMDNSPath, dbusNMDNSInterface, "Configuration", []map[string]dbus.Variant{})
+	bus.Handle(dbusNMObject, dbusNMInterface+".GetDeviceByIpIface", nm.getDeviceByIPIface)
+	bus.Handle(dbusNMObject, dbusNMDevice+".GetAppliedConnection", nm.getAppliedConnection)
+	bus.Handle(dbusNMObject, dbusNMDevice+".Reapply", nm.reapply)
+	bus.Own(dbusNMObject)
+	return nm
+}
+
+// AddDevice adds a device for the interface named ifName, with an
+// active connection that has no DNS settings.
+func (nm *FakeNetworkManager) AddDevice(ifName string) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	nm.devices[ifName] = &fakeNMDevice{
+		path: dbusNMPath + dbus.ObjectPath("/Devices/"+strconv.Itoa(len(nm.devices)+1)),
+		settings: nmConnectionSettings{
+			"connection": {"interface-name": dbus.MakeVariant(ifName)},
+			// NetworkManager returns the deprecated addresses,
+			// but rejects them in Reapply.
+			"ipv4": {"method": dbus.MakeVariant("manual"), "addresses": dbus.MakeVariant([][]uint32{})},
+			"ipv6": {"method": dbus.MakeVariant("ignore")},
+		},
+		version: 1,
+	}
+}
+
+// Fail makes the calls of the method, such as "Reapply", fail with err,
+// or succeed again if err is nil.
+func (nm *FakeNetworkManager) Fail(method string, err error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if err == nil {
+		delete(nm.failures, method)
+		return
+	}
+	nm.failures[method] = err
+}
+
+// SetDNSConfiguration sets the DNS configuration of all devices that
+// NetworkManager reports, as read by GetBaseConfig.
+func (nm *FakeNetworkManager) SetDNSConfiguration(cfgs []map[string]dbus.Variant) {
+	nm.bus.SetProperty(dbusNMObject, dbusNMDNSPath, dbusNMDNSInterface, "Configuration", cfgs)
+}
+
+// Applied returns the applied connection of the device of the interface
+// named ifName, and its version, which Reapply increments.
+func (nm *FakeNetworkManager) Applied(ifName string) (settings map[string]map[string]dbus.Variant, version uint64) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	d := nm.devices[ifName]
+	if d == nil {
+		return nil, 0
+	}
+	return copyNMSettings(d.settings), d.version
+}
+
+// copyNMSettings returns a copy of s, so that changes to it don't
+// change s.
+func copyNMSettings(s nmConnectionSettings) nmConnectionSettings {
+	ret := nmConnectionSettings{}
+	for k, m := range s {
+		ret[k] = map[string]dbus.Variant{}
+		for kk, v := range m {
+			ret[k][kk] = v
+		}
+	}
+	return ret
+}
+
+// deviceLocked returns the device at path, or the error of method, if
+// any.
+// nm.mu must be held.
+func (nm *FakeNetworkManager) deviceLocked(method string, path dbus.ObjectPath) (*fakeNMDevice, error) {
+	if err := nm.failures[method]; err != nil {
+		return nil, err
+	}
+	for _, d := range nm.devices {
+		if d.path == path {
+			return d, nil
+		}
+	}
+	return nil, dbus.Error{Name: "org.freedesktop.DBus.Error.UnknownObject", Body: []any{"No such object path " + string(path)}}
+}
+
+func (nm *FakeNetworkManager) getDeviceByIPIface(_ context.Context, _ dbus.ObjectPath, args []any) ([]any, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	if err := nm.failures["GetDeviceByIpIface"]; err != nil {
+		return nil, err
+	}
+	var name string
+	if err := dbus.Store(args, &name); err != nil {
+		return nil, dbus.ErrMsgInvalidArg
+	}
+	d := nm.devices[name]
+	if d == nil {
+		return nil, dbus.Error{Name: "org.freedesktop.NetworkManager.UnknownDevice", Body: []any{"No device found for the requested iface."}}
+	}
+	return []any{d.path}, nil
+}
+
+func (nm *FakeNetworkManager) getAppliedConnection(_ context.Context, path dbus.ObjectPath, _ []any) ([]any, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	d, err := nm.deviceLocked("GetAppliedConnection", path)
+	if err != nil {
+		return nil, err
+	}
+	return []any{copyNMSettings(d.settings), d.version}, nil
+}
+
+func (nm *FakeNetworkManager) reapply(_ context.Context, path dbus.ObjectPath, args []any) ([]any, error) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	d, err := nm.deviceLocked("Reapply", path)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		settings nmConnectionSettings
+		version  uint64
+		flags    uint32
+	)
+	if err := dbus.Store(args, &settings, &version, &flags); err != nil {
+		return nil, dbus.ErrMsgInvalidArg
+	}
+	if version != d.version {
+		return nil, dbus.Error{Name: "org.freedesktop.NetworkManager.Device.VersionIdMismatch", Body: []any{"Version id mismatch"}}
+	}
+	for _, ip := range []string{"ipv4", "ipv6"} {
+		for _, p := range []string{"addresses", "routes"} {
+			if _, ok := settings[ip][p]; ok {
+				return nil, dbus.Error{Name: "org.freedesktop.NetworkManager.Device.InvalidConnection", Body: []any{ip + "." + p + ": deprecated"}}
+			}
+		}
+	}
+	d.settings = copyNMSettings(settings)
+	d.version++
+	return nil, nil
+}
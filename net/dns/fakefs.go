@@ -0,0 +1,376 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FakeFS is an in-memory WholeFileFS for tests. It can inject the
+// failures of the file systems found in the wild, such as the
+// bind-mounted /etc/resolv.conf of containers, and it logs the
+// operations made on it. The zero value is an empty file system.
+//
+// Directories aren't kept: any name can be written, and a name is a
+// directory if it's a prefix of some file's.
+type FakeFS struct {
+	mu      sync.Mutex
+	files   map[string]*fakeFile
+	bound   map[string]bool
+	faults  []*fakeFSFault
+	limited bool // whether free applies
+	free    int  // bytes left for writes, if limited
+	ops     []FakeFSOp
+}
+
+type fakeFile struct {
+	data []byte
+	perm os.FileMode
+}
+
+// A FakeFSFault is a failure that a FakeFS injects in the operations it
+// matches.
+type FakeFSFault struct {
+	// Op is the WholeFileFS method matched, such as "Rename". Empty
+	// matches all of them.
+	Op string
+	// Path is a path.Match pattern of the names matched, either of
+	// them for Rename. Empty matches all names.
+	Path string
+	// Times is how many operations fail, after which the fault is
+	// gone. Zero means forever.
+	Times int
+
+	// Err is the error that the operations fail with, usually a
+	// syscall.Errno, such as syscall.EXDEV or syscall.EPERM. It's
+	// wrapped in an *fs.PathError or *os.LinkError, as by the os
+	// package. If nil, the operations succeed after Delay.
+	Err error
+	// Delay is how long the operations take, failing or not, as on
+	// a slow file system.
+	Delay time.Duration
+
+	// Partial, for WriteFile, makes the write fail partway through:
+	// the file is truncated and left with the first Written bytes.
+	// Otherwise, the file is left as it was, as when it can't be
+	// opened.
+	Partial bool
+	Written int
+}
+
+type fakeFSFault struct {
+	FakeFSFault
+	left int // of Times
+}
+
+// matches reports whether f applies to the operation op on names.
+func (f *fakeFSFault) matches(op string, names ...string) bool {
+	if f.Op != "" && f.Op != op {
+		return false
+	}
+	if f.Path == "" {
+		return true
+	}
+	for _, name := range names {
+		if ok, _ := path.Match(f.Path, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// A FakeFSOp is an operation made on a FakeFS.
+type FakeFSOp struct {
+	Op      string // the WholeFileFS method, such as "Rename"
+	Name    string
+	NewName string // for Rename
+	Err     error  // the error returned
+}
+
+func (o FakeFSOp) String() string {
+	s := o.Op + " " + o.Name
+	if o.NewName != "" {
+		s += " " + o.NewName
+	}
+	if o.Err != nil {
+		s += ": " + o.Err.Error()
+	}
+	return s
+}
+
+// Inject makes f fail, or slow down, the operations that fault
+// matches. The earliest injected fault that matches applies.
+func (f *FakeFS) Inject(fault FakeFSFault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &fakeFSFault{fault, fault.Times})
+}
+
+// BindMount makes the file name act like a file bind-mounted into a
+// container, as /etc/resolv.conf is by Docker: it can be read and
+// written, but renaming it, renaming another file over it, or removing
+// it fails with EBUSY.
+func (f *FakeFS) BindMount(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.bound == nil {
+		f.bound = map[string]bool{}
+	}
+	f.bound[name] = true
+}
+
+// SetFreeSpace limits the bytes that writes can add to n, as on a disk
+// that's almost full. A write that doesn't fit fails partway through
+// with ENOSPC. Writes over a file, or removing it, free its bytes. A
+// negative n removes the limit, as in the zero FakeFS.
+func (f *FakeFS) SetFreeSpace(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.limited = n >= 0
+	f.free = n
+}
+
+// SetFile sets the contents of the file name, bypassing faults and the
+// operation log.
+func (f *FakeFS) SetFile(name string, contents []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.files == nil {
+		f.files = map[string]*fakeFile{}
+	}
+	f.files[name] = &fakeFile{data: append([]byte(nil), contents...), perm: 0644}
+}
+
+// File returns the contents of the file name, if it exists, bypassing
+// faults and the operation log.
+func (f *FakeFS) File(name string) (contents []byte, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ff := f.files[name]
+	if ff == nil {
+		return nil, false
+	}
+	return append([]byte(nil), ff.data...), true
+}
+
+// Files returns the names of the files, sorted.
+func (f *FakeFS) Files() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ret []string
+	for name := range f.files {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Ops returns the operations made so far, in order.
+func (f *FakeFS) Ops() []FakeFSOp {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeFSOp(nil), f.ops...)
+}
+
+// fault returns the fault of the operation op on names, if any, after
+// its delay. It locks f.mu, which the caller must unlock.
+func (f *FakeFS) fault(op string, names ...string) *FakeFSFault {
+	f.mu.Lock()
+	var ret *FakeFSFault
+	for i, ff := range f.faults {
+		if !ff.matches(op, names...) {
+			continue
+		}
+		fault := ff.FakeFSFault
+		ret = &fault
+		if ff.Times > 0 {
+			ff.left--
+			if ff.left == 0 {
+				f.faults = append(f.faults[:i:i], f.faults[i+1:]...)
+			}
+		}
+		break
+	}
+	if ret != nil && ret.Delay > 0 {
+		f.mu.Unlock()
+		time.Sleep(ret.Delay)
+		f.mu.Lock()
+	}
+	return ret
+}
+
+// logLocked logs the operation op on names, which returned err, and
+// returns err. f.mu must be held.
+func (f *FakeFS) logLocked(err error, op string, names ...string) error {
+	o := FakeFSOp{Op: op, Name: names[0], Err: err}
+	if len(names) > 1 {
+		o.NewName = names[1]
+	}
+	f.ops = append(f.ops, o)
+	return err
+}
+
+// pathError returns the error of the os package's op on name.
+func pathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// isDirLocked reports whether name is a directory. f.mu must be held.
+func (f *FakeFS) isDirLocked(name string) bool {
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for n := range f.files {
+		if strings.HasPrefix(n, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *FakeFS) Stat(name string) (isRegular bool, err error) {
+	fault := f.fault("Stat", name)
+	defer f.mu.Unlock()
+	switch {
+	case fault != nil && fault.Err != nil:
+		err = pathError("stat", name, fault.Err)
+	case f.files[name] != nil:
+		isRegular = true
+	case !f.isDirLocked(name):
+		err = pathError("stat", name, syscall.ENOENT)
+	}
+	return isRegular, f.logLocked(err, "Stat", name)
+}
+
+func (f *FakeFS) Rename(oldName, newName string) error {
+	fault := f.fault("Rename", oldName, newName)
+	defer f.mu.Unlock()
+	linkError := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: err}
+	}
+	var err error
+	switch {
+	case fault != nil && fault.Err != nil:
+		err = linkError(fault.Err)
+	case f.files[oldName] == nil:
+		err = linkError(syscall.ENOENT)
+	case f.bound[oldName] || f.bound[newName]:
+		err = linkError(syscall.EBUSY)
+	case oldName != newName:
+		if old := f.files[newName]; old != nil && f.limited {
+			f.free += len(old.data)
+		}
+		f.files[newName] = f.files[oldName]
+		delete(f.files, oldName)
+	}
+	return f.logLocked(err, "Rename", oldName, newName)
+}
+
+func (f *FakeFS) Remove(name string) error {
+	fault := f.fault("Remove", name)
+	defer f.mu.Unlock()
+	var err error
+	switch {
+	case fault != nil && fault.Err != nil:
+		err = pathError("remove", name, fault.Err)
+	case f.files[name] == nil:
+		err = pathError("remove", name, syscall.ENOENT)
+	case f.bound[name]:
+		err = pathError("remove", name, syscall.EBUSY)
+	default:
+		if f.limited {
+			f.free += len(f.files[name].data)
+		}
+		delete(f.files, name)
+	}
+	return f.logLocked(err, "Remove", name)
+}
+
+func (f *FakeFS) ReadFile(name string) ([]byte, error) {
+	fault := f.fault("ReadFile", name)
+	defer f.mu.Unlock()
+	var (
+		ret []byte
+		err error
+	)
+	switch {
+	case fault != nil && fault.Err != nil:
+		err = pathError("open", name, fault.Err)
+	case f.files[name] == nil:
+		err = pathError("open", name, syscall.ENOENT)
+	default:
+		ret = append([]byte(nil), f.files[name].data...)
+	}
+	return ret, f.logLocked(err, "ReadFile", name)
+}
+
+func (f *FakeFS) Truncate(name string) error {
+	fault := f.fault("Truncate", name)
+	defer f.mu.Unlock()
+	var err error
+	switch {
+	case fault != nil && fault.Err != nil:
+		err = pathError("truncate", name, fault.Err)
+	case f.files[name] == nil:
+		err = pathError("truncate", name, syscall.ENOENT)
+	default:
+		f.writeLocked(name, nil, 0)
+	}
+	return f.logLocked(err, "Truncate", name)
+}
+
+func (f *FakeFS) WriteFile(name string, contents []byte, perm os.FileMode) error {
+	fault := f.fault("WriteFile", name)
+	defer f.mu.Unlock()
+	var err error
+	switch {
+	case fault != nil && fault.Err != nil && !fault.Partial:
+		err = pathError("open", name, fault.Err)
+	case fault != nil && fault.Err != nil:
+		n := fault.Written
+		if n > len(contents) {
+			n = len(contents)
+		}
+		if !f.writeLocked(name, contents[:n], perm) {
+			err = pathError("write", name, syscall.ENOSPC)
+		} else {
+			err = pathError("write", name, fault.Err)
+		}
+	default:
+		if !f.writeLocked(name, contents, perm) {
+			err = pathError("write", name, syscall.ENOSPC)
+		}
+	}
+	return f.logLocked(err, "WriteFile", name)
+}
+
+// writeLocked replaces the contents of the file name with as much of
+// contents as fits in the free space, creating it with perm if needed.
+// It reports whether all of contents fit. f.mu must be held.
+func (f *FakeFS) writeLocked(name string, contents []byte, perm os.FileMode) bool {
+	if f.files == nil {
+		f.files = map[string]*fakeFile{}
+	}
+	ff := f.files[name]
+	if ff == nil {
+		ff = &fakeFile{perm: perm}
+		f.files[name] = ff
+	}
+	fits := true
+	if f.limited {
+		f.free += len(ff.data)
+		if len(contents) > f.free {
+			contents = contents[:f.free]
+			fits = false
+		}
+		f.free -= len(contents)
+	}
+	ff.data = append([]byte(nil), contents...)
+	return fits
+}
@@ -0,0 +1,142 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFakeFS(t *testing.T) {
+	fs := new(FakeFS)
+	if err := fs.WriteFile("/etc/a", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if isRegular, err := fs.Stat("/etc"); err != nil || isRegular {
+		t.Errorf("Stat of a directory = %v, %v; want false, nil", isRegular, err)
+	}
+	if _, err := fs.Stat("/etc/b"); !os.IsNotExist(err) {
+		t.Errorf("Stat of a missing file = %v; want it not to exist", err)
+	}
+	if err := fs.Rename("/etc/a", "/etc/b"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.ReadFile("/etc/b"); err != nil || string(got) != "a" {
+		t.Errorf("ReadFile after Rename = %q, %v", got, err)
+	}
+	if err := fs.Truncate("/etc/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("/etc/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("/etc/b"); !os.IsNotExist(err) {
+		t.Errorf("second Remove = %v; want it not to exist", err)
+	}
+
+	var got []string
+	for _, op := range fs.Ops() {
+		got = append(got, op.String())
+	}
+	want := []string{
+		"WriteFile /etc/a",
+		"Stat /etc",
+		"Stat /etc/b: stat /etc/b: no such file or directory",
+		"Rename /etc/a /etc/b",
+		"ReadFile /etc/b",
+		"Truncate /etc/b",
+		"Remove /etc/b",
+		"Remove /etc/b: remove /etc/b: no such file or directory",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ops:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestFakeFSBindMount(t *testing.T) {
+	fs := new(FakeFS)
+	fs.SetFile("/etc/resolv.conf", []byte("old"))
+	fs.SetFile("/etc/resolv.conf.tmp", []byte("new"))
+	fs.BindMount("/etc/resolv.conf")
+
+	if err := fs.Rename("/etc/resolv.conf.tmp", "/etc/resolv.conf"); !errors.Is(err, syscall.EBUSY) {
+		t.Errorf("Rename over it = %v; want EBUSY", err)
+	}
+	if err := fs.Remove("/etc/resolv.conf"); !errors.Is(err, syscall.EBUSY) {
+		t.Errorf("Remove = %v; want EBUSY", err)
+	}
+	if err := fs.WriteFile("/etc/resolv.conf", []byte("new"), 0644); err != nil {
+		t.Errorf("WriteFile = %v; want it to work", err)
+	}
+}
+
+func TestFakeFSFaults(t *testing.T) {
+	fs := new(FakeFS)
+	fs.SetFile("/etc/resolv.conf", []byte("old"))
+	fs.Inject(FakeFSFault{Op: "Rename", Path: "/etc/*", Times: 1, Err: syscall.EXDEV})
+	fs.Inject(FakeFSFault{Op: "WriteFile", Path: "/etc/hosts", Err: syscall.EPERM})
+	fs.Inject(FakeFSFault{Op: "WriteFile", Path: "/etc/resolv.conf", Times: 1, Err: syscall.EIO, Partial: true, Written: 2})
+
+	err := fs.Rename("/etc/resolv.conf", "/etc/resolv.bak")
+	var lerr *os.LinkError
+	if !errors.As(err, &lerr) || !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("Rename = %v; want a LinkError of EXDEV", err)
+	}
+	if err := fs.Rename("/etc/resolv.conf", "/etc/resolv.bak"); err != nil {
+		t.Errorf("Rename after the fault's Times = %v", err)
+	}
+
+	if err := fs.WriteFile("/etc/hosts", []byte("x"), 0644); !errors.Is(err, syscall.EPERM) {
+		t.Errorf("WriteFile = %v; want EPERM", err)
+	}
+	if _, ok := fs.File("/etc/hosts"); ok {
+		t.Error("file created by a write that couldn't open it")
+	}
+
+	if err := fs.WriteFile("/etc/resolv.conf", []byte("partial"), 0644); !errors.Is(err, syscall.EIO) {
+		t.Errorf("partial WriteFile = %v; want EIO", err)
+	}
+	if got, _ := fs.File("/etc/resolv.conf"); string(got) != "pa" {
+		t.Errorf("after a partial write, file = %q; want %q", got, "pa")
+	}
+}
+
+func TestFakeFSFreeSpace(t *testing.T) {
+	fs := new(FakeFS)
+	fs.SetFreeSpace(8)
+	if err := fs.WriteFile("/a", []byte("12345"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/b", []byte("12345"), 0644); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("WriteFile past the free space = %v; want ENOSPC", err)
+	}
+	if got, _ := fs.File("/b"); string(got) != "123" {
+		t.Errorf("file written partway = %q; want %q", got, "123")
+	}
+
+	// Removing a file frees its space.
+	if err := fs.Remove("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile("/b", []byte("12345"), 0644); err != nil {
+		t.Errorf("WriteFile after freeing space = %v", err)
+	}
+}
+
+func TestFakeFSDelay(t *testing.T) {
+	fs := new(FakeFS)
+	const delay = 20 * time.Millisecond
+	fs.Inject(FakeFSFault{Op: "WriteFile", Delay: delay})
+	start := time.Now()
+	if err := fs.WriteFile("/a", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < delay {
+		t.Errorf("slow WriteFile took %v; want at least %v", d, delay)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sync"
+)
+
+// FakeRunner is a CommandRunner for tests that runs nothing. It answers
+// each command with the responses scripted for its command line by On,
+// and fails the others as if the program were missing.
+type FakeRunner struct {
+	// Paths are the paths LookPath returns, by program name.
+	// Programs with scripted responses are found too, at their own
+	// name.
+	Paths map[string]string
+
+	mu        sync.Mutex
+	responses map[string][]FakeResponse // by Command.String
+	calls     []Command
+}
+
+// A FakeResponse is how a FakeRunner answers a command.
+type FakeResponse struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+
+	// Func, if non-nil, is called with the command, such as to look
+	// at its standard input, and its result is used instead of the
+	// fields above.
+	Func func(Command) CommandResult
+}
+
+// On scripts the responses to the command line cmdline, as formatted by
+// Command.String, such as "resolvconf -d tun0". Successive runs get
+// successive responses, and the last one is repeated.
+func (f *FakeRunner) On(cmdline string, resps ...FakeResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.responses == nil {
+		f.responses = map[string][]FakeResponse{}
+	}
+	f.responses[cmdline] = append(f.responses[cmdline], resps...)
+}
+
+// Calls returns the commands run so far, in order.
+func (f *FakeRunner) Calls() []Command {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Command(nil), f.calls...)
+}
+
+func (f *FakeRunner) LookPath(file string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p, ok := f.Paths[file]; ok {
+		return p, nil
+	}
+	for cmdline := range f.responses {
+		if cmdline == file || len(cmdline) > len(file) && cmdline[:len(file)+1] == file+" " {
+			return file, nil
+		}
+	}
+	return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+}
+
+func (f *FakeRunner) Run(ctx context.Context, c Command) (CommandResult, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, c)
+	resps := f.responses[c.String()]
+	var resp FakeResponse
+	if len(resps) > 0 {
+		resp = resps[0]
+		if len(resps) > 1 {
+			f.responses[c.String()] = resps[1:]
+		}
+	}
+	f.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return CommandResult{ExitCode: -1}, err
+	}
+	if len(resps) == 0 {
+		return CommandResult{ExitCode: -1}, fmt.Errorf("fake runner: unexpected command %q", c)
+	}
+	res := CommandResult{Stdout: []byte(resp.Stdout), Stderr: []byte(resp.Stderr), ExitCode: resp.ExitCode}
+	if resp.Func != nil {
+		res = resp.Func(c)
+	}
+	if res.ExitCode != 0 {
+		return res, fmt.Errorf("exit status %d", res.ExitCode)
+	}
+	return res, nil
+}
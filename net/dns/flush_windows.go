@@ -3,17 +3,11 @@
 
 package dns
 
-import (
-	"fmt"
-	"os/exec"
-)
+import "context"
 
 func flushCaches() error {
-	out, err := exec.Command("ipconfig", "/flushdns").CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%v (output: %s)", err, out)
-	}
-	return nil
+	_, err := runCommand(context.Background(), nil, "ipconfig", "/flushdns")
+	return err
 }
 
 // Flush clears the local resolver cache.
@@ -0,0 +1,516 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anywherelan/ts-dns/types/logger"
+	"github.com/anywherelan/ts-dns/util/dnsname"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Limits and timeouts of the Forwarder.
+const (
+	// minUDPSize is the size of the UDP responses every client
+	// accepts, and the limit for those that don't say otherwise
+	// with EDNS0.
+	minUDPSize = 512
+	// maxMessageSize is the largest DNS message, over TCP.
+	maxMessageSize = 65535
+	// forwardTimeout bounds each attempt to get an answer from an
+	// upstream nameserver.
+	forwardTimeout = 2 * time.Second
+	// tcpIdleTimeout is how long a TCP client connection is kept
+	// open without queries.
+	tcpIdleTimeout = 10 * time.Second
+	// hostsTTL is the TTL of the answers from the hosts set with
+	// SetHosts.
+	hostsTTL = 60
+	// maxUDPHandlers bounds the UDP queries handled at once. Beyond
+	// it, the Forwarder stops reading until one is done, and bursts
+	// are left to the socket's buffer.
+	maxUDPHandlers = 64
+)
+
+// messageBufs holds buffers of maxMessageSize bytes, as *[]byte.
+var messageBufs = sync.Pool{New: func() any {
+	b := make([]byte, maxMessageSize)
+	return &b
+}}
+
+// A Forwarder is an in-process DNS stub that forwards each query it
+// receives, over UDP or TCP, to the upstream nameservers of the longest
+// route matching the queried name, or to the fallback nameservers if
+// none matches. Responses are passed back as they are; if a UDP
+// response is too large for the client, it's truncated so that the
+// client retries over TCP. Names set with SetHosts are answered
+// locally instead, so they resolve even when no upstream does.
+//
+// It gives split DNS to OS configurations that only have a list of
+// nameservers, such as resolv.conf.
+type Forwarder struct {
+	logf logger.Logf
+	udp  net.PacketConn
+	tcp  net.Listener
+	wg   sync.WaitGroup
+
+	// udpHandlers has a token for each UDP query being handled.
+	udpHandlers chan struct{}
+
+	// timeout is forwardTimeout, unless changed by tests.
+	timeout time.Duration
+
+	mu       sync.Mutex
+	routes   []forwardRoute // most specific first
+	fallback []netip.AddrPort
+	hosts    map[dnsname.FQDN][]netip.Addr
+	conns    map[net.Conn]bool // open TCP client connections
+	closed   bool
+}
+
+type forwardRoute struct {
+	domain    dnsname.FQDN
+	upstreams []netip.AddrPort
+}
+
+// ListenForwarder returns a Forwarder serving UDP and TCP on addr. If
+// addr's port is zero, one is picked. It forwards nothing until
+// SetRoutes is called.
+func ListenForwarder(logf logger.Logf, addr netip.AddrPort) (*Forwarder, error) {
+	udp, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+	if err != nil {
+		return nil, err
+	}
+	// Use the same port for TCP, in case it was picked for UDP.
+	tcpAddr := netip.AddrPortFrom(addr.Addr(), udp.LocalAddr().(*net.UDPAddr).AddrPort().Port())
+	tcp, err := net.ListenTCP("tcp", net.TCPAddrFromAddrPort(tcpAddr))
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	f := &Forwarder{
+		logf:        logger.WithPrefix(logf, "dns: forwarder: "),
+		udp:         udp,
+		tcp:         tcp,
+		timeout:     forwardTimeout,
+		udpHandlers: make(chan struct{}, maxUDPHandlers),
+		conns:       map[net.Conn]bool{},
+	}
+	f.wg.Add(2)
+	go f.serveUDP()
+	go f.serveTCP()
+	return f, nil
+}
+
+// Addr returns the address f serves on.
+func (f *Forwarder) Addr() netip.AddrPort {
+	return f.udp.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// SetRoutes replaces f's routes. Queries for names within a domain of
+// routes go to its upstreams, tried in order; all others go to
+// fallback. With no fallback, they fail.
+func (f *Forwarder) SetRoutes(routes map[dnsname.FQDN][]netip.AddrPort, fallback []netip.AddrPort) {
+	var rs []forwardRoute
+	for d, ups := range routes {
+		rs = append(rs, forwardRoute{domain: d, upstreams: ups})
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		if a, b := rs[i].domain.NumLabels(), rs[j].domain.NumLabels(); a != b {
+			return a > b
+		}
+		return rs[i].domain < rs[j].domain
+	})
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.routes = rs
+	f.fallback = fallback
+}
+
+// SetHosts replaces the hosts that f answers for itself.
+func (f *Forwarder) SetHosts(hosts []*HostEntry) {
+	m := map[dnsname.FQDN][]netip.Addr{}
+	for _, he := range hosts {
+		for _, h := range he.Hosts {
+			fqdn, err := dnsname.ToFQDN(strings.ToLower(h))
+			if err != nil {
+				continue
+			}
+			m[fqdn] = append(m[fqdn], he.Addr)
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hosts = m
+}
+
+// hostAddrs returns the addresses of name set with SetHosts, and
+// whether it has any.
+func (f *Forwarder) hostAddrs(name dnsname.FQDN) ([]netip.Addr, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	addrs, ok := f.hosts[name]
+	return addrs, ok
+}
+
+// upstreamsFor returns the upstream nameservers for name.
+func (f *Forwarder) upstreamsFor(name dnsname.FQDN) []netip.AddrPort {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.routes {
+		if r.domain.Contains(name) {
+			return r.upstreams
+		}
+	}
+	return f.fallback
+}
+
+// Close stops f and closes its listeners and connections.
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	for c := range f.conns {
+		c.Close()
+	}
+	f.mu.Unlock()
+	err := errors.Join(f.udp.Close(), f.tcp.Close())
+	f.wg.Wait()
+	return err
+}
+
+func (f *Forwarder) serveUDP() {
+	defer f.wg.Done()
+	for {
+		buf := messageBufs.Get().(*[]byte)
+		n, addr, err := f.udp.ReadFrom(*buf)
+		if err != nil {
+			messageBufs.Put(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			f.logf("reading UDP: %v", err)
+			continue
+		}
+		f.udpHandlers <- struct{}{}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer func() { <-f.udpHandlers }()
+			// The response may share buf, so it's only put back
+			// once sent.
+			defer messageBufs.Put(buf)
+			resp := f.forward("udp", (*buf)[:n])
+			if resp == nil {
+				return
+			}
+			if _, err := f.udp.WriteTo(resp, addr); err != nil && !errors.Is(err, net.ErrClosed) {
+				f.logf("replying to %v: %v", addr, err)
+			}
+		}()
+	}
+}
+
+func (f *Forwarder) serveTCP() {
+	defer f.wg.Done()
+	for {
+		c, err := f.tcp.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			f.logf("accepting TCP: %v", err)
+			continue
+		}
+		f.mu.Lock()
+		if f.closed {
+			f.mu.Unlock()
+			c.Close()
+			return
+		}
+		f.conns[c] = true
+		f.mu.Unlock()
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			f.handleTCP(c)
+			f.mu.Lock()
+			delete(f.conns, c)
+			f.mu.Unlock()
+			c.Close()
+		}()
+	}
+}
+
+// handleTCP serves the queries of the TCP client on c, one at a time,
+// until it goes idle or away.
+func (f *Forwarder) handleTCP(c net.Conn) {
+	for {
+		c.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		query, err := readTCPMessage(c)
+		if err != nil {
+			return
+		}
+		resp := f.forward("tcp", query)
+		if resp == nil {
+			return
+		}
+		c.SetWriteDeadline(time.Now().Add(f.timeout))
+		if err := writeTCPMessage(c, resp); err != nil {
+			return
+		}
+	}
+}
+
+// forward returns the response to query, received over network, or nil
+// if it's not a query that can be answered at all.
+func (f *Forwarder) forward(network string, query []byte) []byte {
+	q, name, maxSize, err := parseQuery(query)
+	if err != nil {
+		return nil
+	}
+	if addrs, ok := f.hostAddrs(name); ok {
+		return hostsResponse(query, q, addrs)
+	}
+	if network == "tcp" {
+		maxSize = maxMessageSize
+	}
+	var errs []error
+	for _, up := range f.upstreamsFor(name) {
+		resp, err := f.exchange(network, up, query)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(resp) > maxSize {
+			return truncateResponse(resp)
+		}
+		return resp
+	}
+	if len(errs) > 0 {
+		f.logf("%s: %v", name, errors.Join(errs...))
+	}
+	return errorResponse(query, dnsmessage.RCodeServerFailure)
+}
+
+// exchange sends query to the nameserver at up over network, and
+// returns its response.
+func (f *Forwarder) exchange(network string, up netip.AddrPort, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, up.String())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	deadline, _ := ctx.Deadline()
+	c.SetDeadline(deadline)
+
+	if network == "tcp" {
+		if err := writeTCPMessage(c, query); err != nil {
+			return nil, err
+		}
+		resp, err := readTCPMessage(c)
+		if err != nil {
+			return nil, err
+		}
+		if !sameID(query, resp) {
+			return nil, fmt.Errorf("%v: response doesn't match the query", up)
+		}
+		return resp, nil
+	}
+
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+	buf := messageBufs.Get().(*[]byte)
+	defer messageBufs.Put(buf)
+	for {
+		n, err := c.Read(*buf)
+		if err != nil {
+			return nil, err
+		}
+		// Skip stray datagrams, such as late responses to
+		// earlier queries.
+		if sameID(query, (*buf)[:n]) {
+			return append([]byte(nil), (*buf)[:n]...), nil
+		}
+	}
+}
+
+// parseQuery returns the question of query, the name it asks about,
+// and the largest UDP response the client accepts.
+func parseQuery(query []byte) (q dnsmessage.Question, name dnsname.FQDN, maxUDPSize int, err error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return q, "", 0, err
+	}
+	if h.Response {
+		return q, "", 0, errors.New("not a query")
+	}
+	q, err = p.Question()
+	if err != nil {
+		return q, "", 0, err
+	}
+	name, err = dnsname.ToFQDN(strings.ToLower(q.Name.String()))
+	if err != nil {
+		return q, "", 0, err
+	}
+	maxUDPSize = minUDPSize
+	if err := p.SkipAllQuestions(); err != nil {
+		return q, name, maxUDPSize, nil
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return q, name, maxUDPSize, nil
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return q, name, maxUDPSize, nil
+	}
+	for {
+		rh, err := p.AdditionalHeader()
+		if err != nil {
+			break
+		}
+		if rh.Type == dnsmessage.TypeOPT {
+			// The OPT record's class is the client's UDP
+			// payload size.
+			if size := int(rh.Class); size > maxUDPSize {
+				maxUDPSize = size
+			}
+			break
+		}
+		if err := p.SkipAdditional(); err != nil {
+			break
+		}
+	}
+	return q, name, maxUDPSize, nil
+}
+
+// hostsResponse returns the authoritative response to query, whose
+// question is q, for a name with the addresses addrs. Queries for
+// types other than A and AAAA get no answers.
+func hostsResponse(query []byte, q dnsmessage.Question, addrs []netip.Addr) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	b.EnableCompression()
+	if b.StartQuestions() != nil || b.Question(q) != nil || b.StartAnswers() != nil {
+		return nil
+	}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: hostsTTL}
+	for _, a := range addrs {
+		var err error
+		switch {
+		case q.Type == dnsmessage.TypeA && a.Is4():
+			err = b.AResource(rh, dnsmessage.AResource{A: a.As4()})
+		case q.Type == dnsmessage.TypeAAAA && a.Is6() && !a.Is4In6():
+			err = b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: a.As16()})
+		}
+		if err != nil {
+			return nil
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// truncateResponse returns resp cut down to its header and question,
+// with the TC bit set, so the client retries over TCP.
+func truncateResponse(resp []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil
+	}
+	h.Truncated = true
+	return responseWithQuestions(h, &p)
+}
+
+// errorResponse returns a response to query with rcode and no answers.
+func errorResponse(query []byte, rcode dnsmessage.RCode) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	h.Response = true
+	h.RecursionAvailable = true
+	h.RCode = rcode
+	return responseWithQuestions(h, &p)
+}
+
+// responseWithQuestions returns a message with header h and the
+// questions left in p.
+func responseWithQuestions(h dnsmessage.Header, p *dnsmessage.Parser) []byte {
+	qs, err := p.AllQuestions()
+	if err != nil {
+		return nil
+	}
+	b := dnsmessage.NewBuilder(nil, h)
+	if err := b.StartQuestions(); err != nil {
+		return nil
+	}
+	for _, q := range qs {
+		if err := b.Question(q); err != nil {
+			return nil
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// sameID reports whether the DNS messages a and b have the same ID.
+func sameID(a, b []byte) bool {
+	return len(a) >= 2 && len(b) >= 2 && a[0] == b[0] && a[1] == b[1]
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	if len(msg) > maxMessageSize {
+		return errors.New("DNS message too large")
+	}
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,316 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anywherelan/ts-dns/util/dnsname"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// bigAnswers is the number of A records in the answers to "big" and
+// "huge" names, too many for a UDP response.
+const bigAnswers = 100
+
+// startUpstream runs a nameserver on the loopback interface, over UDP
+// and TCP, that answers A queries with addresses whose first three
+// bytes are those of prefix. Names starting with "big." get bigAnswers
+// addresses, and a truncated response over UDP; names starting with
+// "huge." get them over UDP too, ignoring the client's size limit.
+func startUpstream(t *testing.T, prefix netip.Addr) netip.AddrPort {
+	t.Helper()
+	answer := func(network string, query []byte) []byte {
+		var p dnsmessage.Parser
+		h, err := p.Start(query)
+		if err != nil {
+			return nil
+		}
+		q, err := p.Question()
+		if err != nil {
+			return nil
+		}
+		name := strings.ToLower(q.Name.String())
+		n := 1
+		if strings.HasPrefix(name, "big.") || strings.HasPrefix(name, "huge.") {
+			n = bigAnswers
+		}
+		h.Response = true
+		h.Truncated = network == "udp" && strings.HasPrefix(name, "big.")
+		if h.Truncated {
+			n = 0
+		}
+		b := dnsmessage.NewBuilder(nil, h)
+		b.StartQuestions()
+		b.Question(q)
+		b.StartAnswers()
+		for i := 0; i < n && q.Type == dnsmessage.TypeA; i++ {
+			a := prefix.As4()
+			a[3] = byte(i + 1)
+			b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: a})
+		}
+		resp, _ := b.Finish()
+		return resp
+	}
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udp.Close() })
+	addr := udp.LocalAddr().(*net.UDPAddr).AddrPort()
+	tcp, err := net.Listen("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			n, from, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := answer("udp", buf[:n]); resp != nil {
+				udp.WriteTo(resp, from)
+			}
+		}
+	}()
+	go func() {
+		for {
+			c, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				for {
+					query, err := readTCPMessage(c)
+					if err != nil {
+						return
+					}
+					if err := writeTCPMessage(c, answer("tcp", query)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return addr
+}
+
+// queryUDP sends a query without EDNS0 for the A records of name to
+// addr over UDP, and returns the response.
+func queryUDP(t *testing.T, addr netip.AddrPort, name string) (dnsmessage.Header, []byte) {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write(query); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, maxMessageSize)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p dnsmessage.Parser
+	h, err := p.Start(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h, buf[:n]
+}
+
+func TestForwarder(t *testing.T) {
+	fwd, err := ListenForwarder(t.Logf, netip.MustParseAddrPort("127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fwd.Close()
+	fwd.timeout = 500 * time.Millisecond
+
+	ours := startUpstream(t, netip.MustParseAddr("100.64.0.0"))
+	base := startUpstream(t, netip.MustParseAddr("192.168.1.0"))
+	fwd.SetRoutes(map[dnsname.FQDN][]netip.AddrPort{
+		"corp.example.": {ours},
+		// The more specific route wins over "corp.example.".
+		"lab.corp.example.": {base},
+	}, []netip.AddrPort{base})
+
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, fwd.Addr().String())
+		},
+	}
+	tests := []struct {
+		host   string
+		want   string // first address
+		wantN  int
+		useTCP bool
+	}{
+		{host: "a.corp.example.", want: "100.64.0.1", wantN: 1},
+		{host: "A.Corp.Example.", want: "100.64.0.1", wantN: 1},
+		{host: "corp.example.", want: "100.64.0.1", wantN: 1},
+		{host: "x.lab.corp.example.", want: "192.168.1.1", wantN: 1},
+		{host: "www.example.com.", want: "192.168.1.1", wantN: 1},
+		{host: "notcorp.example.", want: "192.168.1.1", wantN: 1},
+		// The upstream truncates over UDP, so the client retries
+		// over TCP.
+		{host: "big.corp.example.", want: "100.64.0.1", wantN: bigAnswers},
+		// The upstream's UDP response is larger than the client's
+		// EDNS0 size, so the forwarder truncates it.
+		{host: "huge.corp.example.", want: "100.64.0.1", wantN: bigAnswers},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			addrs, err := r.LookupNetIP(ctx, "ip4", tt.host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(addrs) != tt.wantN || addrs[0].String() != tt.want {
+				t.Errorf("got %d addresses starting with %v; want %d starting with %v", len(addrs), addrs[0], tt.wantN, tt.want)
+			}
+		})
+	}
+
+	t.Run("truncate-without-edns0", func(t *testing.T) {
+		h, resp := queryUDP(t, fwd.Addr(), "huge.corp.example.")
+		if !h.Truncated || len(resp) > minUDPSize {
+			t.Errorf("got TC=%v, %d bytes; want a truncated response of at most %d bytes", h.Truncated, len(resp), minUDPSize)
+		}
+	})
+
+	t.Run("servfail-without-upstreams", func(t *testing.T) {
+		fwd.SetRoutes(map[dnsname.FQDN][]netip.AddrPort{"corp.example.": {ours}}, nil)
+		h, _ := queryUDP(t, fwd.Addr(), "www.example.com.")
+		if h.RCode != dnsmessage.RCodeServerFailure {
+			t.Errorf("rcode = %v; want SERVFAIL", h.RCode)
+		}
+	})
+}
+
+func TestSplitStub(t *testing.T) {
+	fake := &fakeOSConfigurator{
+		BaseConfig: OSConfig{
+			Nameservers:   mustIPs("192.168.1.1", "127.0.0.1"),
+			SearchDomains: fqdns("home.arpa"),
+		},
+	}
+	s := newSplitStub(t.Logf, fake, netip.MustParseAddrPort("127.0.0.1:0"))
+	if !s.SupportsSplitDNS() {
+		t.Fatal("SupportsSplitDNS = false")
+	}
+
+	split := OSConfig{
+		Nameservers:   mustIPs("100.100.100.100"),
+		SearchDomains: fqdns("ts.net"),
+		MatchDomains:  fqdns("ts.net", "corp.example"),
+	}
+	if err := s.SetDNS(split); err != nil {
+		t.Fatal(err)
+	}
+	want := OSConfig{
+		Nameservers:   mustIPs("127.0.0.1"),
+		SearchDomains: fqdns("ts.net", "home.arpa"),
+	}
+	if !reflect.DeepEqual(fake.OSConfig, want) {
+		t.Errorf("OS config = %+v; want %+v", fake.OSConfig, want)
+	}
+	for name, want := range map[dnsname.FQDN][]netip.AddrPort{
+		"a.ts.net.":       {netip.MustParseAddrPort("100.100.100.100:53")},
+		"a.corp.example.": {netip.MustParseAddrPort("100.100.100.100:53")},
+		// Not the stub itself, though it's in the base config.
+		"www.example.com.": {netip.MustParseAddrPort("192.168.1.1:53")},
+	} {
+		if got := s.fwd.upstreamsFor(name); !reflect.DeepEqual(got, want) {
+			t.Errorf("upstreams for %s = %v; want %v", name, got, want)
+		}
+	}
+
+	// A primary configuration doesn't need the stub.
+	primary := OSConfig{Nameservers: mustIPs("100.100.100.100")}
+	if err := s.SetDNS(primary); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fake.OSConfig, primary) || s.fwd != nil {
+		t.Errorf("after primary config: OS config = %+v, stub running = %v", fake.OSConfig, s.fwd != nil)
+	}
+
+	fake.SetErr = errors.New("boom")
+	if err := s.SetDNS(split); err == nil {
+		t.Error("SetDNS succeeded despite the OS failing")
+	}
+	if err := s.Close(); err != nil || !fake.Closed || s.fwd != nil {
+		t.Errorf("Close = %v, OS closed = %v, stub running = %v", err, fake.Closed, s.fwd != nil)
+	}
+}
+
+func TestForwarderBoundsUDPHandlers(t *testing.T) {
+	fwd, err := ListenForwarder(t.Logf, netip.MustParseAddrPort("127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fwd.Close()
+	fwd.timeout = 300 * time.Millisecond
+
+	// An upstream that never answers keeps every handler busy.
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	fwd.SetRoutes(nil, []netip.AddrPort{silent.LocalAddr().(*net.UDPAddr).AddrPort()})
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("www.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("udp", fwd.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	before := runtime.NumGoroutine()
+	for i := 0; i < 3*maxUDPHandlers; i++ {
+		if _, err := c.Write(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(fwd.udpHandlers) < maxUDPHandlers; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d UDP handlers; want %d busy", len(fwd.udpHandlers), maxUDPHandlers)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine() - before; n > maxUDPHandlers+10 {
+		t.Errorf("%d more goroutines for %d queries; want at most about %d", n, 3*maxUDPHandlers, maxUDPHandlers)
+	}
+}
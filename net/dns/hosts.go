@@ -0,0 +1,385 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/anywherelan/ts-dns/types/logger"
+	"github.com/anywherelan/ts-dns/util/dnsname"
+	"github.com/anywherelan/ts-dns/util/hostsfile"
+)
+
+// HostsMode says how OSConfig.Hosts is applied on platforms other than
+// Windows, which always adds them to its hosts file.
+type HostsMode int
+
+const (
+	// HostsIgnore ignores OSConfig.Hosts.
+	HostsIgnore HostsMode = iota
+	// HostsFile adds them to a section of /etc/hosts that we
+	// manage. Lookups through libc see them, but lookups that go
+	// straight to a DNS server, like those of dig, don't.
+	HostsFile
+	// HostsResponder answers queries for them from an in-process
+	// DNS responder on Options.HostsResponderAddr, which becomes
+	// our nameserver for their names. It forwards other queries to
+	// our nameservers. It needs a DNS mode with split DNS, or
+	// Options.SplitDNSStub.
+	HostsResponder
+)
+
+func (m HostsMode) String() string {
+	switch m {
+	case HostsIgnore:
+		return "ignore"
+	case HostsFile:
+		return "file"
+	case HostsResponder:
+		return "responder"
+	}
+	return fmt.Sprintf("HostsMode(%d)", int(m))
+}
+
+// hostsFile is the hosts(5) file.
+const hostsFile = "/etc/hosts"
+
+// hostsSectionName returns the name of the hosts file section of the
+// product called name. For "tailscale", it's the section Tailscale has
+// always written on Windows.
+func hostsSectionName(name string) string {
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// hostsComments returns the comments at the top of id's section of
+// /etc/hosts.
+func hostsComments(id Identity) []string {
+	return []string{
+		"# This section holds the hosts of the DNS configuration of " + id.daemonName() + ".",
+		"# Do not edit this section manually; " + id.daemonName() + " rewrites it.",
+	}
+}
+
+// windowsHostsComments returns the comments at the top of id's section
+// of the Windows hosts file. For "tailscale", they're the ones Tailscale
+// has always written.
+func windowsHostsComments(id Identity) []string {
+	return []string{
+		"# This section contains MagicDNS entries for " + hostsSectionName(id.name()) + ".",
+		"# Do not edit this section manually.",
+	}
+}
+
+// setHostsSection returns the hosts file contents prev, parsed, with the
+// section of the product called name holding comments and hosts, or
+// without it if hosts is empty. Other lines are left as they are.
+// newEOL is the line ending to use if prev has none yet.
+func setHostsSection(prev []byte, name string, comments []string, hosts []*HostEntry, newEOL string) *hostsfile.File {
+	f := hostsfile.Parse(prev)
+	if !bytes.Contains(prev, []byte("\n")) {
+		f.EOL = newEOL
+	}
+	var entries []hostsfile.Entry
+	for _, he := range hosts {
+		entries = append(entries, hostsfile.Entry{Addr: he.Addr, Names: he.Hosts})
+	}
+	f.SetSection(hostsSectionName(name), comments, entries)
+	return f
+}
+
+// configuratorWrapper is embedded by OSConfigurators that wrap another,
+// to pass through its methods, including the optional ones.
+type configuratorWrapper struct {
+	os OSConfigurator
+}
+
+func (w configuratorWrapper) SupportsSplitDNS() bool { return w.os.SupportsSplitDNS() }
+
+func (w configuratorWrapper) GetBaseConfig() (OSConfig, error) { return w.os.GetBaseConfig() }
+
+// UnsupportedResolverOptions implements ResolverOptionsChecker.
+func (w configuratorWrapper) UnsupportedResolverOptions(o ResolverOptions) []string {
+	return unsupportedResolverOptions(w.os, o)
+}
+
+// TrampleStats implements TrampleReporter. It's zero if the wrapped
+// OSConfigurator doesn't notice tramples.
+func (w configuratorWrapper) TrampleStats() TrampleStats {
+	if tr, ok := w.os.(TrampleReporter); ok {
+		return tr.TrampleStats()
+	}
+	return TrampleStats{}
+}
+
+// hostsFileManager is an OSConfigurator that adds OSConfig.Hosts to our
+// section of /etc/hosts, and leaves the rest to the one it wraps.
+type hostsFileManager struct {
+	configuratorWrapper
+	logf  logger.Logf
+	fs    WholeFileFS
+	ident Identity // names our section and its comments
+
+	// writer writes the file like directManager writes resolv.conf,
+	// falling back to copying where it's bind-mounted.
+	writer *directManager
+	// journal records our section, or is nil.
+	journal *journal
+	// owner is held around changes to the file, which other products
+	// have sections of too.
+	owner *ownerLock
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newHostsFileManager(logf logger.Logf, os OSConfigurator, opts Options) *hostsFileManager {
+	fs := opts.fs()
+	return &hostsFileManager{
+		configuratorWrapper: configuratorWrapper{os},
+		logf:                logf,
+		fs:                  fs,
+		ident:               opts.Identity,
+		writer:              &directManager{logf: logf, fs: fs},
+		journal:             opts.journal,
+		owner:               newOwnerLock(logf, opts),
+	}
+}
+
+// setHosts makes our section of the hosts file hold hosts, waiting for
+// the owner file's lock until ctx is done. It reports whether the file
+// changed.
+func (m *hostsFileManager) setHosts(ctx context.Context, hosts []*HostEntry) (changed bool, err error) {
+	unlock, err := m.owner.serialize(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	prev, err := m.fs.ReadFile(hostsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if len(hosts) == 0 && !hostsfile.Parse(prev).HasSection(hostsSectionName(m.ident.name())) {
+		return false, nil
+	}
+	f := setHostsSection(prev, m.ident.name(), hostsComments(m.ident), hosts, "\n")
+	next := f.Bytes()
+	if bytes.Equal(prev, next) {
+		return false, nil
+	}
+	m.logProblems(f)
+	entry := JournalEntry{Kind: JournalHostsSection, Target: hostsFile}
+	if len(hosts) > 0 {
+		if err := m.journal.intend(entry); err != nil {
+			return false, err
+		}
+	}
+	if err := m.writer.atomicWriteFile(m.fs, hostsFile, next, 0644); err != nil {
+		return true, err
+	}
+	if len(hosts) > 0 {
+		m.journal.applied(m.logf, entry)
+	} else {
+		m.journal.forget(m.logf, entry)
+	}
+	return true, nil
+}
+
+// logProblems logs the problems in f that involve our section, such as
+// other lines giving our names other addresses.
+func (m *hostsFileManager) logProblems(f *hostsfile.File) {
+	ours := map[int]bool{}
+	for _, e := range f.Entries() {
+		if e.Section == hostsSectionName(m.ident.name()) {
+			ours[e.Line] = true
+		}
+	}
+	for _, p := range f.Check() {
+		if p.Kind != hostsfile.Malformed && (ours[p.Line] || ours[p.Prev]) {
+			m.logf("%s: %v", hostsFile, p)
+		}
+	}
+}
+
+func (m *hostsFileManager) SetDNS(cfg OSConfig) error {
+	return m.SetDNSContext(context.Background(), cfg)
+}
+
+// SetDNSContext implements ContextOSConfigurator.
+func (m *hostsFileManager) SetDNSContext(ctx context.Context, cfg OSConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	snap, err := snapshotFiles(m.fs, hostsFile)
+	if err != nil {
+		return err
+	}
+	undo := func() (bool, error) {
+		// Put the file back even if ctx is done.
+		unlock, err := m.owner.serialize(context.Background())
+		if err != nil {
+			return false, err
+		}
+		defer unlock()
+		return restoreFiles(m.fs, snap, func(name string, contents []byte) error {
+			return m.writer.atomicWriteFile(m.fs, name, contents, 0644)
+		})
+	}
+	if _, err := m.setHosts(ctx, cfg.Hosts); err != nil {
+		return rollBack(m.logf, fmt.Errorf("updating %s: %w", hostsFile, err), undo)
+	}
+	if err := SetDNSContext(ctx, m.os, cfg); err != nil {
+		return rollBack(m.logf, err, undo)
+	}
+	return nil
+}
+
+func (m *hostsFileManager) Close() error {
+	return m.CloseContext(context.Background())
+}
+
+// CloseContext implements ContextOSConfigurator.
+func (m *hostsFileManager) CloseContext(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	_, err := m.setHosts(ctx, nil)
+	if err != nil {
+		err = fmt.Errorf("updating %s: %w", hostsFile, err)
+	}
+	return errors.Join(err, CloseContext(ctx, m.os))
+}
+
+// recoverHostsFile removes the sections of /etc/hosts left behind by a
+// HostsFile run, unless another live process owns the DNS
+// configuration.
+func recoverHostsFile(logf logger.Logf, opts Options) []RecoveryAction {
+	unlock, err := newOwnerLock(logf, opts).serializeUnowned()
+	if err != nil {
+		return []RecoveryAction{{Target: hostsFile, Action: "skipped", Err: err}}
+	}
+	defer unlock()
+
+	var actions []RecoveryAction
+	for _, name := range opts.Identity.allNames() {
+		m := &hostsFileManager{logf: logf, fs: opts.fs(), ident: Identity{Name: name}, writer: &directManager{logf: logf, fs: opts.fs()}}
+		if changed, err := m.setHosts(context.Background(), nil); changed || err != nil {
+			actions = append(actions, RecoveryAction{Target: hostsFile, Action: "removed " + name + " section from", Err: err})
+		}
+	}
+	return actions
+}
+
+// hostsResponder is an OSConfigurator that answers queries for the
+// names in OSConfig.Hosts from a Forwarder on a loopback address,
+// which it makes our nameserver for them and the match domains. The
+// Forwarder passes other queries on to our nameservers.
+type hostsResponder struct {
+	configuratorWrapper
+	logf logger.Logf
+	addr netip.AddrPort // where the Forwarder listens
+
+	mu     sync.Mutex
+	fwd    *Forwarder // or nil, if not started
+	closed bool
+}
+
+func newHostsResponder(logf logger.Logf, os OSConfigurator, addr netip.AddrPort) *hostsResponder {
+	return &hostsResponder{configuratorWrapper: configuratorWrapper{os}, logf: logf, addr: addr}
+}
+
+func (r *hostsResponder) SetDNS(cfg OSConfig) error {
+	return r.SetDNSContext(context.Background(), cfg)
+}
+
+// SetDNSContext implements ContextOSConfigurator.
+func (r *hostsResponder) SetDNSContext(ctx context.Context, cfg OSConfig) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+	if len(cfg.Hosts) == 0 {
+		if err := SetDNSContext(ctx, r.os, cfg); err != nil {
+			return err
+		}
+		return r.stopLocked()
+	}
+
+	if r.fwd == nil {
+		fwd, err := ListenForwarder(r.logf, r.addr)
+		if err != nil {
+			return fmt.Errorf("hosts responder: %w", err)
+		}
+		r.fwd = fwd
+	}
+	stub := r.fwd.Addr().Addr()
+	r.fwd.SetHosts(cfg.Hosts)
+	r.fwd.SetRoutes(nil, upstreamAddrs(cfg.Nameservers, stub))
+
+	// A configuration without match domains makes us the primary
+	// resolver, which takes care of the hosts' names too, unless
+	// there are no nameservers.
+	match := cfg.MatchDomains
+	if len(match) > 0 || len(cfg.Nameservers) == 0 {
+		match = appendUniqueDomains(append([]dnsname.FQDN(nil), match...), hostNames(cfg.Hosts)...)
+	}
+	return SetDNSContext(ctx, r.os, OSConfig{
+		Hosts:           cfg.Hosts,
+		Nameservers:     []netip.Addr{stub},
+		SearchDomains:   cfg.SearchDomains,
+		MatchDomains:    match,
+		ResolverOptions: cfg.ResolverOptions,
+	})
+}
+
+// hostNames returns the names in hosts, as FQDNs. Invalid names are
+// left out.
+func hostNames(hosts []*HostEntry) []dnsname.FQDN {
+	var ret []dnsname.FQDN
+	for _, he := range hosts {
+		for _, h := range he.Hosts {
+			if fqdn, err := dnsname.ToFQDN(strings.ToLower(h)); err == nil {
+				ret = append(ret, fqdn)
+			}
+		}
+	}
+	return ret
+}
+
+func (r *hostsResponder) stopLocked() error {
+	if r.fwd == nil {
+		return nil
+	}
+	err := r.fwd.Close()
+	r.fwd = nil
+	return err
+}
+
+func (r *hostsResponder) Close() error {
+	return r.CloseContext(context.Background())
+}
+
+// CloseContext implements ContextOSConfigurator.
+func (r *hostsResponder) CloseContext(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return errors.Join(CloseContext(ctx, r.os), r.stopLocked())
+}
@@ -0,0 +1,226 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSetHostsSection(t *testing.T) {
+	hosts := []*HostEntry{
+		{Addr: netip.MustParseAddr("100.64.0.1"), Hosts: []string{"a.ts.net.", "a"}},
+		{Addr: netip.MustParseAddr("fd7a:115c:a1e0::2"), Hosts: []string{"b.ts.net."}},
+	}
+	// The section Tailscale has always written on Windows.
+	const section = "# TailscaleHostsSectionStart\r\n" +
+		"# This section contains MagicDNS entries for Tailscale.\r\n" +
+		"# Do not edit this section manually.\r\n" +
+		"\r\n" +
+		"100.64.0.1 a.ts.net. a\r\n" +
+		"fd7a:115c:a1e0::2 b.ts.net.\r\n" +
+		"\r\n" +
+		"# TailscaleHostsSectionEnd\r\n"
+	tests := []struct {
+		name   string
+		prev   string
+		hosts  []*HostEntry
+		newEOL string
+		want   string
+	}{
+		{
+			name:   "new-file",
+			hosts:  hosts,
+			newEOL: "\r\n",
+			want:   section,
+		},
+		{
+			name:   "add",
+			prev:   "127.0.0.1   localhost  \r\n",
+			hosts:  hosts,
+			newEOL: "\n",
+			want:   "127.0.0.1   localhost  \r\n" + section,
+		},
+		{
+			name:   "remove",
+			prev:   "127.0.0.1 localhost\r\n" + section + "::1 localhost\r\n",
+			newEOL: "\r\n",
+			want:   "127.0.0.1 localhost\r\n::1 localhost\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := setHostsSection([]byte(tt.prev), "tailscale", windowsHostsComments(DefaultIdentity), tt.hosts, tt.newEOL).Bytes()
+			if string(got) != tt.want {
+				t.Errorf("got:\n%q\nwant:\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostsFileManager(t *testing.T) {
+	const orig = "127.0.0.1 localhost\n"
+	tmp := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmp, "etc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(tmp, hostsFile)
+	if err := os.WriteFile(path, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	read := func() string {
+		t.Helper()
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(bs)
+	}
+
+	fake := &fakeOSConfigurator{}
+	opts, _ := Options{Root: tmp}.withDefaults()
+	m := newHostsFileManager(t.Logf, fake, opts)
+	cfg := OSConfig{
+		Nameservers: mustIPs("100.100.100.100"),
+		Hosts:       []*HostEntry{{Addr: netip.MustParseAddr("100.64.0.1"), Hosts: []string{"peer.ts.net."}}},
+	}
+	if err := m.SetDNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := orig +
+		"# TailscaleHostsSectionStart\n" +
+		"# This section holds the hosts of the DNS configuration of tailscaled.\n" +
+		"# Do not edit this section manually; tailscaled rewrites it.\n" +
+		"\n" +
+		"100.64.0.1 peer.ts.net.\n" +
+		"\n" +
+		"# TailscaleHostsSectionEnd\n"
+	if got := read(); got != want {
+		t.Errorf("hosts file:\n%s\nwant:\n%s", got, want)
+	}
+	if fake.SetCalls != 1 {
+		t.Errorf("wrapped SetDNS calls = %d; want 1", fake.SetCalls)
+	}
+
+	// If the wrapped OSConfigurator fails, the hosts file is put back.
+	fake.SetErr = errors.New("boom")
+	next := cfg
+	next.Hosts = []*HostEntry{{Addr: netip.MustParseAddr("100.64.0.9"), Hosts: []string{"other.ts.net."}}}
+	var rerr *RollbackError
+	if err := m.SetDNS(next); !errors.As(err, &rerr) || !rerr.RolledBack() {
+		t.Fatalf("SetDNS = %v; want a successful rollback", err)
+	}
+	if got := read(); got != want {
+		t.Errorf("hosts file after rollback:\n%s\nwant:\n%s", got, want)
+	}
+	fake.SetErr = nil
+
+	// A run that dies leaves the section behind for recovery.
+	if actions := recoverHostsFile(t.Logf, opts); len(actions) != 1 || actions[0].Err != nil {
+		t.Errorf("recovery actions = %v; want one successful one", actions)
+	}
+	if got := read(); got != orig {
+		t.Errorf("hosts file after recovery:\n%s\nwant:\n%s", got, orig)
+	}
+
+	if err := m.SetDNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); got != orig || !fake.Closed {
+		t.Errorf("after Close: hosts file:\n%s\nwrapped closed = %v", got, fake.Closed)
+	}
+}
+
+func TestHostsFileManagerSerialized(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the owner file isn't locked on Windows")
+	}
+	tmp := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmp, "etc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	opts, _ := Options{Root: tmp}.withDefaults()
+	m := newHostsFileManager(t.Logf, &fakeOSConfigurator{}, opts)
+
+	// Another product changing its section holds the lock.
+	unlock, err := newOwnerLock(t.Logf, opts).serialize(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- m.SetDNS(OSConfig{Hosts: []*HostEntry{{Addr: netip.MustParseAddr("100.64.0.1"), Hosts: []string{"peer.ts.net."}}}})
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("SetDNS returned while the lock was held: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostsResponder(t *testing.T) {
+	fake := &fakeOSConfigurator{SplitDNS: true}
+	r := newHostsResponder(t.Logf, fake, netip.MustParseAddrPort("127.0.0.1:0"))
+	defer r.Close()
+
+	// The nameserver is in TEST-NET-1, where nothing answers, as if
+	// it were down.
+	cfg := OSConfig{
+		Nameservers:  mustIPs("192.0.2.1"),
+		MatchDomains: fqdns("ts.net"),
+		Hosts: []*HostEntry{
+			{Addr: netip.MustParseAddr("100.64.0.2"), Hosts: []string{"peer.ts.net.", "peer"}},
+		},
+	}
+	if err := r.SetDNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if want := fqdns("ts.net", "peer.ts.net", "peer"); !reflect.DeepEqual(fake.OSConfig.MatchDomains, want) {
+		t.Errorf("match domains = %v; want %v", fake.OSConfig.MatchDomains, want)
+	}
+	if want := mustIPs("127.0.0.1"); !reflect.DeepEqual(fake.OSConfig.Nameservers, want) {
+		t.Errorf("nameservers = %v; want %v", fake.OSConfig.Nameservers, want)
+	}
+
+	res := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, r.fwd.Addr().String())
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	addrs, err := res.LookupNetIP(ctx, "ip4", "Peer.TS.net.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustIPs("100.64.0.2"); !reflect.DeepEqual(addrs, want) {
+		t.Errorf("addresses = %v; want %v", addrs, want)
+	}
+
+	// Without hosts, the responder isn't needed.
+	cfg.Hosts = nil
+	if err := r.SetDNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fake.OSConfig, cfg) || r.fwd != nil {
+		t.Errorf("without hosts: OS config = %+v, responder running = %v", fake.OSConfig, r.fwd != nil)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"fmt"
+	"strings"
+)
+
+// legacyName is the product name this package used before Identity
+// existed. Files and records carrying it are only recognized as ours if
+// it's one of an Identity's LegacyNames, since a Tailscale daemon on the
+// same host may own them, with one exception: see withUpgradeFrom.
+const legacyName = "tailscale"
+
+// Identity describes the product on whose behalf DNS configuration is
+// written. It determines the names of the files and records we create,
+// the markers we use to recognize them later, and the help links in
+// generated files and health warnings.
+type Identity struct {
+	// Name is the short product name, such as "tailscale". It must
+	// be a valid file name component; see Validate.
+	Name string
+
+	// DaemonName is the name of the program that writes the
+	// configuration, used in headers that historically named it
+	// (macOS /etc/resolver files). If empty, Name is used.
+	DaemonName string
+
+	// HelpURLBase, if non-empty, is prefixed to a topic name such
+	// as "dns-fight" to build the help URLs included in generated
+	// files and health warnings. If empty, no URLs are included.
+	HelpURLBase string
+
+	// LegacyNames are Names used by earlier versions of the
+	// product. Their files and records are recognized as ours and
+	// migrated or removed. Products upgrading from the layout this
+	// package used before Identity existed list "tailscale"; its
+	// resolv.conf backup is restored even if they don't, as long as
+	// resolv.conf is still the one it generated.
+	LegacyNames []string
+}
+
+// DefaultIdentity is the Identity used when Options.Identity is the
+// zero value. It matches the names used by upstream Tailscale.
+var DefaultIdentity = Identity{
+	Name:        legacyName,
+	DaemonName:  "tailscaled",
+	HelpURLBase: "https://tailscale.com/s/",
+}
+
+// orDefault returns id, or DefaultIdentity if id has no Name.
+func (id Identity) orDefault() Identity {
+	if id.Name == "" {
+		return DefaultIdentity
+	}
+	return id
+}
+
+// Validate reports whether id can be used to name files and records.
+// The zero Identity is valid and means DefaultIdentity.
+func (id Identity) Validate() error {
+	id = id.orDefault()
+	for _, name := range append([]string{id.Name}, id.LegacyNames...) {
+		if err := validIdentityName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validIdentityName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty identity name")
+	}
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_':
+		default:
+			return fmt.Errorf("invalid character %q in identity name %q", c, name)
+		}
+	}
+	return nil
+}
+
+func (id Identity) name() string { return id.orDefault().Name }
+
+func (id Identity) daemonName() string {
+	id = id.orDefault()
+	if id.DaemonName != "" {
+		return id.DaemonName
+	}
+	return id.Name
+}
+
+// legacyNames returns the names, other than id's own, whose leftovers
+// should be treated as ours.
+func (id Identity) legacyNames() []string {
+	id = id.orDefault()
+	var ret []string
+	for _, n := range id.LegacyNames {
+		if n == id.Name {
+			continue
+		}
+		dup := false
+		for _, have := range ret {
+			if have == n {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+// withUpgradeFrom returns id, with legacyName as a legacy name too if
+// the resolv.conf contents bs carry its generated-by marker. Products
+// upgrading from before Identity existed may not list it, and its
+// backup then holds the only copy of the original resolv.conf.
+func (id Identity) withUpgradeFrom(bs []byte) Identity {
+	id = id.orDefault()
+	if id.Name == legacyName || !strings.Contains(string(bs), generatedMarkerFor(legacyName)) {
+		return id
+	}
+	id.LegacyNames = append(append([]string(nil), id.LegacyNames...), legacyName)
+	return id
+}
+
+// allNames returns id's name followed by its legacy names.
+func (id Identity) allNames() []string {
+	return append([]string{id.name()}, id.legacyNames()...)
+}
+
+// helpURL returns the help URL for topic, or "" if id has none.
+func (id Identity) helpURL(topic string) string {
+	id = id.orDefault()
+	if id.HelpURLBase == "" {
+		return ""
+	}
+	return id.HelpURLBase + topic
+}
+
+// seeHelp returns a sentence pointing at the help URL for topic,
+// with a leading space, or "" if id has no help URLs.
+func (id Identity) seeHelp(topic string) string {
+	if u := id.helpURL(topic); u != "" {
+		return " See " + u
+	}
+	return ""
+}
+
+// backupConfFor returns the path that the direct manager of the product
+// called name backs up /etc/resolv.conf to.
+func backupConfFor(name string) string {
+	return "/etc/resolv.pre-" + name + "-backup.conf"
+}
+
+// backupConf returns the path that /etc/resolv.conf is backed up to.
+func (id Identity) backupConf() string { return backupConfFor(id.name()) }
+
+// generatedMarkerFor returns the line fragment that identifies a
+// resolv.conf written for the product called name.
+func generatedMarkerFor(name string) string {
+	return "file generated by " + name + "\n"
+}
+
+// isGeneratedResolvConf reports whether resolv.conf contents bs were
+// written by us, under id's name or a legacy one.
+func (id Identity) isGeneratedResolvConf(bs []byte) bool {
+	s := string(bs)
+	for _, name := range id.allNames() {
+		if strings.Contains(s, generatedMarkerFor(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvconfRecordFor returns the name of the record submitted to
+// Debian resolvconf for the product called name.
+func resolvconfRecordFor(name string) string {
+	return "tun-" + name + ".inet"
+}
@@ -0,0 +1,308 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/anywherelan/ts-dns/atomicfile"
+	"github.com/anywherelan/ts-dns/types/logger"
+)
+
+// A Journal is the record, kept in a JSON file under Options.StateDir,
+// of the changes to the OS that an OSConfigurator has made or is about
+// to make. Each change is recorded before it's made, so that a later
+// run can tell what a previous one left behind even if it was killed
+// partway. RecoverStale undoes the changes it lists.
+type Journal struct {
+	// Owner is the process that last wrote the journal.
+	Owner Owner `json:"owner"`
+	// Entries are the changes, in the order they were first made.
+	Entries []JournalEntry `json:"entries"`
+}
+
+// Kinds of JournalEntry.
+const (
+	// JournalBackup is a file, Target, replaced by a generated one
+	// after moving the original to Backup.
+	JournalBackup = "backup"
+	// JournalHostsSection is our section of the hosts file Target.
+	JournalHostsSection = "hosts-section"
+	// JournalLink is the per-link DNS settings of the interface
+	// named Target, with index Index.
+	JournalLink = "link"
+	// JournalRecord is the resolvconf(8) record named Target.
+	JournalRecord = "record"
+	// JournalFiles are the files we wrote in the directory Target.
+	JournalFiles = "files"
+)
+
+// A JournalEntry is a change to the OS.
+type JournalEntry struct {
+	Mode   string `json:"mode,omitempty"` // the backend making it, if any; one of the Mode constants
+	Kind   string `json:"kind"`           // one of the Journal kind constants
+	Target string `json:"target"`         // what's changed, as described by Kind
+	Backup string `json:"backup,omitempty"`
+	Index  int    `json:"index,omitempty"`
+
+	// Applied is whether the change was made. If false, it was
+	// about to be, and may have been made partly.
+	Applied bool      `json:"applied"`
+	Time    time.Time `json:"time"` // when it was last recorded
+}
+
+func (e JournalEntry) String() string {
+	s := e.Kind + " " + e.Target
+	if e.Mode != "" {
+		s = e.Mode + ": " + s
+	}
+	if e.Backup != "" {
+		s += " (backup " + e.Backup + ")"
+	}
+	if e.Index != 0 {
+		s += fmt.Sprintf(" (index %d)", e.Index)
+	}
+	if !e.Applied {
+		s += " [intended]"
+	}
+	return s
+}
+
+// sameChange reports whether e and o record the same change.
+func (e JournalEntry) sameChange(o JournalEntry) bool {
+	return e.Mode == o.Mode && e.Kind == o.Kind && e.Target == o.Target
+}
+
+// journalPath returns the path of the journal of opts, or "" if it has
+// no StateDir. opts must have its defaults.
+func journalPath(opts Options) string {
+	if opts.StateDir == "" {
+		return ""
+	}
+	return filepath.Join(opts.StateDir, opts.Identity.name()+"-dns-journal.json")
+}
+
+// ReadJournal returns the journal kept under opts.StateDir, or nil if
+// there's none, such as after a clean shutdown.
+func ReadJournal(opts Options) (*Journal, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return readJournal(journalPath(opts))
+}
+
+func readJournal(path string) (*Journal, error) {
+	if path == "" {
+		return nil, nil
+	}
+	bs, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	j := new(Journal)
+	if err := json.Unmarshal(bs, j); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return j, nil
+}
+
+// writeJournal replaces the journal at path with j, or removes it if j
+// has no entries.
+func writeJournal(path string, j *Journal) error {
+	if len(j.Entries) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	bs, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, append(bs, '\n'), 0600)
+}
+
+// journal records the changes of the OSConfigurators built from one
+// Options. A nil *journal records nothing, for Options without a
+// StateDir.
+type journal struct {
+	path string
+	self Owner
+
+	mu *sync.Mutex // serializes updates of the file; shared by its journals
+}
+
+var (
+	journalMusMu sync.Mutex
+	journalMus   = map[string]*sync.Mutex{} // by journal path
+)
+
+// journalMu returns the mutex of the journals at path. OSConfigurators
+// created separately with the same Identity and StateDir have journals
+// of their own at the same path, whose updates mustn't interleave.
+func journalMu(path string) *sync.Mutex {
+	journalMusMu.Lock()
+	defer journalMusMu.Unlock()
+	mu, ok := journalMus[path]
+	if !ok {
+		mu = new(sync.Mutex)
+		journalMus[path] = mu
+	}
+	return mu
+}
+
+func newJournal(opts Options) *journal {
+	path := journalPath(opts)
+	if path == "" {
+		return nil
+	}
+	return &journal{
+		path: path,
+		self: Owner{Product: opts.Identity.name(), PID: os.Getpid(), Instance: newInstanceID()},
+		mu:   journalMu(path),
+	}
+}
+
+// update applies fn to the entries of the journal on disk, and writes
+// them back.
+func (j *journal) update(fn func([]JournalEntry) []JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	cur, err := readJournal(j.path)
+	if err != nil {
+		return err
+	}
+	if cur == nil {
+		cur = new(Journal)
+	}
+	return writeJournal(j.path, &Journal{Owner: j.self, Entries: fn(cur.Entries)})
+}
+
+// record records e, replacing any entry for the same change.
+func (j *journal) record(e JournalEntry) error {
+	e.Time = time.Now().UTC()
+	return j.update(func(ents []JournalEntry) []JournalEntry {
+		for i := range ents {
+			if ents[i].sameChange(e) {
+				ents[i] = e
+				return ents
+			}
+		}
+		return append(ents, e)
+	})
+}
+
+// intend records that the change e is about to be made. It must be
+// called before making it; if it fails, the change must not be made.
+func (j *journal) intend(e JournalEntry) error {
+	if j == nil {
+		return nil
+	}
+	e.Applied = false
+	if err := j.record(e); err != nil {
+		return fmt.Errorf("recording in journal: %w", err)
+	}
+	return nil
+}
+
+// applied records that the change e was made. Failures are logged to
+// logf.
+func (j *journal) applied(logf logger.Logf, e JournalEntry) {
+	if j == nil {
+		return
+	}
+	e.Applied = true
+	if err := j.record(e); err != nil {
+		logf("recording in journal: %v", err)
+	}
+}
+
+// forget removes the change e, once it's been undone. Failures are
+// logged to logf.
+func (j *journal) forget(logf logger.Logf, e JournalEntry) {
+	if j == nil {
+		return
+	}
+	err := j.update(func(ents []JournalEntry) []JournalEntry {
+		ret := ents[:0]
+		for _, x := range ents {
+			if !x.sameChange(e) {
+				ret = append(ret, x)
+			}
+		}
+		return ret
+	})
+	if err != nil {
+		logf("updating journal: %v", err)
+	}
+}
+
+// undoJournal undoes the changes listed in the journal of opts, and
+// removes them from it. Changes whose undoing failed are kept, to be
+// tried again by the next run.
+func undoJournal(logf logger.Logf, opts Options) []RecoveryAction {
+	path := journalPath(opts)
+	j, err := readJournal(path)
+	if err != nil {
+		return []RecoveryAction{{Target: path, Action: "read", Err: err}}
+	}
+	if j == nil {
+		return nil
+	}
+	logf("dns: undoing %d changes journaled by %v", len(j.Entries), j.Owner)
+	var actions []RecoveryAction
+	var kept []JournalEntry
+	for _, e := range j.Entries {
+		acts := undoJournalEntry(logf, opts, e)
+		failed := false
+		for _, a := range acts {
+			// A generated resolv.conf without a backup can't
+			// be undone by trying again.
+			failed = failed || (a.Err != nil && a.Err != errNoBackup)
+		}
+		if failed {
+			kept = append(kept, e)
+		}
+		actions = append(actions, acts...)
+	}
+	j.Entries = kept
+	if err := writeJournal(path, j); err != nil {
+		actions = append(actions, RecoveryAction{Target: path, Action: "updated", Err: err})
+	}
+	return actions
+}
+
+// undoJournalEntry undoes the change e. Undoing is idempotent, so it
+// doesn't matter whether e was applied fully, partly or not at all.
+func undoJournalEntry(logf logger.Logf, opts Options, e JournalEntry) []RecoveryAction {
+	switch e.Kind {
+	case JournalBackup:
+		if e.Mode == ModeDirect {
+			return recoverDirect(logf, opts)
+		}
+	case JournalHostsSection:
+		m := newHostsFileManager(logf, nil, opts)
+		if changed, err := m.setHosts(context.Background(), nil); changed || err != nil {
+			return []RecoveryAction{{Target: e.Target, Action: "removed " + m.ident.name() + " section from", Err: err}}
+		}
+		return nil
+	}
+	if acts, ok := undoPlatformJournalEntry(logf, opts, e); ok {
+		return acts
+	}
+	return []RecoveryAction{{Mode: e.Mode, Target: e.Target, Action: "undid", Err: fmt.Errorf("unknown journal entry %v", e)}}
+}
@@ -0,0 +1,180 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// journalOptions returns Options for a test with a Root and a StateDir.
+func journalOptions(t *testing.T) Options {
+	tmp := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmp, "etc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := Options{
+		Root:     tmp,
+		StateDir: filepath.Join(tmp, "state"),
+		Identity: Identity{Name: "example"},
+	}.withDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+// journalEntries returns the entries of the journal of opts, without
+// their times.
+func journalEntries(t *testing.T, opts Options) []JournalEntry {
+	t.Helper()
+	j, err := ReadJournal(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j == nil {
+		return nil
+	}
+	if j.Owner.Product != "example" || j.Owner.PID != os.Getpid() {
+		t.Errorf("journal owner = %v", j.Owner)
+	}
+	var ret []JournalEntry
+	for _, e := range j.Entries {
+		if e.Time.IsZero() {
+			t.Errorf("entry %v has no time", e)
+		}
+		e.Time = time.Time{}
+		ret = append(ret, e)
+	}
+	return ret
+}
+
+func TestJournalDirect(t *testing.T) {
+	const orig = "nameserver 9.9.9.9 # orig\n"
+	opts := journalOptions(t)
+	fs := opts.fs()
+	if err := fs.WriteFile(resolvConf, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := newDirectManagerOnFS(t.Logf, fs, opts)
+	defer m.ctxClose()
+
+	if err := m.SetDNS(OSConfig{Nameservers: mustIPs("100.100.100.100")}); err != nil {
+		t.Fatal(err)
+	}
+	want := []JournalEntry{{
+		Mode:    ModeDirect,
+		Kind:    JournalBackup,
+		Target:  resolvConf,
+		Backup:  "/etc/resolv.pre-example-backup.conf",
+		Applied: true,
+	}}
+	if got := journalEntries(t, opts); !reflect.DeepEqual(got, want) {
+		t.Fatalf("journal after SetDNS:\n got %v\nwant %v", got, want)
+	}
+
+	// Pretend we crashed, and undo the journal at the next start.
+	actions := undoJournal(t.Logf, opts)
+	if want := []RecoveryAction{{Mode: ModeDirect, Target: "/etc/resolv.pre-example-backup.conf", Action: "restored"}}; !reflect.DeepEqual(actions, want) {
+		t.Errorf("actions = %v; want %v", actions, want)
+	}
+	if got, _ := fs.ReadFile(resolvConf); string(got) != orig {
+		t.Errorf("resolv.conf after undoing:\n%s", got)
+	}
+	if got := journalEntries(t, opts); got != nil {
+		t.Errorf("journal after undoing = %v; want none", got)
+	}
+}
+
+func TestJournalHostsSection(t *testing.T) {
+	opts := journalOptions(t)
+	opts.Hosts = HostsFile
+	m := newHostsFileManager(t.Logf, &fakeOSConfigurator{}, opts)
+	hosts := []*HostEntry{{Addr: netip.MustParseAddr("100.64.0.1"), Hosts: []string{"peer"}}}
+	if err := m.SetDNS(OSConfig{Hosts: hosts}); err != nil {
+		t.Fatal(err)
+	}
+	want := []JournalEntry{{Kind: JournalHostsSection, Target: hostsFile, Applied: true}}
+	if got := journalEntries(t, opts); !reflect.DeepEqual(got, want) {
+		t.Fatalf("journal after SetDNS:\n got %v\nwant %v", got, want)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := journalEntries(t, opts); got != nil {
+		t.Errorf("journal after Close = %v; want none", got)
+	}
+	if _, err := os.Stat(journalPath(opts)); !os.IsNotExist(err) {
+		t.Errorf("journal file still present: %v", err)
+	}
+}
+
+func TestJournalShared(t *testing.T) {
+	opts := journalOptions(t)
+	other := opts
+	other.journal = newJournal(opts)
+
+	// Two journals at the same path, as of two OSConfigurators with
+	// the same Options, don't lose each other's entries.
+	const n = 20
+	var wg sync.WaitGroup
+	for i, j := range []*journal{opts.journal, other.journal} {
+		i, j := i, j
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; k < n; k++ {
+				if err := j.intend(JournalEntry{Kind: JournalFiles, Target: fmt.Sprintf("/dir%d-%d", i, k)}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := journalEntries(t, opts); len(got) != 2*n {
+		t.Errorf("journal has %d entries; want %d", len(got), 2*n)
+	}
+}
+
+func TestJournalWriteFailure(t *testing.T) {
+	const orig = "nameserver 9.9.9.9 # orig\n"
+	opts := journalOptions(t)
+	fs := opts.fs()
+	if err := fs.WriteFile(resolvConf, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A file where the state directory should be.
+	if err := os.WriteFile(opts.StateDir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m := newDirectManagerOnFS(t.Logf, fs, opts)
+	defer m.ctxClose()
+	if err := m.SetDNS(OSConfig{Nameservers: mustIPs("100.100.100.100")}); err == nil {
+		t.Fatal("SetDNS succeeded without a journal")
+	}
+	if got, _ := fs.ReadFile(resolvConf); string(got) != orig {
+		t.Errorf("resolv.conf changed without a journal:\n%s", got)
+	}
+}
+
+func TestJournalKeepsFailures(t *testing.T) {
+	opts := journalOptions(t)
+	bogus := JournalEntry{Mode: "bogus", Kind: "bogus", Target: "x"}
+	if err := opts.journal.intend(bogus); err != nil {
+		t.Fatal(err)
+	}
+	actions := undoJournal(t.Logf, opts)
+	if len(actions) != 1 || actions[0].Err == nil {
+		t.Errorf("actions = %v; want one failure", actions)
+	}
+	if got, want := journalEntries(t, opts), []JournalEntry{bogus}; !reflect.DeepEqual(got, want) {
+		t.Errorf("journal = %v; want %v", got, want)
+	}
+}
@@ -5,7 +5,16 @@
 package dns
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
 	"time"
+
+	"github.com/anywherelan/ts-dns/types/logger"
+	"github.com/anywherelan/ts-dns/util/dnsname"
 )
 
 // We use file-ignore below instead of ignore because on some platforms,
@@ -19,4 +28,336 @@ import (
 // This is particularly useful because certain conditions can cause indefinite hangs
 // (such as improper dbus auth followed by contextless dbus.Object.Call).
 // Such operations should be wrapped in a timeout context.
+//
+// It's only the default: a deadline passed to a ContextOSConfigurator
+// replaces it.
 const reconfigTimeout = time.Second
+
+// withDefaultTimeout returns a copy of ctx that's done after timeout
+// d, unless ctx has a deadline of its own, which wins.
+func withDefaultTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// Config is a high-level DNS configuration. A Manager compiles it
+// into an OSConfig suitable for the host's OSConfigurator.
+type Config struct {
+	// DefaultResolvers are the nameservers to use for queries that
+	// don't match any of Routes. If empty, the OS's own resolvers
+	// keep answering those queries when the OSConfigurator supports
+	// split DNS.
+	DefaultResolvers []netip.Addr
+	// Routes maps DNS name suffixes to the nameservers that should
+	// answer queries for names under them.
+	Routes map[dnsname.FQDN][]netip.Addr
+	// SearchDomains are the domain suffixes to use when expanding
+	// single-label name queries.
+	SearchDomains []dnsname.FQDN
+	// Hosts maps DNS FQDNs to their IPs. They are passed through to
+	// OSConfig.Hosts for OSConfigurators that support a hosts file.
+	Hosts map[dnsname.FQDN][]netip.Addr
+	// ResolverOptions are passed through to OSConfig.ResolverOptions
+	// whenever our nameservers are installed.
+	ResolverOptions ResolverOptions
+}
+
+// needsAnyResolvers reports whether c requires any nameservers to be
+// installed in the OS.
+func (c Config) needsAnyResolvers() bool {
+	return len(c.DefaultResolvers) > 0 || len(c.Routes) > 0
+}
+
+// routeDomains returns the keys of c.Routes in sorted order.
+func (c Config) routeDomains() []dnsname.FQDN {
+	ret := make([]dnsname.FQDN, 0, len(c.Routes))
+	for suffix := range c.Routes {
+		ret = append(ret, suffix)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// singleRouteResolvers returns the nameservers shared by every route in
+// c, or ok=false if the routes use different sets of nameservers.
+func (c Config) singleRouteResolvers() (resolvers []netip.Addr, ok bool) {
+	first := true
+	for _, suffix := range c.routeDomains() {
+		rs := c.Routes[suffix]
+		if first {
+			resolvers, first = rs, false
+			continue
+		}
+		if !sameAddrs(resolvers, rs) {
+			return nil, false
+		}
+	}
+	return resolvers, len(resolvers) > 0
+}
+
+// hostEntries converts c.Hosts into HostEntry values, one per address,
+// sorted by address for a stable hosts file.
+func (c Config) hostEntries() []*HostEntry {
+	if len(c.Hosts) == 0 {
+		return nil
+	}
+	byAddr := map[netip.Addr]*HostEntry{}
+	var ret []*HostEntry
+	names := make([]dnsname.FQDN, 0, len(c.Hosts))
+	for name := range c.Hosts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	for _, name := range names {
+		for _, ip := range c.Hosts[name] {
+			he, ok := byAddr[ip]
+			if !ok {
+				he = &HostEntry{Addr: ip}
+				byAddr[ip] = he
+				ret = append(ret, he)
+			}
+			he.Hosts = append(he.Hosts, name.WithoutTrailingDot())
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Addr.Less(ret[j].Addr) })
+	return ret
+}
+
+func sameAddrs(a, b []netip.Addr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// appendUniqueAddrs appends the addresses in add to dst that are not
+// already present in it.
+func appendUniqueAddrs(dst []netip.Addr, add ...netip.Addr) []netip.Addr {
+	for _, ip := range add {
+		dup := false
+		for _, have := range dst {
+			if have == ip {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			dst = append(dst, ip)
+		}
+	}
+	return dst
+}
+
+// appendUniqueDomains appends the domains in add to dst that are not
+// already present in it.
+func appendUniqueDomains(dst []dnsname.FQDN, add ...dnsname.FQDN) []dnsname.FQDN {
+	for _, d := range add {
+		dup := false
+		for _, have := range dst {
+			if have == d {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			dst = append(dst, d)
+		}
+	}
+	return dst
+}
+
+// Manager compiles a Config into an OSConfig and applies it through an
+// OSConfigurator. It remembers the last Config it was given so that it
+// can be applied again after a failure.
+type Manager struct {
+	logf   logger.Logf
+	os     OSConfigurator
+	health HealthSink
+
+	mu         sync.Mutex
+	haveConfig bool     // whether config has been set
+	config     Config   // last Config passed to Set
+	osConfig   OSConfig // last OSConfig passed to os.SetDNS
+	applied    bool     // whether osConfig was applied without error
+}
+
+// NewManager returns a Manager that applies DNS configuration through
+// oscfg. The Manager takes ownership of oscfg; it's closed by Down.
+func NewManager(logf logger.Logf, oscfg OSConfigurator) *Manager {
+	return NewManagerWithHealth(logf, oscfg, nil)
+}
+
+// NewManagerWithHealth is like NewManager, but reports the health of
+// applying configuration to h instead of the health package's default
+// Tracker. A nil h means the default Tracker.
+func NewManagerWithHealth(logf logger.Logf, oscfg OSConfigurator, h HealthSink) *Manager {
+	if oscfg == nil {
+		panic("nil OSConfigurator")
+	}
+	return &Manager{
+		logf:   logger.WithPrefix(logf, "dns: "),
+		os:     oscfg,
+		health: healthOrDefault(h),
+	}
+}
+
+// Set compiles cfg and applies the result to the OS. If the compiled
+// configuration is the same as the last one applied successfully, the
+// OS isn't touched.
+//
+// cfg is remembered even if applying it fails, so a later Reapply can
+// retry it.
+func (m *Manager) Set(cfg Config) error {
+	return m.SetContext(context.Background(), cfg)
+}
+
+// SetContext is like Set, but the OS configuration is applied within
+// ctx, as by SetDNSContext.
+func (m *Manager) SetContext(ctx context.Context, cfg Config) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config = cfg
+	m.haveConfig = true
+	return m.setLocked(ctx, false)
+}
+
+// Reapply compiles and applies the last Config passed to Set again,
+// even if the OS configuration looks unchanged. It's meant to be
+// called after a failed Set, or when the OS configuration was changed
+// behind our back. It's a no-op if Set was never called.
+func (m *Manager) Reapply() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.haveConfig {
+		return nil
+	}
+	return m.setLocked(context.Background(), true)
+}
+
+func (m *Manager) setLocked(ctx context.Context, force bool) error {
+	ocfg, err := m.compileConfig(m.config)
+	if err != nil {
+		m.health.SetDNSOSHealth(err)
+		return err
+	}
+	if !force && m.applied && ocfg.Equal(m.osConfig) && sameHostEntries(ocfg.Hosts, m.osConfig.Hosts) {
+		return nil
+	}
+	m.logf("Set: %+v", ocfg)
+
+	m.osConfig = ocfg
+	m.applied = false
+	if err := SetDNSContext(ctx, m.os, ocfg); err != nil {
+		m.health.SetDNSOSHealth(err)
+		return err
+	}
+	m.applied = true
+	m.health.SetDNSOSHealth(nil)
+	return nil
+}
+
+// compileConfig converts cfg into an OSConfig for m.os.
+//
+// If the OS supports split DNS and every route uses the same
+// nameservers, the routes are installed as match domains. Otherwise
+// the configuration falls back to full interception: our nameservers
+// become the OS's primary resolvers and receive all queries, so they
+// must be able to answer or forward names outside of cfg.Routes.
+func (m *Manager) compileConfig(cfg Config) (OSConfig, error) {
+	ocfg := OSConfig{
+		Hosts:         cfg.hostEntries(),
+		SearchDomains: cfg.SearchDomains,
+	}
+	if !cfg.needsAnyResolvers() {
+		// Only search domains and hosts. Every OSConfigurator can
+		// express that without taking over resolution.
+		return ocfg, nil
+	}
+	ocfg.ResolverOptions = cfg.ResolverOptions
+
+	split := m.os.SupportsSplitDNS()
+	if split && len(cfg.DefaultResolvers) == 0 {
+		if resolvers, ok := cfg.singleRouteResolvers(); ok {
+			ocfg.Nameservers = resolvers
+			ocfg.MatchDomains = cfg.routeDomains()
+			return ocfg, nil
+		}
+	}
+
+	// Full interception.
+	ocfg.Nameservers = appendUniqueAddrs(nil, cfg.DefaultResolvers...)
+	if len(cfg.DefaultResolvers) > 0 && len(cfg.Routes) > 0 {
+		m.logf("routes for %v can't be expressed alongside default resolvers; using default resolvers for all queries", cfg.routeDomains())
+	} else {
+		for _, suffix := range cfg.routeDomains() {
+			ocfg.Nameservers = appendUniqueAddrs(ocfg.Nameservers, cfg.Routes[suffix]...)
+		}
+	}
+	if len(ocfg.Nameservers) == 0 {
+		return OSConfig{}, errors.New("routes have no nameservers")
+	}
+
+	if split {
+		// Split-capable OSes keep their own search domains next to ours.
+		return ocfg, nil
+	}
+	// Without split DNS, our config replaces the OS's entirely, so
+	// carry over its search domains to keep single-label names working.
+	base, err := m.os.GetBaseConfig()
+	if err != nil {
+		if errors.Is(err, ErrGetBaseConfigNotSupported) {
+			return ocfg, nil
+		}
+		return OSConfig{}, fmt.Errorf("getting OS base config: %w", err)
+	}
+	ocfg.SearchDomains = appendUniqueDomains(append([]dnsname.FQDN(nil), cfg.SearchDomains...), base.SearchDomains...)
+	return ocfg, nil
+}
+
+// LastOSConfig returns the OSConfig most recently passed to the
+// OSConfigurator, and whether it was applied without error.
+func (m *Manager) LastOSConfig() (cfg OSConfig, applied bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.osConfig, m.applied
+}
+
+// Down removes all our DNS configuration from the OS and closes the
+// underlying OSConfigurator. The Manager must not be used afterwards.
+func (m *Manager) Down() error {
+	return m.DownContext(context.Background())
+}
+
+// DownContext is like Down, but gives up removing our configuration
+// when ctx is done, as by CloseContext.
+func (m *Manager) DownContext(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.haveConfig = false
+	m.applied = false
+	return CloseContext(ctx, m.os)
+}
+
+func sameHostEntries(a, b []*HostEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Addr != b[i].Addr || len(a[i].Hosts) != len(b[i].Hosts) {
+			return false
+		}
+		for j := range a[i].Hosts {
+			if a[i].Hosts[j] != b[i].Hosts[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -5,15 +5,20 @@ package dns
 
 import (
 	"bytes"
+	"context"
 	"os"
+	"path/filepath"
+	"sort"
 
 	"github.com/anywherelan/ts-dns/types/logger"
-	"github.com/anywherelan/ts-dns/util/mak"
 	"go4.org/mem"
 )
 
-func NewOSConfigurator(logf logger.Logf, ifName string) (OSConfigurator, error) {
-	return &darwinConfigurator{logf: logf, ifName: ifName}, nil
+func newOSConfigurator(logf logger.Logf, ifName string, opts Options) (OSConfigurator, error) {
+	if opts.Mode != "" {
+		return nil, errUnsupportedMode(opts.Mode)
+	}
+	return &darwinConfigurator{logf: logf, ifName: ifName, ident: opts.Identity, resolverDir: opts.path("/etc/resolver"), journal: opts.journal}, nil
 }
 
 // darwinConfigurator is the tailscaled-on-macOS DNS OS configurator that
@@ -22,11 +27,25 @@ func NewOSConfigurator(logf logger.Logf, ifName string) (OSConfigurator, error)
 type darwinConfigurator struct {
 	logf   logger.Logf
 	ifName string
+	ident  Identity // names our files and their header
+
+	resolverDir string   // usually /etc/resolver
+	journal     *journal // records our files, or nil
+	life        lifecycle
+}
+
+// journalEntry returns the journal entry for our files.
+func (c *darwinConfigurator) journalEntry() JournalEntry {
+	return JournalEntry{Kind: JournalFiles, Target: c.resolverDir}
 }
 
 func (c *darwinConfigurator) Close() error {
-	c.removeResolverFiles(func(domain string) bool { return true })
-	return nil
+	return c.life.close(func() error {
+		if err := c.removeResolverFiles(func(domain string) bool { return true }); err == nil {
+			c.journal.forget(c.logf, c.journalEntry())
+		}
+		return nil
+	})
 }
 
 func (c *darwinConfigurator) SupportsSplitDNS() bool {
@@ -34,8 +53,14 @@ func (c *darwinConfigurator) SupportsSplitDNS() bool {
 }
 
 func (c *darwinConfigurator) SetDNS(cfg OSConfig) error {
+	return c.life.set(func() error { return c.setDNS(cfg) })
+}
+
+// setDNS implements SetDNS.
+func (c *darwinConfigurator) setDNS(cfg OSConfig) error {
+	header := c.macResolverFileHeader()
 	var buf bytes.Buffer
-	buf.WriteString(macResolverFileHeader)
+	buf.WriteString(header)
 	for i, ip := range cfg.Nameservers {
 		if i == 0 {
 			buf.WriteString("nameserver ")
@@ -46,52 +71,109 @@ func (c *darwinConfigurator) SetDNS(cfg OSConfig) error {
 	}
 	buf.WriteString("\n")
 
-	if err := os.MkdirAll("/etc/resolver", 0755); err != nil {
+	if err := os.MkdirAll(c.resolverDir, 0755); err != nil {
 		return err
 	}
 
-	var keep map[string]bool
+	files := map[string][]byte{} // file name in resolverDir -> contents
 
 	// Add a dummy file to /etc/resolver with a "search ..." directive if we have
 	// search suffixes to add.
 	if len(cfg.SearchDomains) > 0 {
-		const searchFile = "search.tailscale" // fake DNS suffix+TLD to put our search
-		mak.Set(&keep, searchFile, true)
+		searchFile := "search." + c.ident.name() // fake DNS suffix+TLD to put our search
 		var sbuf bytes.Buffer
-		sbuf.WriteString(macResolverFileHeader)
+		sbuf.WriteString(header)
 		sbuf.WriteString("search")
 		for _, d := range cfg.SearchDomains {
 			sbuf.WriteString(" ")
 			sbuf.WriteString(string(d.WithoutTrailingDot()))
 		}
 		sbuf.WriteString("\n")
-		if err := os.WriteFile("/etc/resolver/"+searchFile, sbuf.Bytes(), 0644); err != nil {
-			return err
-		}
+		files[searchFile] = sbuf.Bytes()
 	}
-
 	for _, d := range cfg.MatchDomains {
-		fileBase := string(d.WithoutTrailingDot())
-		mak.Set(&keep, fileBase, true)
-		fullPath := "/etc/resolver/" + fileBase
+		files[string(d.WithoutTrailingDot())] = buf.Bytes()
+	}
 
-		if err := os.WriteFile(fullPath, buf.Bytes(), 0644); err != nil {
+	// Snapshot every file we may write or remove, to put them back if
+	// we fail partway.
+	fs := directFS{}
+	var names []string
+	for name := range files {
+		names = append(names, filepath.Join(c.resolverDir, name))
+	}
+	if dents, err := os.ReadDir(c.resolverDir); err == nil {
+		for _, de := range dents {
+			if _, ok := files[de.Name()]; !ok && de.Type().IsRegular() {
+				names = append(names, filepath.Join(c.resolverDir, de.Name()))
+			}
+		}
+	}
+	sort.Strings(names)
+	snap, err := snapshotFiles(fs, names...)
+	if err != nil {
+		return err
+	}
+	undo := func() (bool, error) {
+		return restoreFiles(fs, snap, func(name string, contents []byte) error {
+			return os.WriteFile(name, contents, 0644)
+		})
+	}
+	if len(files) > 0 {
+		if err := c.journal.intend(c.journalEntry()); err != nil {
 			return err
 		}
 	}
-	return c.removeResolverFiles(func(domain string) bool { return !keep[domain] })
+
+	for _, name := range names {
+		contents, ok := files[filepath.Base(name)]
+		if !ok {
+			continue
+		}
+		if err := os.WriteFile(name, contents, 0644); err != nil {
+			return rollBack(c.logf, err, undo)
+		}
+	}
+	if err := c.removeResolverFiles(func(domain string) bool { _, keep := files[domain]; return !keep }); err != nil {
+		return rollBack(c.logf, err, undo)
+	}
+	if len(files) > 0 {
+		c.journal.applied(c.logf, c.journalEntry())
+	} else {
+		c.journal.forget(c.logf, c.journalEntry())
+	}
+	return nil
 }
 
 func (c *darwinConfigurator) GetBaseConfig() (OSConfig, error) {
 	return OSConfig{}, ErrGetBaseConfigNotSupported
 }
 
-const macResolverFileHeader = "# Added by tailscaled\n"
+// macResolverFileHeader returns the header of the /etc/resolver files we write.
+func (c *darwinConfigurator) macResolverFileHeader() string {
+	return "# Added by " + c.ident.daemonName() + "\n"
+}
+
+// isOurResolverFile reports whether contents start with a header
+// written by us, under our current identity or a legacy one.
+// Legacy daemons were named after the product with a "d" suffix.
+func (c *darwinConfigurator) isOurResolverFile(contents []byte) bool {
+	headers := []string{c.macResolverFileHeader()}
+	for _, name := range c.ident.allNames() {
+		headers = append(headers, "# Added by "+name+"\n", "# Added by "+name+"d\n")
+	}
+	for _, h := range headers {
+		if mem.HasPrefix(mem.B(contents), mem.S(h)) {
+			return true
+		}
+	}
+	return false
+}
 
-// removeResolverFiles deletes all files in /etc/resolver for which the shouldDelete
-// func returns true.
+// removeResolverFiles deletes all files in /etc/resolver that we wrote
+// and for which the shouldDelete func returns true.
 func (c *darwinConfigurator) removeResolverFiles(shouldDelete func(domain string) bool) error {
-	dents, err := os.ReadDir("/etc/resolver")
+	dents, err := os.ReadDir(c.resolverDir)
 	if os.IsNotExist(err) {
 		return nil
 	}
@@ -106,7 +188,7 @@ func (c *darwinConfigurator) removeResolverFiles(shouldDelete func(domain string
 		if !shouldDelete(name) {
 			continue
 		}
-		fullPath := "/etc/resolver/" + name
+		fullPath := filepath.Join(c.resolverDir, name)
 		contents, err := os.ReadFile(fullPath)
 		if err != nil {
 			if os.IsNotExist(err) { // race?
@@ -114,7 +196,7 @@ func (c *darwinConfigurator) removeResolverFiles(shouldDelete func(domain string
 			}
 			return err
 		}
-		if !mem.HasPrefix(mem.B(contents), mem.S(macResolverFileHeader)) {
+		if !c.isOurResolverFile(contents) {
 			continue
 		}
 		if err := os.Remove(fullPath); err != nil {
@@ -123,3 +205,32 @@ func (c *darwinConfigurator) removeResolverFiles(shouldDelete func(domain string
 	}
 	return nil
 }
+
+// detectMode detects which backend to use on this system.
+func detectMode(context.Context, logger.Logf, Options) (*ModeReport, error) {
+	return singleBackendReport("/etc/resolver files"), nil
+}
+
+// recoverStale removes the /etc/resolver files left behind by a
+// previous run.
+func recoverStale(logf logger.Logf, ifName string, opts Options) []RecoveryAction {
+	c := &darwinConfigurator{logf: logf, ifName: ifName, ident: opts.Identity, resolverDir: opts.path("/etc/resolver")}
+	var actions []RecoveryAction
+	err := c.removeResolverFiles(func(domain string) bool {
+		actions = append(actions, RecoveryAction{Target: filepath.Join(c.resolverDir, domain), Action: "removed"})
+		return true
+	})
+	if err != nil {
+		actions = append(actions, RecoveryAction{Target: c.resolverDir, Action: "cleaned", Err: err})
+	}
+	return actions
+}
+
+// undoPlatformJournalEntry undoes the journaled changes specific to
+// macOS, and reports whether e was one.
+func undoPlatformJournalEntry(logf logger.Logf, opts Options, e JournalEntry) ([]RecoveryAction, bool) {
+	if e.Kind != JournalFiles {
+		return nil, false
+	}
+	return recoverStale(logf, "", opts), true
+}
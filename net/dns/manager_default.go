@@ -5,11 +5,35 @@
 
 package dns
 
-import "github.com/anywherelan/ts-dns/types/logger"
+import (
+	"context"
 
-func NewOSConfigurator(logger.Logf, string) (OSConfigurator, error) {
+	"github.com/anywherelan/ts-dns/types/logger"
+)
+
+// detectMode detects which backend to use on this system.
+func detectMode(context.Context, logger.Logf, Options) (*ModeReport, error) {
+	return singleBackendReport("none, DNS configuration is not supported"), nil
+}
+
+func newOSConfigurator(_ logger.Logf, _ string, opts Options) (OSConfigurator, error) {
+	if opts.Mode != "" {
+		return nil, errUnsupportedMode(opts.Mode)
+	}
 	// TODO(dmytro): on darwin, we should use a macOS-specific method such as scutil.
 	// This is currently not implemented. Editing /etc/resolv.conf does not work,
 	// as most applications use the system resolver, which disregards it.
 	return NewNoopManager()
 }
+
+// recoverStale does nothing, as we don't change anything on this
+// platform.
+func recoverStale(logger.Logf, string, Options) []RecoveryAction {
+	return nil
+}
+
+// undoPlatformJournalEntry undoes the journaled changes specific to
+// this platform, of which there are none.
+func undoPlatformJournalEntry(logger.Logf, Options, JournalEntry) ([]RecoveryAction, bool) {
+	return nil, false
+}
@@ -4,35 +4,90 @@
 package dns
 
 import (
+	"context"
 	"fmt"
 	"os"
 
 	"github.com/anywherelan/ts-dns/types/logger"
 )
 
-func NewOSConfigurator(logf logger.Logf, _ string) (OSConfigurator, error) {
-	bs, err := os.ReadFile("/etc/resolv.conf")
+func newOSConfigurator(logf logger.Logf, _ string, opts Options) (OSConfigurator, error) {
+	if opts.Mode == "" {
+		rep, err := detectMode(context.Background(), logf, opts)
+		if err != nil {
+			return nil, err
+		}
+		opts.Mode = rep.Mode
+	}
+	switch opts.Mode {
+	case ModeDirect:
+		return newDirectManager(logf, opts), nil
+	case ModeDebianResolvconf:
+		return newDebianResolvconfManager(logf, opts)
+	case ModeOpenresolv:
+		return newOpenresolvManager(logf, opts)
+	default:
+		return nil, errUnsupportedMode(opts.Mode)
+	}
+}
+
+// recoverStale recovers from every backend that may have been used on
+// this system.
+func recoverStale(logf logger.Logf, _ string, opts Options) []RecoveryAction {
+	return append(recoverDirect(logf, opts), recoverResolvconf(logf, opts)...)
+}
+
+// detectMode detects which backend to use on this system.
+func detectMode(_ context.Context, logf logger.Logf, opts Options) (*ModeReport, error) {
+	rep := new(ModeReport)
+	bs, err := os.ReadFile(opts.path("/etc/resolv.conf"))
 	if os.IsNotExist(err) {
-		return newDirectManager(logf), nil
+		rep.probe("rc", "missing")
+		rep.reason("/etc/resolv.conf doesn't exist, so we create it ourselves")
+		rep.Mode = ModeDirect
+		return rep, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("reading /etc/resolv.conf: %w", err)
 	}
 
-	switch resolvOwner(bs) {
+	rep.ResolvConfOwner = resolvOwner(bs)
+	switch rep.ResolvConfOwner {
 	case "resolvconf":
-		switch resolvconfStyle() {
+		rep.probe("rc", "resolvconf")
+		rep.reason("/etc/resolv.conf header says it's managed by resolvconf")
+		switch style := resolvconfStyle(opts.Runner); style {
 		case "":
-			return newDirectManager(logf), nil
+			rep.probe("resolvconf", "no")
+			rep.reason("but no resolvconf program is installed, so we replace it directly")
+			rep.Mode = ModeDirect
 		case "debian":
-			return newDebianResolvconfManager(logf)
+			rep.probe("resolvconf", "debian")
+			rep.reason("resolvconf is Debian's implementation")
+			rep.Mode = ModeDebianResolvconf
 		case "openresolv":
-			return newOpenresolvManager()
+			rep.probe("resolvconf", "openresolv")
+			rep.reason("resolvconf is openresolv")
+			rep.Mode = ModeOpenresolv
 		default:
-			logf("[unexpected] got unknown flavor of resolvconf %q, falling back to direct manager", resolvconfStyle())
-			return newDirectManager(logf), nil
+			logf("[unexpected] got unknown flavor of resolvconf %q, falling back to direct manager", style)
+			rep.probe("resolvconf", style)
+			rep.reason("resolvconf flavor %q is unknown, so we replace /etc/resolv.conf directly", style)
+			rep.Mode = ModeDirect
 		}
 	default:
-		return newDirectManager(logf), nil
+		rep.probe("rc", "unknown")
+		rep.reason("/etc/resolv.conf has no known owner, so we replace it directly")
+		rep.Mode = ModeDirect
+	}
+	return rep, nil
+}
+
+// undoPlatformJournalEntry undoes the journaled changes specific to
+// this platform, and reports whether e was one.
+func undoPlatformJournalEntry(logf logger.Logf, opts Options, e JournalEntry) ([]RecoveryAction, bool) {
+	if e.Kind != JournalRecord {
+		return nil, false
 	}
+	return undoResolvconfRecord(logf, opts, e), true
 }
@@ -13,7 +13,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/anywherelan/ts-dns/health"
 	"github.com/anywherelan/ts-dns/net/netaddr"
 	"github.com/anywherelan/ts-dns/types/logger"
 	"github.com/godbus/dbus/v5"
@@ -21,71 +20,96 @@ import (
 	"github.com/anywherelan/ts-dns/util/cmpver"
 )
 
-type kv struct {
-	k, v string
-}
-
-func (kv kv) String() string {
-	return fmt.Sprintf("%s=%s", kv.k, kv.v)
-}
-
 var publishOnce sync.Once
 
-func NewOSConfigurator(logf logger.Logf, interfaceName string) (ret OSConfigurator, err error) {
-	env := newOSConfigEnv{
-		fs:                directFS{},
-		dbusPing:          dbusPing,
-		dbusReadString:    dbusReadString,
-		nmIsUsingResolved: nmIsUsingResolved,
-		nmVersionBetween:  nmVersionBetween,
-		resolvconfStyle:   resolvconfStyle,
-	}
-	mode, err := dnsMode(logf, env)
-	if err != nil {
-		return nil, err
+func newOSConfigurator(logf logger.Logf, interfaceName string, opts Options) (ret OSConfigurator, err error) {
+	mode := opts.Mode
+	if mode == "" {
+		rep, err := detectMode(context.Background(), logf, opts)
+		if err != nil {
+			return nil, err
+		}
+		mode = rep.Mode
 	}
 
 	logf("dns: using %q mode", mode)
 	switch mode {
-	case "direct":
-		return newDirectManagerOnFS(logf, env.fs), nil
-	case "systemd-resolved":
-		return newResolvedManager(logf, interfaceName)
-	case "network-manager":
-		return newNMManager(interfaceName)
-	case "debian-resolvconf":
-		return newDebianResolvconfManager(logf)
-	case "openresolv":
-		return newOpenresolvManager()
+	case ModeDirect:
+		return newDirectManager(logf, opts), nil
+	case ModeSystemdResolved:
+		return newResolvedManager(logf, interfaceName, opts)
+	case ModeNetworkManager:
+		return newNMManager(interfaceName, opts)
+	case ModeDebianResolvconf:
+		return newDebianResolvconfManager(logf, opts)
+	case ModeOpenresolv:
+		return newOpenresolvManager(logf, opts)
 	default:
+		if opts.Mode != "" {
+			return nil, errUnsupportedMode(mode)
+		}
 		logf("[unexpected] detected unknown DNS mode %q, using direct manager as last resort", mode)
-		return newDirectManagerOnFS(logf, env.fs), nil
+		return newDirectManager(logf, opts), nil
+	}
+}
+
+// recoverStale recovers from every backend that may have been used on
+// this system.
+func recoverStale(logf logger.Logf, interfaceName string, opts Options) []RecoveryAction {
+	actions := recoverDirect(logf, opts)
+	actions = append(actions, recoverResolvconf(logf, opts)...)
+	actions = append(actions, recoverResolved(opts.Bus, interfaceName)...)
+	return actions
+}
+
+// detectMode detects which backend to use on this system.
+func detectMode(ctx context.Context, logf logger.Logf, opts Options) (*ModeReport, error) {
+	env := newOSConfigEnv{
+		ident:           opts.Identity,
+		health:          opts.Health,
+		fs:              opts.fs(),
+		bus:             opts.Bus,
+		resolvconfStyle: func() string { return resolvconfStyle(opts.Runner) },
 	}
+	rep := new(ModeReport)
+	if _, err := dnsMode(ctx, logf, env, rep); err != nil {
+		return nil, err
+	}
+	return rep, nil
 }
 
 // newOSConfigEnv are the funcs newOSConfigurator needs, pulled out for testing.
 type newOSConfigEnv struct {
-	fs                        wholeFileFS
-	dbusPing                  func(string, string) error
-	dbusReadString            func(string, string, string, string) (string, error)
-	nmIsUsingResolved         func() error
-	nmVersionBetween          func(v1, v2 string) (safe bool, err error)
+	ident                     Identity   // for health warning text
+	health                    HealthSink // nil means the global health state
+	fs                        WholeFileFS
+	bus                       BusDialer // nil means the system bus
 	resolvconfStyle           func() string
 	isResolvconfDebianVersion func() bool
 }
 
-func dnsMode(logf logger.Logf, env newOSConfigEnv) (ret string, err error) {
-	var debug []kv
-	dbg := func(k, v string) {
-		debug = append(debug, kv{k, v})
-	}
+// dnsMode detects the mode to use and returns its name. It records the
+// probes it made and the reasoning behind its decision in rep.
+func dnsMode(ctx context.Context, logf logger.Logf, env newOSConfigEnv, rep *ModeReport) (ret string, err error) {
+	dbg := rep.probe
+	why := rep.reason
 	defer func() {
 		if ret != "" {
 			dbg("ret", ret)
+			rep.Mode = ret
 		}
-		logf("dns: %v", debug)
+		logf("dns: %v", rep.Probes)
 	}()
 
+	nmVersionBetween := func(first, last string) (bool, error) {
+		v, err := nmVersion(ctx, env.bus)
+		if err != nil {
+			return false, err
+		}
+		rep.NMVersion = v
+		return versionBetween(v, first, last), nil
+	}
+
 	// In all cases that we detect systemd-resolved, try asking it what it
 	// thinks the current resolv.conf mode is so we can add it to our logs.
 	defer func() {
@@ -96,12 +120,13 @@ func dnsMode(logf logger.Logf, env newOSConfigEnv) (ret string, err error) {
 		// Try to ask systemd-resolved what it thinks the current
 		// status of resolv.conf is. This is documented at:
 		//    https://www.freedesktop.org/software/systemd/man/org.freedesktop.resolve1.html
-		mode, err := env.dbusReadString("org.freedesktop.resolve1", "/org/freedesktop/resolve1", "org.freedesktop.resolve1.Manager", "ResolvConfMode")
+		mode, err := dbusReadString(ctx, env.bus, "org.freedesktop.resolve1", "/org/freedesktop/resolve1", "org.freedesktop.resolve1.Manager", "ResolvConfMode")
 		if err != nil {
 			logf("dns: ResolvConfMode error: %v", err)
 			dbg("resolv-conf-mode", "error")
 		} else {
 			dbg("resolv-conf-mode", mode)
+			rep.ResolvConfMode = mode
 		}
 	}()
 
@@ -112,7 +137,7 @@ func dnsMode(logf logger.Logf, env newOSConfigEnv) (ret string, err error) {
 	// before it replies to the ping. (see how systemd's
 	// src/resolve/resolved.c calls manager_write_resolv_conf
 	// before the sd_event_loop starts)
-	resolvedUp := env.dbusPing("org.freedesktop.resolve1", "/org/freedesktop/resolve1") == nil
+	resolvedUp := dbusPing(ctx, env.bus, "org.freedesktop.resolve1", "/org/freedesktop/resolve1") == nil
 	if resolvedUp {
 		dbg("resolved-ping", "yes")
 	}
@@ -120,15 +145,18 @@ func dnsMode(logf logger.Logf, env newOSConfigEnv) (ret string, err error) {
 	bs, err := env.fs.ReadFile(resolvConf)
 	if os.IsNotExist(err) {
 		dbg("rc", "missing")
+		why("/etc/resolv.conf doesn't exist, so we create it ourselves")
 		return "direct", nil
 	}
 	if err != nil {
 		return "", fmt.Errorf("reading /etc/resolv.conf: %w", err)
 	}
 
-	switch resolvOwner(bs) {
+	rep.ResolvConfOwner = resolvOwner(bs)
+	switch rep.ResolvConfOwner {
 	case "systemd-resolved":
 		dbg("rc", "resolved")
+		why("/etc/resolv.conf header says it's managed by systemd-resolved")
 
 		// Some systems, for reasons known only to them, have a
 		// resolv.conf that has the word "systemd-resolved" in its
@@ -138,18 +166,22 @@ func dnsMode(logf logger.Logf, env newOSConfigEnv) (ret string, err error) {
 		if err := resolvedIsActuallyResolver(bs); err != nil {
 			logf("dns: resolvedIsActuallyResolver error: %v", err)
 			dbg("resolved", "not-in-use")
+			why("but it doesn't point at the systemd-resolved stub (%v), so we replace it directly", err)
 			return "direct", nil
 		}
-		if err := env.dbusPing("org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager/DnsManager"); err != nil {
+		if err := dbusPing(ctx, env.bus, "org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager/DnsManager"); err != nil {
 			dbg("nm", "no")
+			why("NetworkManager isn't running, so we program systemd-resolved")
 			return "systemd-resolved", nil
 		}
 		dbg("nm", "yes")
-		if err := env.nmIsUsingResolved(); err != nil {
+		if err := nmIsUsingResolved(ctx, env.bus); err != nil {
 			dbg("nm-resolved", "no")
+			why("NetworkManager isn't pushing DNS to systemd-resolved (%v), so we program systemd-resolved", err)
 			return "systemd-resolved", nil
 		}
 		dbg("nm-resolved", "yes")
+		why("NetworkManager is pushing DNS to systemd-resolved")
 
 		// Version of NetworkManager before 1.26.6 programmed resolved
 		// incorrectly, such that NM's settings would always take
@@ -185,7 +217,7 @@ func dnsMode(logf logger.Logf, env newOSConfigEnv) (ret string, err error) {
 		// that comes with it (see
 		// https://github.com/tailscale/tailscale/issues/1699,
 		// https://github.com/tailscale/tailscale/pull/1945)
-		safe, err := env.nmVersionBetween("1.26.0", "1.26.5")
+		safe, err := nmVersionBetween("1.26.0", "1.26.5")
 		if err != nil {
 			// Failed to figure out NM's version, can't make a correct
 			// decision.
@@ -193,32 +225,40 @@ func dnsMode(logf logger.Logf, env newOSConfigEnv) (ret string, err error) {
 		}
 		if safe {
 			dbg("nm-safe", "yes")
+			why("NetworkManager %s overrides other systemd-resolved clients, so we must go through it", rep.NMVersion)
 			return "network-manager", nil
 		}
 		dbg("nm-safe", "no")
+		why("NetworkManager %s doesn't get in the way, so we program systemd-resolved", rep.NMVersion)
 		return "systemd-resolved", nil
 	case "resolvconf":
 		dbg("rc", "resolvconf")
+		why("/etc/resolv.conf header says it's managed by resolvconf")
 		style := env.resolvconfStyle()
 		switch style {
 		case "":
 			dbg("resolvconf", "no")
+			why("but no resolvconf program is installed, so we replace it directly")
 			return "direct", nil
 		case "debian":
 			dbg("resolvconf", "debian")
+			why("resolvconf is Debian's implementation")
 			return "debian-resolvconf", nil
 		case "openresolv":
 			dbg("resolvconf", "openresolv")
+			why("resolvconf is openresolv")
 			return "openresolv", nil
 		default:
 			// Shouldn't happen, that means we updated flavors of
 			// resolvconf without updating here.
 			dbg("resolvconf", style)
-			logf("[unexpected] got unknown flavor of resolvconf %q, falling back to direct manager", env.resolvconfStyle())
+			logf("[unexpected] got unknown flavor of resolvconf %q, falling back to direct manager", style)
+			why("resolvconf flavor %q is unknown, so we replace /etc/resolv.conf directly", style)
 			return "direct", nil
 		}
 	case "NetworkManager":
 		dbg("rc", "nm")
+		why("/etc/resolv.conf header says it's managed by NetworkManager")
 		// Sometimes, NetworkManager owns the configuration but points
 		// it at systemd-resolved.
 		if err := resolvedIsActuallyResolver(bs); err != nil {
@@ -237,9 +277,11 @@ func dnsMode(logf logger.Logf, env newOSConfigEnv) (ret string, err error) {
 			// that versions >=1.26.6 will ignore DNS configuration
 			// anyway, so you still need a fallback path that uses
 			// directManager.
+			why("it doesn't point at the systemd-resolved stub (%v), so we replace it directly rather than lose IPv6 config through NetworkManager", err)
 			return "direct", nil
 		}
 		dbg("nm-resolved", "yes")
+		why("it points at the systemd-resolved stub")
 
 		// See large comment above for reasons we'd use NM rather than
 		// resolved. systemd-resolved is actually in charge of DNS
@@ -247,11 +289,12 @@ func dnsMode(logf logger.Logf, env newOSConfigEnv) (ret string, err error) {
 		// it via NetworkManager. All the logic below is probing for
 		// that case: is NetworkManager running? If so, is it one of
 		// the versions that requires direct interaction with it?
-		if err := env.dbusPing("org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager/DnsManager"); err != nil {
+		if err := dbusPing(ctx, env.bus, "org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager/DnsManager"); err != nil {
 			dbg("nm", "no")
+			why("NetworkManager isn't running, so we program systemd-resolved")
 			return "systemd-resolved", nil
 		}
-		safe, err := env.nmVersionBetween("1.26.0", "1.26.5")
+		safe, err := nmVersionBetween("1.26.0", "1.26.5")
 		if err != nil {
 			// Failed to figure out NM's version, can't make a correct
 			// decision.
@@ -259,48 +302,41 @@ func dnsMode(logf logger.Logf, env newOSConfigEnv) (ret string, err error) {
 		}
 		if safe {
 			dbg("nm-safe", "yes")
+			why("NetworkManager %s overrides other systemd-resolved clients, so we must go through it", rep.NMVersion)
 			return "network-manager", nil
 		}
-		health.SetDNSManagerHealth(errors.New("systemd-resolved and NetworkManager are wired together incorrectly; MagicDNS will probably not work. For more info, see https://tailscale.com/s/resolved-nm"))
+		healthOrDefault(env.health).SetDNSManagerHealth(errors.New("systemd-resolved and NetworkManager are wired together incorrectly; DNS configuration will probably not work." + env.ident.seeHelp("resolved-nm")))
 		dbg("nm-safe", "no")
+		why("NetworkManager %s and systemd-resolved are wired together incorrectly; programming systemd-resolved is the best we can do", rep.NMVersion)
 		return "systemd-resolved", nil
 	default:
 		dbg("rc", "unknown")
+		why("/etc/resolv.conf has no known owner, so we replace it directly")
 		return "direct", nil
 	}
 }
 
-func nmVersionBetween(first, last string) (bool, error) {
-	conn, err := dbus.SystemBus()
-	if err != nil {
-		// DBus probably not running.
-		return false, err
-	}
+// versionBetween reports whether version is within [first, last].
+func versionBetween(version, first, last string) bool {
+	outside := cmpver.Compare(version, first) < 0 || cmpver.Compare(version, last) > 0
+	return !outside
+}
 
-	nm := conn.Object("org.freedesktop.NetworkManager", dbus.ObjectPath("/org/freedesktop/NetworkManager"))
-	v, err := nm.GetProperty("org.freedesktop.NetworkManager.Version")
+func nmVersion(ctx context.Context, bus BusDialer) (string, error) {
+	v, err := dbusGetProperty(ctx, bus, "org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager", "org.freedesktop.NetworkManager", "Version")
 	if err != nil {
-		return false, err
+		return "", err
 	}
 
 	version, ok := v.Value().(string)
 	if !ok {
-		return false, fmt.Errorf("unexpected type %T for NM version", v.Value())
+		return "", fmt.Errorf("unexpected type %T for NM version", v.Value())
 	}
-
-	outside := cmpver.Compare(version, first) < 0 || cmpver.Compare(version, last) > 0
-	return !outside, nil
+	return version, nil
 }
 
-func nmIsUsingResolved() error {
-	conn, err := dbus.SystemBus()
-	if err != nil {
-		// DBus probably not running.
-		return err
-	}
-
-	nm := conn.Object("org.freedesktop.NetworkManager", dbus.ObjectPath("/org/freedesktop/NetworkManager/DnsManager"))
-	v, err := nm.GetProperty("org.freedesktop.NetworkManager.DnsManager.Mode")
+func nmIsUsingResolved(ctx context.Context, bus BusDialer) error {
+	v, err := dbusGetProperty(ctx, bus, "org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager/DnsManager", "org.freedesktop.NetworkManager.DnsManager", "Mode")
 	if err != nil {
 		return fmt.Errorf("getting NM mode: %w", err)
 	}
@@ -341,43 +377,62 @@ func resolvedIsActuallyResolver(bs []byte) error {
 	return nil
 }
 
-func dbusPing(name, objectPath string) error {
-	conn, err := dbus.SystemBus()
+// dbusPing checks that the provided name answers at the object path on
+// the bus dialed by bus, or the system bus if it's nil.
+func dbusPing(ctx context.Context, bus BusDialer, name, objectPath string) error {
+	conn, err := busOrDefault(bus).Dial()
 	if err != nil {
 		// DBus probably not running.
 		return err
 	}
+	defer conn.Close()
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
 
-	obj := conn.Object(name, dbus.ObjectPath(objectPath))
-	call := obj.CallWithContext(ctx, "org.freedesktop.DBus.Peer.Ping", 0)
-	return call.Err
+	_, err = conn.Call(ctx, name, dbus.ObjectPath(objectPath), dbusPeerPing)
+	return err
 }
 
 // dbusReadString reads a string property from the provided name and object
 // path. property must be in "interface.member" notation.
-func dbusReadString(name, objectPath, iface, member string) (string, error) {
-	conn, err := dbus.SystemBus()
+func dbusReadString(ctx context.Context, bus BusDialer, name, objectPath, iface, member string) (string, error) {
+	result, err := dbusGetProperty(ctx, bus, name, objectPath, iface, member)
 	if err != nil {
-		// DBus probably not running.
 		return "", err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-
-	obj := conn.Object(name, dbus.ObjectPath(objectPath))
+	if s, ok := result.Value().(string); ok {
+		return s, nil
+	}
+	return result.String(), nil
+}
 
-	var result dbus.Variant
-	err = obj.CallWithContext(ctx, "org.freedesktop.DBus.Properties.Get", 0, iface, member).Store(&result)
+// dbusGetProperty reads the property iface.member from the provided name
+// and object path, on the bus dialed by bus, or the system bus if it's
+// nil.
+func dbusGetProperty(ctx context.Context, bus BusDialer, name, objectPath, iface, member string) (dbus.Variant, error) {
+	conn, err := busOrDefault(bus).Dial()
 	if err != nil {
-		return "", err
+		// DBus probably not running.
+		return dbus.Variant{}, err
 	}
+	defer conn.Close()
 
-	if s, ok := result.Value().(string); ok {
-		return s, nil
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	return conn.GetProperty(ctx, name, dbus.ObjectPath(objectPath), iface, member)
+}
+
+// undoPlatformJournalEntry undoes the journaled changes specific to
+// Linux, and reports whether e was one.
+func undoPlatformJournalEntry(logf logger.Logf, opts Options, e JournalEntry) ([]RecoveryAction, bool) {
+	switch e.Kind {
+	case JournalLink:
+		return undoResolvedLink(opts.Bus, e), true
+	case JournalRecord:
+		return undoResolvconfRecord(logf, opts, e), true
 	}
-	return result.String(), nil
+	return nil, false
 }
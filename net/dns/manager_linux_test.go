@@ -0,0 +1,161 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type fakeHealth struct {
+	osErr, managerErr error
+}
+
+func (h *fakeHealth) SetDNSOSHealth(err error)      { h.osErr = err }
+func (h *fakeHealth) SetDNSManagerHealth(err error) { h.managerErr = err }
+
+func TestDNSModeReport(t *testing.T) {
+	const resolvedStub = "# This is /run/systemd/resolve/stub-resolv.conf managed by man:systemd-resolved(8).\nnameserver 127.0.0.53\n"
+	tests := []struct {
+		name       string
+		resolvConf string // empty means missing
+		nm         bool   // NetworkManager running and using resolved
+		nmVersion  string
+		want       ModeReport
+	}{
+		{
+			name: "missing",
+			want: ModeReport{
+				Mode:    ModeDirect,
+				Probes:  []Probe{{"resolved-ping", "yes"}, {"rc", "missing"}, {"ret", "direct"}},
+				Reasons: []string{"/etc/resolv.conf doesn't exist, so we create it ourselves"},
+			},
+		},
+		{
+			name:       "resolved",
+			resolvConf: resolvedStub,
+			want: ModeReport{
+				Mode:            ModeSystemdResolved,
+				Probes:          []Probe{{"resolved-ping", "yes"}, {"rc", "resolved"}, {"nm", "no"}, {"resolv-conf-mode", "stub"}, {"ret", "systemd-resolved"}},
+				ResolvConfOwner: "systemd-resolved",
+				ResolvConfMode:  "stub",
+				Reasons: []string{
+					"/etc/resolv.conf header says it's managed by systemd-resolved",
+					"NetworkManager isn't running, so we program systemd-resolved",
+				},
+			},
+		},
+		{
+			name:       "old_nm",
+			resolvConf: resolvedStub,
+			nm:         true,
+			nmVersion:  "1.26.2",
+			want: ModeReport{
+				Mode:            ModeNetworkManager,
+				Probes:          []Probe{{"resolved-ping", "yes"}, {"rc", "resolved"}, {"nm", "yes"}, {"nm-resolved", "yes"}, {"nm-safe", "yes"}, {"ret", "network-manager"}},
+				ResolvConfOwner: "systemd-resolved",
+				NMVersion:       "1.26.2",
+				Reasons: []string{
+					"/etc/resolv.conf header says it's managed by systemd-resolved",
+					"NetworkManager is pushing DNS to systemd-resolved",
+					"NetworkManager 1.26.2 overrides other systemd-resolved clients, so we must go through it",
+				},
+			},
+		},
+		{
+			name:       "new_nm",
+			resolvConf: resolvedStub,
+			nm:         true,
+			nmVersion:  "1.30.0",
+			want: ModeReport{
+				Mode:            ModeSystemdResolved,
+				Probes:          []Probe{{"resolved-ping", "yes"}, {"rc", "resolved"}, {"nm", "yes"}, {"nm-resolved", "yes"}, {"nm-safe", "no"}, {"resolv-conf-mode", "stub"}, {"ret", "systemd-resolved"}},
+				ResolvConfOwner: "systemd-resolved",
+				NMVersion:       "1.30.0",
+				ResolvConfMode:  "stub",
+				Reasons: []string{
+					"/etc/resolv.conf header says it's managed by systemd-resolved",
+					"NetworkManager is pushing DNS to systemd-resolved",
+					"NetworkManager 1.30.0 doesn't get in the way, so we program systemd-resolved",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if tt.resolvConf != "" {
+				if err := os.MkdirAll(filepath.Join(root, "etc"), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(root, "etc/resolv.conf"), []byte(tt.resolvConf), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			bus := NewFakeBus()
+			NewFakeResolved(bus)
+			if tt.nm {
+				NewFakeNetworkManager(bus, tt.nmVersion, "systemd-resolved")
+			}
+			env := newOSConfigEnv{
+				health:          new(fakeHealth),
+				fs:              directFS{prefix: root},
+				bus:             bus,
+				resolvconfStyle: func() string { return "" },
+			}
+			var got ModeReport
+			mode, err := dnsMode(context.Background(), t.Logf, env, &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode != tt.want.Mode {
+				t.Errorf("mode = %q; want %q", mode, tt.want.Mode)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("report mismatch\n got: %+v\nwant: %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolvedUnsupportedOptions(t *testing.T) {
+	got := resolvedUnsupportedOptions(ResolverOptions{Ndots: 3, Rotate: true, EDNS0: true, UseVC: true, TrustAD: true})
+	want := []string{"ndots", "rotate", "use-vc"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if got := resolvedUnsupportedOptions(ResolverOptions{EDNS0: true, TrustAD: true}); len(got) != 0 {
+		t.Errorf("got %q; want none", got)
+	}
+}
+
+func TestBusConnsClosed(t *testing.T) {
+	ctx := context.Background()
+	bus := NewFakeBus()
+	NewFakeResolved(bus)
+	nm := NewFakeNetworkManager(bus, "1.26.2", "dnsmasq")
+	nm.AddDevice("tun0")
+
+	if err := dbusPing(ctx, bus, dbusResolvedObject, string(dbusResolvedPath)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dbusReadString(ctx, bus, dbusNMObject, string(dbusNMPath), dbusNMInterface, "Version"); err != nil {
+		t.Fatal(err)
+	}
+	lo := loopbackInterface(t)
+	revertResolvedLink(bus, &lo)
+	m, err := newNMManager("tun0", Options{Bus: bus})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := bus.OpenConns(); n != 0 {
+		t.Errorf("%d connections left open", n)
+	}
+}
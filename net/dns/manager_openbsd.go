@@ -5,62 +5,100 @@ package dns
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 
 	"github.com/anywherelan/ts-dns/types/logger"
 )
 
-type kv struct {
-	k, v string
+func newOSConfigurator(logf logger.Logf, interfaceName string, opts Options) (OSConfigurator, error) {
+	if opts.Mode == "" {
+		rep, err := detectMode(context.Background(), logf, opts)
+		if err != nil {
+			return nil, err
+		}
+		opts.Mode = rep.Mode
+	}
+	switch opts.Mode {
+	case ModeDirect:
+		return newDirectManager(logf, opts), nil
+	case ModeResolvd:
+		return newResolvdManager(logf, interfaceName, opts)
+	default:
+		return nil, errUnsupportedMode(opts.Mode)
+	}
 }
 
-func (kv kv) String() string {
-	return fmt.Sprintf("%s=%s", kv.k, kv.v)
+// recoverStale recovers from every backend that may have been used on
+// this system.
+func recoverStale(logf logger.Logf, interfaceName string, opts Options) []RecoveryAction {
+	var actions []RecoveryAction
+	// resolvd mode backs up resolv.conf like direct mode does, but
+	// what it leaves in place isn't marked as ours.
+	if bs, err := opts.fs().ReadFile(resolvConf); err == nil && rcIsResolvd(bs) {
+		m, err := newResolvdManager(logf, interfaceName, opts)
+		if err == nil {
+			if _, err := m.fs.Stat(opts.Identity.backupConf()); err == nil {
+				actions = append(actions, RecoveryAction{
+					Mode:   ModeResolvd,
+					Target: opts.Identity.backupConf(),
+					Action: "restored",
+					Err:    m.Close(),
+				})
+			}
+		}
+	}
+	actions = append(actions, recoverDirect(logf, opts)...)
+	return append(actions, recoverResolvconf(logf, opts)...)
 }
 
-func NewOSConfigurator(logf logger.Logf, interfaceName string) (OSConfigurator, error) {
-	return newOSConfigurator(logf, interfaceName,
-		newOSConfigEnv{
-			rcIsResolvd: rcIsResolvd,
-			fs:          directFS{},
-		})
+// detectMode detects which backend to use on this system.
+func detectMode(_ context.Context, logf logger.Logf, opts Options) (*ModeReport, error) {
+	return detectModeEnv(logf, newOSConfigEnv{
+		rcIsResolvd: rcIsResolvd,
+		fs:          opts.fs(),
+	})
 }
 
-// newOSConfigEnv are the funcs newOSConfigurator needs, pulled out for testing.
+// newOSConfigEnv are the funcs detectModeEnv needs, pulled out for testing.
 type newOSConfigEnv struct {
-	fs          directFS
+	fs          WholeFileFS
 	rcIsResolvd func(resolvConfContents []byte) bool
 }
 
-func newOSConfigurator(logf logger.Logf, interfaceName string, env newOSConfigEnv) (ret OSConfigurator, err error) {
-	var debug []kv
-	dbg := func(k, v string) {
-		debug = append(debug, kv{k, v})
-	}
+func detectModeEnv(logf logger.Logf, env newOSConfigEnv) (*ModeReport, error) {
+	rep := new(ModeReport)
 	defer func() {
-		if ret != nil {
-			dbg("ret", fmt.Sprintf("%T", ret))
+		if rep.Mode != "" {
+			rep.probe("ret", rep.Mode)
 		}
-		logf("dns: %v", debug)
+		logf("dns: %v", rep.Probes)
 	}()
 
 	bs, err := env.fs.ReadFile(resolvConf)
 	if os.IsNotExist(err) {
-		dbg("rc", "missing")
-		return newDirectManager(logf), nil
+		rep.probe("rc", "missing")
+		rep.reason("/etc/resolv.conf doesn't exist, so we create it ourselves")
+		rep.Mode = ModeDirect
+		return rep, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("reading /etc/resolv.conf: %w", err)
 	}
 
 	if env.rcIsResolvd(bs) {
-		dbg("resolvd", "yes")
-		return newResolvdManager(logf, interfaceName)
+		rep.probe("resolvd", "yes")
+		rep.ResolvConfOwner = "resolvd"
+		rep.reason("/etc/resolv.conf header says it's managed by resolvd")
+		rep.Mode = ModeResolvd
+		return rep, nil
 	}
 
-	dbg("resolvd", "missing")
-	return newDirectManager(logf), nil
+	rep.probe("resolvd", "missing")
+	rep.reason("/etc/resolv.conf isn't managed by resolvd, so we replace it directly")
+	rep.Mode = ModeDirect
+	return rep, nil
 }
 
 func rcIsResolvd(resolvConfContents []byte) bool {
@@ -71,3 +109,12 @@ func rcIsResolvd(resolvConfContents []byte) bool {
 	}
 	return false
 }
+
+// undoPlatformJournalEntry undoes the journaled changes specific to
+// this platform, and reports whether e was one.
+func undoPlatformJournalEntry(logf logger.Logf, opts Options, e JournalEntry) ([]RecoveryAction, bool) {
+	if e.Kind != JournalRecord {
+		return nil, false
+	}
+	return undoResolvconfRecord(logf, opts, e), true
+}
@@ -0,0 +1,250 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/anywherelan/ts-dns/util/dnsname"
+)
+
+type fakeOSConfigurator struct {
+	SplitDNS   bool
+	BaseConfig OSConfig
+	BaseErr    error
+	SetErr     error
+
+	OSConfig OSConfig
+	SetCalls int
+	Closed   bool
+}
+
+func (c *fakeOSConfigurator) SetDNS(cfg OSConfig) error {
+	c.SetCalls++
+	if c.SetErr != nil {
+		return c.SetErr
+	}
+	c.OSConfig = cfg
+	return nil
+}
+
+func (c *fakeOSConfigurator) SupportsSplitDNS() bool { return c.SplitDNS }
+
+func (c *fakeOSConfigurator) GetBaseConfig() (OSConfig, error) {
+	return c.BaseConfig, c.BaseErr
+}
+
+func (c *fakeOSConfigurator) Close() error {
+	c.Closed = true
+	return nil
+}
+
+func mustIPs(strs ...string) (ret []netip.Addr) {
+	for _, s := range strs {
+		ret = append(ret, netip.MustParseAddr(s))
+	}
+	return ret
+}
+
+func fqdns(strs ...string) (ret []dnsname.FQDN) {
+	for _, s := range strs {
+		fqdn, err := dnsname.ToFQDN(s)
+		if err != nil {
+			panic(err)
+		}
+		ret = append(ret, fqdn)
+	}
+	return ret
+}
+
+func TestManagerCompile(t *testing.T) {
+	tests := []struct {
+		name  string
+		split bool
+		bs    OSConfig
+		in    Config
+		want  OSConfig
+	}{
+		{
+			name: "empty",
+			in:   Config{},
+			want: OSConfig{},
+		},
+		{
+			name: "search-only",
+			in:   Config{SearchDomains: fqdns("corp.example")},
+			want: OSConfig{SearchDomains: fqdns("corp.example")},
+		},
+		{
+			name:  "split",
+			split: true,
+			in: Config{
+				Routes: map[dnsname.FQDN][]netip.Addr{
+					"b.example.": mustIPs("10.0.0.1"),
+					"a.example.": mustIPs("10.0.0.1"),
+				},
+				SearchDomains: fqdns("a.example"),
+			},
+			want: OSConfig{
+				Nameservers:   mustIPs("10.0.0.1"),
+				SearchDomains: fqdns("a.example"),
+				MatchDomains:  fqdns("a.example", "b.example"),
+			},
+		},
+		{
+			name:  "split-different-resolvers",
+			split: true,
+			in: Config{
+				Routes: map[dnsname.FQDN][]netip.Addr{
+					"a.example.": mustIPs("10.0.0.1"),
+					"b.example.": mustIPs("10.0.0.2", "10.0.0.1"),
+				},
+			},
+			want: OSConfig{
+				Nameservers: mustIPs("10.0.0.1", "10.0.0.2"),
+			},
+		},
+		{
+			name: "no-split-merges-base-search",
+			bs: OSConfig{
+				Nameservers:   mustIPs("192.168.1.1"),
+				SearchDomains: fqdns("home.lan", "a.example"),
+			},
+			in: Config{
+				Routes: map[dnsname.FQDN][]netip.Addr{
+					"a.example.": mustIPs("10.0.0.1"),
+				},
+				SearchDomains: fqdns("a.example"),
+			},
+			want: OSConfig{
+				Nameservers:   mustIPs("10.0.0.1"),
+				SearchDomains: fqdns("a.example", "home.lan"),
+			},
+		},
+		{
+			name:  "default-resolvers",
+			split: true,
+			in: Config{
+				DefaultResolvers: mustIPs("10.0.0.53"),
+				Routes: map[dnsname.FQDN][]netip.Addr{
+					"a.example.": mustIPs("10.0.0.1"),
+				},
+			},
+			want: OSConfig{
+				Nameservers: mustIPs("10.0.0.53"),
+			},
+		},
+		{
+			name: "hosts",
+			in: Config{
+				Hosts: map[dnsname.FQDN][]netip.Addr{
+					"b.example.": mustIPs("10.0.0.2"),
+					"a.example.": mustIPs("10.0.0.2", "10.0.0.1"),
+				},
+			},
+			want: OSConfig{
+				Hosts: []*HostEntry{
+					{Addr: netip.MustParseAddr("10.0.0.1"), Hosts: []string{"a.example"}},
+					{Addr: netip.MustParseAddr("10.0.0.2"), Hosts: []string{"a.example", "b.example"}},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeOSConfigurator{SplitDNS: tt.split, BaseConfig: tt.bs}
+			m := NewManager(t.Logf, f)
+			if err := m.Set(tt.in); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(f.OSConfig, tt.want) {
+				t.Errorf("wrong OSConfig\n got: %+v\nwant: %+v", f.OSConfig, tt.want)
+			}
+		})
+	}
+}
+
+func TestManagerReapply(t *testing.T) {
+	f := &fakeOSConfigurator{SplitDNS: true}
+	m := NewManager(t.Logf, f)
+	cfg := Config{
+		Routes: map[dnsname.FQDN][]netip.Addr{
+			"a.example.": mustIPs("10.0.0.1"),
+		},
+	}
+
+	if err := m.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if f.SetCalls != 1 {
+		t.Errorf("SetCalls = %d after identical Set; want 1", f.SetCalls)
+	}
+
+	f.SetErr = errors.New("boom")
+	if err := m.Reapply(); err == nil {
+		t.Fatal("Reapply succeeded; want error")
+	}
+	if _, applied := m.LastOSConfig(); applied {
+		t.Error("LastOSConfig reports applied after failure")
+	}
+
+	// After an error, an identical Set must hit the OS again.
+	f.SetErr = nil
+	if err := m.Set(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if f.SetCalls != 3 {
+		t.Errorf("SetCalls = %d; want 3", f.SetCalls)
+	}
+	if _, applied := m.LastOSConfig(); !applied {
+		t.Error("LastOSConfig reports not applied after success")
+	}
+
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Closed {
+		t.Error("Down didn't close the OSConfigurator")
+	}
+}
+
+func TestManagerSetContext(t *testing.T) {
+	f := &fakeOSConfigurator{SplitDNS: true}
+	m := NewManager(t.Logf, f)
+	cfg := Config{Routes: map[dnsname.FQDN][]netip.Addr{"a.example.": mustIPs("10.0.0.1")}}
+
+	// An OSConfigurator without context support isn't called at all
+	// once ctx is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.SetContext(ctx, cfg); !errors.Is(err, context.Canceled) {
+		t.Errorf("SetContext with a cancelled ctx = %v; want %v", err, context.Canceled)
+	}
+	if f.SetCalls != 0 {
+		t.Errorf("SetCalls = %d after a cancelled SetContext; want 0", f.SetCalls)
+	}
+	if _, applied := m.LastOSConfig(); applied {
+		t.Error("LastOSConfig reports applied after a cancelled SetContext")
+	}
+
+	if err := m.SetContext(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if f.SetCalls != 1 {
+		t.Errorf("SetCalls = %d; want 1", f.SetCalls)
+	}
+	if err := m.DownContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Closed {
+		t.Error("DownContext didn't close the OSConfigurator")
+	}
+}
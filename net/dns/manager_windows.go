@@ -4,17 +4,14 @@
 package dns
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net/netip"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"sort"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/anywherelan/ts-dns/atomicfile"
@@ -36,15 +33,28 @@ var configureWSL = envknob.RegisterBool("TS_DEBUG_CONFIGURE_WSL")
 type windowsManager struct {
 	logf       logger.Logf
 	guid       string
+	ident      Identity      // names our hosts file section
+	runner     CommandRunner // for ipconfig
 	nrptDB     *nrptRuleDatabase
 	wslManager *wslManager
+	life       lifecycle
 }
 
-func NewOSConfigurator(logf logger.Logf, interfaceName string) (OSConfigurator, error) {
+// detectMode detects which backend to use on this system.
+func detectMode(context.Context, logger.Logf, Options) (*ModeReport, error) {
+	return singleBackendReport("NRPT rules and interface settings"), nil
+}
+
+func newOSConfigurator(logf logger.Logf, interfaceName string, opts Options) (OSConfigurator, error) {
+	if opts.Mode != "" {
+		return nil, errUnsupportedMode(opts.Mode)
+	}
 	ret := &windowsManager{
 		logf:       logf,
 		guid:       interfaceName,
-		wslManager: newWSLManager(logf),
+		ident:      opts.Identity,
+		runner:     opts.Runner,
+		wslManager: newWSLManager(logf, opts),
 	}
 
 	if isWindows10OrBetter() {
@@ -53,7 +63,7 @@ func NewOSConfigurator(logf logger.Logf, interfaceName string) (OSConfigurator,
 
 	go func() {
 		// Log WSL status once at startup.
-		if distros, err := wslDistros(); err != nil {
+		if distros, err := wslDistros(opts.Runner); err != nil {
 			logf("WSL: could not list distributions: %v", err)
 		} else {
 			logf("WSL: found %d distributions", len(distros))
@@ -106,52 +116,6 @@ func (m *windowsManager) setSplitDNS(resolvers []netip.Addr, domains []dnsname.F
 	return m.nrptDB.WriteSplitDNSConfig(servers, domains)
 }
 
-func setTailscaleHosts(prevHostsFile []byte, hosts []*HostEntry) ([]byte, error) {
-	b := bytes.ReplaceAll(prevHostsFile, []byte("\r\n"), []byte("\n"))
-	sc := bufio.NewScanner(bytes.NewReader(b))
-	const (
-		header = "# TailscaleHostsSectionStart"
-		footer = "# TailscaleHostsSectionEnd"
-	)
-	var comments = []string{
-		"# This section contains MagicDNS entries for Tailscale.",
-		"# Do not edit this section manually.",
-	}
-	var out bytes.Buffer
-	var inSection bool
-	for sc.Scan() {
-		line := strings.TrimSpace(sc.Text())
-		if line == header {
-			inSection = true
-			continue
-		}
-		if line == footer {
-			inSection = false
-			continue
-		}
-		if inSection {
-			continue
-		}
-		fmt.Fprintln(&out, line)
-	}
-	if err := sc.Err(); err != nil {
-		return nil, err
-	}
-	if len(hosts) > 0 {
-		fmt.Fprintln(&out, header)
-		for _, c := range comments {
-			fmt.Fprintln(&out, c)
-		}
-		fmt.Fprintln(&out)
-		for _, he := range hosts {
-			fmt.Fprintf(&out, "%s %s\n", he.Addr, strings.Join(he.Hosts, " "))
-		}
-		fmt.Fprintln(&out)
-		fmt.Fprintln(&out, footer)
-	}
-	return bytes.ReplaceAll(out.Bytes(), []byte("\n"), []byte("\r\n")), nil
-}
-
 // setHosts sets the hosts file to contain the given host entries.
 func (m *windowsManager) setHosts(hosts []*HostEntry) error {
 	systemDir, err := windows.GetSystemDirectory()
@@ -163,10 +127,7 @@ func (m *windowsManager) setHosts(hosts []*HostEntry) error {
 	if err != nil {
 		return err
 	}
-	outB, err := setTailscaleHosts(b, hosts)
-	if err != nil {
-		return err
-	}
+	outB := setHostsSection(b, m.ident.name(), windowsHostsComments(m.ident), hosts, "\r\n").Bytes()
 	const fileMode = 0 // ignored on windows.
 
 	// This can fail spuriously with an access denied error, so retry it a
@@ -261,6 +222,11 @@ func (m *windowsManager) setPrimaryDNS(resolvers []netip.Addr, domains []dnsname
 }
 
 func (m *windowsManager) SetDNS(cfg OSConfig) error {
+	return m.life.set(func() error { return m.setDNS(cfg) })
+}
+
+// setDNS implements SetDNS.
+func (m *windowsManager) setDNS(cfg OSConfig) error {
 	// We can configure Windows DNS in one of two ways:
 	//
 	//  - In primary DNS mode, we set the NameServer and SearchList
@@ -344,9 +310,7 @@ func (m *windowsManager) SetDNS(cfg OSConfig) error {
 	go func() {
 		t0 := time.Now()
 		m.logf("running ipconfig /registerdns ...")
-		cmd := exec.Command("ipconfig", "/registerdns")
-		cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
-		err := cmd.Run()
+		_, err := runCommand(context.Background(), m.runner, "ipconfig", "/registerdns")
 		d := time.Since(t0).Round(time.Millisecond)
 		if err != nil {
 			m.logf("error running ipconfig /registerdns after %v: %v", d, err)
@@ -356,9 +320,7 @@ func (m *windowsManager) SetDNS(cfg OSConfig) error {
 
 		t0 = time.Now()
 		m.logf("running ipconfig /flushdns ...")
-		cmd = exec.Command("ipconfig", "/flushdns")
-		cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
-		err = cmd.Run()
+		_, err = runCommand(context.Background(), m.runner, "ipconfig", "/flushdns")
 		d = time.Since(t0).Round(time.Millisecond)
 		if err != nil {
 			m.logf("error running ipconfig /flushdns after %v: %v", d, err)
@@ -387,12 +349,14 @@ func (m *windowsManager) SupportsSplitDNS() bool {
 }
 
 func (m *windowsManager) Close() error {
-	err := m.SetDNS(OSConfig{})
-	if m.nrptDB != nil {
-		m.nrptDB.Close()
-		m.nrptDB = nil
-	}
-	return err
+	return m.life.close(func() error {
+		err := m.setDNS(OSConfig{})
+		if m.nrptDB != nil {
+			m.nrptDB.Close()
+			m.nrptDB = nil
+		}
+		return err
+	})
 }
 
 // disableDynamicUpdates sets the appropriate registry values to prevent the
@@ -541,3 +505,15 @@ func isWindows10OrBetter() bool {
 	}
 	return true
 }
+
+// recoverStale does nothing: the NRPT rules and interface settings we
+// write are tied to our interface, and go away with it.
+func recoverStale(logger.Logf, string, Options) []RecoveryAction {
+	return nil
+}
+
+// undoPlatformJournalEntry undoes the journaled changes specific to
+// this platform, of which there are none.
+func undoPlatformJournalEntry(logger.Logf, Options, JournalEntry) ([]RecoveryAction, bool) {
+	return nil, false
+}
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/anywherelan/ts-dns/net/interfaces"
+	"github.com/anywherelan/ts-dns/types/logger"
 	"github.com/anywherelan/ts-dns/util/dnsname"
 	"github.com/godbus/dbus/v5"
 	"github.com/josharian/native"
@@ -24,55 +25,84 @@ const (
 	lowerPriority   = int32(200) // lower than all builtin auto priorities
 )
 
+// D-Bus entities of NetworkManager.
+const (
+	dbusNMObject                       = "org.freedesktop.NetworkManager"
+	dbusNMPath         dbus.ObjectPath = "/org/freedesktop/NetworkManager"
+	dbusNMInterface                    = "org.freedesktop.NetworkManager"
+	dbusNMDevice                       = "org.freedesktop.NetworkManager.Device"
+	dbusNMDNSPath      dbus.ObjectPath = "/org/freedesktop/NetworkManager/DnsManager"
+	dbusNMDNSInterface                 = "org.freedesktop.NetworkManager.DnsManager"
+)
+
 // nmManager uses the NetworkManager DBus API.
 type nmManager struct {
 	interfaceName string
-	manager       dbus.BusObject
-	dnsManager    dbus.BusObject
+	bus           Bus
+	life          lifecycle
+}
+
+// NewNMManager returns an OSConfigurator that programs NetworkManager
+// over D-Bus for the interface named interfaceName. It's the
+// ModeNetworkManager backend.
+func NewNMManager(logf logger.Logf, interfaceName string, opts Options) (OSConfigurator, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return newNMManager(interfaceName, opts)
 }
 
-func newNMManager(interfaceName string) (*nmManager, error) {
-	conn, err := dbus.SystemBus()
+func newNMManager(interfaceName string, opts Options) (*nmManager, error) {
+	conn, err := busOrDefault(opts.Bus).Dial()
 	if err != nil {
 		return nil, err
 	}
 
 	return &nmManager{
 		interfaceName: interfaceName,
-		manager:       conn.Object("org.freedesktop.NetworkManager", dbus.ObjectPath("/org/freedesktop/NetworkManager")),
-		dnsManager:    conn.Object("org.freedesktop.NetworkManager", dbus.ObjectPath("/org/freedesktop/NetworkManager/DnsManager")),
+		bus:           conn,
 	}, nil
 }
 
 type nmConnectionSettings map[string]map[string]dbus.Variant
 
 func (m *nmManager) SetDNS(config OSConfig) error {
-	ctx, cancel := context.WithTimeout(context.Background(), reconfigTimeout)
+	return m.SetDNSContext(context.Background(), config)
+}
+
+// SetDNSContext implements ContextOSConfigurator.
+func (m *nmManager) SetDNSContext(ctx context.Context, config OSConfig) error {
+	return m.life.set(func() error { return m.setDNS(ctx, config) })
+}
+
+// setDNS implements SetDNSContext.
+func (m *nmManager) setDNS(ctx context.Context, config OSConfig) error {
+	ctx, cancel := withDefaultTimeout(ctx, reconfigTimeout)
 	defer cancel()
 
 	// NetworkManager only lets you set DNS settings on "active"
 	// connections, which requires an assigned IP address. This got
 	// configured before the DNS manager was invoked, but it might
 	// take a little time for the netlink notifications to propagate
-	// up. So, keep retrying for the duration of the reconfigTimeout.
-	var err error
-	for ctx.Err() == nil {
-		err = m.trySet(ctx, config)
+	// up. So, keep retrying until ctx is done.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for {
+		err := m.trySet(ctx, config)
 		if err == nil {
-			break
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(10 * time.Millisecond):
 		}
-		time.Sleep(10 * time.Millisecond)
 	}
-
-	return err
 }
 
 func (m *nmManager) trySet(ctx context.Context, config OSConfig) error {
-	conn, err := dbus.SystemBus()
-	if err != nil {
-		return fmt.Errorf("connecting to system bus: %w", err)
-	}
-
 	// This is how we get at the DNS settings:
 	//
 	//               org.freedesktop.NetworkManager
@@ -92,29 +122,19 @@ func (m *nmManager) trySet(ctx context.Context, config OSConfig) error {
 	//
 	// Ref: https://developer.gnome.org/NetworkManager/stable/settings-ipv4.html.
 
-	nm := conn.Object(
-		"org.freedesktop.NetworkManager",
-		dbus.ObjectPath("/org/freedesktop/NetworkManager"),
-	)
-
-	var devicePath dbus.ObjectPath
-	err = nm.CallWithContext(
-		ctx, "org.freedesktop.NetworkManager.GetDeviceByIpIface", 0,
-		m.interfaceName,
-	).Store(&devicePath)
+	devicePath, err := m.devicePath(ctx)
 	if err != nil {
-		return fmt.Errorf("getDeviceByIpIface: %w", err)
+		return err
 	}
-	device := conn.Object("org.freedesktop.NetworkManager", devicePath)
 
 	var (
 		settings nmConnectionSettings
 		version  uint64
 	)
-	err = device.CallWithContext(
-		ctx, "org.freedesktop.NetworkManager.Device.GetAppliedConnection", 0,
-		uint32(0),
-	).Store(&settings, &version)
+	body, err := m.bus.Call(ctx, dbusNMObject, devicePath, dbusNMDevice+".GetAppliedConnection", uint32(0))
+	if err == nil {
+		err = dbus.Store(body, &settings, &version)
+	}
 	if err != nil {
 		return fmt.Errorf("getAppliedConnection: %w", err)
 	}
@@ -167,7 +187,7 @@ func (m *nmManager) trySet(ctx context.Context, config OSConfig) error {
 		seen[dom] = true
 		search = append(search, "~"+dom.WithTrailingDot())
 	}
-	if len(config.MatchDomains) == 0 {
+	if len(config.MatchDomains) == 0 && len(config.Nameservers) > 0 {
 		// Non-split routing requested, add an all-domains match.
 		search = append(search, "~.")
 	}
@@ -179,9 +199,15 @@ func (m *nmManager) trySet(ctx context.Context, config OSConfig) error {
 	// effectively fine. We used to try and enforce LLMNR and mdns
 	// settings here, but that led to #1870.
 
+	var dnsOptions []string
+	for _, o := range config.ResolverOptions.resolvConfOptions() {
+		dnsOptions = append(dnsOptions, o.String())
+	}
+
 	ipv4Map := settings["ipv4"]
 	ipv4Map["dns"] = dbus.MakeVariant(dnsv4)
 	ipv4Map["dns-search"] = dbus.MakeVariant(search)
+	setNMDNSOptions(ipv4Map, dnsOptions)
 	// We should only request priority if we have nameservers to set.
 	if len(dnsv4) == 0 {
 		ipv4Map["dns-priority"] = dbus.MakeVariant(lowerPriority)
@@ -221,6 +247,7 @@ func (m *nmManager) trySet(ctx context.Context, config OSConfig) error {
 
 	ipv6Map["dns"] = dbus.MakeVariant(dnsv6)
 	ipv6Map["dns-search"] = dbus.MakeVariant(search)
+	setNMDNSOptions(ipv6Map, dnsOptions)
 	if len(dnsv6) == 0 {
 		ipv6Map["dns-priority"] = dbus.MakeVariant(lowerPriority)
 	} else if len(config.MatchDomains) > 0 {
@@ -246,23 +273,66 @@ func (m *nmManager) trySet(ctx context.Context, config OSConfig) error {
 		delete(ipv6Map, property)
 	}
 
-	if call := device.CallWithContext(ctx, "org.freedesktop.NetworkManager.Device.Reapply", 0, settings, version, uint32(0)); call.Err != nil {
-		return fmt.Errorf("reapply: %w", call.Err)
+	// Reapply is the only call that changes anything, and
+	// NetworkManager applies it all or nothing, so a failure never
+	// needs rolling back.
+	if _, err := m.bus.Call(ctx, dbusNMObject, devicePath, dbusNMDevice+".Reapply", settings, version, uint32(0)); err != nil {
+		return fmt.Errorf("reapply: %w", err)
 	}
 
 	return nil
 }
 
-func (m *nmManager) SupportsSplitDNS() bool {
-	var mode string
-	v, err := m.dnsManager.GetProperty("org.freedesktop.NetworkManager.DnsManager.Mode")
+// devicePath returns the object path of the NetworkManager device of
+// our interface.
+func (m *nmManager) devicePath(ctx context.Context) (dbus.ObjectPath, error) {
+	var path dbus.ObjectPath
+	body, err := m.bus.Call(ctx, dbusNMObject, dbusNMPath, dbusNMInterface+".GetDeviceByIpIface", m.interfaceName)
+	if err == nil {
+		err = dbus.Store(body, &path)
+	}
 	if err != nil {
-		return false
+		return "", fmt.Errorf("getDeviceByIpIface: %w", err)
 	}
-	mode, ok := v.Value().(string)
-	if !ok {
-		return false
+	return path, nil
+}
+
+// dnsMode returns NetworkManager's DNS processing mode, such as
+// "systemd-resolved" or "dnsmasq", or "" if it can't be read.
+func (m *nmManager) dnsMode() string {
+	ctx, cancel := context.WithTimeout(context.Background(), reconfigTimeout)
+	defer cancel()
+	v, err := m.bus.GetProperty(ctx, dbusNMObject, dbusNMDNSPath, dbusNMDNSInterface, "Mode")
+	if err != nil {
+		return ""
+	}
+	mode, _ := v.Value().(string)
+	return mode
+}
+
+// UnsupportedResolverOptions implements ResolverOptionsChecker.
+// NetworkManager applies ResolverOptions as the connection's
+// dns-options, which it writes to resolv.conf itself in most modes, but
+// doesn't pass on to systemd-resolved.
+func (m *nmManager) UnsupportedResolverOptions(o ResolverOptions) []string {
+	if m.dnsMode() == "systemd-resolved" {
+		return resolvedUnsupportedOptions(o)
+	}
+	return nil
+}
+
+// setNMDNSOptions sets the dns-options of the IP settings ipMap to
+// opts, or resets them to the default if opts is empty.
+func setNMDNSOptions(ipMap map[string]dbus.Variant, opts []string) {
+	if len(opts) == 0 {
+		delete(ipMap, "dns-options")
+		return
 	}
+	ipMap["dns-options"] = dbus.MakeVariant(opts)
+}
+
+func (m *nmManager) SupportsSplitDNS() bool {
+	mode := m.dnsMode()
 
 	// Per NM's documentation, it only does split-DNS when it's
 	// programming dnsmasq or systemd-resolved. All other modes are
@@ -271,13 +341,9 @@ func (m *nmManager) SupportsSplitDNS() bool {
 }
 
 func (m *nmManager) GetBaseConfig() (OSConfig, error) {
-	conn, err := dbus.SystemBus()
-	if err != nil {
-		return OSConfig{}, err
-	}
-
-	nm := conn.Object("org.freedesktop.NetworkManager", dbus.ObjectPath("/org/freedesktop/NetworkManager/DnsManager"))
-	v, err := nm.GetProperty("org.freedesktop.NetworkManager.DnsManager.Configuration")
+	ctx, cancel := context.WithTimeout(context.Background(), reconfigTimeout)
+	defer cancel()
+	v, err := m.bus.GetProperty(ctx, dbusNMObject, dbusNMDNSPath, dbusNMDNSInterface, "Configuration")
 	if err != nil {
 		return OSConfig{}, err
 	}
@@ -373,7 +439,21 @@ func (m *nmManager) GetBaseConfig() (OSConfig, error) {
 }
 
 func (m *nmManager) Close() error {
-	// No need to do anything on close, NetworkManager will delete our
-	// settings when the tailscale interface goes away.
-	return nil
+	return m.CloseContext(context.Background())
+}
+
+// CloseContext implements ContextOSConfigurator.
+func (m *nmManager) CloseContext(ctx context.Context) error {
+	return m.life.close(func() error {
+		defer m.bus.Close()
+		ctx, cancel := withDefaultTimeout(ctx, reconfigTimeout)
+		defer cancel()
+		// NetworkManager deletes our settings when the tailscale
+		// interface goes away, so if it's gone already, or
+		// NetworkManager is, there's nothing to remove.
+		if _, err := m.devicePath(ctx); err != nil {
+			return nil
+		}
+		return m.trySet(ctx, OSConfig{})
+	})
 }
@@ -0,0 +1,160 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package dns
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/josharian/native"
+)
+
+func TestNMSetDNS(t *testing.T) {
+	bus := NewFakeBus()
+	nm := NewFakeNetworkManager(bus, "1.26.2", "dnsmasq")
+	nm.AddDevice("tun0")
+	m, err := newNMManager("tun0", Options{Bus: bus})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.SupportsSplitDNS() {
+		t.Error("no split DNS with dnsmasq")
+	}
+
+	ns := mustIPs("100.101.102.103", "fd7a:115c:a1e0::53")
+	if err := m.SetDNS(OSConfig{
+		Nameservers:     ns,
+		SearchDomains:   fqdns("corp.example."),
+		MatchDomains:    fqdns("ts.example."),
+		ResolverOptions: ResolverOptions{Ndots: 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	settings, version := nm.Applied("tun0")
+	if version != 2 {
+		t.Errorf("version = %d; want 2, after one Reapply", version)
+	}
+	v4 := ns[0].As4()
+	ns6 := ns[1].As16()
+	want := map[string]any{
+		"ipv4.dns":          []uint32{native.Endian.Uint32(v4[:])},
+		"ipv4.dns-search":   []string{"corp.example.", "~ts.example."},
+		"ipv4.dns-priority": mediumPriority,
+		"ipv4.dns-options":  []string{"ndots:2"},
+		"ipv6.dns":          [][]byte{ns6[:]},
+		"ipv6.dns-priority": mediumPriority,
+		"ipv6.method":       "auto",
+	}
+	for k, w := range want {
+		ip, name, _ := strings.Cut(k, ".")
+		if got := settings[ip][name].Value(); !reflect.DeepEqual(got, w) {
+			t.Errorf("%s = %#v; want %#v", k, got, w)
+		}
+	}
+	if _, ok := settings["ipv4"]["addresses"]; ok {
+		t.Error("deprecated ipv4.addresses were reapplied")
+	}
+
+	// A zero config sets a low priority, so that other connections win.
+	if err := m.SetDNS(OSConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	settings, _ = nm.Applied("tun0")
+	if got := settings["ipv4"]["dns-priority"].Value(); got != lowerPriority {
+		t.Errorf("ipv4.dns-priority of a zero config = %v; want %v", got, lowerPriority)
+	}
+	if _, ok := settings["ipv4"]["dns-options"]; ok {
+		t.Error("ipv4.dns-options kept after a zero config")
+	}
+}
+
+func TestNMSetDNSUnknownDevice(t *testing.T) {
+	bus := NewFakeBus()
+	NewFakeNetworkManager(bus, "1.26.2", "default")
+	m, err := newNMManager("tun0", Options{Bus: bus})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.SupportsSplitDNS() {
+		t.Error("split DNS in the default mode")
+	}
+	if err := m.SetDNS(OSConfig{Nameservers: mustIPs("100.100.100.100")}); err == nil {
+		t.Error("SetDNS succeeded without a device")
+	}
+}
+
+func TestNMSetDNSContext(t *testing.T) {
+	bus := NewFakeBus()
+	nm := NewFakeNetworkManager(bus, "1.26.2", "default")
+	m, err := newNMManager("tun0", Options{Bus: bus})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := OSConfig{Nameservers: mustIPs("100.100.100.100")}
+
+	// A short deadline cuts the retries for the device short.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := m.SetDNSContext(ctx, cfg); err == nil {
+		t.Error("SetDNSContext succeeded without a device")
+	}
+	if d := time.Since(start); d >= reconfigTimeout {
+		t.Errorf("SetDNSContext took %v; want it to give up at the deadline", d)
+	}
+
+	// A long one waits for a device that shows up after the default
+	// limit.
+	timer := time.AfterFunc(reconfigTimeout+50*time.Millisecond, func() { nm.AddDevice("tun0") })
+	defer timer.Stop()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := m.SetDNSContext(ctx, cfg); err != nil {
+		t.Errorf("SetDNSContext with a long deadline: %v", err)
+	}
+}
+
+func TestNMGetBaseConfig(t *testing.T) {
+	bus := NewFakeBus()
+	nm := NewFakeNetworkManager(bus, "1.26.2", "dnsmasq")
+	nm.SetDNSConfiguration([]map[string]dbus.Variant{
+		{
+			"interface":   dbus.MakeVariant("tun0"),
+			"nameservers": dbus.MakeVariant([]string{"100.100.100.100"}),
+			"priority":    dbus.MakeVariant(int32(-1)),
+		},
+		{
+			"interface":   dbus.MakeVariant("eth0"),
+			"nameservers": dbus.MakeVariant([]string{"192.168.1.1"}),
+			"domains":     dbus.MakeVariant([]string{"lan"}),
+			"priority":    dbus.MakeVariant(int32(100)),
+		},
+		{
+			"interface":   dbus.MakeVariant("wlan0"),
+			"nameservers": dbus.MakeVariant([]string{"10.0.0.1", "192.168.1.1"}),
+			"priority":    dbus.MakeVariant(int32(50)),
+		},
+	})
+	m, err := newNMManager("tun0", Options{Bus: bus})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.GetBaseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := OSConfig{
+		Nameservers:   mustIPs("10.0.0.1", "192.168.1.1"),
+		SearchDomains: fqdns("lan."),
+	}
+	if !got.Equal(want) {
+		t.Errorf("GetBaseConfig = %v; want %v", got, want)
+	}
+}
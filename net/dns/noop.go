@@ -3,15 +3,21 @@
 
 package dns
 
-type noopManager struct{}
+type noopManager struct {
+	life lifecycle
+}
 
-func (m noopManager) SetDNS(OSConfig) error  { return nil }
-func (m noopManager) SupportsSplitDNS() bool { return false }
-func (m noopManager) Close() error           { return nil }
-func (m noopManager) GetBaseConfig() (OSConfig, error) {
+func (m *noopManager) SetDNS(OSConfig) error {
+	return m.life.set(func() error { return nil })
+}
+func (m *noopManager) SupportsSplitDNS() bool { return false }
+func (m *noopManager) Close() error {
+	return m.life.close(func() error { return nil })
+}
+func (m *noopManager) GetBaseConfig() (OSConfig, error) {
 	return OSConfig{}, ErrGetBaseConfigNotSupported
 }
 
-func NewNoopManager() (noopManager, error) {
-	return noopManager{}, nil
+func NewNoopManager() (*noopManager, error) {
+	return new(noopManager), nil
 }
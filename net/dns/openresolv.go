@@ -7,62 +7,148 @@ package dns
 
 import (
 	"bytes"
-	"fmt"
-	"os/exec"
+	"context"
 	"strings"
+
+	"github.com/anywherelan/ts-dns/types/logger"
 )
 
 // openresolvManager manages DNS configuration using the openresolv
 // implementation of the `resolvconf` program.
-type openresolvManager struct{}
-
-func newOpenresolvManager() (openresolvManager, error) {
-	return openresolvManager{}, nil
+//
+// Our config snippet is named after the product, as given by ident.
+type openresolvManager struct {
+	logf    logger.Logf
+	ident   Identity
+	runner  CommandRunner
+	journal *journal   // records our snippet, or nil
+	owner   *ownerLock // held around our changes
+	life    lifecycle
 }
 
-func (m openresolvManager) deleteTailscaleConfig() error {
-	cmd := exec.Command("resolvconf", "-f", "-d", "tailscale")
-	out, err := cmd.CombinedOutput()
+// NewOpenresolvManager returns an OSConfigurator that uses the
+// openresolv implementation of resolvconf(8). It's the ModeOpenresolv
+// backend.
+func NewOpenresolvManager(logf logger.Logf, opts Options) (OSConfigurator, error) {
+	opts, err := opts.withDefaults()
 	if err != nil {
-		return fmt.Errorf("running %s: %s", cmd, out)
+		return nil, err
 	}
-	return nil
+	return newOpenresolvManager(logf, opts)
 }
 
-func (m openresolvManager) SetDNS(config OSConfig) error {
-	if config.IsZero() {
-		return m.deleteTailscaleConfig()
+func newOpenresolvManager(logf logger.Logf, opts Options) (*openresolvManager, error) {
+	return &openresolvManager{
+		logf:    logf,
+		ident:   opts.Identity,
+		runner:  opts.Runner,
+		journal: opts.journal,
+		owner:   newOwnerLock(logf, opts),
+	}, nil
+}
+
+// journalEntry returns the journal entry for our snippet.
+func (m *openresolvManager) journalEntry() JournalEntry {
+	return JournalEntry{Mode: ModeOpenresolv, Kind: JournalRecord, Target: m.ident.name()}
+}
+
+func (m *openresolvManager) deleteConfig(ctx context.Context, name string) error {
+	_, err := runCommand(ctx, m.runner, "resolvconf", "-f", "-d", name)
+	return err
+}
+
+func (m *openresolvManager) SetDNS(config OSConfig) error {
+	return m.SetDNSContext(context.Background(), config)
+}
+
+// SetDNSContext implements ContextOSConfigurator.
+func (m *openresolvManager) SetDNSContext(ctx context.Context, config OSConfig) error {
+	return m.life.set(func() error { return m.setDNS(ctx, config) })
+}
+
+// setDNS implements SetDNSContext.
+func (m *openresolvManager) setDNS(ctx context.Context, config OSConfig) error {
+	unlock, err := m.owner.serialize(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if !config.IsZero() {
+		if err := m.journal.intend(m.journalEntry()); err != nil {
+			return err
+		}
+	}
+
+	// Snippets left behind under a legacy product name would blend
+	// into, or even override, our config. Remove them, best effort.
+	for _, name := range m.ident.legacyNames() {
+		m.deleteConfig(ctx, name)
 	}
 
-	var stdin bytes.Buffer
-	writeResolvConf(&stdin, config.Nameservers, config.SearchDomains)
+	// Snapshot our snippet, to put it back if resolvconf fails
+	// after storing the new one, such as in a subscriber.
+	res, err := runCommand(ctx, m.runner, "resolvconf", "-l", m.ident.name())
+	if err != nil {
+		return err
+	}
+	prev := res.Stdout
 
-	cmd := exec.Command("resolvconf", "-m", "0", "-x", "-a", "tailscale")
-	cmd.Stdin = &stdin
-	out, err := cmd.CombinedOutput()
+	if config.IsZero() {
+		err = m.deleteConfig(ctx, m.ident.name())
+	} else {
+		var stdin bytes.Buffer
+		writeResolvConf(&stdin, m.ident, config)
+		err = m.addConfig(ctx, stdin.Bytes())
+	}
 	if err != nil {
-		return fmt.Errorf("running %s: %s", cmd, out)
+		return rollBack(m.logf, err, func() (bool, error) {
+			// ctx may be done, so the rollback isn't bound
+			// by it.
+			ctx := context.Background()
+			if len(bytes.TrimSpace(prev)) == 0 {
+				return true, m.deleteConfig(ctx, m.ident.name())
+			}
+			return true, m.addConfig(ctx, prev)
+		})
+	}
+	if config.IsZero() {
+		m.journal.forget(m.logf, m.journalEntry())
+	} else {
+		m.journal.applied(m.logf, m.journalEntry())
 	}
 	return nil
 }
 
-func (m openresolvManager) SupportsSplitDNS() bool {
+// addConfig adds or replaces our snippet with the resolv.conf conf, in
+// exclusive mode and ahead of all others.
+func (m *openresolvManager) addConfig(ctx context.Context, conf []byte) error {
+	_, err := runCommandStdin(ctx, m.runner, conf, "resolvconf", "-m", "0", "-x", "-a", m.ident.name())
+	return err
+}
+
+func (m *openresolvManager) SupportsSplitDNS() bool {
 	return false
 }
 
-func (m openresolvManager) GetBaseConfig() (OSConfig, error) {
+func (m *openresolvManager) GetBaseConfig() (OSConfig, error) {
 	// List the names of all config snippets openresolv is aware
 	// of. Snippets get listed in priority order (most to least),
 	// which we'll exploit later.
-	bs, err := exec.Command("resolvconf", "-i").CombinedOutput()
+	res, err := runCommand(context.Background(), m.runner, "resolvconf", "-i")
 	if err != nil {
 		return OSConfig{}, err
 	}
+	bs := res.CombinedOutput()
+
+	ours := map[string]bool{}
+	for _, name := range m.ident.allNames() {
+		ours[name] = true
+	}
 
-	// Remove the "tailscale" snippet from the list.
+	// Remove our own snippets from the list.
 	args := []string{"-l"}
 	for _, f := range strings.Split(strings.TrimSpace(string(bs)), " ") {
-		if f == "tailscale" {
+		if ours[f] {
 			continue
 		}
 		args = append(args, f)
@@ -79,15 +165,32 @@ func (m openresolvManager) GetBaseConfig() (OSConfig, error) {
 	// practice, openresolv uses are generally quite limited, and boil
 	// down to 1-2 DHCP leases, for which the correct outcome is a
 	// blended config like the one we produce here.
-	var buf bytes.Buffer
-	cmd := exec.Command("resolvconf", args...)
-	cmd.Stdout = &buf
-	if err := cmd.Run(); err != nil {
+	res, err = runCommand(context.Background(), m.runner, "resolvconf", args...)
+	if err != nil {
 		return OSConfig{}, err
 	}
-	return readResolv(&buf)
+	return readResolv(bytes.NewReader(res.Stdout))
+}
+
+func (m *openresolvManager) Close() error {
+	return m.CloseContext(context.Background())
+}
+
+// CloseContext implements ContextOSConfigurator.
+func (m *openresolvManager) CloseContext(ctx context.Context) error {
+	return m.life.close(func() error { return m.close(ctx) })
 }
 
-func (m openresolvManager) Close() error {
-	return m.deleteTailscaleConfig()
+// close implements CloseContext.
+func (m *openresolvManager) close(ctx context.Context) error {
+	unlock, err := m.owner.serialize(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := m.deleteConfig(ctx, m.ident.name()); err != nil {
+		return err
+	}
+	m.journal.forget(m.logf, m.journalEntry())
+	return nil
 }
@@ -0,0 +1,337 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"runtime"
+
+	"github.com/anywherelan/ts-dns/envknob"
+	"github.com/anywherelan/ts-dns/health"
+	"github.com/anywherelan/ts-dns/types/logger"
+)
+
+// Names of the OSConfigurator backends, for Options.Mode.
+// Each backend is only available on some platforms.
+const (
+	ModeDirect           = "direct"            // rewrite /etc/resolv.conf
+	ModeSystemdResolved  = "systemd-resolved"  // Linux: systemd-resolved over D-Bus
+	ModeNetworkManager   = "network-manager"   // Linux: NetworkManager over D-Bus
+	ModeDebianResolvconf = "debian-resolvconf" // Debian's resolvconf(8)
+	ModeOpenresolv       = "openresolv"        // openresolv's resolvconf(8)
+	ModeResolvd          = "resolvd"           // OpenBSD: resolvd(8) via route(8)
+)
+
+// modeEnvKnob names the environment variable that overrides
+// Options.Mode, for debugging in the field.
+const modeEnvKnob = "TS_DEBUG_DNS_MODE"
+
+// HealthSink receives the health state reported by an OSConfigurator.
+// *health.Tracker implements it.
+type HealthSink interface {
+	// SetDNSOSHealth sets the state of the OSConfigurator.
+	SetDNSOSHealth(error)
+	// SetDNSManagerHealth sets the state of the discovery of the
+	// OS's DNS setup.
+	SetDNSManagerHealth(error)
+}
+
+// healthOrDefault returns h, or the health package's default Tracker if
+// h is nil.
+func healthOrDefault(h HealthSink) HealthSink {
+	if h == nil {
+		return health.Default()
+	}
+	return h
+}
+
+// A BusDialer connects to the D-Bus system bus. On other platforms
+// than Linux, where D-Bus isn't used, Bus is only a placeholder.
+type BusDialer interface {
+	// Dial returns a new connection, which the caller must close.
+	Dial() (Bus, error)
+}
+
+// warnableTracker is implemented by HealthSinks, such as
+// *health.Tracker, that can also track Warnables.
+type warnableTracker interface {
+	NewWarnable(...health.WarnableOpt) *health.Warnable
+}
+
+// Options configures the OSConfigurator returned by
+// NewOSConfiguratorWithOptions. The zero value is the configuration
+// used by NewOSConfigurator.
+type Options struct {
+	// Identity names the files and records written to the OS, and
+	// the help links in generated files and health warnings.
+	// The zero value means DefaultIdentity.
+	Identity Identity
+
+	// Mode, if non-empty, forces the use of the named backend (one
+	// of the Mode constants) instead of detecting the right one.
+	// The TS_DEBUG_DNS_MODE environment variable overrides it.
+	Mode string
+
+	// Root, if non-empty, is prefixed to the paths of the files we
+	// read and write, such as /etc/resolv.conf. It's meant for
+	// tests and for managing a chroot or container from outside.
+	Root string
+
+	// FS, if non-nil, is the file system of the files that
+	// ModeDirect and Options.Hosts read and write, such as
+	// /etc/resolv.conf, instead of the host's under Root. A FakeFS
+	// fakes the file systems of containers and appliances in tests.
+	FS WholeFileFS
+
+	// Health receives health state changes. If nil, they go to the
+	// health package's default Tracker. Use a separate
+	// *health.Tracker per OSConfigurator to tell their health apart.
+	Health HealthSink
+
+	// Runner runs external programs, such as resolvconf(8) and
+	// systemctl(1). If nil, they're run on the host with os/exec.
+	// A RecordingRunner records what's run; a FakeRunner scripts
+	// the programs in tests.
+	Runner CommandRunner
+
+	// Bus connects to the D-Bus system bus, for the systemd-resolved
+	// and NetworkManager backends on Linux, and for detecting them.
+	// If nil, the host's system bus is used. A FakeBus fakes those
+	// services in tests.
+	Bus BusDialer
+
+	// DirectMerge configures how ModeDirect combines our
+	// configuration with the resolv.conf it replaces. The zero value
+	// replaces it entirely.
+	DirectMerge DirectMerge
+
+	// Trample says what ModeDirect does when another program
+	// overwrites the /etc/resolv.conf it wrote. The zero value,
+	// TrampleWarn, only reports it.
+	Trample TramplePolicy
+
+	// SplitDNSStub, if its address is valid, gives split DNS to the
+	// backends that lack it, such as ModeDirect and the resolvconf
+	// ones. For split configurations, they're pointed at an
+	// in-process Forwarder listening there, which sends queries for
+	// the match domains to our nameservers and the rest to the base
+	// configuration's. It should be an otherwise unused loopback
+	// address, like 127.0.0.100; its port must be 0 or 53, the only
+	// one resolv.conf can name. The backend must be able to report
+	// its base configuration.
+	SplitDNSStub netip.AddrPort
+
+	// Hosts says how OSConfig.Hosts is applied, on platforms other
+	// than Windows. The zero value, HostsIgnore, ignores them.
+	Hosts HostsMode
+
+	// HostsResponderAddr is the loopback address of the responder
+	// for HostsResponder, such as 127.0.0.101. A zero port means 53,
+	// the only one some backends can name.
+	HostsResponderAddr netip.AddrPort
+
+	// Ownership says what SetDNS does when another process,
+	// possibly of another product, owns the DNS configuration, as
+	// recorded in /var/run/ts-dns.owner. Every backend takes that
+	// file's lock while changing shared files, but only ModeDirect
+	// and ModeResolvd, which replace resolv.conf, claim ownership;
+	// the others write records or sections of their own. The zero
+	// value, OwnershipFail, fails SetDNS with an *OwnedError.
+	Ownership OwnershipPolicy
+
+	// StateDir, if non-empty, is the directory where the changes
+	// made to the OS are journaled, so that RecoverStale can undo
+	// them after a crash, and ReadJournal can show them. Unlike the
+	// files we configure, it's not under Root.
+	StateDir string
+
+	journal *journal // for StateDir; set by withDefaults
+}
+
+// TramplePolicy says what ModeDirect does when another program, such as
+// a DHCP client, overwrites the /etc/resolv.conf it wrote. Other
+// programs' changes are only noticed on Linux.
+type TramplePolicy int
+
+const (
+	// TrampleWarn logs the change and sets a health warning.
+	TrampleWarn TramplePolicy = iota
+	// TrampleReassert also rewrites our configuration. If the file
+	// keeps being overwritten, the rewrites back off, so as not to
+	// get into a write war with the other program.
+	TrampleReassert
+	// TrampleYield also takes the new file as the base
+	// configuration, as if it had been there before us, and
+	// re-applies our configuration on top of it. It backs off like
+	// TrampleReassert.
+	TrampleYield
+)
+
+func (p TramplePolicy) String() string {
+	switch p {
+	case TrampleWarn:
+		return "warn"
+	case TrampleReassert:
+		return "reassert"
+	case TrampleYield:
+		return "yield"
+	}
+	return fmt.Sprintf("TramplePolicy(%d)", int(p))
+}
+
+// DirectMerge is a strategy for merging our configuration with the
+// base resolv.conf, the one that was in place before we took over,
+// in ModeDirect.
+//
+// When any merging is requested, the base file's options are kept too,
+// unless our configuration sets an option of the same name.
+type DirectMerge struct {
+	// KeepNameservers keeps the base nameservers as fallbacks after
+	// ours. With no nameservers of our own, the base ones are used
+	// as they are.
+	KeepNameservers bool
+
+	// Search says how our search domains combine with the base
+	// ones.
+	Search SearchMerge
+}
+
+// enabled reports whether d requests any merging.
+func (d DirectMerge) enabled() bool {
+	return d.KeepNameservers || d.Search != SearchReplace
+}
+
+// SearchMerge says how our search domains combine with the base ones.
+type SearchMerge int
+
+const (
+	SearchReplace SearchMerge = iota // use only our search domains
+	SearchPrepend                    // ours, followed by the base ones
+	SearchAppend                     // the base ones, followed by ours
+)
+
+// withDefaults returns o with its nil and zero fields replaced by
+// their defaults, or an error if o is invalid.
+func (o Options) withDefaults() (Options, error) {
+	if err := o.Identity.Validate(); err != nil {
+		return o, err
+	}
+	if p := o.SplitDNSStub.Port(); o.SplitDNSStub.Addr().IsValid() && p != 0 && p != 53 {
+		return o, fmt.Errorf("the split DNS stub needs port 53, the only one resolv.conf can name, not %d", p)
+	}
+	switch o.Hosts {
+	case HostsIgnore, HostsFile, HostsResponder:
+	default:
+		return o, fmt.Errorf("unknown %v", o.Hosts)
+	}
+	if o.Hosts == HostsResponder && !o.HostsResponderAddr.Addr().IsValid() {
+		return o, errors.New("the hosts responder needs Options.HostsResponderAddr")
+	}
+	o.Identity = o.Identity.orDefault()
+	o.Health = healthOrDefault(o.Health)
+	o.Runner = runnerOrDefault(o.Runner)
+	o.Bus = busOrDefault(o.Bus)
+	if o.journal == nil {
+		o.journal = newJournal(o)
+	}
+	return o, nil
+}
+
+// path returns the location of the absolute path p under o.Root.
+func (o Options) path(p string) string {
+	return filepath.Join(o.Root, p)
+}
+
+// fs returns o.FS, or the host's file system under o.Root.
+func (o Options) fs() WholeFileFS {
+	if o.FS != nil {
+		return o.FS
+	}
+	return directFS{prefix: o.Root}
+}
+
+// NewOSConfigurator returns an OSConfigurator for the current OS that
+// manages DNS for the interface named interfaceName, using the default
+// Options.
+func NewOSConfigurator(logf logger.Logf, interfaceName string) (OSConfigurator, error) {
+	return NewOSConfiguratorWithOptions(logf, interfaceName, Options{})
+}
+
+// NewOSConfiguratorWithOptions is like NewOSConfigurator, but
+// configured by opts.
+func NewOSConfiguratorWithOptions(logf logger.Logf, interfaceName string, opts Options) (OSConfigurator, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	if mode := envknob.String(modeEnvKnob); mode != "" {
+		logf("dns: mode %q forced by %s", mode, modeEnvKnob)
+		opts.Mode = mode
+	}
+	c, err := newOSConfigurator(logf, interfaceName, opts)
+	if err != nil {
+		return nil, err
+	}
+	return wrapOSConfigurator(logf, c, opts)
+}
+
+// wrapOSConfigurator wraps the backend c in the OSConfigurators that add
+// the features opts asks for.
+func wrapOSConfigurator(logf logger.Logf, c OSConfigurator, opts Options) (OSConfigurator, error) {
+	if stub := opts.SplitDNSStub; stub.Addr().IsValid() && !c.SupportsSplitDNS() {
+		// The stub sends the queries outside the match domains to
+		// the base configuration's nameservers.
+		if _, err := c.GetBaseConfig(); errors.Is(err, ErrGetBaseConfigNotSupported) {
+			c.Close()
+			return nil, errors.New("the split DNS stub needs a DNS mode that reports its base configuration")
+		}
+		c = newSplitStub(logf, c, withDNSPort(stub))
+	}
+	if runtime.GOOS == "windows" {
+		return c, nil
+	}
+	switch opts.Hosts {
+	case HostsIgnore:
+	case HostsFile:
+		c = newHostsFileManager(logf, c, opts)
+	case HostsResponder:
+		if !c.SupportsSplitDNS() {
+			c.Close()
+			return nil, errors.New("the hosts responder needs a DNS mode with split DNS, or Options.SplitDNSStub")
+		}
+		c = newHostsResponder(logf, c, withDNSPort(opts.HostsResponderAddr))
+	default:
+		c.Close()
+		return nil, fmt.Errorf("unknown %v", opts.Hosts)
+	}
+	return c, nil
+}
+
+// withDNSPort returns ap, with port 53 if it has none.
+func withDNSPort(ap netip.AddrPort) netip.AddrPort {
+	if ap.Port() == 0 {
+		return netip.AddrPortFrom(ap.Addr(), 53)
+	}
+	return ap
+}
+
+// errUnsupportedMode returns the error for a forced mode that isn't
+// available on this platform.
+func errUnsupportedMode(mode string) error {
+	return fmt.Errorf("DNS mode %q is not supported on %s", mode, runtime.GOOS)
+}
+
+// NewDirectManager returns an OSConfigurator that replaces
+// /etc/resolv.conf with a generated file, keeping a backup of the
+// original. It's the ModeDirect backend.
+func NewDirectManager(logf logger.Logf, opts Options) (OSConfigurator, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return newDirectManager(logf, opts), nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestNewDirectManagerRoot(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "etc/resolv.conf"), []byte("nameserver 9.9.9.9\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewDirectManager(t.Logf, Options{Root: root, Identity: Identity{Name: "example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetDNS(OSConfig{Nameservers: []netip.Addr{netip.MustParseAddr("8.8.8.8")}}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(root, "etc/resolv.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(got), "nameserver 8.8.8.8\n") {
+		t.Errorf("resolv.conf under root wasn't written; got:\n%s", got)
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc/resolv.pre-example-backup.conf")); err != nil {
+		t.Errorf("backup under root: %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOptionsValidation(t *testing.T) {
+	if _, err := NewOSConfiguratorWithOptions(t.Logf, "none0", Options{Identity: Identity{Name: "../evil"}}); err == nil {
+		t.Error("invalid identity accepted")
+	}
+	if _, err := NewOSConfiguratorWithOptions(t.Logf, "none0", Options{Mode: "bogus"}); err == nil {
+		t.Error("unknown mode accepted")
+	}
+
+	if _, err := NewOSConfiguratorWithOptions(t.Logf, "none0", Options{SplitDNSStub: netip.MustParseAddrPort("127.0.0.100:5353")}); err == nil {
+		t.Error("split DNS stub on port 5353 accepted")
+	}
+	if _, err := NewOSConfiguratorWithOptions(t.Logf, "none0", Options{Hosts: HostsMode(42)}); err == nil {
+		t.Error("unknown hosts mode accepted")
+	}
+
+	// The split DNS stub needs the backend's base configuration.
+	fake := &fakeOSConfigurator{BaseErr: ErrGetBaseConfigNotSupported}
+	if _, err := wrapOSConfigurator(t.Logf, fake, Options{SplitDNSStub: netip.MustParseAddrPort("127.0.0.100:0")}); err == nil {
+		t.Error("split DNS stub accepted without a base config")
+	}
+	if !fake.Closed {
+		t.Error("backend not closed after failing to wrap it")
+	}
+	if runtime.GOOS != "windows" {
+		fake := new(fakeOSConfigurator)
+		if _, err := wrapOSConfigurator(t.Logf, fake, Options{Hosts: HostsMode(42)}); err == nil {
+			t.Error("unknown hosts mode accepted")
+		}
+		if !fake.Closed {
+			t.Error("backend not closed after an unknown hosts mode")
+		}
+	}
+
+	// The environment knob wins over Options.Mode.
+	t.Setenv(modeEnvKnob, "bogus")
+	_, err := NewOSConfiguratorWithOptions(t.Logf, "none0", Options{Mode: ModeDirect})
+	if err == nil || !strings.Contains(err.Error(), `"bogus"`) {
+		t.Errorf("env knob didn't override mode; err = %v", err)
+	}
+}
+
+func TestDetectModeForced(t *testing.T) {
+	rep, err := DetectModeWithOptions(context.Background(), Options{Mode: ModeDirect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Mode != ModeDirect || rep.ForcedBy != "options" {
+		t.Errorf("got mode %q forced by %q; want %q forced by options", rep.Mode, rep.ForcedBy, ModeDirect)
+	}
+
+	t.Setenv(modeEnvKnob, ModeOpenresolv)
+	rep, err = DetectModeWithOptions(context.Background(), Options{Mode: ModeDirect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Mode != ModeOpenresolv || rep.ForcedBy != modeEnvKnob {
+		t.Errorf("got mode %q forced by %q; want %q forced by %s", rep.Mode, rep.ForcedBy, ModeOpenresolv, modeEnvKnob)
+	}
+}
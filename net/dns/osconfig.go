@@ -5,10 +5,15 @@ package dns
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"net/netip"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/anywherelan/ts-dns/net/dns/resolvconffile"
 	"github.com/anywherelan/ts-dns/types/logger"
 	"github.com/anywherelan/ts-dns/util/dnsname"
 )
@@ -18,7 +23,8 @@ type OSConfigurator interface {
 	// SetDNS updates the OS's DNS configuration to match cfg.
 	// If cfg is the zero value, all Tailscale-related DNS
 	// configuration is removed.
-	// SetDNS must not be called after Close.
+	// SetDNS fails with ErrClosed after Close. It's safe to call
+	// concurrently.
 	// SetDNS takes ownership of cfg.
 	SetDNS(cfg OSConfig) error
 	// SupportsSplitDNS reports whether the configurator is capable of
@@ -36,9 +42,53 @@ type OSConfigurator interface {
 	// return ErrGetBaseConfigNotSupported.
 	GetBaseConfig() (OSConfig, error)
 	// Close removes Tailscale-related DNS configuration from the OS.
+	// Closing again does nothing.
 	Close() error
 }
 
+// A ContextOSConfigurator is an OSConfigurator whose changes the
+// caller can bound with a context. Its deadline and cancellation apply
+// to the D-Bus calls, commands and retries made, instead of the
+// backend's fixed limits, which only apply if the context has no
+// deadline. Slow machines at boot can then wait longer, and shutdown
+// paths less.
+//
+// The SetDNSContext and CloseContext functions work with any
+// OSConfigurator.
+type ContextOSConfigurator interface {
+	OSConfigurator
+	// SetDNSContext is like SetDNS, but gives up when ctx is done.
+	// Like a failing SetDNS, it may then leave a partial
+	// configuration in place.
+	SetDNSContext(ctx context.Context, cfg OSConfig) error
+	// CloseContext is like Close, but gives up when ctx is done,
+	// which may leave some of our configuration in place. The
+	// configurator is closed all the same.
+	CloseContext(ctx context.Context) error
+}
+
+// SetDNSContext applies cfg with c.SetDNSContext, if c is a
+// ContextOSConfigurator. Otherwise, it calls c.SetDNS, unless ctx is
+// already done, and the backend's own limits apply.
+func SetDNSContext(ctx context.Context, c OSConfigurator, cfg OSConfig) error {
+	if cc, ok := c.(ContextOSConfigurator); ok {
+		return cc.SetDNSContext(ctx, cfg)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.SetDNS(cfg)
+}
+
+// CloseContext closes c with c.CloseContext, if c is a
+// ContextOSConfigurator, and with c.Close otherwise.
+func CloseContext(ctx context.Context, c OSConfigurator) error {
+	if cc, ok := c.(ContextOSConfigurator); ok {
+		return cc.CloseContext(ctx)
+	}
+	return c.Close()
+}
+
 // HostEntry represents a single line in the OS's hosts file.
 type HostEntry struct {
 	Addr  netip.Addr
@@ -49,7 +99,8 @@ type HostEntry struct {
 type OSConfig struct {
 	// Hosts is a map of DNS FQDNs to their IPs, which should be added to the
 	// OS's hosts file. Currently, (2022-08-12) it is only populated for Windows
-	// in SplitDNS mode and with Smart Name Resolution turned on.
+	// in SplitDNS mode and with Smart Name Resolution turned on. Elsewhere,
+	// it's only applied as Options.Hosts says.
 	Hosts []*HostEntry
 	// Nameservers are the IP addresses of the nameservers to use.
 	Nameservers []netip.Addr
@@ -63,6 +114,138 @@ type OSConfig struct {
 	// from the OS, which will only work with OSConfigurators that
 	// report SupportsSplitDNS()=true.
 	MatchDomains []dnsname.FQDN
+	// ResolverOptions are the stub resolver options to use along
+	// with Nameservers. Backends that can't apply some of them
+	// implement ResolverOptionsChecker.
+	ResolverOptions ResolverOptions
+}
+
+// ResolverOptions are the options of the system's stub resolver, as in
+// the "options" directive of resolv.conf(5). The zero value requests
+// the system defaults.
+type ResolverOptions struct {
+	// Ndots is the number of dots a name must have to be tried as
+	// an absolute name before the search domains are appended.
+	// Zero means the default (1).
+	Ndots int
+	// Timeout is how long to wait for a nameserver's response
+	// before trying the next one. resolv.conf only allows whole
+	// seconds, so it's rounded up. Zero means the default (5s).
+	Timeout time.Duration
+	// Attempts is how many times to try each nameserver. Zero means
+	// the default (2).
+	Attempts int
+	// Rotate spreads queries across nameservers instead of always
+	// trying them in order.
+	Rotate bool
+	// EDNS0 enables the EDNS0 extensions.
+	EDNS0 bool
+	// UseVC sends queries over TCP instead of UDP.
+	UseVC bool
+	// TrustAD sets the AD bit in queries and trusts it in
+	// responses, which only makes sense with a trusted, usually
+	// local, nameserver.
+	TrustAD bool
+}
+
+// IsZero reports whether o requests only the system defaults.
+func (o ResolverOptions) IsZero() bool { return o == ResolverOptions{} }
+
+// resolvConfOptions returns o as resolv.conf options, in a stable order.
+func (o ResolverOptions) resolvConfOptions() []resolvconffile.Option {
+	var ret []resolvconffile.Option
+	if o.Ndots > 0 {
+		ret = append(ret, resolvconffile.Option{Name: "ndots", Value: strconv.Itoa(o.Ndots)})
+	}
+	if o.Timeout > 0 {
+		secs := (o.Timeout + time.Second - 1) / time.Second
+		ret = append(ret, resolvconffile.Option{Name: "timeout", Value: strconv.Itoa(int(secs))})
+	}
+	if o.Attempts > 0 {
+		ret = append(ret, resolvconffile.Option{Name: "attempts", Value: strconv.Itoa(o.Attempts)})
+	}
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{o.Rotate, "rotate"},
+		{o.EDNS0, "edns0"},
+		{o.UseVC, "use-vc"},
+		{o.TrustAD, "trust-ad"},
+	} {
+		if f.set {
+			ret = append(ret, resolvconffile.Option{Name: f.name})
+		}
+	}
+	return ret
+}
+
+// names returns the resolv.conf names of the options set in o.
+func (o ResolverOptions) names() []string {
+	var ret []string
+	for _, opt := range o.resolvConfOptions() {
+		ret = append(ret, opt.Name)
+	}
+	return ret
+}
+
+// OSConfigFromResolvConf returns the OSConfig described by the
+// resolv.conf(5) c. As in libc, the domain directive is used as the
+// search list when there is no search directive.
+func OSConfigFromResolvConf(c *resolvconffile.Config) OSConfig {
+	cfg := OSConfig{
+		Nameservers:     c.Nameservers,
+		SearchDomains:   c.SearchDomains,
+		ResolverOptions: resolverOptionsFromConf(c.Options),
+	}
+	if len(cfg.SearchDomains) == 0 && c.Domain != "" {
+		cfg.SearchDomains = []dnsname.FQDN{c.Domain}
+	}
+	return cfg
+}
+
+// resolverOptionsFromConf returns the ResolverOptions set by the
+// resolv.conf options opts. Options it doesn't model are ignored.
+func resolverOptionsFromConf(opts []resolvconffile.Option) ResolverOptions {
+	var o ResolverOptions
+	for _, opt := range opts {
+		n, _ := strconv.Atoi(opt.Value)
+		switch opt.Name {
+		case "ndots":
+			o.Ndots = n
+		case "timeout":
+			o.Timeout = time.Duration(n) * time.Second
+		case "attempts":
+			o.Attempts = n
+		case "rotate":
+			o.Rotate = true
+		case "edns0":
+			o.EDNS0 = true
+		case "use-vc", "usevc":
+			o.UseVC = true
+		case "trust-ad":
+			o.TrustAD = true
+		}
+	}
+	return o
+}
+
+// ResolverOptionsChecker is implemented by OSConfigurators that can't
+// apply every ResolverOptions field. They apply the nearest equivalent
+// they have, if any, and ignore the rest.
+type ResolverOptionsChecker interface {
+	// UnsupportedResolverOptions returns the resolv.conf names, such
+	// as "use-vc", of the options set in o that SetDNS can't apply.
+	UnsupportedResolverOptions(o ResolverOptions) []string
+}
+
+// unsupportedResolverOptions returns the names of the options in o
+// that c can't apply.
+func unsupportedResolverOptions(c OSConfigurator, o ResolverOptions) []string {
+	if rc, ok := c.(ResolverOptionsChecker); ok {
+		return rc.UnsupportedResolverOptions(o)
+	}
+	return nil
 }
 
 func (o OSConfig) IsZero() bool {
@@ -96,7 +279,113 @@ func (a OSConfig) Equal(b OSConfig) bool {
 		}
 	}
 
-	return true
+	return a.ResolverOptions == b.ResolverOptions
+}
+
+// A MergeConflict is a config that MergeOSConfigs left out, since its
+// nameservers would have served the domains of an earlier one, or the
+// other way around.
+type MergeConflict struct {
+	Index int // of the config left out, in the cfgs passed
+	With  int // of the earlier config that it conflicts with
+}
+
+func (c MergeConflict) String() string {
+	return fmt.Sprintf("config %d conflicts with config %d", c.Index, c.With)
+}
+
+// MergeOSConfigs combines the configurations contributed by several
+// parties into one, for an OSConfigurator that has a single owner.
+// Earlier configs take precedence where they conflict.
+//
+// Nameservers, search domains and match domains are the ordered unions
+// of those in cfgs. An OSConfig can only route its match domains to all
+// of its nameservers, so configs with nameservers are only merged if
+// that doesn't send one party's queries to another's nameservers: all
+// of them have no match domains, or all of them have match domains and
+// the same nameservers. The first config with nameservers decides
+// which. The others are left out altogether and returned as conflicts,
+// so that the caller can reject or report them.
+//
+// Hosts are combined by address. Of the ResolverOptions, the first
+// non-zero value of each numeric field is used, and boolean options are
+// set if any config sets them.
+func MergeOSConfigs(cfgs ...OSConfig) (OSConfig, []MergeConflict) {
+	var (
+		ret       OSConfig
+		conflicts []MergeConflict
+	)
+	owner := -1 // the first config with nameservers
+	hosts := map[netip.Addr]*HostEntry{}
+	for i, c := range cfgs {
+		if len(c.Nameservers) > 0 {
+			if owner < 0 {
+				owner = i
+			} else if !mergeableNameservers(cfgs[owner], c) {
+				conflicts = append(conflicts, MergeConflict{Index: i, With: owner})
+				continue
+			}
+			ret.Nameservers = appendUniqueAddrs(ret.Nameservers, c.Nameservers...)
+			ret.MatchDomains = appendUniqueDomains(ret.MatchDomains, c.MatchDomains...)
+		}
+		ret.SearchDomains = appendUniqueDomains(ret.SearchDomains, c.SearchDomains...)
+		for _, he := range c.Hosts {
+			m, ok := hosts[he.Addr]
+			if !ok {
+				m = &HostEntry{Addr: he.Addr}
+				hosts[he.Addr] = m
+				ret.Hosts = append(ret.Hosts, m)
+			}
+			for _, h := range he.Hosts {
+				if !containsString(m.Hosts, h) {
+					m.Hosts = append(m.Hosts, h)
+				}
+			}
+		}
+
+		o, r := c.ResolverOptions, &ret.ResolverOptions
+		if r.Ndots == 0 {
+			r.Ndots = o.Ndots
+		}
+		if r.Timeout == 0 {
+			r.Timeout = o.Timeout
+		}
+		if r.Attempts == 0 {
+			r.Attempts = o.Attempts
+		}
+		r.Rotate = r.Rotate || o.Rotate
+		r.EDNS0 = r.EDNS0 || o.EDNS0
+		r.UseVC = r.UseVC || o.UseVC
+		r.TrustAD = r.TrustAD || o.TrustAD
+	}
+	return ret, conflicts
+}
+
+// mergeableNameservers reports whether the nameservers of c can be
+// merged with those of owner, both having some: either both configs
+// want all queries, or both route their match domains to the same
+// nameservers.
+func mergeableNameservers(owner, c OSConfig) bool {
+	if len(owner.MatchDomains) == 0 || len(c.MatchDomains) == 0 {
+		return len(owner.MatchDomains) == 0 && len(c.MatchDomains) == 0
+	}
+	return sameAddrSet(owner.Nameservers, c.Nameservers)
+}
+
+// sameAddrSet reports whether a and b have the same addresses, in any
+// order.
+func sameAddrSet(a, b []netip.Addr) bool {
+	return len(appendUniqueAddrs(a[:len(a):len(a)], b...)) == len(a) &&
+		len(appendUniqueAddrs(b[:len(b):len(b)], a...)) == len(b)
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
 
 // Format implements the fmt.Formatter interface to ensure that Hosts is
@@ -133,7 +422,11 @@ func (a OSConfig) Format(f fmt.State, verb rune) {
 			}
 			fmt.Fprintf(w, "%+v", host)
 		}
-		w.WriteString(`]}`)
+		w.WriteString(`]`)
+		if !a.ResolverOptions.IsZero() {
+			fmt.Fprintf(w, " ResolverOptions:%+v", a.ResolverOptions)
+		}
+		w.WriteString(`}`)
 	}).Format(f, verb)
 }
 
@@ -141,3 +434,35 @@ func (a OSConfig) Format(f fmt.State, verb rune) {
 // OSConfigurator.GetBaseConfig returns when the OSConfigurator
 // doesn't support reading the underlying configuration out of the OS.
 var ErrGetBaseConfigNotSupported = errors.New("getting OS base config is not supported")
+
+// ErrClosed is the error OSConfigurator.SetDNS returns after Close.
+var ErrClosed = errors.New("DNS configurator is closed")
+
+// lifecycle is embedded by OSConfigurators to serialize their SetDNS
+// and Close calls, reject SetDNS after Close, and make Close
+// idempotent.
+type lifecycle struct {
+	mu     sync.Mutex
+	closed bool
+}
+
+// set runs fn, the work of SetDNS, unless Close was called.
+func (l *lifecycle) set(fn func() error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return fn()
+}
+
+// close runs fn, the work of Close, unless it ran already.
+func (l *lifecycle) close(fn func() error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	return fn()
+}
@@ -6,6 +6,7 @@ package dns
 import (
 	"fmt"
 	"net/netip"
+	"reflect"
 	"testing"
 
 	"github.com/anywherelan/ts-dns/util/dnsname"
@@ -41,3 +42,125 @@ func TestOSConfigPrintable(t *testing.T) {
 		t.Errorf("format mismatch:\n   got: %s\n  want: %s", s, expected)
 	}
 }
+
+func TestResolverOptionsPrintable(t *testing.T) {
+	ocfg := OSConfig{
+		Nameservers:     []netip.Addr{netip.AddrFrom4([4]byte{127, 0, 0, 1})},
+		ResolverOptions: ResolverOptions{Ndots: 2, EDNS0: true},
+	}
+	s := fmt.Sprintf("%+v", ocfg)
+	const expected = `{Nameservers:[127.0.0.1] SearchDomains:[] MatchDomains:[] Hosts:[] ResolverOptions:{Ndots:2 Timeout:0s Attempts:0 Rotate:false EDNS0:true UseVC:false TrustAD:false}}`
+	if s != expected {
+		t.Errorf("format mismatch:\n   got: %s\n  want: %s", s, expected)
+	}
+	if ocfg.Equal(OSConfig{Nameservers: ocfg.Nameservers}) {
+		t.Error("configs differing only in ResolverOptions are Equal")
+	}
+}
+
+func TestMergeOSConfigs(t *testing.T) {
+	ip := netip.MustParseAddr
+	tests := []struct {
+		name      string
+		in        []OSConfig
+		want      OSConfig
+		conflicts []MergeConflict
+	}{
+		{
+			name: "none",
+			want: OSConfig{},
+		},
+		{
+			name: "split",
+			in: []OSConfig{
+				{Nameservers: []netip.Addr{ip("100.100.100.100")}, MatchDomains: []dnsname.FQDN{"ts.net."}},
+				{Nameservers: []netip.Addr{ip("100.100.100.100")}, MatchDomains: []dnsname.FQDN{"corp.", "ts.net."}},
+			},
+			want: OSConfig{
+				Nameservers:  []netip.Addr{ip("100.100.100.100")},
+				MatchDomains: []dnsname.FQDN{"ts.net.", "corp."},
+			},
+		},
+		{
+			name: "split-other-nameservers",
+			in: []OSConfig{
+				{Nameservers: []netip.Addr{ip("100.100.100.100")}, MatchDomains: []dnsname.FQDN{"ts.net."}},
+				{SearchDomains: []dnsname.FQDN{"example.com."}},
+				{Nameservers: []netip.Addr{ip("10.0.0.53"), ip("100.100.100.100")}, MatchDomains: []dnsname.FQDN{"corp."}, SearchDomains: []dnsname.FQDN{"corp."}},
+			},
+			want: OSConfig{
+				Nameservers:   []netip.Addr{ip("100.100.100.100")},
+				SearchDomains: []dnsname.FQDN{"example.com."},
+				MatchDomains:  []dnsname.FQDN{"ts.net."},
+			},
+			conflicts: []MergeConflict{{Index: 2, With: 0}},
+		},
+		{
+			name: "split-then-primary",
+			in: []OSConfig{
+				{Nameservers: []netip.Addr{ip("100.100.100.100")}, MatchDomains: []dnsname.FQDN{"ts.net."}},
+				{Nameservers: []netip.Addr{ip("8.8.8.8")}, SearchDomains: []dnsname.FQDN{"example.com."}},
+			},
+			want: OSConfig{
+				Nameservers:  []netip.Addr{ip("100.100.100.100")},
+				MatchDomains: []dnsname.FQDN{"ts.net."},
+			},
+			conflicts: []MergeConflict{{Index: 1, With: 0}},
+		},
+		{
+			name: "primaries",
+			in: []OSConfig{
+				{Nameservers: []netip.Addr{ip("8.8.8.8")}},
+				{Nameservers: []netip.Addr{ip("1.1.1.1")}, SearchDomains: []dnsname.FQDN{"example.com."}},
+				{Nameservers: []netip.Addr{ip("100.100.100.100")}, MatchDomains: []dnsname.FQDN{"ts.net."}},
+			},
+			want: OSConfig{
+				Nameservers:   []netip.Addr{ip("8.8.8.8"), ip("1.1.1.1")},
+				SearchDomains: []dnsname.FQDN{"example.com."},
+			},
+			conflicts: []MergeConflict{{Index: 2, With: 0}},
+		},
+		{
+			name: "search-only",
+			in: []OSConfig{
+				{SearchDomains: []dnsname.FQDN{"a.example."}},
+				{SearchDomains: []dnsname.FQDN{"b.example.", "a.example."}},
+			},
+			want: OSConfig{SearchDomains: []dnsname.FQDN{"a.example.", "b.example."}},
+		},
+		{
+			name: "options-and-hosts",
+			in: []OSConfig{
+				{
+					Hosts:           []*HostEntry{{Addr: ip("100.1.1.1"), Hosts: []string{"a"}}},
+					ResolverOptions: ResolverOptions{Ndots: 2, Rotate: true},
+				},
+				{
+					Hosts: []*HostEntry{
+						{Addr: ip("100.1.1.1"), Hosts: []string{"a", "a2"}},
+						{Addr: ip("100.1.1.2"), Hosts: []string{"b"}},
+					},
+					ResolverOptions: ResolverOptions{Ndots: 5, Attempts: 3, EDNS0: true},
+				},
+			},
+			want: OSConfig{
+				Hosts: []*HostEntry{
+					{Addr: ip("100.1.1.1"), Hosts: []string{"a", "a2"}},
+					{Addr: ip("100.1.1.2"), Hosts: []string{"b"}},
+				},
+				ResolverOptions: ResolverOptions{Ndots: 2, Attempts: 3, Rotate: true, EDNS0: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, conflicts := MergeOSConfigs(tt.in...)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(conflicts, tt.conflicts) {
+				t.Errorf("conflicts = %v; want %v", conflicts, tt.conflicts)
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anywherelan/ts-dns/types/logger"
+)
+
+// ownerFile records which process owns the DNS configuration written by
+// ModeDirect or ModeResolvd, which replace /etc/resolv.conf. It's shared
+// by every product using this package, and is locked with flock(2)
+// around every change that they make to shared files: resolv.conf and
+// our backup of it, resolvconf's records, and /etc/hosts. Only the
+// backends that replace resolv.conf claim ownership; in the others,
+// each product has a record or section of its own.
+const ownerFile = "/var/run/ts-dns.owner"
+
+// An Owner identifies the process that owns the host's DNS
+// configuration.
+type Owner struct {
+	Product  string `json:"product"`  // the Identity name
+	PID      int    `json:"pid"`      // the process ID
+	Instance string `json:"instance"` // random, per OSConfigurator
+}
+
+func (o Owner) String() string {
+	return fmt.Sprintf("%s (pid %d, instance %s)", o.Product, o.PID, o.Instance)
+}
+
+// note returns the line recording o in the header of generated files.
+func (o Owner) note() string {
+	return fmt.Sprintf("owner: %s pid=%d instance=%s", o.Product, o.PID, o.Instance)
+}
+
+// OwnedError is returned when the DNS configuration is owned by another
+// live process.
+type OwnedError struct {
+	Owner Owner
+}
+
+func (e *OwnedError) Error() string {
+	return "DNS configuration is owned by " + e.Owner.String()
+}
+
+// OwnershipPolicy says what an OSConfigurator does when another process
+// owns the DNS configuration.
+type OwnershipPolicy int
+
+const (
+	// OwnershipFail fails SetDNS with an *OwnedError.
+	OwnershipFail OwnershipPolicy = iota
+	// OwnershipQueue makes SetDNS wait until the other process
+	// gives up ownership by closing its OSConfigurator, or exits.
+	OwnershipQueue
+)
+
+func (p OwnershipPolicy) String() string {
+	switch p {
+	case OwnershipFail:
+		return "fail"
+	case OwnershipQueue:
+		return "queue"
+	}
+	return fmt.Sprintf("OwnershipPolicy(%d)", int(p))
+}
+
+// ownerPollInterval is how often a queued ownerLock checks whether the
+// owner has gone.
+const ownerPollInterval = 500 * time.Millisecond
+
+// flockRetryInterval is how often the owner file's flock is retried
+// while another process holds it, which it only does for the moment
+// it takes to change the files.
+const flockRetryInterval = 10 * time.Millisecond
+
+// ownerLock serializes changes to the DNS configuration between
+// processes, and records which of them owns it. A nil *ownerLock does
+// nothing, for configurators that don't share state with others.
+type ownerLock struct {
+	logf   logger.Logf
+	path   string // of ownerFile, under Options.Root
+	self   Owner
+	policy OwnershipPolicy
+
+	poll  time.Duration
+	alive func(pid int) bool // reports whether a process exists
+}
+
+func newOwnerLock(logf logger.Logf, opts Options) *ownerLock {
+	return &ownerLock{
+		logf:   logf,
+		path:   opts.path(ownerFile),
+		self:   Owner{Product: opts.Identity.name(), PID: os.Getpid(), Instance: newInstanceID()},
+		policy: opts.Ownership,
+		poll:   ownerPollInterval,
+		alive:  processAlive,
+	}
+}
+
+// newInstanceID returns a random ID for an Owner.
+func newInstanceID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// owner returns the Owner l records, or nil if l is nil.
+func (l *ownerLock) owner() *Owner {
+	if l == nil {
+		return nil
+	}
+	return &l.self
+}
+
+// lock takes the lock, and records l's process as the owner. If another
+// live process owns the configuration, it fails with an *OwnedError,
+// or with OwnershipQueue, waits until ctx is done for the owner to go.
+// Stale records of exited processes are taken over. Either way, it
+// waits for the lock itself, held by others while they change the
+// files, until ctx is done.
+//
+// The returned function releases the lock; if disown is true, it also
+// gives up ownership.
+func (l *ownerLock) lock(ctx context.Context) (unlock func(disown bool), err error) {
+	if l == nil {
+		return func(bool) {}, nil
+	}
+	return l.acquire(ctx, l.policy == OwnershipQueue)
+}
+
+// serialize takes the lock without claiming ownership, for changes to
+// shared files in which each product has a part of its own, such as its
+// section of /etc/hosts. It waits for the lock until ctx is done. The
+// returned function releases it.
+func (l *ownerLock) serialize(ctx context.Context) (unlock func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	f, err := l.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// serializeUnowned is like serialize, but fails with an *OwnedError if
+// another live process owns the configuration. It's for recovery, which
+// must leave the files of a running owner alone.
+func (l *ownerLock) serializeUnowned() (unlock func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	f, err := l.open(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	cur, err := readOwner(f)
+	if err != nil {
+		l.logf("ignoring corrupt %s: %v", l.path, err)
+	}
+	if l.ownedByOther(cur) {
+		f.Close()
+		return nil, &OwnedError{Owner: cur}
+	}
+	return func() { f.Close() }, nil
+}
+
+// tryLock is like lock, but never waits for another owner, only for
+// the lock itself, until ctx is done.
+func (l *ownerLock) tryLock(ctx context.Context) (unlock func(disown bool), err error) {
+	if l == nil {
+		return func(bool) {}, nil
+	}
+	return l.acquire(ctx, false)
+}
+
+// acquire implements lock and tryLock.
+func (l *ownerLock) acquire(ctx context.Context, wait bool) (unlock func(disown bool), err error) {
+	logged := false
+	for {
+		f, err := l.open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		cur, err := readOwner(f)
+		if err != nil {
+			l.logf("ignoring corrupt %s: %v", l.path, err)
+		}
+		if !l.ownedByOther(cur) {
+			if cur != l.self {
+				if cur.Instance != "" && cur.PID != l.self.PID {
+					l.logf("taking over DNS configuration from exited %v", cur)
+				}
+				if err := writeOwner(f, l.self); err != nil {
+					f.Close()
+					return nil, err
+				}
+			}
+			return func(disown bool) {
+				if disown {
+					if err := writeOwner(f, Owner{}); err != nil {
+						l.logf("clearing %s: %v", l.path, err)
+					}
+				}
+				f.Close()
+			}, nil
+		}
+		f.Close()
+		if !wait {
+			return nil, &OwnedError{Owner: cur}
+		}
+		if !logged {
+			l.logf("waiting for %v to release the DNS configuration", cur)
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for %v: %w", cur, ctx.Err())
+		case <-time.After(l.poll):
+		}
+	}
+}
+
+// ownedByOther reports whether the record cur is that of another live
+// process. Records of our own process are taken over, since it's up to
+// its caller to coordinate the configurators within it.
+func (l *ownerLock) ownedByOther(cur Owner) bool {
+	return cur.Instance != "" && cur.PID != l.self.PID && l.alive(cur.PID)
+}
+
+// open opens and locks the owner file, creating it if needed. It waits
+// for other holders of the lock until ctx is done.
+func (l *ownerLock) open(ctx context.Context) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("locking %s: %w", l.path, err)
+		}
+		if locked {
+			return f, nil
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, fmt.Errorf("locking %s: %w", l.path, ctx.Err())
+		case <-time.After(flockRetryInterval):
+		}
+	}
+}
+
+// readOwner returns the Owner recorded in f, or the zero Owner if f is
+// empty.
+func readOwner(f *os.File) (Owner, error) {
+	var o Owner
+	bs, err := io.ReadAll(io.NewSectionReader(f, 0, 1<<16))
+	if err != nil || len(strings.TrimSpace(string(bs))) == 0 {
+		return o, err
+	}
+	err = json.Unmarshal(bs, &o)
+	return o, err
+}
+
+// writeOwner replaces the contents of f with o, or empties it if o is
+// the zero Owner.
+func writeOwner(f *os.File, o Owner) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if o == (Owner{}) {
+		return nil
+	}
+	bs, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(append(bs, '\n'), 0)
+	return err
+}
@@ -0,0 +1,200 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// asOtherProcess makes owner look like that of another live process to
+// checker.
+func asOtherProcess(owner, checker *ownerLock) {
+	owner.self.PID = os.Getpid() + 1
+	checker.alive = func(int) bool { return true }
+}
+
+func TestOwnerLock(t *testing.T) {
+	opts := Options{Root: t.TempDir(), Identity: Identity{Name: "one"}}
+	a := newOwnerLock(t.Logf, opts)
+	opts.Identity.Name = "two"
+	b := newOwnerLock(t.Logf, opts)
+	asOtherProcess(a, b)
+
+	unlock, err := a.lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock(false)
+
+	var owned *OwnedError
+	if _, err = b.lock(context.Background()); !errors.As(err, &owned) {
+		t.Fatalf("second lock: %v; want an OwnedError", err)
+	}
+	if owned.Owner != a.self {
+		t.Errorf("owner = %v; want %v", owned.Owner, a.self)
+	}
+	if !strings.Contains(err.Error(), "owned by one (pid ") {
+		t.Errorf("error %q doesn't name the owner", err)
+	}
+
+	// Relocking by the owner works, and disowning lets b in.
+	unlock, err = a.lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock(true)
+	unlock, err = b.lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock(false)
+}
+
+func TestOwnerLockStale(t *testing.T) {
+	opts := Options{Root: t.TempDir()}
+	a := newOwnerLock(t.Logf, opts)
+	b := newOwnerLock(t.Logf, opts)
+	a.self.PID = -1 // an exited process
+	unlock, err := a.lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock(false)
+
+	unlock, err = b.lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock(false)
+	bs, err := os.ReadFile(filepath.Join(opts.Root, ownerFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(bs), b.self.Instance) {
+		t.Errorf("owner file = %q; want b's record", bs)
+	}
+}
+
+func TestOwnerLockHonorsContext(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the owner file isn't locked on Windows")
+	}
+	opts := Options{Root: t.TempDir()}
+	a := newOwnerLock(t.Logf, opts)
+	b := newOwnerLock(t.Logf, opts)
+
+	// a holds the flock, as while changing the files; b gives up
+	// waiting for it with its context.
+	unlock, err := a.serialize(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := b.lock(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("lock while the flock is held = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("lock took %v to give up", d)
+	}
+}
+
+func TestOwnerLockQueue(t *testing.T) {
+	opts := Options{Root: t.TempDir(), Ownership: OwnershipQueue}
+	a := newOwnerLock(t.Logf, opts)
+	b := newOwnerLock(t.Logf, opts)
+	asOtherProcess(a, b)
+	b.poll = 10 * time.Millisecond
+	unlock, err := a.lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock(false)
+
+	done := make(chan error, 1)
+	go func() {
+		unlock, err := b.lock(context.Background())
+		if err == nil {
+			unlock(false)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("queued lock returned early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock, err = a.lock(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock(true)
+	if err := <-done; err != nil {
+		t.Fatalf("queued lock: %v", err)
+	}
+
+	// A queued lock gives up with its context.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := a.lock(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("lock with an expired context: %v", err)
+	}
+}
+
+func TestDirectOwnership(t *testing.T) {
+	opts := Options{Root: t.TempDir(), Identity: Identity{Name: "one"}}
+	if err := os.MkdirAll(filepath.Join(opts.Root, "etc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	one := newDirectManager(t.Logf, opts)
+	defer one.Close()
+	opts.Identity.Name = "two"
+	two := newDirectManager(t.Logf, opts)
+	defer two.Close()
+	asOtherProcess(one.owner, two.owner)
+
+	cfg := OSConfig{Nameservers: []netip.Addr{netip.MustParseAddr("8.8.8.8")}}
+	if err := one.SetDNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := one.fs.ReadFile(resolvConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note := "# " + one.owner.self.note() + "\n"; !strings.Contains(string(got), note) {
+		t.Errorf("resolv.conf header lacks %q:\n%s", note, got)
+	}
+
+	var owned *OwnedError
+	if err := two.SetDNS(cfg); !errors.As(err, &owned) || owned.Owner != one.owner.self {
+		t.Fatalf("SetDNS by another product: %v; want an OwnedError", err)
+	}
+	// Closing two must leave one's configuration alone.
+	if err := two.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if cur, _ := one.fs.ReadFile(resolvConf); string(cur) != string(got) {
+		t.Errorf("resolv.conf changed by the non-owner's Close:\n%s", cur)
+	}
+
+	if err := one.Close(); err != nil {
+		t.Fatal(err)
+	}
+	three := newDirectManager(t.Logf, opts)
+	defer three.Close()
+	if err := three.SetDNS(cfg); err != nil {
+		t.Errorf("SetDNS after the owner closed: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
+
+	"github.com/anywherelan/ts-dns/types/logger"
+)
+
+// A RecoveryAction is something RecoverStale did, or tried to do, about
+// state left behind by a previous run.
+type RecoveryAction struct {
+	Mode   string // the backend that left the state behind; one of the Mode constants
+	Target string // the file, record or link concerned
+	Action string // what was done, such as "restored" or "removed"
+	Err    error  // non-nil if the action failed
+}
+
+func (a RecoveryAction) String() string {
+	s := a.Action + " " + a.Target
+	if a.Mode != "" {
+		s = a.Mode + ": " + s
+	}
+	if a.Err != nil {
+		s += ": " + a.Err.Error()
+	}
+	return s
+}
+
+// RecoverStale finds the DNS configuration left behind by a previous
+// run that didn't shut down cleanly, such as one that was killed, and
+// restores or removes it. It first undoes the changes in the Journal
+// under opts.StateDir, if any, then checks every backend available on
+// this platform, under the names of opts.Identity, including legacy
+// ones.
+// interfaceName is the network interface the previous run managed
+// DNS for; if empty, per-interface state isn't checked.
+//
+// It's meant to be run at startup, before NewOSConfigurator, and must
+// not be run while another process manages DNS under the same Identity.
+// It skips resolv.conf and /etc/hosts while another live process owns
+// the DNS configuration, with actions whose Err is an *OwnedError.
+// The returned actions describe what was done; an action with a non-nil
+// Err failed, but doesn't stop the others. The error is only non-nil if
+// opts is invalid.
+func RecoverStale(logf logger.Logf, interfaceName string, opts Options) ([]RecoveryAction, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	actions := undoJournal(logf, opts)
+	actions = append(actions, recoverStale(logf, interfaceName, opts)...)
+	if runtime.GOOS != "windows" {
+		actions = append(actions, recoverHostsFile(logf, opts)...)
+	}
+	for _, a := range actions {
+		logf("dns: recovery: %v", a)
+	}
+	return actions, nil
+}
+
+// errNoBackup is the error of the recovery action for a resolv.conf
+// that we generated, but whose original we have no backup of.
+var errNoBackup = errors.New("generated by a previous run, but there's no backup to restore")
+
+// recoverDirect recovers from a ModeDirect run: it puts the
+// backed up resolv.conf back in place if the current one is ours, and
+// otherwise removes the stale backup. It leaves everything alone while
+// another live process owns the configuration.
+func recoverDirect(logf logger.Logf, opts Options) []RecoveryAction {
+	m := &directManager{logf: logf, fs: opts.fs(), ident: opts.Identity, runner: opts.Runner}
+	var actions []RecoveryAction
+	act := func(target, action string, err error) {
+		actions = append(actions, RecoveryAction{Mode: ModeDirect, Target: target, Action: action, Err: err})
+	}
+
+	unlock, err := newOwnerLock(logf, opts).serializeUnowned()
+	if err != nil {
+		act(resolvConf, "skipped", err)
+		return actions
+	}
+	defer unlock()
+
+	cur, _ := m.fs.ReadFile(resolvConf)
+	restored := false
+	for _, name := range opts.Identity.withUpgradeFrom(cur).allNames() {
+		// Symlink targets from versions that symlinked resolv.conf.
+		old := "/etc/resolv." + name + ".conf"
+		if _, err := m.fs.Stat(old); err == nil {
+			act(old, "removed", m.fs.Remove(old))
+		}
+
+		backup := backupConfFor(name)
+		if _, err := m.fs.Stat(backup); err != nil {
+			continue
+		}
+		owned, err := m.ownedByUs()
+		if err != nil {
+			act(backup, "kept", err)
+			continue
+		}
+		_, err = m.fs.Stat(resolvConf)
+		missing := os.IsNotExist(err)
+		if owned || missing {
+			err := m.rename(backup, resolvConf)
+			act(backup, "restored", err)
+			restored = restored || err == nil
+			continue
+		}
+		// Someone else has written a new resolv.conf since; our
+		// backup is older than it.
+		act(backup, "removed", m.fs.Remove(backup))
+	}
+
+	if !restored {
+		if owned, err := m.ownedByUs(); err == nil && owned {
+			act(resolvConf, "kept", errNoBackup)
+		}
+	}
+	ctx := context.Background()
+	if restored && isResolvedRunning(ctx, m.runner) && !runningAsGUIDesktopUser() {
+		act("systemd-resolved", "restarted", restartResolved(ctx, m.runner))
+	}
+	return actions
+}
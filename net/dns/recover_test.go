@@ -0,0 +1,175 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRecoverDirect(t *testing.T) {
+	const (
+		orig    = "nameserver 9.9.9.9 # orig\n"
+		ours    = "# resolv.conf(5) file generated by example\nnameserver 100.100.100.100\n"
+		foreign = "nameserver 1.1.1.1 # from dhcp\n"
+		backup  = "/etc/resolv.pre-example-backup.conf"
+	)
+	tests := []struct {
+		name       string
+		resolvConf string // "" means missing
+		backup     bool
+		want       []RecoveryAction
+		wantConf   string
+	}{
+		{
+			name:       "ours",
+			resolvConf: ours,
+			backup:     true,
+			want:       []RecoveryAction{{Mode: ModeDirect, Target: backup, Action: "restored"}},
+			wantConf:   orig,
+		},
+		{
+			name:     "missing",
+			backup:   true,
+			want:     []RecoveryAction{{Mode: ModeDirect, Target: backup, Action: "restored"}},
+			wantConf: orig,
+		},
+		{
+			name:       "foreign",
+			resolvConf: foreign,
+			backup:     true,
+			want:       []RecoveryAction{{Mode: ModeDirect, Target: backup, Action: "removed"}},
+			wantConf:   foreign,
+		},
+		{
+			name:       "ours-without-backup",
+			resolvConf: ours,
+			want:       []RecoveryAction{{Mode: ModeDirect, Target: resolvConf, Action: "kept", Err: errNoBackup}},
+			wantConf:   ours,
+		},
+		{
+			name:       "clean",
+			resolvConf: foreign,
+			wantConf:   foreign,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(tmp, "etc"), 0700); err != nil {
+				t.Fatal(err)
+			}
+			opts := Options{Root: tmp, Identity: Identity{Name: "example"}}
+			fs := opts.fs()
+			if tt.resolvConf != "" {
+				if err := fs.WriteFile(resolvConf, []byte(tt.resolvConf), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.backup {
+				if err := fs.WriteFile(backup, []byte(orig), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got := recoverDirect(t.Logf, opts)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("actions = %v; want %v", got, tt.want)
+			}
+			conf, err := fs.ReadFile(resolvConf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(conf) != tt.wantConf {
+				t.Errorf("resolv.conf:\n%s, want:\n%s", conf, tt.wantConf)
+			}
+			if _, err := fs.Stat(backup); !os.IsNotExist(err) {
+				t.Errorf("backup still present: %v", err)
+			}
+		})
+	}
+}
+
+func TestRecoverDirectLegacyUpgrade(t *testing.T) {
+	const orig = "nameserver 9.9.9.9 # orig\n"
+	const legacyBackup = "/etc/resolv.pre-tailscale-backup.conf"
+	tmp := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmp, "etc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Root: tmp, Identity: Identity{Name: "example"}}
+	fs := opts.fs()
+	if err := fs.WriteFile(legacyBackup, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(resolvConf, []byte("# resolv.conf(5) file generated by tailscale\nnameserver 100.100.100.100\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := recoverDirect(t.Logf, opts)
+	want := []RecoveryAction{{Mode: ModeDirect, Target: legacyBackup, Action: "restored"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("actions = %v; want %v", got, want)
+	}
+	if conf, _ := fs.ReadFile(resolvConf); string(conf) != orig {
+		t.Errorf("resolv.conf:\n%s, want:\n%s", conf, orig)
+	}
+}
+
+func TestRecoverOwnedByOther(t *testing.T) {
+	const (
+		ours   = "# resolv.conf(5) file generated by example\nnameserver 100.100.100.100\n"
+		backup = "/etc/resolv.pre-example-backup.conf"
+	)
+	tmp := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmp, "etc"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Root: tmp, Identity: Identity{Name: "example"}}
+	fs := opts.fs()
+	hosts := setHostsSection(nil, "example", hostsComments(opts.Identity), []*HostEntry{{Addr: netip.MustParseAddr("100.64.0.1"), Hosts: []string{"peer.ts.net."}}}, "\n").Bytes()
+	for name, contents := range map[string][]byte{
+		resolvConf: []byte(ours),
+		backup:     []byte("nameserver 9.9.9.9\n"),
+		hostsFile:  hosts,
+	} {
+		if err := fs.WriteFile(name, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Our parent, the go command, stands in for another live owner.
+	other := Owner{Product: "other", PID: os.Getppid(), Instance: "0123456789abcdef"}
+	bs, _ := json.Marshal(other)
+	if err := os.MkdirAll(filepath.Join(tmp, filepath.Dir(ownerFile)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, ownerFile), bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := append(recoverDirect(t.Logf, opts), recoverHostsFile(t.Logf, opts)...)
+	if len(got) != 2 {
+		t.Fatalf("actions = %v; want 2", got)
+	}
+	for i, target := range []string{resolvConf, hostsFile} {
+		var owned *OwnedError
+		if got[i].Target != target || got[i].Action != "skipped" || !errors.As(got[i].Err, &owned) || owned.Owner != other {
+			t.Errorf("actions[%d] = %v; want %s skipped, owned by %v", i, got[i], target, other)
+		}
+	}
+	if conf, _ := fs.ReadFile(resolvConf); string(conf) != ours {
+		t.Errorf("resolv.conf changed:\n%s", conf)
+	}
+	if _, err := fs.Stat(backup); err != nil {
+		t.Errorf("backup: %v", err)
+	}
+	if cur, _ := fs.ReadFile(hostsFile); string(cur) != string(hosts) {
+		t.Errorf("hosts file changed:\n%s", cur)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"github.com/anywherelan/ts-dns/envknob"
+	"github.com/anywherelan/ts-dns/types/logger"
+)
+
+// A Probe is one observation made while detecting the DNS mode, such as
+// whether systemd-resolved answered on D-Bus.
+type Probe struct {
+	Name   string `json:"name"`
+	Result string `json:"result"`
+}
+
+func (p Probe) String() string {
+	return fmt.Sprintf("%s=%s", p.Name, p.Result)
+}
+
+// ModeReport describes how the DNS mode for this system was chosen.
+type ModeReport struct {
+	// Mode is the chosen backend, one of the Mode constants. It's
+	// empty on platforms that have a single, unnamed backend.
+	Mode string `json:"mode"`
+
+	// ForcedBy, if non-empty, says what forced Mode instead of
+	// detecting it: "options" or the name of the environment variable.
+	ForcedBy string `json:"forcedBy,omitempty"`
+
+	// Probes are the observations made, in order.
+	Probes []Probe `json:"probes,omitempty"`
+
+	// ResolvConfOwner is the program that /etc/resolv.conf says
+	// manages it, if any.
+	ResolvConfOwner string `json:"resolvConfOwner,omitempty"`
+
+	// NMVersion is the version of NetworkManager, if it was queried.
+	NMVersion string `json:"nmVersion,omitempty"`
+
+	// ResolvConfMode is systemd-resolved's ResolvConfMode property,
+	// if it was queried.
+	ResolvConfMode string `json:"resolvConfMode,omitempty"`
+
+	// Reasons are the reasoning steps that led to Mode, in order, in
+	// a form suitable for showing to users.
+	Reasons []string `json:"reasons,omitempty"`
+
+	// Journal is the journal under Options.StateDir, if there's one:
+	// the changes a running or crashed OSConfigurator has made.
+	Journal *Journal `json:"journal,omitempty"`
+}
+
+// probe records the observation name=result.
+func (r *ModeReport) probe(name, result string) {
+	r.Probes = append(r.Probes, Probe{Name: name, Result: result})
+}
+
+// reason records a reasoning step.
+func (r *ModeReport) reason(format string, args ...any) {
+	r.Reasons = append(r.Reasons, fmt.Sprintf(format, args...))
+}
+
+// DetectMode reports which DNS mode NewOSConfigurator would use on this
+// system, and why.
+func DetectMode(ctx context.Context) (*ModeReport, error) {
+	return DetectModeWithOptions(ctx, Options{})
+}
+
+// DetectModeWithOptions is like DetectMode, but for the OSConfigurator
+// that NewOSConfiguratorWithOptions would return for opts.
+func DetectModeWithOptions(ctx context.Context, opts Options) (*ModeReport, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	rep, err := detectModeWithOptions(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if rep.Journal, err = readJournal(journalPath(opts)); err != nil {
+		rep.probe("journal", err.Error())
+	}
+	return rep, nil
+}
+
+func detectModeWithOptions(ctx context.Context, opts Options) (*ModeReport, error) {
+	if mode := envknob.String(modeEnvKnob); mode != "" {
+		rep := &ModeReport{Mode: mode, ForcedBy: modeEnvKnob}
+		rep.reason("mode forced by the %s environment variable", modeEnvKnob)
+		return rep, nil
+	}
+	if opts.Mode != "" {
+		rep := &ModeReport{Mode: opts.Mode, ForcedBy: "options"}
+		rep.reason("mode forced by the caller's options")
+		return rep, nil
+	}
+	return detectMode(ctx, logger.Discard, opts)
+}
+
+// singleBackendReport returns the ModeReport for platforms without a
+// choice of backend, where backend describes the one that's used.
+func singleBackendReport(backend string) *ModeReport {
+	rep := new(ModeReport)
+	rep.reason("%s has a single DNS backend: %s", runtime.GOOS, backend)
+	return rep
+}
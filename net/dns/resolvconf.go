@@ -6,20 +6,109 @@
 package dns
 
 import (
-	"os/exec"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anywherelan/ts-dns/types/logger"
 )
 
-func resolvconfStyle() string {
-	if _, err := exec.LookPath("resolvconf"); err != nil {
+func resolvconfStyle(r CommandRunner) string {
+	r = runnerOrDefault(r)
+	if _, err := r.LookPath("resolvconf"); err != nil {
 		return ""
 	}
-	if _, err := exec.Command("resolvconf", "--version").CombinedOutput(); err != nil {
+	if res, err := runCommand(context.Background(), r, "resolvconf", "--version"); err != nil {
 		// Debian resolvconf doesn't understand --version, and
 		// exits with a specific error code.
-		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 99 {
+		if res.ExitCode == 99 {
 			return "debian"
 		}
 	}
 	// Treat everything else as openresolv, by far the more popular implementation.
 	return "openresolv"
 }
+
+// recoverResolvconf recovers from a ModeDebianResolvconf or
+// ModeOpenresolv run, whichever resolvconf is installed. The Debian
+// libc hook script is removed regardless, as it outlives resolvconf
+// being uninstalled.
+func recoverResolvconf(logf logger.Logf, opts Options) []RecoveryAction {
+	var actions []RecoveryAction
+	for _, name := range opts.Identity.allNames() {
+		hook := resolvconfHookPathFor(name)
+		if _, err := os.Stat(opts.path(hook)); err == nil {
+			actions = append(actions, RecoveryAction{
+				Mode:   ModeDebianResolvconf,
+				Target: hook,
+				Action: "removed",
+				Err:    os.Remove(opts.path(hook)),
+			})
+		}
+	}
+
+	switch resolvconfStyle(opts.Runner) {
+	case "debian":
+		m, err := newDebianResolvconfManager(logf, opts)
+		if err != nil {
+			break
+		}
+		for _, name := range opts.Identity.allNames() {
+			record := resolvconfRecordFor(name)
+			if _, err := os.Stat(m.path(filepath.Join(m.interfacesDir, record))); err != nil {
+				continue
+			}
+			actions = append(actions, RecoveryAction{
+				Mode:   ModeDebianResolvconf,
+				Target: record,
+				Action: "removed",
+				Err:    m.deleteConfig(context.Background(), record),
+			})
+		}
+	case "openresolv":
+		m, _ := newOpenresolvManager(logf, opts)
+		res, err := runCommand(context.Background(), m.runner, "resolvconf", "-i")
+		if err != nil {
+			actions = append(actions, RecoveryAction{Mode: ModeOpenresolv, Target: "resolvconf -i", Action: "listed", Err: err})
+			break
+		}
+		ours := map[string]bool{}
+		for _, name := range opts.Identity.allNames() {
+			ours[name] = true
+		}
+		for _, f := range strings.Fields(string(res.Stdout)) {
+			if !ours[f] {
+				continue
+			}
+			actions = append(actions, RecoveryAction{
+				Mode:   ModeOpenresolv,
+				Target: f,
+				Action: "removed",
+				Err:    m.deleteConfig(context.Background(), f),
+			})
+		}
+	}
+	return actions
+}
+
+// undoResolvconfRecord removes the resolvconf record of the JournalRecord
+// entry e.
+func undoResolvconfRecord(logf logger.Logf, opts Options, e JournalEntry) []RecoveryAction {
+	var err error
+	switch e.Mode {
+	case ModeDebianResolvconf:
+		m, _ := newDebianResolvconfManager(logf, opts)
+		if _, serr := os.Stat(m.path(filepath.Join(m.interfacesDir, e.Target))); serr != nil {
+			return nil
+		}
+		err = m.deleteConfig(context.Background(), e.Target)
+	case ModeOpenresolv:
+		m, _ := newOpenresolvManager(logf, opts)
+		err = m.deleteConfig(context.Background(), e.Target)
+	default:
+		err = fmt.Errorf("unknown resolvconf mode %q", e.Mode)
+	}
+	return []RecoveryAction{{Mode: e.Mode, Target: e.Target, Action: "removed", Err: err}}
+}
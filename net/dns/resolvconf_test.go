@@ -0,0 +1,152 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || freebsd || openbsd
+
+package dns
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolvconfStyle(t *testing.T) {
+	tests := []struct {
+		name    string
+		version *FakeResponse // nil means no resolvconf
+		want    string
+	}{
+		{"missing", nil, ""},
+		{"debian", &FakeResponse{Stderr: "resolvconf: Error: Command not recognized", ExitCode: 99}, "debian"},
+		{"openresolv", &FakeResponse{Stdout: "openresolv 3.12.0"}, "openresolv"},
+		{"other-failure", &FakeResponse{ExitCode: 1}, "openresolv"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := new(FakeRunner)
+			if tt.version != nil {
+				f.On("resolvconf --version", *tt.version)
+			}
+			if got := resolvconfStyle(f); got != tt.want {
+				t.Errorf("resolvconfStyle = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// cmdlines returns the command lines of calls.
+func cmdlines(calls []Command) []string {
+	var ret []string
+	for _, c := range calls {
+		ret = append(ret, c.String())
+	}
+	return ret
+}
+
+func TestOpenresolvManager(t *testing.T) {
+	f := new(FakeRunner)
+	opts := Options{Root: t.TempDir(), Identity: Identity{Name: "example"}, Runner: f}
+	m, _ := newOpenresolvManager(t.Logf, opts)
+	var added string
+	f.On("resolvconf -l example", FakeResponse{})
+	f.On("resolvconf -m 0 -x -a example", FakeResponse{Func: func(c Command) CommandResult {
+		added = string(c.Stdin)
+		return CommandResult{}
+	}})
+
+	if err := m.SetDNS(OSConfig{Nameservers: mustIPs("100.100.100.100")}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"resolvconf -l example", "resolvconf -m 0 -x -a example"}
+	if got := cmdlines(f.Calls()); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands:\n got %q\nwant %q", got, want)
+	}
+	if !strings.Contains(added, "generated by example\n") || !strings.Contains(added, "nameserver 100.100.100.100\n") {
+		t.Errorf("added snippet:\n%s", added)
+	}
+
+	f.On("resolvconf -i", FakeResponse{Stdout: "example eth0 wlan0\n"})
+	f.On("resolvconf -l eth0 wlan0", FakeResponse{Stdout: "nameserver 192.168.1.1\nsearch lan\n"})
+	base, err := m.GetBaseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustIPs("192.168.1.1"); !reflect.DeepEqual(base.Nameservers, want) {
+		t.Errorf("base nameservers = %v; want %v", base.Nameservers, want)
+	}
+
+	f.On("resolvconf -f -d example", FakeResponse{})
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenresolvRollback(t *testing.T) {
+	f := new(FakeRunner)
+	m, _ := newOpenresolvManager(t.Logf, Options{Root: t.TempDir(), Identity: Identity{Name: "example"}, Runner: f})
+	const prev = "nameserver 1.2.3.4\n"
+	f.On("resolvconf -l example", FakeResponse{Stdout: prev})
+	var restored string
+	f.On("resolvconf -m 0 -x -a example",
+		FakeResponse{Stderr: "subscriber failed", ExitCode: 1},
+		FakeResponse{Func: func(c Command) CommandResult {
+			restored = string(c.Stdin)
+			return CommandResult{}
+		}})
+
+	err := m.SetDNS(OSConfig{Nameservers: mustIPs("100.100.100.100")})
+	var rerr *RollbackError
+	if !errors.As(err, &rerr) || !rerr.RolledBack() {
+		t.Fatalf("SetDNS = %v; want a rolled back RollbackError", err)
+	}
+	if restored != prev {
+		t.Errorf("restored snippet = %q; want %q", restored, prev)
+	}
+}
+
+func TestDebianResolvconfManager(t *testing.T) {
+	root := t.TempDir()
+	const interfaces = "/run/resolvconf/interface"
+	if err := os.MkdirAll(filepath.Join(root, interfaces), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f := new(FakeRunner)
+	m, err := newDebianResolvconfManager(t.Logf, Options{Root: root, Identity: Identity{Name: "example"}, Runner: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.interfacesDir != interfaces {
+		t.Fatalf("interfacesDir = %q; want %q", m.interfacesDir, interfaces)
+	}
+	var added string
+	f.On("resolvconf -a tun-example.inet", FakeResponse{Func: func(c Command) CommandResult {
+		added = string(c.Stdin)
+		return CommandResult{}
+	}})
+	if err := m.SetDNS(OSConfig{Nameservers: mustIPs("100.100.100.100")}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(added, "nameserver 100.100.100.100\n") {
+		t.Errorf("added record:\n%s", added)
+	}
+	hook := filepath.Join(root, resolvconfHookPathFor("example"))
+	if _, err := os.Stat(hook); err != nil {
+		t.Errorf("hook script not installed: %v", err)
+	}
+
+	f.On("resolvconf -d tun-example.inet", FakeResponse{})
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(hook); !os.IsNotExist(err) {
+		t.Errorf("hook script left behind: %v", err)
+	}
+	want := []string{"resolvconf -a tun-example.inet", "resolvconf -d tun-example.inet"}
+	if got := cmdlines(f.Calls()); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands:\n got %q\nwant %q", got, want)
+	}
+}
@@ -34,19 +34,109 @@ type Config struct {
 	// single-label name queries. SearchDomains is additive to
 	// whatever non-Tailscale search domains the OS has.
 	SearchDomains []dnsname.FQDN
+
+	// Domain is the local domain name from a "domain" directive, if
+	// any. The resolver uses it as the search list when there's no
+	// "search" directive.
+	Domain dnsname.FQDN
+
+	// Sortlist are the address/netmask pairs from "sortlist"
+	// directives, as written.
+	Sortlist []string
+
+	// Options are the resolver options from "options" directives, in
+	// order.
+	Options []Option
+
+	// Unknown are the directives this package doesn't know, in order.
+	Unknown []Directive
+}
+
+// An Option is a resolver option from an "options" directive, such as
+// "ndots:5" or "edns0".
+type Option struct {
+	Name  string // such as "ndots"
+	Value string // such as "5"; empty for flags such as "edns0"
+}
+
+func (o Option) String() string {
+	if o.Value == "" {
+		return o.Name
+	}
+	return o.Name + ":" + o.Value
+}
+
+// parseOption parses an option as written in resolv.conf.
+func parseOption(s string) Option {
+	name, value, _ := strings.Cut(s, ":")
+	return Option{Name: name, Value: value}
+}
+
+// Option returns the value of the last option named name, and whether
+// such an option is present.
+func (c *Config) Option(name string) (value string, ok bool) {
+	for i := len(c.Options) - 1; i >= 0; i-- {
+		if c.Options[i].Name == name {
+			return c.Options[i].Value, true
+		}
+	}
+	return "", false
+}
+
+// A Directive is a resolv.conf line that isn't a comment: a keyword
+// followed by its arguments.
+type Directive struct {
+	Keyword string
+	Args    []string
 }
 
-// Write writes c to w. It does so in one Write call.
+func (d Directive) String() string {
+	return strings.Join(append([]string{d.Keyword}, d.Args...), " ")
+}
+
+// Write writes c to w, with a header naming tailscale as its generator.
+// It does so in one Write call.
 func (c *Config) Write(w io.Writer) error {
+	return c.WriteGenerated(w, "tailscale", "https://tailscale.com/s/resolvconf-overwrite")
+}
+
+// WriteGenerated writes c to w, with a header saying that the file was
+// generated by generator and must not be edited by hand. If infoURL is
+// non-empty, the header points readers at it. It does so in one Write
+// call.
+func (c *Config) WriteGenerated(w io.Writer, generator, infoURL string) error {
+	return c.WriteGeneratedWithNotes(w, generator, infoURL)
+}
+
+// WriteGeneratedWithNotes is like WriteGenerated, but also adds notes to
+// the header, as one comment line each.
+func (c *Config) WriteGeneratedWithNotes(w io.Writer, generator, infoURL string, notes ...string) error {
 	buf := new(bytes.Buffer)
-	io.WriteString(buf, "# resolv.conf(5) file generated by tailscale\n")
-	io.WriteString(buf, "# For more info, see https://tailscale.com/s/resolvconf-overwrite\n")
+	io.WriteString(buf, "# resolv.conf(5) file generated by "+generator+"\n")
+	if infoURL != "" {
+		io.WriteString(buf, "# For more info, see "+infoURL+"\n")
+	}
+	for _, n := range notes {
+		io.WriteString(buf, "# "+n+"\n")
+	}
 	io.WriteString(buf, "# DO NOT EDIT THIS FILE BY HAND -- CHANGES WILL BE OVERWRITTEN\n\n")
+	c.writeDirectives(buf)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeDirectives writes c's directives to buf, without any header.
+func (c *Config) writeDirectives(buf *bytes.Buffer) {
 	for _, ns := range c.Nameservers {
 		io.WriteString(buf, "nameserver ")
 		io.WriteString(buf, ns.String())
 		io.WriteString(buf, "\n")
 	}
+	if c.Domain != "" {
+		io.WriteString(buf, "domain ")
+		io.WriteString(buf, c.Domain.WithoutTrailingDot())
+		io.WriteString(buf, "\n")
+	}
 	if len(c.SearchDomains) > 0 {
 		io.WriteString(buf, "search")
 		for _, domain := range c.SearchDomains {
@@ -55,56 +145,237 @@ func (c *Config) Write(w io.Writer) error {
 		}
 		io.WriteString(buf, "\n")
 	}
-	_, err := w.Write(buf.Bytes())
-	return err
+	if len(c.Sortlist) > 0 {
+		io.WriteString(buf, "sortlist ")
+		io.WriteString(buf, strings.Join(c.Sortlist, " "))
+		io.WriteString(buf, "\n")
+	}
+	if len(c.Options) > 0 {
+		io.WriteString(buf, "options")
+		for _, o := range c.Options {
+			io.WriteString(buf, " ")
+			io.WriteString(buf, o.String())
+		}
+		io.WriteString(buf, "\n")
+	}
+	for _, d := range c.Unknown {
+		io.WriteString(buf, d.String())
+		io.WriteString(buf, "\n")
+	}
 }
 
-// Parse parses a resolv.conf file from r.
+// Parse parses a resolv.conf file from r. It fails on the first
+// "nameserver" or "search" line it can't make sense of, and skips the
+// other lines it can't make sense of. See ParseStrict and ParseLenient
+// for parsers that fail on all of them, or on none.
 func Parse(r io.Reader) (*Config, error) {
-	config := new(Config)
+	f, diags, err := ParseLines(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range diags {
+		if kw := f.Lines[d.Line-1].Directive.Keyword; strings.HasPrefix(kw, "nameserver") || strings.HasPrefix(kw, "search") {
+			return nil, d.Err
+		}
+	}
+	return f.Config(), nil
+}
+
+// ParseStrict parses a resolv.conf file from r. Unlike Parse, it fails
+// on the first line it can't make sense of, whatever its directive.
+func ParseStrict(r io.Reader) (*Config, error) {
+	f, diags, err := ParseLines(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(diags) > 0 {
+		return nil, diags[0].Err
+	}
+	return f.Config(), nil
+}
+
+// ParseLenient parses a resolv.conf file from r, skipping the lines it
+// can't make sense of, like the system resolver does. It returns a
+// Diagnostic for each skipped line. The error is only non-nil if
+// reading r fails.
+func ParseLenient(r io.Reader) (*Config, []Diagnostic, error) {
+	f, diags, err := ParseLines(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f.Config(), diags, nil
+}
+
+// A Diagnostic describes a resolv.conf line that couldn't be parsed.
+type Diagnostic struct {
+	Line int    // 1-based line number
+	Text string // the line as read
+	Err  error
+}
+
+func (d Diagnostic) Error() string {
+	return fmt.Sprintf("line %d: %v", d.Line, d.Err)
+}
+
+// File is a resolv.conf file as a sequence of lines. It keeps the
+// comments, blank lines and order of the original, so that it can be
+// written back unchanged.
+type File struct {
+	Lines []Line
+}
+
+// A Line is one line of a File.
+type Line struct {
+	// Text is the line as read, without its trailing newline. A
+	// carriage return before the newline is kept.
+	Text string
+
+	// Directive is the line's directive, or the zero value for blank
+	// lines and lines that only hold a comment.
+	Directive Directive
+
+	// Comment is the comment on the line, starting with its '#' or
+	// ';', if any.
+	Comment string
+
+	// Err is non-nil if the line couldn't be parsed. Such lines
+	// don't contribute to the File's Config.
+	Err error
+}
+
+// ParseLines parses a resolv.conf file from r, keeping every line. It
+// returns a Diagnostic for each line that couldn't be parsed; those
+// lines are kept in the File with their Err set. The error is only
+// non-nil if reading r fails.
+func ParseLines(r io.Reader) (*File, []Diagnostic, error) {
+	f := new(File)
+	var diags []Diagnostic
 	scanner := bufio.NewScanner(r)
+	scanner.Split(scanLinesKeepCR)
 	for scanner.Scan() {
-		line := scanner.Text()
-		line, _, _ = strings.Cut(line, "#") // remove any comments
-		line = strings.TrimSpace(line)
-
-		if s, ok := strings.CutPrefix(line, "nameserver"); ok {
-			nameserver := strings.TrimSpace(s)
-			if len(nameserver) == len(s) {
-				return nil, fmt.Errorf("missing space after \"nameserver\" in %q", line)
-			}
-			ip, err := netip.ParseAddr(nameserver)
+		l := parseLine(scanner.Text())
+		if l.Err == nil {
+			l.Err = new(Config).apply(l)
+		}
+		if l.Err != nil {
+			diags = append(diags, Diagnostic{Line: len(f.Lines) + 1, Text: l.Text, Err: l.Err})
+		}
+		f.Lines = append(f.Lines, l)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return f, diags, nil
+}
+
+// scanLinesKeepCR is like bufio.ScanLines, but leaves any carriage
+// return before the newline in the token, so that Write can restore it.
+func scanLinesKeepCR(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// directives are the keywords that this package knows.
+var directives = []string{"nameserver", "search", "domain", "sortlist", "options"}
+
+// parseLine splits a line into its directive and comment.
+func parseLine(text string) Line {
+	l := Line{Text: text}
+	line := strings.TrimSuffix(text, "\r")
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line, l.Comment = line[:i], line[i:]
+	} else if trimmed := strings.TrimLeft(line, " \t"); strings.HasPrefix(trimmed, ";") {
+		line, l.Comment = "", trimmed
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return l
+	}
+	l.Directive = Directive{Keyword: fields[0], Args: fields[1:]}
+	for _, kw := range directives {
+		if l.Directive.Keyword != kw && strings.HasPrefix(l.Directive.Keyword, kw) {
+			l.Err = fmt.Errorf("missing space after %q in %q", kw, strings.TrimSpace(line))
+			break
+		}
+	}
+	return l
+}
+
+// apply adds the directive of l to c.
+func (c *Config) apply(l Line) error {
+	d := l.Directive
+	line := strings.TrimSpace(d.String())
+	switch d.Keyword {
+	case "":
+	case "nameserver":
+		if len(d.Args) == 0 {
+			return fmt.Errorf("missing address after \"nameserver\" in %q", line)
+		}
+		ip, err := netip.ParseAddr(d.Args[0])
+		if err != nil {
+			return err
+		}
+		c.Nameservers = append(c.Nameservers, ip)
+	case "search":
+		if len(d.Args) == 0 {
+			return fmt.Errorf("missing domains after \"search\" in %q", line)
+		}
+		var domains []dnsname.FQDN
+		for _, domain := range d.Args {
+			fqdn, err := dnsname.ToFQDN(domain)
 			if err != nil {
-				return nil, err
+				return fmt.Errorf("parsing search domain %q in %q: %w", domain, line, err)
 			}
-			config.Nameservers = append(config.Nameservers, ip)
-			continue
+			domains = append(domains, fqdn)
+		}
+		c.SearchDomains = append(c.SearchDomains, domains...)
+	case "domain":
+		if len(d.Args) == 0 {
+			return fmt.Errorf("missing domain after \"domain\" in %q", line)
 		}
+		fqdn, err := dnsname.ToFQDN(d.Args[0])
+		if err != nil {
+			return fmt.Errorf("parsing domain %q in %q: %w", d.Args[0], line, err)
+		}
+		c.Domain = fqdn
+	case "sortlist":
+		c.Sortlist = append(c.Sortlist, d.Args...)
+	case "options":
+		for _, o := range d.Args {
+			c.Options = append(c.Options, parseOption(o))
+		}
+	default:
+		c.Unknown = append(c.Unknown, Directive{Keyword: d.Keyword, Args: append([]string(nil), d.Args...)})
+	}
+	return nil
+}
 
-		if s, ok := strings.CutPrefix(line, "search"); ok {
-			domains := strings.TrimSpace(s)
-			if len(domains) == len(s) {
-				// No leading space?!
-				return nil, fmt.Errorf("missing space after \"search\" in %q", line)
-			}
-			for len(domains) > 0 {
-				domain := domains
-				i := strings.IndexAny(domain, " \t")
-				if i != -1 {
-					domain = domain[:i]
-					domains = strings.TrimSpace(domains[i+1:])
-				} else {
-					domains = ""
-				}
-				fqdn, err := dnsname.ToFQDN(domain)
-				if err != nil {
-					return nil, fmt.Errorf("parsing search domain %q in %q: %w", domain, line, err)
-				}
-				config.SearchDomains = append(config.SearchDomains, fqdn)
-			}
+// Config returns the configuration described by f's valid lines.
+func (f *File) Config() *Config {
+	c := new(Config)
+	for _, l := range f.Lines {
+		if l.Err == nil {
+			c.apply(l)
 		}
 	}
-	return config, nil
+	return c
+}
+
+// Write writes f to w, line by line as it was parsed, in one Write
+// call. Every line, including the last, ends with a newline.
+func (f *File) Write(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	for _, l := range f.Lines {
+		io.WriteString(buf, l.Text)
+		io.WriteString(buf, "\n")
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
 }
 
 // ParseFile parses the named resolv.conf file.
@@ -101,3 +101,152 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+func TestParseDirectives(t *testing.T) {
+	const in = `# generated by a DHCP client
+domain corp.example
+nameserver 10.0.0.1
+sortlist 130.155.160.0/255.255.240.0 130.155.0.0
+options ndots:5 timeout:1
+options attempts:2 edns0 trust-ad
+lookup file bind
+`
+	cfg, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Config{
+		Nameservers: []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+		Domain:      "corp.example.",
+		Sortlist:    []string{"130.155.160.0/255.255.240.0", "130.155.0.0"},
+		Options: []Option{
+			{Name: "ndots", Value: "5"},
+			{Name: "timeout", Value: "1"},
+			{Name: "attempts", Value: "2"},
+			{Name: "edns0"},
+			{Name: "trust-ad"},
+		},
+		Unknown: []Directive{{Keyword: "lookup", Args: []string{"file", "bind"}}},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got: %+v\nwant: %+v", cfg, want)
+	}
+	if v, ok := cfg.Option("ndots"); !ok || v != "5" {
+		t.Errorf("Option(ndots) = %q, %v; want 5, true", v, ok)
+	}
+	if _, ok := cfg.Option("rotate"); ok {
+		t.Error("Option(rotate) present; want absent")
+	}
+
+	var buf strings.Builder
+	if err := cfg.WriteGenerated(&buf, "example", ""); err != nil {
+		t.Fatal(err)
+	}
+	const wantOut = `# resolv.conf(5) file generated by example
+# DO NOT EDIT THIS FILE BY HAND -- CHANGES WILL BE OVERWRITTEN
+
+nameserver 10.0.0.1
+domain corp.example
+sortlist 130.155.160.0/255.255.240.0 130.155.0.0
+options ndots:5 timeout:1 attempts:2 edns0 trust-ad
+lookup file bind
+`
+	if got := buf.String(); got != wantOut {
+		t.Errorf("Write mismatch\n got: %q\nwant: %q", got, wantOut)
+	}
+	reparsed, err := Parse(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reparsed, want) {
+		t.Errorf("reparsed: %+v\nwant: %+v", reparsed, want)
+	}
+}
+
+func TestParseLenient(t *testing.T) {
+	const in = "nameserver 10.0.0.1\n" +
+		"nameserver not-an-ip\n" +
+		"search good.example\n" +
+		"searchbad.example\n" +
+		"nameserver 10.0.0.2 # backup\n"
+	if _, err := Parse(strings.NewReader(in)); err == nil {
+		t.Error("Parse succeeded; want error")
+	}
+	cfg, diags, err := ParseLenient(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Config{
+		Nameservers:   []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")},
+		SearchDomains: []dnsname.FQDN{"good.example."},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got: %+v\nwant: %+v", cfg, want)
+	}
+	if len(diags) != 2 || diags[0].Line != 2 || diags[1].Line != 4 {
+		t.Fatalf("diagnostics = %v; want lines 2 and 4", diags)
+	}
+	if diags[1].Text != "searchbad.example" {
+		t.Errorf("diagnostic text = %q", diags[1].Text)
+	}
+}
+
+func TestParseStrict(t *testing.T) {
+	// Parse has always skipped lines other than "nameserver" and
+	// "search" ones; only ParseStrict fails on them.
+	const in = "nameserver 10.0.0.1\n" +
+		"domain bad..example\n" +
+		"domainname corp.example\n" +
+		"optionsndots:2\n"
+	cfg, err := Parse(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := &Config{Nameservers: []netip.Addr{netip.MustParseAddr("10.0.0.1")}}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got: %+v\nwant: %+v", cfg, want)
+	}
+	for _, line := range strings.SplitAfter(in, "\n")[1:4] {
+		if _, err := ParseStrict(strings.NewReader(line)); err == nil {
+			t.Errorf("ParseStrict(%q) succeeded; want error", line)
+		}
+	}
+	if _, err := ParseStrict(strings.NewReader("nameserver 10.0.0.1\ndomain corp.example\n")); err != nil {
+		t.Errorf("ParseStrict: %v", err)
+	}
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	const in = "# top comment\n" +
+		"\n" +
+		"options edns0\n" +
+		"nameserver 10.0.0.1   # primary\n" +
+		"; old-style comment\n" +
+		"nameserver bogus\n" +
+		"search a.example b.example\r\n" +
+		"unknown-directive x y\n"
+	f, diags, err := ParseLines(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diags) != 1 || diags[0].Line != 6 {
+		t.Errorf("diagnostics = %v; want one on line 6", diags)
+	}
+	if got := f.Lines[3].Comment; got != "# primary" {
+		t.Errorf("comment = %q; want %q", got, "# primary")
+	}
+	if got := f.Lines[4].Comment; got != "; old-style comment" {
+		t.Errorf("comment = %q; want %q", got, "; old-style comment")
+	}
+	var buf strings.Builder
+	if err := f.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != in {
+		t.Errorf("round trip mismatch\n got: %q\nwant: %q", buf.String(), in)
+	}
+	cfg := f.Config()
+	if len(cfg.Nameservers) != 1 || len(cfg.SearchDomains) != 2 || len(cfg.Options) != 1 || len(cfg.Unknown) != 1 {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+}
@@ -7,8 +7,9 @@ package dns
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"os"
-	"os/exec"
 	"regexp"
 	"strings"
 
@@ -16,11 +17,25 @@ import (
 	"github.com/anywherelan/ts-dns/types/logger"
 )
 
-func newResolvdManager(logf logger.Logf, interfaceName string) (*resolvdManager, error) {
+// NewResolvdManager returns an OSConfigurator that uses route(8) to
+// teach OpenBSD's resolvd(8) about the nameservers of the interface
+// named interfaceName. It's the ModeResolvd backend.
+func NewResolvdManager(logf logger.Logf, interfaceName string, opts Options) (OSConfigurator, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return newResolvdManager(logf, interfaceName, opts)
+}
+
+func newResolvdManager(logf logger.Logf, interfaceName string, opts Options) (*resolvdManager, error) {
 	return &resolvdManager{
 		logf:   logf,
 		ifName: interfaceName,
-		fs:     directFS{},
+		ident:  opts.Identity,
+		runner: opts.Runner,
+		fs:     opts.fs(),
+		owner:  newOwnerLock(logf, opts),
 	}, nil
 }
 
@@ -29,19 +44,56 @@ func newResolvdManager(logf logger.Logf, interfaceName string) (*resolvdManager,
 type resolvdManager struct {
 	logf   logger.Logf
 	ifName string
-	fs     directFS
+	ident  Identity // names our backup file
+	runner CommandRunner
+	fs     WholeFileFS
+	owner  *ownerLock // held around our changes
+	life   lifecycle
 }
 
 func (m *resolvdManager) SetDNS(config OSConfig) error {
+	return m.SetDNSContext(context.Background(), config)
+}
+
+// SetDNSContext implements ContextOSConfigurator.
+func (m *resolvdManager) SetDNSContext(ctx context.Context, config OSConfig) error {
+	return m.life.set(func() error { return m.setDNS(ctx, config) })
+}
+
+// setDNS implements SetDNSContext.
+func (m *resolvdManager) setDNS(ctx context.Context, config OSConfig) (err error) {
+	unlock, err := m.owner.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { unlock(err == nil && config.IsZero()) }()
+
 	args := []string{
 		"nameserver",
 		m.ifName,
 	}
 
-	origResolv, err := m.readAndCopy(resolvConf, backupConf, 0644)
+	snap, err := snapshotFiles(m.fs, resolvConf, m.ident.backupConf())
 	if err != nil {
 		return err
 	}
+	undo := func() (bool, error) {
+		return restoreFiles(m.fs, snap, func(name string, contents []byte) error {
+			return m.fs.WriteFile(name, contents, 0644)
+		})
+	}
+
+	// Back up resolv.conf before our first change only, so that the
+	// backup keeps the original, for GetBaseConfig and Close.
+	var origResolv []byte
+	if _, err = m.fs.Stat(m.ident.backupConf()); err == nil {
+		origResolv, err = m.fs.ReadFile(resolvConf)
+	} else {
+		origResolv, err = m.readAndCopy(resolvConf, m.ident.backupConf(), 0644)
+	}
+	if err != nil {
+		return rollBack(m.logf, err, undo)
+	}
 	newResolvConf := removeSearchLines(origResolv)
 
 	for _, ns := range config.Nameservers {
@@ -61,19 +113,30 @@ func (m *resolvdManager) SetDNS(config OSConfig) error {
 
 	err = m.fs.WriteFile(resolvConf, newResolvConf, 0644)
 	if err != nil {
-		return err
+		return rollBack(m.logf, err, undo)
 	}
 
-	cmd := exec.Command("/sbin/route", args...)
-	return cmd.Run()
+	if _, err := runCommand(ctx, m.runner, "/sbin/route", args...); err != nil {
+		return rollBack(m.logf, err, undo)
+	}
+	return nil
 }
 
 func (m *resolvdManager) SupportsSplitDNS() bool {
 	return false
 }
 
+// GetBaseConfig returns the configuration in our backup of resolv.conf,
+// if there's one, since the live file may point at the split DNS stub
+// already. Otherwise it's that of resolv.conf.
 func (m *resolvdManager) GetBaseConfig() (OSConfig, error) {
-	cfg, err := m.readResolvConf()
+	name := resolvConf
+	if _, err := m.fs.Stat(m.ident.backupConf()); err == nil {
+		name = m.ident.backupConf()
+	} else if !os.IsNotExist(err) {
+		return OSConfig{}, err
+	}
+	cfg, err := m.readResolvConf(name)
 	if err != nil {
 		return OSConfig{}, err
 	}
@@ -82,15 +145,39 @@ func (m *resolvdManager) GetBaseConfig() (OSConfig, error) {
 }
 
 func (m *resolvdManager) Close() error {
+	return m.CloseContext(context.Background())
+}
+
+// CloseContext implements ContextOSConfigurator. Closing only restores
+// resolv.conf, so ctx only bounds the wait for the owner file's lock.
+func (m *resolvdManager) CloseContext(ctx context.Context) error {
+	return m.life.close(func() error { return m.close(ctx) })
+}
+
+// close implements CloseContext.
+func (m *resolvdManager) close(ctx context.Context) error {
+	unlock, err := m.owner.tryLock(ctx)
+	var other *OwnedError
+	if errors.As(err, &other) {
+		// Another process took over, so there's nothing of ours to
+		// restore.
+		m.logf("not restoring resolv.conf: %v", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock(true)
+
 	// resolvd handles teardown of nameservers so we only need to write back the original
 	// config and be done.
 
-	_, err := m.readAndCopy(backupConf, resolvConf, 0644)
+	_, err = m.readAndCopy(m.ident.backupConf(), resolvConf, 0644)
 	if err != nil {
 		return err
 	}
 
-	return m.fs.Remove(backupConf)
+	return m.fs.Remove(m.ident.backupConf())
 }
 
 func (m *resolvdManager) readAndCopy(a, b string, mode os.FileMode) ([]byte, error) {
@@ -106,8 +193,8 @@ func (m *resolvdManager) readAndCopy(a, b string, mode os.FileMode) ([]byte, err
 	return orig, nil
 }
 
-func (m resolvdManager) readResolvConf() (config OSConfig, err error) {
-	b, err := m.fs.ReadFile(resolvConf)
+func (m *resolvdManager) readResolvConf(name string) (config OSConfig, err error) {
+	b, err := m.fs.ReadFile(name)
 	if err != nil {
 		return OSConfig{}, err
 	}
@@ -117,8 +204,9 @@ func (m resolvdManager) readResolvConf() (config OSConfig, err error) {
 		return config, err
 	}
 	return OSConfig{
-		Nameservers:   rconf.Nameservers,
-		SearchDomains: rconf.SearchDomains,
+		Nameservers:     rconf.Nameservers,
+		SearchDomains:   rconf.SearchDomains,
+		ResolverOptions: resolverOptionsFromConf(rconf.Options),
 	}, nil
 }
 
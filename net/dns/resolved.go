@@ -13,7 +13,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/anywherelan/ts-dns/health"
 	"github.com/anywherelan/ts-dns/logtail/backoff"
 	"github.com/anywherelan/ts-dns/net/netaddr"
 	"github.com/anywherelan/ts-dns/types/logger"
@@ -57,12 +56,10 @@ var errNotReady = errors.New("interface not ready")
 // Clients connect to the bus and walk that same hierarchy to invoke
 // RPCs, get/set properties, or listen for signals.
 const (
-	dbusResolvedObject                    = "org.freedesktop.resolve1"
-	dbusResolvedPath      dbus.ObjectPath = "/org/freedesktop/resolve1"
-	dbusResolvedInterface                 = "org.freedesktop.resolve1.Manager"
-	dbusPath              dbus.ObjectPath = "/org/freedesktop/DBus"
-	dbusInterface                         = "org.freedesktop.DBus"
-	dbusOwnerSignal                       = "NameOwnerChanged" // broadcast when a well-known name's owning process changes.
+	dbusResolvedObject                        = "org.freedesktop.resolve1"
+	dbusResolvedPath          dbus.ObjectPath = "/org/freedesktop/resolve1"
+	dbusResolvedInterface                     = "org.freedesktop.resolve1.Manager"
+	dbusResolvedLinkInterface                 = "org.freedesktop.resolve1.Link"
 )
 
 type resolvedLinkNameserver struct {
@@ -77,22 +74,40 @@ type resolvedLinkDomain struct {
 
 // changeRequest tracks latest OSConfig and related error responses to update.
 type changeRequest struct {
-	config OSConfig     // configs OSConfigs, one per each SetDNS call
-	res    chan<- error // response channel
+	ctx    context.Context // of the SetDNSContext call
+	config OSConfig        // configs OSConfigs, one per each SetDNS call
+	res    chan<- error    // response channel
 }
 
 // resolvedManager is an OSConfigurator which uses the systemd-resolved DBus API.
 type resolvedManager struct {
-	ctx    context.Context
-	cancel func() // terminate the context, for close
-
-	logf  logger.Logf
-	ifidx int
+	ctx     context.Context
+	cancel  func()               // terminate the context, for close
+	closing chan context.Context // of the first CloseContext, for run
+	done    chan struct{}        // closed when run returns
+
+	logf    logger.Logf
+	ifidx   int
+	ifName  string
+	health  HealthSink
+	journal *journal // records the link we program, or nil
+	bus     BusDialer
 
 	configCR chan changeRequest // tracks OSConfigs changes and error responses
 }
 
-func newResolvedManager(logf logger.Logf, interfaceName string) (*resolvedManager, error) {
+// NewResolvedManager returns an OSConfigurator that programs
+// systemd-resolved over D-Bus for the interface named interfaceName.
+// It's the ModeSystemdResolved backend.
+func NewResolvedManager(logf logger.Logf, interfaceName string, opts Options) (OSConfigurator, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	return newResolvedManager(logf, interfaceName, opts)
+}
+
+func newResolvedManager(logf logger.Logf, interfaceName string, opts Options) (*resolvedManager, error) {
 	iface, err := net.InterfaceByName(interfaceName)
 	if err != nil {
 		return nil, err
@@ -102,11 +117,17 @@ func newResolvedManager(logf logger.Logf, interfaceName string) (*resolvedManage
 	logf = logger.WithPrefix(logf, "dns: ")
 
 	mgr := &resolvedManager{
-		ctx:    ctx,
-		cancel: cancel,
-
-		logf:  logf,
-		ifidx: iface.Index,
+		ctx:     ctx,
+		cancel:  cancel,
+		closing: make(chan context.Context, 1),
+		done:    make(chan struct{}),
+
+		logf:    logf,
+		ifidx:   iface.Index,
+		ifName:  iface.Name,
+		health:  opts.Health,
+		journal: opts.journal,
+		bus:     busOrDefault(opts.Bus),
 
 		configCR: make(chan changeRequest),
 	}
@@ -116,7 +137,34 @@ func newResolvedManager(logf logger.Logf, interfaceName string) (*resolvedManage
 	return mgr, nil
 }
 
+// resolvedUnsupportedOptions returns the names of the options in o that
+// systemd-resolved can't apply. Its stub resolver always offers EDNS0
+// and trusts the AD bit (its stub resolv.conf says "options edns0
+// trust-ad"), but there are no per-link equivalents of the others.
+func resolvedUnsupportedOptions(o ResolverOptions) []string {
+	o.EDNS0 = false
+	o.TrustAD = false
+	return o.names()
+}
+
+// UnsupportedResolverOptions implements ResolverOptionsChecker.
+func (m *resolvedManager) UnsupportedResolverOptions(o ResolverOptions) []string {
+	return resolvedUnsupportedOptions(o)
+}
+
 func (m *resolvedManager) SetDNS(config OSConfig) error {
+	return m.SetDNSContext(context.Background(), config)
+}
+
+// SetDNSContext implements ContextOSConfigurator.
+func (m *resolvedManager) SetDNSContext(ctx context.Context, config OSConfig) error {
+	if unsupported := resolvedUnsupportedOptions(config.ResolverOptions); len(unsupported) > 0 {
+		m.logf("ignoring resolver options that systemd-resolved can't apply: %v", unsupported)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	// NOTE: don't close this channel, since it's possible that the SetDNS
 	// call will time out and return before the run loop answers, at which
 	// point it will send on the now-closed channel.
@@ -124,13 +172,17 @@ func (m *resolvedManager) SetDNS(config OSConfig) error {
 
 	select {
 	case <-m.ctx.Done():
-		return m.ctx.Err()
-	case m.configCR <- changeRequest{config, errc}:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	case m.configCR <- changeRequest{ctx, config, errc}:
 	}
 
 	select {
 	case <-m.ctx.Done():
-		return m.ctx.Err()
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
 	case err := <-errc:
 		if err != nil {
 			m.logf("failed to configure resolved: %v", err)
@@ -141,12 +193,12 @@ func (m *resolvedManager) SetDNS(config OSConfig) error {
 
 func (m *resolvedManager) run(ctx context.Context) {
 	var (
-		conn     *dbus.Conn
-		signals  chan *dbus.Signal
-		rManager dbus.BusObject // rManager is the Resolved DBus connection
+		conn    Bus // nil while disconnected
+		signals chan *dbus.Signal
 	)
 	bo := backoff.NewBackoff("resolved-dbus", m.logf, 30*time.Second)
 	needsReconnect := make(chan bool, 1)
+	defer close(m.done)
 	defer func() {
 		if conn != nil {
 			conn.Close()
@@ -157,7 +209,7 @@ func (m *resolvedManager) run(ctx context.Context) {
 	reconnect := func() error {
 		var err error
 		signals = make(chan *dbus.Signal, 16)
-		conn, err = dbus.SystemBus()
+		conn, err = m.bus.Dial()
 		if err != nil {
 			m.logf("dbus connection error: %v", err)
 		} else {
@@ -173,20 +225,17 @@ func (m *resolvedManager) run(ctx context.Context) {
 			return err
 		}
 
-		rManager = conn.Object(dbusResolvedObject, dbus.ObjectPath(dbusResolvedPath))
-
 		// Only receive the DBus signals we need to resync our config on
 		// resolved restart. Failure to set filters isn't a fatal error,
 		// we'll just receive all broadcast signals and have to ignore
 		// them on our end.
-		if err = conn.AddMatchSignal(dbus.WithMatchObjectPath(dbusPath), dbus.WithMatchInterface(dbusInterface), dbus.WithMatchMember(dbusOwnerSignal), dbus.WithMatchArg(0, dbusResolvedObject)); err != nil {
+		if err = conn.Subscribe(signals, SignalMatch{Path: dbusPath, Interface: dbusInterface, Member: dbusOwnerSignal, Arg0: dbusResolvedObject}); err != nil {
 			m.logf("[v1] Setting DBus signal filter failed: %v", err)
 		}
-		conn.Signal(signals)
 
 		// Reset backoff and SetNSOSHealth after successful on reconnect.
 		bo.BackOff(ctx, nil)
-		health.SetDNSOSHealth(nil)
+		m.health.SetDNSOSHealth(nil)
 		return nil
 	}
 
@@ -198,26 +247,42 @@ func (m *resolvedManager) run(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
-			if rManager == nil {
+			if conn == nil {
 				return
 			}
-			// RevertLink resets all per-interface settings on systemd-resolved to defaults.
-			// When ctx goes away systemd-resolved auto reverts.
-			// Keeping for potential use in future refactor.
-			if call := rManager.CallWithContext(ctx, dbusResolvedInterface+".RevertLink", 0, m.ifidx); call.Err != nil {
-				m.logf("[v1] RevertLink: %v", call.Err)
+			// RevertLink resets all per-interface settings on
+			// systemd-resolved to defaults. ctx is done, so it
+			// runs within the context given to CloseContext, or
+			// if that's done already too, within the default
+			// time limit.
+			closeCtx := <-m.closing
+			if closeCtx.Err() != nil {
+				closeCtx = context.Background()
+			}
+			revertCtx, cancel := withDefaultTimeout(closeCtx, reconfigTimeout)
+			defer cancel()
+			if err := callResolved(revertCtx, conn, "RevertLink", m.ifidx); err != nil {
+				m.logf("[v1] RevertLink: %v", err)
 				return
 			}
+			m.journal.forget(m.logf, m.journalEntry())
 			return
 		case configCR := <-m.configCR:
 			// Track and update sync with latest config change.
 			lastConfig = configCR.config
 
-			if rManager == nil {
+			if conn == nil {
 				configCR.res <- fmt.Errorf("resolved DBus does not have a connection")
 				continue
 			}
-			err := m.setConfigOverDBus(ctx, rManager, configCR.config)
+			if err := m.journal.intend(m.journalEntry()); err != nil {
+				configCR.res <- err
+				continue
+			}
+			err := m.applyConfig(configCR.ctx, conn, configCR.config)
+			if err == nil {
+				m.journal.applied(m.logf, m.journalEntry())
+			}
 			configCR.res <- err
 		case <-needsReconnect:
 			if err := reconnect(); err != nil {
@@ -260,11 +325,11 @@ func (m *resolvedManager) run(ctx context.Context) {
 			// The resolved bus name has a new owner, meaning resolved
 			// restarted. Reprogram current config.
 			m.logf("systemd-resolved restarted, syncing DNS config")
-			err := m.setConfigOverDBus(ctx, rManager, lastConfig)
+			err := m.applyConfig(ctx, conn, lastConfig)
 			// Set health while holding the lock, because this will
 			// graciously serialize the resync's health outcome with a
 			// concurrent SetDNS call.
-			health.SetDNSOSHealth(err)
+			m.health.SetDNSOSHealth(err)
 			if err != nil {
 				m.logf("failed to configure systemd-resolved: %v", err)
 			}
@@ -272,9 +337,109 @@ func (m *resolvedManager) run(ctx context.Context) {
 	}
 }
 
-// setConfigOverDBus updates resolved DBus config and is only called from the run goroutine.
-func (m *resolvedManager) setConfigOverDBus(ctx context.Context, rManager dbus.BusObject, config OSConfig) error {
-	ctx, cancel := context.WithTimeout(ctx, reconfigTimeout)
+// journalEntry returns the journal entry for the link we program.
+func (m *resolvedManager) journalEntry() JournalEntry {
+	return JournalEntry{Mode: ModeSystemdResolved, Kind: JournalLink, Target: m.ifName, Index: m.ifidx}
+}
+
+// resolvedLinkState is a snapshot of the settings of our link that
+// setConfigOverDBus must change.
+type resolvedLinkState struct {
+	dns          []resolvedLinkNameserver
+	domains      []resolvedLinkDomain
+	defaultRoute *bool // nil if resolved is too old to have it
+}
+
+// snapshotLink returns the current settings of our link.
+func (m *resolvedManager) snapshotLink(ctx context.Context, conn Bus) (*resolvedLinkState, error) {
+	ctx, cancel := withDefaultTimeout(ctx, reconfigTimeout)
+	defer cancel()
+
+	var linkPath dbus.ObjectPath
+	body, err := conn.Call(ctx, dbusResolvedObject, dbusResolvedPath, dbusResolvedInterface+".GetLink", m.ifidx)
+	if err == nil {
+		err = dbus.Store(body, &linkPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getLink: %w", err)
+	}
+	get := func(name string, dst any) error {
+		v, err := conn.GetProperty(ctx, dbusResolvedObject, linkPath, dbusResolvedLinkInterface, name)
+		if err == nil {
+			err = v.Store(dst)
+		}
+		if err != nil {
+			return fmt.Errorf("reading link %s: %w", name, err)
+		}
+		return nil
+	}
+
+	st := new(resolvedLinkState)
+	if err := get("DNS", &st.dns); err != nil {
+		return nil, err
+	}
+	if err := get("Domains", &st.domains); err != nil {
+		return nil, err
+	}
+	var defaultRoute bool
+	if err := get("DefaultRoute", &defaultRoute); err == nil {
+		st.defaultRoute = &defaultRoute
+	}
+	return st, nil
+}
+
+// restoreLink puts back the link settings in st, or reverts the link to
+// resolved's defaults if st is nil.
+func (m *resolvedManager) restoreLink(conn Bus, st *resolvedLinkState) error {
+	// The context of the failed attempt may have expired.
+	ctx, cancel := context.WithTimeout(m.ctx, reconfigTimeout)
+	defer cancel()
+
+	if st == nil {
+		return callResolved(ctx, conn, "RevertLink", m.ifidx)
+	}
+	var errs []error
+	if err := callResolved(ctx, conn, "SetLinkDNS", m.ifidx, st.dns); err != nil {
+		errs = append(errs, fmt.Errorf("setLinkDNS: %w", err))
+	}
+	if err := callResolved(ctx, conn, "SetLinkDomains", m.ifidx, st.domains); err != nil {
+		errs = append(errs, fmt.Errorf("setLinkDomains: %w", err))
+	}
+	if st.defaultRoute != nil {
+		if err := callResolved(ctx, conn, "SetLinkDefaultRoute", m.ifidx, *st.defaultRoute); err != nil {
+			errs = append(errs, fmt.Errorf("setLinkDefaultRoute: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// applyConfig applies config with setConfigOverDBus, and rolls the link
+// back to its previous settings if that fails partway. It's only called
+// from the run goroutine.
+func (m *resolvedManager) applyConfig(ctx context.Context, conn Bus, config OSConfig) error {
+	st, err := m.snapshotLink(ctx, conn)
+	if err != nil {
+		// Too old a resolved, or the link isn't known to it yet.
+		// Rolling back will revert the link to its defaults.
+		m.logf("[v1] can't snapshot link settings: %v", err)
+	}
+	changed, err := m.setConfigOverDBus(ctx, conn, config)
+	if err != nil {
+		return rollBack(m.logf, err, func() (bool, error) {
+			if !changed {
+				return false, nil
+			}
+			return true, m.restoreLink(conn, st)
+		})
+	}
+	return nil
+}
+
+// setConfigOverDBus updates resolved DBus config and is only called from
+// the run goroutine. changed reports whether any of the link's settings
+// were changed, even if it failed.
+func (m *resolvedManager) setConfigOverDBus(ctx context.Context, conn Bus, config OSConfig) (changed bool, err error) {
+	ctx, cancel := withDefaultTimeout(ctx, reconfigTimeout)
 	defer cancel()
 
 	var linkNameservers = make([]resolvedLinkNameserver, len(config.Nameservers))
@@ -292,12 +457,9 @@ func (m *resolvedManager) setConfigOverDBus(ctx context.Context, rManager dbus.B
 			}
 		}
 	}
-	err := rManager.CallWithContext(
-		ctx, dbusResolvedInterface+".SetLinkDNS", 0,
-		m.ifidx, linkNameservers,
-	).Store()
+	err = callResolved(ctx, conn, "SetLinkDNS", m.ifidx, linkNameservers)
 	if err != nil {
-		return fmt.Errorf("setLinkDNS: %w", err)
+		return false, fmt.Errorf("setLinkDNS: %w", err)
 	}
 	linkDomains := make([]resolvedLinkDomain, 0, len(config.SearchDomains)+len(config.MatchDomains))
 	seenDomains := map[dnsname.FQDN]bool{}
@@ -323,7 +485,9 @@ func (m *resolvedManager) setConfigOverDBus(ctx context.Context, rManager dbus.B
 			RoutingOnly: true,
 		})
 	}
-	if len(config.MatchDomains) == 0 && len(config.Nameservers) > 0 {
+	// Without nameservers, as in a zero config, we take no queries.
+	defaultRoute := len(config.MatchDomains) == 0 && len(config.Nameservers) > 0
+	if defaultRoute {
 		// Caller requested full DNS interception, install a
 		// routing-only root domain.
 		linkDomains = append(linkDomains, resolvedLinkDomain{
@@ -332,29 +496,23 @@ func (m *resolvedManager) setConfigOverDBus(ctx context.Context, rManager dbus.B
 		})
 	}
 
-	err = rManager.CallWithContext(
-		ctx, dbusResolvedInterface+".SetLinkDomains", 0,
-		m.ifidx, linkDomains,
-	).Store()
+	err = callResolved(ctx, conn, "SetLinkDomains", m.ifidx, linkDomains)
 	if err != nil && err.Error() == "Argument list too long" { // TODO: better error match
 		// Issue 3188: older systemd-resolved had argument length limits.
 		// Trim out the *.arpa. entries and try again.
-		err = rManager.CallWithContext(
-			ctx, dbusResolvedInterface+".SetLinkDomains", 0,
-			m.ifidx, linkDomainsWithoutReverseDNS(linkDomains),
-		).Store()
+		err = callResolved(ctx, conn, "SetLinkDomains", m.ifidx, linkDomainsWithoutReverseDNS(linkDomains))
 	}
 	if err != nil {
-		return fmt.Errorf("setLinkDomains: %w", err)
+		return true, fmt.Errorf("setLinkDomains: %w", err)
 	}
 
-	if call := rManager.CallWithContext(ctx, dbusResolvedInterface+".SetLinkDefaultRoute", 0, m.ifidx, len(config.MatchDomains) == 0); call.Err != nil {
-		if dbusErr, ok := call.Err.(dbus.Error); ok && dbusErr.Name == dbus.ErrMsgUnknownMethod.Name {
+	if err := callResolved(ctx, conn, "SetLinkDefaultRoute", m.ifidx, defaultRoute); err != nil {
+		if dbusErr, ok := err.(dbus.Error); ok && dbusErr.Name == dbus.ErrMsgUnknownMethod.Name {
 			// on some older systems like Kubuntu 18.04.6 with systemd 237 method SetLinkDefaultRoute is absent,
 			// but otherwise it's working good
-			m.logf("[v1] failed to set SetLinkDefaultRoute: %v", call.Err)
+			m.logf("[v1] failed to set SetLinkDefaultRoute: %v", err)
 		} else {
-			return fmt.Errorf("setLinkDefaultRoute: %w", call.Err)
+			return true, fmt.Errorf("setLinkDefaultRoute: %w", err)
 		}
 	}
 
@@ -363,29 +521,29 @@ func (m *resolvedManager) setConfigOverDBus(ctx context.Context, rManager dbus.B
 	// or something).
 
 	// Disable LLMNR, we don't do multicast.
-	if call := rManager.CallWithContext(ctx, dbusResolvedInterface+".SetLinkLLMNR", 0, m.ifidx, "no"); call.Err != nil {
-		m.logf("[v1] failed to disable LLMNR: %v", call.Err)
+	if err := callResolved(ctx, conn, "SetLinkLLMNR", m.ifidx, "no"); err != nil {
+		m.logf("[v1] failed to disable LLMNR: %v", err)
 	}
 
 	// Disable mdns.
-	if call := rManager.CallWithContext(ctx, dbusResolvedInterface+".SetLinkMulticastDNS", 0, m.ifidx, "no"); call.Err != nil {
-		m.logf("[v1] failed to disable mdns: %v", call.Err)
+	if err := callResolved(ctx, conn, "SetLinkMulticastDNS", m.ifidx, "no"); err != nil {
+		m.logf("[v1] failed to disable mdns: %v", err)
 	}
 
 	// We don't support dnssec consistently right now, force it off to
 	// avoid partial failures when we split DNS internally.
-	if call := rManager.CallWithContext(ctx, dbusResolvedInterface+".SetLinkDNSSEC", 0, m.ifidx, "no"); call.Err != nil {
-		m.logf("[v1] failed to disable DNSSEC: %v", call.Err)
+	if err := callResolved(ctx, conn, "SetLinkDNSSEC", m.ifidx, "no"); err != nil {
+		m.logf("[v1] failed to disable DNSSEC: %v", err)
 	}
 
-	if call := rManager.CallWithContext(ctx, dbusResolvedInterface+".SetLinkDNSOverTLS", 0, m.ifidx, "no"); call.Err != nil {
-		m.logf("[v1] failed to disable DoT: %v", call.Err)
+	if err := callResolved(ctx, conn, "SetLinkDNSOverTLS", m.ifidx, "no"); err != nil {
+		m.logf("[v1] failed to disable DoT: %v", err)
 	}
 
-	if call := rManager.CallWithContext(ctx, dbusResolvedInterface+".FlushCaches", 0); call.Err != nil {
-		m.logf("failed to flush resolved DNS cache: %v", call.Err)
+	if err := callResolved(ctx, conn, "FlushCaches"); err != nil {
+		m.logf("failed to flush resolved DNS cache: %v", err)
 	}
-	return nil
+	return true, nil
 }
 
 func (m *resolvedManager) SupportsSplitDNS() bool {
@@ -397,8 +555,26 @@ func (m *resolvedManager) GetBaseConfig() (OSConfig, error) {
 }
 
 func (m *resolvedManager) Close() error {
+	return m.CloseContext(context.Background())
+}
+
+// CloseContext implements ContextOSConfigurator. If ctx is done before
+// our link is reverted, it returns ctx.Err() and the revert goes on in
+// the background: within ctx if it had started, and otherwise within
+// the default time limit.
+func (m *resolvedManager) CloseContext(ctx context.Context) error {
+	select {
+	case m.closing <- ctx:
+	default:
+		// Closed already.
+	}
 	m.cancel() // stops the 'run' method goroutine
-	return nil
+	select {
+	case <-m.done: // which reverts our link
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // linkDomainsWithoutReverseDNS returns a copy of v without
@@ -413,3 +589,51 @@ func linkDomainsWithoutReverseDNS(v []resolvedLinkDomain) (ret []resolvedLinkDom
 	}
 	return ret
 }
+
+// recoverResolved reverts the systemd-resolved settings of the link
+// named interfaceName, which a ModeSystemdResolved run may have left
+// behind. If the link is gone, resolved has forgotten its settings
+// already.
+func recoverResolved(bus BusDialer, interfaceName string) []RecoveryAction {
+	if interfaceName == "" {
+		return nil
+	}
+	iface, err := net.InterfaceByName(interfaceName)
+	if err != nil {
+		return nil
+	}
+	return revertResolvedLink(bus, iface)
+}
+
+// undoResolvedLink reverts the link of the JournalLink entry e. If the
+// interface is gone, or its index now belongs to another, resolved has
+// forgotten the settings already.
+func undoResolvedLink(bus BusDialer, e JournalEntry) []RecoveryAction {
+	iface, err := net.InterfaceByIndex(e.Index)
+	if err != nil || iface.Name != e.Target {
+		return nil
+	}
+	return revertResolvedLink(bus, iface)
+}
+
+// revertResolvedLink reverts the systemd-resolved settings of iface.
+func revertResolvedLink(bus BusDialer, iface *net.Interface) []RecoveryAction {
+	ctx, cancel := context.WithTimeout(context.Background(), reconfigTimeout)
+	defer cancel()
+	if err := dbusPing(ctx, bus, dbusResolvedObject, string(dbusResolvedPath)); err != nil {
+		return nil
+	}
+	conn, err := busOrDefault(bus).Dial()
+	if err == nil {
+		err = callResolved(ctx, conn, "RevertLink", iface.Index)
+		conn.Close()
+	}
+	return []RecoveryAction{{Mode: ModeSystemdResolved, Target: iface.Name, Action: "reverted", Err: err}}
+}
+
+// callResolved calls the method of systemd-resolved's Manager interface
+// on conn.
+func callResolved(ctx context.Context, conn Bus, method string, args ...any) error {
+	_, err := conn.Call(ctx, dbusResolvedObject, dbusResolvedPath, dbusResolvedInterface+"."+method, args...)
+	return err
+}
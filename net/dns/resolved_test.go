@@ -0,0 +1,184 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/anywherelan/ts-dns/health"
+	"github.com/godbus/dbus/v5"
+)
+
+// loopbackInterface returns the loopback interface, for the backends
+// that need a real one.
+func loopbackInterface(t *testing.T) net.Interface {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifs {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface
+		}
+	}
+	t.Skip("no loopback interface")
+	return net.Interface{}
+}
+
+// waitFor waits for cond to hold, or fails the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// subscribers returns the number of signal subscriptions on bus.
+func subscribers(bus *FakeBus) int {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	n := 0
+	for c := range bus.conns {
+		n += len(c.subs)
+	}
+	return n
+}
+
+// newFakeResolvedManager returns a resolvedManager of the loopback
+// interface talking to a FakeResolved.
+func newFakeResolvedManager(t *testing.T) (*resolvedManager, *FakeBus, *FakeResolved) {
+	bus := NewFakeBus()
+	r := NewFakeResolved(bus)
+	m, err := newResolvedManager(t.Logf, loopbackInterface(t).Name, Options{Bus: bus, Health: new(health.Tracker)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m, bus, r
+}
+
+func TestResolvedSetDNS(t *testing.T) {
+	m, _, r := newFakeResolvedManager(t)
+	if err := m.SetDNS(OSConfig{
+		Nameservers:   mustIPs("100.100.100.100", "fd7a:115c:a1e0::53"),
+		SearchDomains: fqdns("corp.example."),
+		MatchDomains:  fqdns("ts.example."),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := FakeResolvedLink{
+		DNS: mustIPs("100.100.100.100", "fd7a:115c:a1e0::53"),
+		Domains: []FakeResolvedDomain{
+			{Domain: "corp.example."},
+			{Domain: "ts.example.", RoutingOnly: true},
+		},
+		LLMNR:        "no",
+		MulticastDNS: "no",
+		DNSSEC:       "no",
+		DNSOverTLS:   "no",
+	}
+	if got := r.Link(m.ifidx); !reflect.DeepEqual(got, want) {
+		t.Errorf("link:\n got %+v\nwant %+v", got, want)
+	}
+
+	// Without match domains, we take all queries.
+	if err := m.SetDNS(OSConfig{Nameservers: mustIPs("100.100.100.100")}); err != nil {
+		t.Fatal(err)
+	}
+	got := r.Link(m.ifidx)
+	if want := []FakeResolvedDomain{{Domain: ".", RoutingOnly: true}}; !reflect.DeepEqual(got.Domains, want) || !got.DefaultRoute {
+		t.Errorf("link = %+v; want the default route and domains %v", got, want)
+	}
+}
+
+func TestResolvedOldVersion(t *testing.T) {
+	m, _, r := newFakeResolvedManager(t)
+	r.Fail("SetLinkDefaultRoute", dbus.ErrMsgUnknownMethod)
+	if err := m.SetDNS(OSConfig{Nameservers: mustIPs("100.100.100.100")}); err != nil {
+		t.Errorf("SetDNS without SetLinkDefaultRoute: %v", err)
+	}
+}
+
+func TestResolvedRollback(t *testing.T) {
+	m, _, r := newFakeResolvedManager(t)
+	if err := m.SetDNS(OSConfig{Nameservers: mustIPs("100.100.100.100"), MatchDomains: fqdns("ts.example.")}); err != nil {
+		t.Fatal(err)
+	}
+	before := r.Link(m.ifidx)
+
+	r.Fail("SetLinkDomains", errors.New("injected"))
+	err := m.SetDNS(OSConfig{Nameservers: mustIPs("100.100.100.101"), MatchDomains: fqdns("other.example.")})
+	if err == nil {
+		t.Fatal("SetDNS succeeded despite the failure")
+	}
+	r.Fail("SetLinkDomains", nil)
+	if got := r.Link(m.ifidx); !reflect.DeepEqual(got.DNS, before.DNS) {
+		t.Errorf("DNS after the failure = %v; want it rolled back to %v", got.DNS, before.DNS)
+	}
+}
+
+func TestResolvedSetDNSContext(t *testing.T) {
+	m, _, r := newFakeResolvedManager(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := m.SetDNSContext(ctx, OSConfig{Nameservers: mustIPs("100.100.100.100")})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("SetDNSContext with a cancelled ctx = %v; want %v", err, context.Canceled)
+	}
+	if got := r.Link(m.ifidx); len(got.DNS) > 0 {
+		t.Errorf("DNS = %v after a cancelled SetDNSContext; want none", got.DNS)
+	}
+
+	if err := m.CloseContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetDNSContext(context.Background(), OSConfig{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("SetDNSContext after CloseContext = %v; want %v", err, ErrClosed)
+	}
+}
+
+func TestResolvedCloseContextCancelled(t *testing.T) {
+	m, _, r := newFakeResolvedManager(t)
+	if err := m.SetDNS(OSConfig{Nameservers: mustIPs("100.100.100.100")}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.CloseContext(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		t.Errorf("CloseContext with a cancelled ctx = %v", err)
+	}
+	// The link is still reverted, in the background.
+	waitFor(t, "the link to be reverted", func() bool { return len(r.Link(m.ifidx).DNS) == 0 })
+}
+
+func TestResolvedResync(t *testing.T) {
+	m, bus, r := newFakeResolvedManager(t)
+	cfg := OSConfig{Nameservers: mustIPs("100.100.100.100"), MatchDomains: fqdns("ts.example.")}
+	if err := m.SetDNS(cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := r.Link(m.ifidx)
+	resynced := func() bool { return reflect.DeepEqual(r.Link(m.ifidx), want) }
+
+	// A restart of resolved forgets our link, until we notice the new
+	// owner of its bus name.
+	r.Restart()
+	waitFor(t, "the resync after a restart", resynced)
+
+	// After losing the bus, we reconnect and keep watching.
+	bus.Disconnect()
+	waitFor(t, "the reconnection", func() bool { return subscribers(bus) > 0 })
+	r.Restart()
+	waitFor(t, "the resync after reconnecting", resynced)
+}
@@ -0,0 +1,109 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/anywherelan/ts-dns/types/logger"
+)
+
+// A RollbackError is returned by SetDNS when applying a configuration
+// failed after some of its steps had already changed the OS. The
+// OSConfigurator then tried to roll the OS back to the snapshot it took
+// before the call.
+//
+// Errors from SetDNS that aren't RollbackErrors mean that the failure
+// happened before anything was changed.
+type RollbackError struct {
+	// Err is why applying the configuration failed.
+	Err error
+	// RollbackErr is why rolling back failed, or nil if the OS is
+	// back to the snapshot.
+	RollbackErr error
+}
+
+func (e *RollbackError) Error() string {
+	if e.RollbackErr != nil {
+		return fmt.Sprintf("%v; rolling back also failed, DNS may be half-configured: %v", e.Err, e.RollbackErr)
+	}
+	return fmt.Sprintf("%v (rolled back)", e.Err)
+}
+
+func (e *RollbackError) Unwrap() error { return e.Err }
+
+// RolledBack reports whether the OS was rolled back to its state from
+// before the failed SetDNS call.
+func (e *RollbackError) RolledBack() bool { return e.RollbackErr == nil }
+
+// rollBack undoes a partially applied configuration that failed with
+// err, and returns the resulting RollbackError. undo reports whether
+// it had anything to undo; if it didn't, err is returned as is.
+func rollBack(logf logger.Logf, err error, undo func() (undone bool, err error)) error {
+	undone, rerr := undo()
+	if !undone && rerr == nil {
+		return err
+	}
+	if rerr != nil {
+		logf("rolling back after %v: %v", err, rerr)
+	} else {
+		logf("rolled back after: %v", err)
+	}
+	return &RollbackError{Err: err, RollbackErr: rerr}
+}
+
+// A fileSnapshot is the state of a file before we changed it.
+type fileSnapshot struct {
+	name     string
+	exists   bool
+	contents []byte
+}
+
+// snapshotFiles returns the current state of the named files in fs.
+func snapshotFiles(fs WholeFileFS, names ...string) ([]fileSnapshot, error) {
+	var ret []fileSnapshot
+	for _, name := range names {
+		bs, err := fs.ReadFile(name)
+		switch {
+		case err == nil:
+			ret = append(ret, fileSnapshot{name: name, exists: true, contents: bs})
+		case os.IsNotExist(err):
+			ret = append(ret, fileSnapshot{name: name})
+		default:
+			return nil, fmt.Errorf("taking snapshot: %w", err)
+		}
+	}
+	return ret, nil
+}
+
+// restoreFiles puts the files in snaps back the way they were, using
+// write to replace their contents. Files that already are as they were
+// aren't touched; restored reports whether any weren't.
+func restoreFiles(fs WholeFileFS, snaps []fileSnapshot, write func(name string, contents []byte) error) (restored bool, err error) {
+	var errs []error
+	for _, s := range snaps {
+		cur, err := fs.ReadFile(s.name)
+		exists := err == nil
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+			continue
+		}
+		err = nil
+		switch {
+		case !s.exists && exists:
+			restored = true
+			err = fs.Remove(s.name)
+		case s.exists && (!exists || !bytes.Equal(cur, s.contents)):
+			restored = true
+			err = write(s.name, s.contents)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return restored, errors.Join(errs...)
+}
@@ -0,0 +1,121 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/anywherelan/ts-dns/types/logger"
+	"github.com/anywherelan/ts-dns/util/dnsname"
+)
+
+// splitStub is an OSConfigurator that gives split DNS to one that lacks
+// it, such as ModeDirect. Split configurations are applied by running a
+// Forwarder on a loopback address and making it the OS's only
+// nameserver: it sends queries for the match domains to our
+// nameservers, and the rest to the base configuration's.
+type splitStub struct {
+	configuratorWrapper
+	logf logger.Logf
+	addr netip.AddrPort // where the Forwarder listens
+
+	mu     sync.Mutex
+	fwd    *Forwarder // or nil, if not started
+	closed bool
+}
+
+// newSplitStub returns a splitStub for os, listening on addr when
+// needed.
+func newSplitStub(logf logger.Logf, os OSConfigurator, addr netip.AddrPort) *splitStub {
+	return &splitStub{configuratorWrapper: configuratorWrapper{os}, logf: logf, addr: addr}
+}
+
+func (s *splitStub) SetDNS(cfg OSConfig) error {
+	return s.SetDNSContext(context.Background(), cfg)
+}
+
+// SetDNSContext implements ContextOSConfigurator.
+func (s *splitStub) SetDNSContext(ctx context.Context, cfg OSConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if len(cfg.MatchDomains) == 0 || len(cfg.Nameservers) == 0 {
+		// Not split DNS, so the OS can do it without us.
+		if err := SetDNSContext(ctx, s.os, cfg); err != nil {
+			return err
+		}
+		return s.stopLocked()
+	}
+
+	base, err := s.os.GetBaseConfig()
+	if err != nil {
+		return fmt.Errorf("split DNS stub: getting base config: %w", err)
+	}
+	if s.fwd == nil {
+		fwd, err := ListenForwarder(s.logf, s.addr)
+		if err != nil {
+			return fmt.Errorf("split DNS stub: %w", err)
+		}
+		s.fwd = fwd
+	}
+	stub := s.fwd.Addr().Addr()
+
+	routes := map[dnsname.FQDN][]netip.AddrPort{}
+	ours := upstreamAddrs(cfg.Nameservers, stub)
+	for _, d := range cfg.MatchDomains {
+		routes[d] = ours
+	}
+	s.fwd.SetRoutes(routes, upstreamAddrs(base.Nameservers, stub))
+
+	return SetDNSContext(ctx, s.os, OSConfig{
+		Hosts:           cfg.Hosts,
+		Nameservers:     []netip.Addr{stub},
+		SearchDomains:   appendUniqueDomains(append([]dnsname.FQDN(nil), cfg.SearchDomains...), base.SearchDomains...),
+		ResolverOptions: cfg.ResolverOptions,
+	})
+}
+
+// upstreamAddrs returns the DNS addresses of the nameservers ips,
+// leaving out the stub itself.
+func upstreamAddrs(ips []netip.Addr, stub netip.Addr) []netip.AddrPort {
+	var ret []netip.AddrPort
+	for _, ip := range ips {
+		if ip != stub {
+			ret = append(ret, netip.AddrPortFrom(ip, 53))
+		}
+	}
+	return ret
+}
+
+func (s *splitStub) stopLocked() error {
+	if s.fwd == nil {
+		return nil
+	}
+	err := s.fwd.Close()
+	s.fwd = nil
+	return err
+}
+
+func (s *splitStub) SupportsSplitDNS() bool { return true }
+
+func (s *splitStub) Close() error {
+	return s.CloseContext(context.Background())
+}
+
+// CloseContext implements ContextOSConfigurator.
+func (s *splitStub) CloseContext(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return errors.Join(CloseContext(ctx, s.os), s.stopLocked())
+}
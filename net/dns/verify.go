@@ -0,0 +1,285 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anywherelan/ts-dns/util/dnsname"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ProbeAnswer is the address that probe names resolve to, when queries
+// for them reach a probe responder. It's in TEST-NET-1, so no real
+// name resolves to it.
+var ProbeAnswer = netip.MustParseAddr("192.0.2.53")
+
+// probeLabelPrefix starts the first label of every probe name.
+const probeLabelPrefix = "ts-dns-probe-"
+
+// isProbeName reports whether the DNS name is a probe name.
+func isProbeName(name string) bool {
+	return len(name) >= len(probeLabelPrefix) && strings.EqualFold(name[:len(probeLabelPrefix)], probeLabelPrefix)
+}
+
+// AnswerProbe returns the response to query if it's a query for a probe
+// name, as made by Verifier.Verify. DNS servers that should pass
+// verification call it for each query they receive and, if ok, send
+// resp instead of resolving the query themselves.
+func AnswerProbe(query []byte) (resp []byte, ok bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil, false
+	}
+	q, err := p.Question()
+	if err != nil || q.Class != dnsmessage.ClassINET || !isProbeName(q.Name.String()) {
+		return nil, false
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, false
+	}
+	if err := b.Question(q); err != nil {
+		return nil, false
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, false
+	}
+	// Other types get an empty answer, so that resolvers asking
+	// for AAAA alongside A don't wait for it.
+	if q.Type == dnsmessage.TypeA {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET}
+		if err := b.AResource(rh, dnsmessage.AResource{A: ProbeAnswer.As4()}); err != nil {
+			return nil, false
+		}
+	}
+	resp, err = b.Finish()
+	if err != nil {
+		return nil, false
+	}
+	return resp, true
+}
+
+// A ProbeResponder is a DNS server that answers only queries for probe
+// names. It's the test responder for Verifier: listen on the address
+// of the nameserver in the OSConfig being verified. Other queries are
+// ignored.
+type ProbeResponder struct {
+	pc        net.PacketConn
+	probes    atomic.Int64
+	closeOnce sync.Once
+	closing   chan struct{} // closed by Close, to cut a backoff short
+	done      chan struct{}
+}
+
+// NewProbeResponder returns a ProbeResponder serving on pc, until it's
+// closed.
+func NewProbeResponder(pc net.PacketConn) *ProbeResponder {
+	r := &ProbeResponder{pc: pc, closing: make(chan struct{}), done: make(chan struct{})}
+	go r.serve()
+	return r
+}
+
+// Bounds of the delay before reading again after a read error, doubled
+// after each consecutive one.
+const (
+	minReadErrorDelay = 5 * time.Millisecond
+	maxReadErrorDelay = time.Second
+)
+
+func (r *ProbeResponder) serve() {
+	defer close(r.done)
+	buf := make([]byte, 512)
+	var delay time.Duration
+	for {
+		n, addr, err := r.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// Some errors last, such as those of a deadline set
+			// on pc, so back off instead of spinning on them.
+			if delay *= 2; delay < minReadErrorDelay {
+				delay = minReadErrorDelay
+			} else if delay > maxReadErrorDelay {
+				delay = maxReadErrorDelay
+			}
+			select {
+			case <-r.closing:
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		delay = 0
+		resp, ok := AnswerProbe(buf[:n])
+		if !ok {
+			continue
+		}
+		r.probes.Add(1)
+		r.pc.WriteTo(resp, addr)
+	}
+}
+
+// Addr returns the address r serves on.
+func (r *ProbeResponder) Addr() net.Addr { return r.pc.LocalAddr() }
+
+// Probes returns the number of probe queries r has answered.
+func (r *ProbeResponder) Probes() int { return int(r.probes.Load()) }
+
+// Close stops r and closes its connection.
+func (r *ProbeResponder) Close() error {
+	r.closeOnce.Do(func() { close(r.closing) })
+	err := r.pc.Close()
+	<-r.done
+	return err
+}
+
+// Verifier checks that a DNS configuration applied to the OS is in
+// effect, by resolving a probe name through the system's resolver.
+// The query must reach a DNS server that answers probes, such as a
+// ProbeResponder or one that calls AnswerProbe, at the configuration's
+// nameservers. SetDNS succeeding doesn't prove that: some versions of
+// NetworkManager silently ignore our settings, and systemd-resolved can
+// be wired to other links.
+//
+// The zero value is a Verifier using the host's resolver.
+type Verifier struct {
+	// Domain is the domain under which probe names are made up.
+	// If empty, it's the first match domain of the configuration
+	// being verified, or else its first search domain.
+	Domain dnsname.FQDN
+
+	// Lookup resolves the IPv4 addresses of host, which is fully
+	// qualified, the way the host's programs do. If nil, it's
+	// net.DefaultResolver, which uses libc or reads
+	// /etc/resolv.conf like it does.
+	Lookup func(ctx context.Context, host string) ([]netip.Addr, error)
+
+	// Timeout bounds the verification. The OS can take a moment to
+	// pick up a new configuration, so the probe is retried until
+	// then. If zero, it's defaultVerifyTimeout.
+	Timeout time.Duration
+}
+
+const probeRetryInterval = 250 * time.Millisecond
+
+// defaultVerifyTimeout is the default Verifier.Timeout. Go's own
+// resolver, which the default Lookup may be, re-reads /etc/resolv.conf
+// at most every 5 seconds, so right after a ModeDirect write it can keep
+// asking the old nameservers for that long. The default leaves time for
+// probes after that, so a good configuration isn't rolled back.
+const defaultVerifyTimeout = 10 * time.Second
+
+// probeName returns a new probe name for cfg, or "" if cfg sends no
+// queries anywhere and so there's nothing to verify.
+func (v Verifier) probeName(cfg OSConfig) (string, error) {
+	if len(cfg.Nameservers) == 0 {
+		return "", nil
+	}
+	domain := v.Domain
+	switch {
+	case domain != "":
+	case len(cfg.MatchDomains) > 0:
+		domain = cfg.MatchDomains[0]
+	case len(cfg.SearchDomains) > 0:
+		domain = cfg.SearchDomains[0]
+	default:
+		return "", errors.New("no domain to make up a probe name under; set Verifier.Domain")
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	// A unique name, so that no cache along the way can answer it.
+	return probeLabelPrefix + hex.EncodeToString(b[:]) + "." + domain.WithTrailingDot(), nil
+}
+
+// Verify checks that queries sent according to cfg, which has been
+// applied to the OS, reach a server that answers probes.
+func (v Verifier) Verify(ctx context.Context, cfg OSConfig) error {
+	name, err := v.probeName(cfg)
+	if err != nil || name == "" {
+		return err
+	}
+	return v.probe(ctx, name)
+}
+
+func (v Verifier) probe(ctx context.Context, name string) error {
+	lookup := v.Lookup
+	if lookup == nil {
+		lookup = func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip4", host)
+		}
+	}
+	timeout := v.Timeout
+	if timeout == 0 {
+		timeout = defaultVerifyTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var lastErr error
+	for {
+		addrs, err := lookup(ctx, name)
+		if err == nil {
+			for _, a := range addrs {
+				if a.Unmap() == ProbeAnswer {
+					return nil
+				}
+			}
+			err = fmt.Errorf("answered with %v by another server", addrs)
+		}
+		// Keep the reason of the last complete attempt, rather than
+		// that of the one cut short by the timeout.
+		if ctx.Err() == nil || lastErr == nil {
+			lastErr = err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("probe %s didn't reach our nameservers: %w", name, lastErr)
+		case <-time.After(probeRetryInterval):
+		}
+	}
+}
+
+// SetDNSVerified applies cfg with c, like SetDNSContext, and then verifies it
+// with v. If the verification fails, c is set back to prev, which should
+// be the configuration it had before, and a *RollbackError is returned.
+func SetDNSVerified(ctx context.Context, c OSConfigurator, prev, cfg OSConfig, v Verifier) error {
+	// SetDNS takes ownership of cfg, so make up the name first.
+	name, err := v.probeName(cfg)
+	if err != nil {
+		return fmt.Errorf("verifying: %w", err)
+	}
+	if err := SetDNSContext(ctx, c, cfg); err != nil {
+		return err
+	}
+	if name == "" {
+		return nil
+	}
+	if err := v.probe(ctx, name); err != nil {
+		// ctx may be done, so the rollback is only bounded by c.
+		return &RollbackError{Err: fmt.Errorf("verifying: %w", err), RollbackErr: c.SetDNS(prev)}
+	}
+	return nil
+}
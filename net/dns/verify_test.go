@@ -0,0 +1,149 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listenUDP returns a UDP listener on the loopback interface.
+func listenUDP(t *testing.T) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+// lookupVia returns a Verifier.Lookup that sends all queries to addr,
+// standing in for the system path the OS configuration would set up.
+func lookupVia(addr net.Addr) func(context.Context, string) ([]netip.Addr, error) {
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", addr.String())
+		},
+	}
+	return func(ctx context.Context, host string) ([]netip.Addr, error) {
+		return r.LookupNetIP(ctx, "ip4", host)
+	}
+}
+
+func TestSetDNSVerified(t *testing.T) {
+	prev := OSConfig{Nameservers: mustIPs("10.0.0.1"), MatchDomains: fqdns("old.example")}
+	cfg := OSConfig{Nameservers: mustIPs("100.100.100.100"), MatchDomains: fqdns("ts.net")}
+
+	tests := []struct {
+		name    string
+		miswire bool // whether queries go somewhere other than the responder
+		wantErr bool
+	}{
+		{name: "reaches"},
+		{name: "miswired", miswire: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responder := NewProbeResponder(listenUDP(t))
+			defer responder.Close()
+			target := responder.Addr()
+			if tt.miswire {
+				// A server that never answers.
+				target = listenUDP(t).LocalAddr()
+			}
+			v := Verifier{Lookup: lookupVia(target), Timeout: 500 * time.Millisecond}
+			fake := &fakeOSConfigurator{OSConfig: prev}
+
+			err := SetDNSVerified(context.Background(), fake, prev, cfg, v)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fake.SetCalls != 1 || !reflect.DeepEqual(fake.OSConfig, cfg) {
+					t.Errorf("SetDNS calls = %d, config = %v; want 1, %v", fake.SetCalls, fake.OSConfig, cfg)
+				}
+				if responder.Probes() == 0 {
+					t.Error("responder got no probes")
+				}
+				return
+			}
+			var rerr *RollbackError
+			if !errors.As(err, &rerr) || !rerr.RolledBack() {
+				t.Fatalf("err = %v; want a successful rollback", err)
+			}
+			if !strings.Contains(err.Error(), "ts.net") {
+				t.Errorf("err = %v; want the probe name", err)
+			}
+			if fake.SetCalls != 2 || !reflect.DeepEqual(fake.OSConfig, prev) {
+				t.Errorf("SetDNS calls = %d, config = %v; want 2, %v", fake.SetCalls, fake.OSConfig, prev)
+			}
+		})
+	}
+}
+
+func TestVerifyNothingToProbe(t *testing.T) {
+	v := Verifier{Lookup: func(context.Context, string) ([]netip.Addr, error) {
+		t.Error("unexpected lookup")
+		return nil, nil
+	}}
+	if err := v.Verify(context.Background(), OSConfig{SearchDomains: fqdns("corp.example")}); err != nil {
+		t.Errorf("Verify without nameservers = %v", err)
+	}
+	if err := v.Verify(context.Background(), OSConfig{Nameservers: mustIPs("10.0.0.1")}); err == nil {
+		t.Error("Verify of primary config without domains succeeded; want an error asking for Verifier.Domain")
+	}
+}
+
+func TestAnswerProbeIgnoresOthers(t *testing.T) {
+	responder := NewProbeResponder(listenUDP(t))
+	defer responder.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if addrs, err := lookupVia(responder.Addr())(ctx, "www.example.com."); err == nil {
+		t.Errorf("lookup of a non-probe name = %v; want no answer", addrs)
+	}
+	if n := responder.Probes(); n != 0 {
+		t.Errorf("Probes = %d; want 0", n)
+	}
+}
+
+// countingConn counts the reads of a PacketConn.
+type countingConn struct {
+	net.PacketConn
+	reads atomic.Int64
+}
+
+func (c *countingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.reads.Add(1)
+	return c.PacketConn.ReadFrom(b)
+}
+
+func TestProbeResponderReadErrors(t *testing.T) {
+	pc := &countingConn{PacketConn: listenUDP(t)}
+	// A deadline in the past makes every read fail.
+	pc.SetReadDeadline(time.Unix(1, 0))
+	responder := NewProbeResponder(pc)
+	time.Sleep(100 * time.Millisecond)
+	if n := pc.reads.Load(); n > 10 {
+		t.Errorf("%d reads in 100ms of failing ones; want a backoff", n)
+	}
+
+	start := time.Now()
+	if err := responder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > maxReadErrorDelay/2 {
+		t.Errorf("Close took %v while backing off", d)
+	}
+}
@@ -4,34 +4,29 @@
 package dns
 
 import (
-	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"os"
-	"os/exec"
-	"os/user"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/anywherelan/ts-dns/types/logger"
-	"github.com/anywherelan/ts-dns/util/winutil"
-	"golang.org/x/sys/windows"
 )
 
-// wslDistros reports the names of the installed WSL2 linux distributions.
-func wslDistros() ([]string, error) {
+// wslDistros reports the names of the installed WSL2 linux
+// distributions, running wsl.exe through runner.
+func wslDistros(runner CommandRunner) ([]string, error) {
 	// There is a bug in some builds of wsl.exe that causes it to block
 	// indefinitely while executing this operation. Set a timeout so that we don't
 	// get wedged! (Issue #7476)
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	b, err := wslCombinedOutput(exec.CommandContext(ctx, "wsl.exe", "-l"))
+	res, err := runCommand(ctx, runner, "wsl.exe", "-l")
 	if err != nil {
-		return nil, fmt.Errorf("%v: %q", err, string(b))
+		return nil, err
 	}
+	b := maybeUnUTF16(res.CombinedOutput())
 
 	lines := strings.Split(string(b), "\n")
 	if len(lines) < 1 {
@@ -54,18 +49,22 @@ func wslDistros() ([]string, error) {
 // wslManager is a DNS manager for WSL2 linux distributions.
 // It configures /etc/wsl.conf and /etc/resolv.conf.
 type wslManager struct {
-	logf logger.Logf
+	logf   logger.Logf
+	runner CommandRunner // for wsl.exe
+	opts   Options       // passed on to each distro's directManager
 }
 
-func newWSLManager(logf logger.Logf) *wslManager {
+func newWSLManager(logf logger.Logf, opts Options) *wslManager {
 	m := &wslManager{
-		logf: logf,
+		logf:   logf,
+		runner: opts.Runner,
+		opts:   opts,
 	}
 	return m
 }
 
 func (wm *wslManager) SetDNS(cfg OSConfig) error {
-	distros, err := wslDistros()
+	distros, err := wslDistros(wm.runner)
 	if err != nil {
 		return err
 	} else if len(distros) == 0 {
@@ -76,7 +75,8 @@ func (wm *wslManager) SetDNS(cfg OSConfig) error {
 		managers[distro] = newDirectManagerOnFS(wm.logf, wslFS{
 			user:   "root",
 			distro: distro,
-		})
+			runner: wm.runner,
+		}, wm.opts)
 	}
 
 	if !cfg.IsZero() {
@@ -91,8 +91,8 @@ func (wm *wslManager) SetDNS(cfg OSConfig) error {
 			// have to shut down WSL2.
 			//
 			// So we do it here, before we call wsl.exe to write resolv.conf.
-			if b, err := wslCombinedOutput(wslCommand("--shutdown")); err != nil {
-				wm.logf("WSL SetDNS shutdown: %v: %s", err, b)
+			if _, err := runCommand(context.Background(), wm.runner, "wsl.exe", "--shutdown"); err != nil {
+				wm.logf("WSL SetDNS shutdown: %v", err)
 			}
 		}
 	}
@@ -143,12 +143,13 @@ func (m *wslManager) Close() error           { return m.SetDNS(OSConfig{}) }
 type wslFS struct {
 	user   string
 	distro string
+	runner CommandRunner
 }
 
 func (fs wslFS) Stat(name string) (isRegular bool, err error) {
-	err = wslRun(fs.cmd("test", "-f", name))
-	if ee, _ := err.(*exec.ExitError); ee != nil {
-		if ee.ExitCode() == 1 {
+	res, err := fs.run(nil, "test", "-f", name)
+	if err != nil {
+		if res.ExitCode == 1 {
 			return false, os.ErrNotExist
 		}
 		return false, err
@@ -157,76 +158,39 @@ func (fs wslFS) Stat(name string) (isRegular bool, err error) {
 }
 
 func (fs wslFS) Rename(oldName, newName string) error {
-	return wslRun(fs.cmd("mv", "--", oldName, newName))
+	_, err := fs.run(nil, "mv", "--", oldName, newName)
+	return err
+}
+
+func (fs wslFS) Remove(name string) error {
+	_, err := fs.run(nil, "rm", "--", name)
+	return err
 }
-func (fs wslFS) Remove(name string) error { return wslRun(fs.cmd("rm", "--", name)) }
 
 func (fs wslFS) Truncate(name string) error { return fs.WriteFile(name, nil, 0644) }
 
 func (fs wslFS) ReadFile(name string) ([]byte, error) {
-	b, err := wslCombinedOutput(fs.cmd("cat", "--", name))
-	var ee *exec.ExitError
-	if errors.As(err, &ee) && ee.ExitCode() == 1 {
-		return nil, os.ErrNotExist
+	res, err := fs.run(nil, "cat", "--", name)
+	if err != nil {
+		if res.ExitCode == 1 {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
 	}
-	return b, err
+	return maybeUnUTF16(res.Stdout), nil
 }
 
 func (fs wslFS) WriteFile(name string, contents []byte, perm os.FileMode) error {
-	cmd := fs.cmd("tee", "--", name)
-	cmd.Stdin = bytes.NewReader(contents)
-	cmd.Stdout = nil
-	if err := wslRun(cmd); err != nil {
+	if _, err := fs.run(contents, "tee", "--", name); err != nil {
 		return err
 	}
-	return wslRun(fs.cmd("chmod", "--", fmt.Sprintf("%04o", perm), name))
-}
-
-func (fs wslFS) cmd(args ...string) *exec.Cmd {
-	cmd := wslCommand("-u", fs.user, "-d", fs.distro, "-e")
-	cmd.Args = append(cmd.Args, args...)
-	return cmd
-}
-
-func wslCommand(args ...string) *exec.Cmd {
-	cmd := exec.Command("wsl.exe", args...)
-	return cmd
-}
-
-func wslCombinedOutput(cmd *exec.Cmd) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	cmd.Stdout = buf
-	cmd.Stderr = buf
-	err := wslRun(cmd)
-	if err != nil {
-		return nil, err
-	}
-	return maybeUnUTF16(buf.Bytes()), nil
+	_, err := fs.run(nil, "chmod", "--", fmt.Sprintf("%04o", perm), name)
+	return err
 }
 
-func wslRun(cmd *exec.Cmd) (err error) {
-	defer func() {
-		if err != nil {
-			err = fmt.Errorf("wslRun(%v): %w", cmd.Args, err)
-		}
-	}()
-
-	var token windows.Token
-	if u, err := user.Current(); err == nil && u.Name == "SYSTEM" {
-		// We need to switch user to run wsl.exe.
-		// https://github.com/microsoft/WSL/issues/4803
-		sessionID := winutil.WTSGetActiveConsoleSessionId()
-		if sessionID != 0xFFFFFFFF {
-			if err := windows.WTSQueryUserToken(sessionID, &token); err != nil {
-				return err
-			}
-			defer token.Close()
-		}
-	}
-
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Token:      syscall.Token(token),
-		HideWindow: true,
-	}
-	return cmd.Run()
+// run runs the program args[0] with the rest of args in the distro, as
+// fs.user, with stdin as its standard input.
+func (fs wslFS) run(stdin []byte, args ...string) (CommandResult, error) {
+	args = append([]string{"-u", fs.user, "-d", fs.distro, "-e"}, args...)
+	return runCommandStdin(context.Background(), fs.runner, stdin, "wsl.exe", args...)
 }
@@ -0,0 +1,47 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package dns
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestWSLDistros(t *testing.T) {
+	f := new(FakeRunner)
+	f.On("wsl.exe -l", FakeResponse{Stdout: "Windows Subsystem for Linux Distributions:\r\nUbuntu (Default)\r\nDebian\r\n"})
+	got, err := wslDistros(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Ubuntu", "Debian"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("distros = %q; want %q", got, want)
+	}
+}
+
+func TestWSLFS(t *testing.T) {
+	f := new(FakeRunner)
+	fs := wslFS{user: "root", distro: "Ubuntu", runner: f}
+	f.On("wsl.exe -u root -d Ubuntu -e cat -- /etc/wsl.conf", FakeResponse{ExitCode: 1})
+	if _, err := fs.ReadFile("/etc/wsl.conf"); !os.IsNotExist(err) {
+		t.Errorf("ReadFile of a missing file = %v; want a not-exist error", err)
+	}
+
+	f.On("wsl.exe -u root -d Ubuntu -e tee -- /etc/wsl.conf", FakeResponse{})
+	f.On("wsl.exe -u root -d Ubuntu -e chmod -- 0644 /etc/wsl.conf", FakeResponse{})
+	if err := fs.WriteFile("/etc/wsl.conf", []byte("[network]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	calls := f.Calls()
+	if len(calls) != 3 {
+		t.Fatalf("calls = %v; want cat, tee and chmod", calls)
+	}
+	if got := string(calls[1].Stdin); got != "[network]\n" {
+		t.Errorf("tee stdin = %q", got)
+	}
+	if got, want := calls[2].String(), "wsl.exe -u root -d Ubuntu -e chmod -- 0644 /etc/wsl.conf"; got != want {
+		t.Errorf("chmod = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,345 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package hostsfile reads and edits hosts(5) files.
+//
+// A File keeps every line as it was read, so editing a managed section
+// leaves the lines outside it byte for byte the same, whether they end
+// in LF or CRLF. A managed section is delimited by marker comments that
+// name it, as in:
+//
+//	# TailscaleHostsSectionStart
+//	# This section contains MagicDNS entries for Tailscale.
+//	# Do not edit this section manually.
+//
+//	100.101.102.103 peer.example.ts.net. peer
+//
+//	# TailscaleHostsSectionEnd
+package hostsfile
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"unicode"
+)
+
+// A File is a parsed hosts file.
+type File struct {
+	// EOL is the line ending of the lines that SetSection writes.
+	// Parse sets it to that of the first line, or to "\n" if no
+	// line has one.
+	EOL string
+
+	lines []line
+}
+
+type line struct {
+	text string // without the line ending
+	eol  string // "\n", "\r\n", or "" for a last line without one
+}
+
+// An Entry is an address and its names, from one line of a hosts file.
+type Entry struct {
+	Addr  netip.Addr
+	Names []string
+
+	// Line is the entry's line number, starting at 1, or 0 for
+	// entries not read from a file.
+	Line int
+	// Section is the name of the managed section the entry is in,
+	// or "" if it's in none.
+	Section string
+}
+
+// Parse parses the hosts file contents b. Lines that aren't valid
+// entries are kept, and reported by Check.
+func Parse(b []byte) *File {
+	f := &File{EOL: "\n"}
+	s := string(b)
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			f.lines = append(f.lines, line{text: s})
+			break
+		}
+		l := line{text: s[:i], eol: "\n"}
+		if strings.HasSuffix(l.text, "\r") {
+			l.text, l.eol = l.text[:len(l.text)-1], "\r\n"
+		}
+		f.lines = append(f.lines, l)
+		s = s[i+1:]
+	}
+	for _, l := range f.lines {
+		if l.eol != "" {
+			f.EOL = l.eol
+			break
+		}
+	}
+	return f
+}
+
+// Bytes returns the contents of f.
+func (f *File) Bytes() []byte {
+	var sb strings.Builder
+	for _, l := range f.lines {
+		sb.WriteString(l.text)
+		sb.WriteString(l.eol)
+	}
+	return []byte(sb.String())
+}
+
+// sectionHeader and sectionFooter return the marker lines of the
+// section called name.
+func sectionHeader(name string) string { return "# " + name + "HostsSectionStart" }
+func sectionFooter(name string) string { return "# " + name + "HostsSectionEnd" }
+
+// sectionName returns the name of the section that text starts, or ""
+// if it's not a section header.
+func sectionName(text string) string {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "# ") || !strings.HasSuffix(text, "HostsSectionStart") {
+		return ""
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(text, "# "), "HostsSectionStart")
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return ""
+	}
+	return name
+}
+
+// walk calls fn for each line of f, with its index and the name of the
+// section it's in, or "". Marker lines are in their section. A section
+// without an end marker runs to the end of the file.
+func (f *File) walk(fn func(i int, section string)) {
+	section := ""
+	for i, l := range f.lines {
+		if section == "" {
+			section = sectionName(l.text)
+			fn(i, section)
+			continue
+		}
+		fn(i, section)
+		if strings.TrimSpace(l.text) == sectionFooter(section) {
+			section = ""
+		}
+	}
+}
+
+// Sections returns the names of the managed sections in f, in order.
+func (f *File) Sections() []string {
+	var ret []string
+	f.walk(func(i int, section string) {
+		if section != "" && sectionName(f.lines[i].text) == section {
+			ret = append(ret, section)
+		}
+	})
+	return ret
+}
+
+// HasSection reports whether f has a section called name.
+func (f *File) HasSection(name string) bool {
+	for _, s := range f.Sections() {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Entries returns the entries in f, in order.
+func (f *File) Entries() []Entry {
+	var ret []Entry
+	f.walk(func(i int, section string) {
+		if e, ok := parseEntry(f.lines[i].text); ok {
+			e.Line = i + 1
+			e.Section = section
+			ret = append(ret, e)
+		}
+	})
+	return ret
+}
+
+// parseEntry parses the hosts file line text. ok is false if it holds no
+// entry; if text isn't blank or a comment either, it's malformed.
+func parseEntry(text string) (e Entry, ok bool) {
+	if i := strings.IndexByte(text, '#'); i >= 0 {
+		text = text[:i]
+	}
+	fields := strings.Fields(text)
+	if len(fields) < 2 {
+		return e, false
+	}
+	addr, err := netip.ParseAddr(fields[0])
+	if err != nil {
+		return e, false
+	}
+	return Entry{Addr: addr, Names: fields[1:]}, true
+}
+
+// ValidName reports whether name can be written as a name of an entry:
+// it's not empty, and has no whitespace, control characters or "#",
+// which would end the entry or start a new line.
+func ValidName(name string) bool {
+	return name != "" && strings.IndexFunc(name, func(r rune) bool {
+		return r == '#' || unicode.IsSpace(r) || unicode.IsControl(r)
+	}) < 0
+}
+
+// validEntries returns entries without the names that aren't ValidName,
+// and without the entries left with no names or with an invalid Addr.
+func validEntries(entries []Entry) []Entry {
+	var ret []Entry
+	for _, e := range entries {
+		var names []string
+		for _, n := range e.Names {
+			if ValidName(n) {
+				names = append(names, n)
+			}
+		}
+		if e.Addr.IsValid() && len(names) > 0 {
+			e.Names = names
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// SetSection replaces the section called name with one holding comments
+// and entries, or adds it at the end if f has none. If entries is
+// empty, the section is removed instead. The section's lines end with
+// f.EOL; the other lines are left as they are.
+//
+// Names that aren't ValidName are dropped, and so are the entries left
+// with none, or with an invalid Addr. name must not contain spaces.
+// comments are written as they are, so they should start with "#".
+func (f *File) SetSection(name string, comments []string, entries []Entry) {
+	entries = validEntries(entries)
+	var section []line
+	if len(entries) > 0 {
+		add := func(text string) { section = append(section, line{text: text, eol: f.EOL}) }
+		add(sectionHeader(name))
+		for _, c := range comments {
+			add(c)
+		}
+		add("")
+		for _, e := range entries {
+			add(e.Addr.String() + " " + strings.Join(e.Names, " "))
+		}
+		add("")
+		add(sectionFooter(name))
+	}
+
+	var out []line
+	placed := false
+	f.walk(func(i int, s string) {
+		if s != name {
+			out = append(out, f.lines[i])
+			return
+		}
+		if !placed {
+			out = append(out, section...)
+			placed = true
+		}
+	})
+	if !placed && len(section) > 0 {
+		if n := len(out); n > 0 && out[n-1].eol == "" {
+			out[n-1].eol = f.EOL
+		}
+		out = append(out, section...)
+	}
+	f.lines = out
+}
+
+// RemoveSection removes the section called name, and reports whether
+// there was one.
+func (f *File) RemoveSection(name string) bool {
+	if !f.HasSection(name) {
+		return false
+	}
+	f.SetSection(name, nil, nil)
+	return true
+}
+
+// ProblemKind is a kind of Problem.
+type ProblemKind int
+
+const (
+	// Malformed is a line that's neither an entry, a comment nor
+	// blank.
+	Malformed ProblemKind = iota
+	// Duplicate is an entry giving a name the same address as an
+	// earlier one.
+	Duplicate
+	// Conflict is an entry giving a name another address of the
+	// same family than an earlier one. Resolvers only use the
+	// first.
+	Conflict
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case Malformed:
+		return "malformed"
+	case Duplicate:
+		return "duplicate"
+	case Conflict:
+		return "conflict"
+	}
+	return fmt.Sprintf("ProblemKind(%d)", int(k))
+}
+
+// A Problem is something wrong in a hosts file.
+type Problem struct {
+	Kind ProblemKind
+	Line int // the line number of the problem, starting at 1
+
+	// For Duplicate and Conflict, Name is the name concerned and
+	// Prev is the line number of the earlier entry.
+	Name string
+	Prev int
+}
+
+func (p Problem) String() string {
+	if p.Kind == Malformed {
+		return fmt.Sprintf("line %d: malformed", p.Line)
+	}
+	return fmt.Sprintf("line %d: %v %s (see line %d)", p.Line, p.Kind, p.Name, p.Prev)
+}
+
+// Check returns the problems in f, in line order.
+func (f *File) Check() []Problem {
+	var ret []Problem
+	type seen struct {
+		addr netip.Addr
+		line int
+	}
+	byName := map[string][]seen{}
+	for i, l := range f.lines {
+		e, ok := parseEntry(l.text)
+		if !ok {
+			text := strings.TrimSpace(l.text)
+			if text != "" && !strings.HasPrefix(text, "#") {
+				ret = append(ret, Problem{Kind: Malformed, Line: i + 1})
+			}
+			continue
+		}
+		addr := e.Addr.Unmap()
+		for _, name := range e.Names {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			for _, s := range byName[name] {
+				if s.addr.Is4() != addr.Is4() {
+					continue
+				}
+				kind := Conflict
+				if s.addr == addr {
+					kind = Duplicate
+				}
+				ret = append(ret, Problem{Kind: kind, Line: i + 1, Name: name, Prev: s.line})
+				break
+			}
+			byName[name] = append(byName[name], seen{addr, i + 1})
+		}
+	}
+	return ret
+}
@@ -0,0 +1,172 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package hostsfile
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"127.0.0.1 localhost\n",
+		"127.0.0.1\tlocalhost  \r\n::1 localhost\r\n",
+		"# mixed\r\n127.0.0.1 localhost\n  garbage here\nno final newline",
+		"\n\n\r\n",
+	} {
+		if got := string(Parse([]byte(in)).Bytes()); got != in {
+			t.Errorf("Parse(%q).Bytes() = %q", in, got)
+		}
+	}
+}
+
+func TestEntries(t *testing.T) {
+	const in = "127.0.0.1 localhost # the loopback\r\n" +
+		"\r\n" +
+		"# TailscaleHostsSectionStart\r\n" +
+		"# comment\r\n" +
+		"100.64.0.1 peer.ts.net. peer\r\n" +
+		"# TailscaleHostsSectionEnd\r\n" +
+		"fe80::1%eth0 router\r\n" +
+		"not-an-address foo\r\n"
+	f := Parse([]byte(in))
+	if f.EOL != "\r\n" {
+		t.Errorf("EOL = %q; want CRLF", f.EOL)
+	}
+	want := []Entry{
+		{Addr: netip.MustParseAddr("127.0.0.1"), Names: []string{"localhost"}, Line: 1},
+		{Addr: netip.MustParseAddr("100.64.0.1"), Names: []string{"peer.ts.net.", "peer"}, Line: 5, Section: "Tailscale"},
+		{Addr: netip.MustParseAddr("fe80::1%eth0"), Names: []string{"router"}, Line: 7},
+	}
+	if got := f.Entries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Entries:\n got %+v\nwant %+v", got, want)
+	}
+	if got := f.Sections(); !reflect.DeepEqual(got, []string{"Tailscale"}) {
+		t.Errorf("Sections = %q", got)
+	}
+}
+
+func TestSetSection(t *testing.T) {
+	entries := []Entry{{Addr: netip.MustParseAddr("100.64.0.1"), Names: []string{"a.ts.net.", "a"}}}
+	comments := []string{"# Managed by acme."}
+	const section = "# AcmeHostsSectionStart\n" +
+		"# Managed by acme.\n" +
+		"\n" +
+		"100.64.0.1 a.ts.net. a\n" +
+		"\n" +
+		"# AcmeHostsSectionEnd\n"
+	tests := []struct {
+		name    string
+		in      string
+		entries []Entry
+		want    string
+	}{
+		{
+			name:    "add-to-empty",
+			entries: entries,
+			want:    section,
+		},
+		{
+			name:    "add-keeps-foreign-lines",
+			in:      "127.0.0.1   localhost   \n#comment",
+			entries: entries,
+			want:    "127.0.0.1   localhost   \n#comment\n" + section,
+		},
+		{
+			name:    "replace-in-place",
+			in:      "1.1.1.1 one\n# AcmeHostsSectionStart\n9.9.9.9 old\n# AcmeHostsSectionEnd\n2.2.2.2 two\n",
+			entries: entries,
+			want:    "1.1.1.1 one\n" + section + "2.2.2.2 two\n",
+		},
+		{
+			name:    "replace-duplicate-sections",
+			in:      "# AcmeHostsSectionStart\n# AcmeHostsSectionEnd\n1.1.1.1 one\n# AcmeHostsSectionStart\n# AcmeHostsSectionEnd\n",
+			entries: entries,
+			want:    section + "1.1.1.1 one\n",
+		},
+		{
+			name: "remove",
+			in:   "1.1.1.1 one\n" + section + "2.2.2.2 two\n",
+			want: "1.1.1.1 one\n2.2.2.2 two\n",
+		},
+		{
+			name: "remove-unterminated",
+			in:   "1.1.1.1 one\n# AcmeHostsSectionStart\n9.9.9.9 old\n",
+			want: "1.1.1.1 one\n",
+		},
+		{
+			name: "other-sections-kept",
+			in:   "# OtherHostsSectionStart\n3.3.3.3 x\n# OtherHostsSectionEnd\n" + section,
+			want: "# OtherHostsSectionStart\n3.3.3.3 x\n# OtherHostsSectionEnd\n",
+		},
+		{
+			name: "invalid-names-dropped",
+			entries: []Entry{
+				{Addr: netip.MustParseAddr("100.64.0.1"), Names: []string{"a.ts.net.", "x\n1.2.3.4 evil", "", "a", "b#c"}},
+				{Addr: netip.MustParseAddr("100.64.0.2"), Names: []string{"\tb"}},
+				{Addr: netip.MustParseAddr("100.64.0.3")},
+				{Names: []string{"c"}},
+			},
+			want: section,
+		},
+		{
+			name:    "only-invalid-entries",
+			in:      "1.1.1.1 one\n" + section,
+			entries: []Entry{{Addr: netip.MustParseAddr("100.64.0.1"), Names: []string{"a b"}}},
+			want:    "1.1.1.1 one\n",
+		},
+		{
+			name:    "crlf",
+			in:      "127.0.0.1 localhost\r\n",
+			entries: entries,
+			want: "127.0.0.1 localhost\r\n# AcmeHostsSectionStart\r\n# Managed by acme.\r\n\r\n" +
+				"100.64.0.1 a.ts.net. a\r\n\r\n# AcmeHostsSectionEnd\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := Parse([]byte(tt.in))
+			f.SetSection("Acme", comments, tt.entries)
+			if got := string(f.Bytes()); got != tt.want {
+				t.Errorf("got:\n%q\nwant:\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveSection(t *testing.T) {
+	f := Parse([]byte("1.1.1.1 one\n"))
+	if f.RemoveSection("Acme") {
+		t.Error("RemoveSection of a missing section = true")
+	}
+	f.SetSection("Acme", nil, []Entry{{Addr: netip.MustParseAddr("1.2.3.4"), Names: []string{"x"}}})
+	if !f.RemoveSection("Acme") || f.HasSection("Acme") {
+		t.Error("RemoveSection didn't remove the section")
+	}
+	if got := string(f.Bytes()); got != "1.1.1.1 one\n" {
+		t.Errorf("after removal: %q", got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	const in = "127.0.0.1 localhost\n" + // 1
+		"::1 localhost\n" + // 2: other family, fine
+		"100.64.0.1 peer.ts.net\n" + // 3
+		"100.64.0.1 PEER.ts.net.\n" + // 4: duplicate of 3
+		"100.64.0.2 peer.ts.net\n" + // 5: conflicts with 3
+		"bogus line\n" + // 6
+		"# comment\n" + // 7
+		"10.0.0.1 a a\n" // 8: duplicate on the same line
+	want := []Problem{
+		{Kind: Duplicate, Line: 4, Name: "peer.ts.net", Prev: 3},
+		{Kind: Conflict, Line: 5, Name: "peer.ts.net", Prev: 3},
+		{Kind: Malformed, Line: 6},
+		{Kind: Duplicate, Line: 8, Name: "a", Prev: 8},
+	}
+	if got := Parse([]byte(in)).Check(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Check:\n got %v\nwant %v", got, want)
+	}
+}